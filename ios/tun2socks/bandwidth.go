@@ -0,0 +1,183 @@
+package tun2socks
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const minBurst = 64 << 10
+
+type bandwidthConfig struct {
+	UploadKbps       int64 `json:"uploadKbps,omitempty"`
+	DownloadKbps     int64 `json:"downloadKbps,omitempty"`
+	ConnUploadKbps   int64 `json:"connUploadKbps,omitempty"`
+	ConnDownloadKbps int64 `json:"connDownloadKbps,omitempty"`
+}
+
+var (
+	uplinkLimit    = &tokenBucket{}
+	downlinkLimit  = &tokenBucket{}
+	connUplinkRate atomic.Int64
+	connDownRate   atomic.Int64
+)
+
+func kbpsToBytes(kbps int64) int64 {
+	return kbps * 1000 / 8
+}
+
+func configureBandwidth(cfg *bandwidthConfig) {
+	if cfg == nil {
+		cfg = &bandwidthConfig{}
+	}
+	uplinkLimit.setRate(kbpsToBytes(cfg.UploadKbps))
+	downlinkLimit.setRate(kbpsToBytes(cfg.DownloadKbps))
+	connUplinkRate.Store(kbpsToBytes(cfg.ConnUploadKbps))
+	connDownRate.Store(kbpsToBytes(cfg.ConnDownloadKbps))
+}
+
+// SetBandwidthLimit changes the tunnel-wide upload and download caps in
+// kilobits per second; 0 removes a cap. The values hold until the next
+// start or reload.
+func SetBandwidthLimit(uploadKbps int64, downloadKbps int64) error {
+	if uploadKbps < 0 || downloadKbps < 0 {
+		return ErrInvalidConfig
+	}
+	uplinkLimit.setRate(kbpsToBytes(uploadKbps))
+	downlinkLimit.setRate(kbpsToBytes(downloadKbps))
+	return nil
+}
+
+// tokenBucket meters bytes at a fixed rate. A zero rate is unlimited.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSec int64) *tokenBucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	b := &tokenBucket{}
+	b.setRate(bytesPerSec)
+	return b
+}
+
+func (b *tokenBucket) setRate(bytesPerSec int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(bytesPerSec)
+	b.tokens = b.burst()
+	b.last = time.Now()
+}
+
+func (b *tokenBucket) burst() float64 {
+	return max(b.rate/5, minBurst)
+}
+
+func (b *tokenBucket) refillLocked() {
+	now := time.Now()
+	b.tokens = min(b.burst(), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// reserve takes n bytes from the bucket, going into debt if needed, and
+// returns how long the caller must wait before sending them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refillLocked()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// bytesPerSec returns the rate, 0 when unlimited.
+func (b *tokenBucket) bytesPerSec() float64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// allow takes n bytes only if they are available right away.
+func (b *tokenBucket) allow(n int) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refillLocked()
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// limiter applies the tunnel-wide bucket of one direction together with the
+// bucket of a single connection. With QoS on, the writes of a flow are paced
+// at its class's share of the tunnel-wide rate instead.
+type limiter struct {
+	global *tokenBucket
+	conn   *tokenBucket
+	queue  *priorityQueue
+	flow   *connRecord
+}
+
+func uplinkLimiter() limiter {
+	return limiter{global: uplinkLimit, conn: newTokenBucket(connUplinkRate.Load()), queue: uplinkQueue}
+}
+
+func downlinkLimiter() limiter {
+	return limiter{global: downlinkLimit, conn: newTokenBucket(connDownRate.Load()), queue: downlinkQueue}
+}
+
+func (l limiter) forFlow(record *connRecord) limiter {
+	l.flow = record
+	return l
+}
+
+func (l limiter) wait(n int) {
+	if qos := activeQoS.Load(); qos != nil && l.flow != nil && l.global.bytesPerSec() > 0 {
+		l.queue.wait(n, l.flow.getPriority(), qos.weights)
+		if d := l.conn.reserve(n); d > 0 {
+			time.Sleep(d)
+		}
+		return
+	}
+	if d := max(l.global.reserve(n), l.conn.reserve(n)); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// allow is used for datagrams, which are dropped rather than delayed.
+func (l limiter) allow(n int) bool {
+	return l.global.allow(n) && l.conn.allow(n)
+}
+
+type shapedWriter struct {
+	io.Writer
+	limiter limiter
+}
+
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	w.limiter.wait(len(p))
+	return w.Writer.Write(p)
+}
@@ -0,0 +1,129 @@
+package tun2socks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+)
+
+// bindAcceptTimeout bounds how long a bound address waits for its peer.
+const bindAcceptTimeout = 2 * time.Minute
+
+var errBindUnsupported = errors.New("outbound cannot accept connections (socks5 BIND)")
+
+// binder is implemented by outbounds whose proxy can accept a connection
+// from target on the tunnel's behalf, as SOCKS5 BIND does for active-mode
+// FTP and some peer-to-peer protocols.
+type binder interface {
+	Bind(target string) (*binding, error)
+	// CanBind reports whether a Bind for target would reach a proxy that
+	// supports it, without contacting the proxy.
+	CanBind(target string) bool
+}
+
+// bindThrough has ob bind for target, if it can.
+func bindThrough(ob outbound, target string) (*binding, error) {
+	if b, ok := ob.(binder); ok {
+		return b.Bind(target)
+	}
+	return nil, errBindUnsupported
+}
+
+// canBindThrough reports whether ob can bind for target.
+func canBindThrough(ob outbound, target string) bool {
+	b, ok := ob.(binder)
+	return ok && b.CanBind(target)
+}
+
+// binding is an address the proxy listens on for one connection.
+type binding struct {
+	conn net.Conn
+	// bound is the host:port the peer is told to connect to.
+	bound string
+}
+
+// accept waits for the peer to connect and returns the connection to it
+// and the peer's address.
+func (b *binding) accept(timeout time.Duration) (net.Conn, string, error) {
+	b.conn.SetReadDeadline(time.Now().Add(timeout))
+	peer, err := readSocks5Reply(b.conn)
+	if err != nil {
+		b.conn.Close()
+		return nil, "", err
+	}
+	b.conn.SetReadDeadline(time.Time{})
+	return b.conn, peer.String(), nil
+}
+
+func (b *binding) Close() error {
+	return b.conn.Close()
+}
+
+func (h *socksTCPHandler) Bind(target string) (*binding, error) {
+	addr := socks.ParseAddr(target)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid bind target %q", target)
+	}
+	conn, err := h.forward().Dial("tcp", h.proxyAddr())
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(handshakeDeadline())
+	if err := socks5Handshake(conn, h.auth); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	bound, err := socks5Request(conn, socks5CmdBind, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &binding{conn: conn, bound: h.boundAddr(bound, conn)}, nil
+}
+
+func (h *socksTCPHandler) CanBind(target string) bool {
+	return true
+}
+
+// boundAddr makes the address a proxy reports reachable from outside: an
+// unspecified one stands for the address the proxy was reached at.
+func (h *socksTCPHandler) boundAddr(bound socks.Addr, conn net.Conn) string {
+	ap, err := netip.ParseAddrPort(bound.String())
+	if err != nil || !ap.Addr().IsUnspecified() || isUnixSocket(h.proxyHost) {
+		return bound.String()
+	}
+	port := strconv.Itoa(int(ap.Port()))
+	if ip, err := netip.ParseAddr(h.proxyHost); err == nil {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok && h.via == nil && h.transport == nil {
+		return net.JoinHostPort(tcp.IP.String(), port)
+	}
+	return net.JoinHostPort(h.proxyHost, port)
+}
+
+// relayBound accepts the peer of b and relays it with the app-side
+// connection made by connect, which sees the peer's address.
+func relayBound(b *binding, connect func(peer string) (net.Conn, error)) {
+	upstream, peer, err := b.accept(bindAcceptTimeout)
+	if err != nil {
+		if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			logger.Debug("bind accept failed", "bound", b.bound, "error", err)
+		}
+		return
+	}
+	conn, err := connect(peer)
+	if err != nil {
+		logger.Warn("bind connection failed", "peer", peer, "error", err)
+		upstream.Close()
+		return
+	}
+	relayConn(conn, upstream, openConn("tcp", conn.RemoteAddr(), hostAddr(peer)))
+}
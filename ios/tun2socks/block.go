@@ -0,0 +1,126 @@
+package tun2socks
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var errBlocked = errors.New("blocked by routing")
+
+// Names that hosts files map to themselves and that must not be blocked.
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+// blockOutbound refuses every flow; the stack answers the app as the
+// reject mode sets.
+type blockOutbound struct{}
+
+func (blockOutbound) Handle(conn net.Conn, target *net.TCPAddr) error {
+	stats.blockedFlows.Add(1)
+	return errBlocked
+}
+
+func (blockOutbound) Dial(network string, addr string) (net.Conn, error) {
+	stats.blockedFlows.Add(1)
+	return nil, errBlocked
+}
+
+func (blockOutbound) Bind(target string) (*binding, error) {
+	stats.blockedFlows.Add(1)
+	return nil, errBlocked
+}
+
+func (blockOutbound) CanBind(target string) bool {
+	return false
+}
+
+type blockUDPHandler struct{}
+
+func (blockUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	stats.blockedFlows.Add(1)
+	return errBlocked
+}
+
+func (blockUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	return errBlocked
+}
+
+func (blockUDPHandler) Close(conn core.UDPConn) {}
+
+// loadBlocklist reads a hosts-style file: "0.0.0.0 ads.example.com" lines
+// or bare domains, one per line, with # comments.
+func loadBlocklist(path string, blocked map[string]struct{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := netip.ParseAddr(fields[0]); err == nil {
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			name = normalizeDomain(name)
+			if !hostsLocalNames[name] {
+				blocked[name] = struct{}{}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// blockingResolver answers queries for blocked names with NXDOMAIN, so
+// apps give up before opening a connection.
+type blockingResolver struct {
+	inner  dnsUpstream
+	router *router
+}
+
+func newBlockingResolver(inner dnsUpstream, r *router) dnsUpstream {
+	return &blockingResolver{inner: inner, router: r}
+}
+
+func (r *blockingResolver) Exchange(query []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return r.inner.Exchange(query)
+	}
+	name := msg.Questions[0].Name.String()
+	if r.router.route(net.JoinHostPort(name, "0")) != outboundBlock {
+		return r.inner.Exchange(query)
+	}
+
+	stats.blockedQueries.Add(1)
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 msg.ID,
+			Response:           true,
+			RecursionDesired:   msg.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              dnsmessage.RCodeNameError,
+		},
+		Questions: msg.Questions,
+	}
+	return resp.Pack()
+}
@@ -0,0 +1,224 @@
+package tun2socks
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// serverAddrTTL is how long proxy server addresses are used before they
+	// are looked up again. The system resolver does not report TTLs.
+	serverAddrTTL = 5 * time.Minute
+	// serverAddrRetry is how long addresses are kept after a failed refresh
+	// before the next attempt.
+	serverAddrRetry = 30 * time.Second
+)
+
+type serverAddrs struct {
+	ready chan struct{}
+
+	// Guarded by serverResolver.mu.
+	addrs      []netip.Addr
+	err        error
+	expires    time.Time
+	refreshing bool
+}
+
+// serverResolver resolves the names of the proxy servers the tunnel dials.
+// Addresses are cached and refreshed in the background while the old ones
+// stay in use, so only the first dial of a server waits for DNS. Looking a
+// server up for every flow deadlocks when the system resolver sends its
+// queries into the tunnel.
+type serverResolver struct {
+	resolver *net.Resolver
+	hosts    map[string][]netip.Addr
+	servers  []serverEndpoint
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*serverAddrs
+}
+
+var activeServerResolver atomic.Pointer[serverResolver]
+
+// configureBootstrap starts an empty cache for cfg and looks up its proxy
+// servers in the background.
+func configureBootstrap(cfg *tunnelConfig) {
+	activeServerResolver.Store(newServerResolver(cfg))
+}
+
+// newServerResolver returns an empty cache for cfg, already looking up its
+// proxy servers.
+func newServerResolver(cfg *tunnelConfig) *serverResolver {
+	r := &serverResolver{
+		resolver: net.DefaultResolver,
+		hosts:    make(map[string][]netip.Addr, len(cfg.DNS.ProxyHosts)),
+		timeout:  cfg.Timeouts.connect(),
+		entries:  make(map[string]*serverAddrs),
+	}
+	if cfg.DNS.Bootstrap != "" {
+		server := withDefaultPort(cfg.DNS.Bootstrap, "53")
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				return socketDialer().DialContext(ctx, network, server)
+			},
+		}
+	}
+	for host, addrs := range cfg.DNS.ProxyHosts {
+		host = strings.ToLower(host)
+		for _, s := range addrs {
+			if addr, err := netip.ParseAddr(s); err == nil {
+				r.hosts[host] = append(r.hosts[host], addr)
+			}
+		}
+	}
+	for _, pc := range append([]proxyConfig{cfg.Proxy}, cfg.Outbounds...) {
+		if pc.Host != "" && !isUnixSocket(pc.Host) {
+			r.servers = append(r.servers, serverEndpoint{host: strings.ToLower(pc.Host), port: uint16(pc.Port)})
+		}
+	}
+	for _, s := range r.servers {
+		if _, ok := r.fixed(s.host); !ok {
+			r.entry(s.host)
+		}
+	}
+	return r
+}
+
+// lookupServer resolves the host of a proxy server, through the system
+// resolver before a tunnel has been configured.
+func lookupServer(ctx context.Context, host string) ([]netip.Addr, error) {
+	if r := activeServerResolver.Load(); r != nil {
+		return r.lookup(ctx, host)
+	}
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// refreshServerAddrs looks the cached proxy servers up again and returns
+// when done.
+func refreshServerAddrs() {
+	if r := activeServerResolver.Load(); r != nil {
+		r.refreshAll()
+	}
+}
+
+// fixed returns the addresses of host that need no lookup: an IP literal
+// or the configured override.
+func (r *serverResolver) fixed(host string) ([]netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, true
+	}
+	addrs, ok := r.hosts[host]
+	return addrs, ok
+}
+
+// entry returns the cache entry of host, starting its lookup if there is
+// none.
+func (r *serverResolver) entry(host string) *serverAddrs {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[host]
+	if !ok {
+		e = &serverAddrs{ready: make(chan struct{})}
+		r.entries[host] = e
+		go r.resolve(host, e)
+	}
+	return e
+}
+
+func (r *serverResolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = strings.ToLower(host)
+	if addrs, ok := r.fixed(host); ok {
+		return addrs, nil
+	}
+
+	e := r.entry(host)
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e.err != nil {
+		return nil, e.err
+	}
+	if !e.refreshing && time.Now().After(e.expires) {
+		e.refreshing = true
+		go r.refresh(host, e)
+	}
+	return e.addrs, nil
+}
+
+// resolve fills a new entry. A failed one is dropped, so the next dial
+// tries again.
+func (r *serverResolver) resolve(host string, e *serverAddrs) {
+	addrs, err := r.query(host)
+	r.mu.Lock()
+	e.addrs, e.err, e.expires = addrs, err, time.Now().Add(serverAddrTTL)
+	if err != nil {
+		logger.Warn("proxy server lookup failed", "host", host, "error", err)
+		if r.entries[host] == e {
+			delete(r.entries, host)
+		}
+	}
+	r.mu.Unlock()
+	close(e.ready)
+}
+
+// refresh looks host up again, keeping the addresses in use when that
+// fails.
+func (r *serverResolver) refresh(host string, e *serverAddrs) {
+	addrs, err := r.query(host)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e.refreshing = false
+	if err != nil {
+		logger.Debug("proxy server lookup failed, keeping addresses", "host", host, "error", err)
+		e.expires = time.Now().Add(serverAddrRetry)
+		return
+	}
+	e.addrs, e.expires = addrs, time.Now().Add(serverAddrTTL)
+}
+
+func (r *serverResolver) refreshAll() {
+	var wg sync.WaitGroup
+	r.mu.Lock()
+	for host, e := range r.entries {
+		select {
+		case <-e.ready:
+		default:
+			continue
+		}
+		if e.refreshing {
+			continue
+		}
+		e.refreshing = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.refresh(host, e)
+		}()
+	}
+	r.mu.Unlock()
+	wg.Wait()
+}
+
+func (r *serverResolver) query(host string) ([]netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	addrs, err := r.resolver.LookupNetIP(ctx, "ip", host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return addrs, err
+}
@@ -0,0 +1,66 @@
+package tun2socks
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	smallPacket = 2048
+	largePacket = 65536
+)
+
+// Packets crossing the C boundary are copied into pooled buffers so the
+// packet path does not allocate per packet. Every buffer taken with
+// getPacket must be handed back with putPacket once nothing refers to it.
+var (
+	smallPackets = sync.Pool{New: func() any { return new([smallPacket]byte) }}
+	largePackets = sync.Pool{New: func() any { return new([largePacket]byte) }}
+
+	relayBuffers sync.Pool
+	// relayBufferSize is set by the memory profile. Pooled buffers of
+	// another size are dropped as they come back.
+	relayBufferSize atomic.Int64
+)
+
+func init() {
+	relayBufferSize.Store(int64(memoryProfiles[""].relayBuffer))
+}
+
+func getPacket(n int) []byte {
+	switch {
+	case n <= smallPacket:
+		return smallPackets.Get().(*[smallPacket]byte)[:n]
+	case n <= largePacket:
+		return largePackets.Get().(*[largePacket]byte)[:n]
+	default:
+		return make([]byte, n)
+	}
+}
+
+func putPacket(b []byte) {
+	switch cap(b) {
+	case smallPacket:
+		smallPackets.Put((*[smallPacket]byte)(b[:smallPacket]))
+	case largePacket:
+		largePackets.Put((*[largePacket]byte)(b[:largePacket]))
+	}
+}
+
+// copyRelay copies src to dst through a pooled buffer until EOF or an error.
+// The relay wrappers hide ReaderFrom and WriterTo, so the buffer is always
+// used and no per-flow buffer is allocated.
+func copyRelay(dst io.Writer, src io.Reader) error {
+	size := int(relayBufferSize.Load())
+	buf, ok := relayBuffers.Get().(*[]byte)
+	if !ok || len(*buf) != size {
+		b := make([]byte, size)
+		buf = &b
+	}
+	_, err := io.CopyBuffer(dst, src, *buf)
+	if len(*buf) == int(relayBufferSize.Load()) {
+		relayBuffers.Put(buf)
+	}
+	return err
+}
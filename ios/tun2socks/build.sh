@@ -22,7 +22,7 @@ cd "$ROOT_DIR"
 
 go mod download
 
-go build -buildmode=c-archive -o "$OUTPUT_DIR/libtun2socks.a"
+go build -buildmode=c-archive -o "$OUTPUT_DIR/libtun2socks.a" ./cmd/libtun2socks
 
 if [[ ! -f "$OUTPUT_DIR/libtun2socks.h" ]]; then
   echo "Missing libtun2socks.h after build" >&2
@@ -0,0 +1,214 @@
+package tun2socks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCaptureBytes = 32 << 20
+
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngInterface       = 1
+	pcapngEnhancedPacket  = 6
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+	pcapngLinkTypeRaw     = 101
+	pcapngFlagsOption     = 2
+	pcapngInbound         = 1
+	pcapngOutbound        = 2
+	captureFlushInterval  = time.Second
+	captureBufferSize     = 64 << 10
+	pcapngPacketOverhead  = 28 + 12 + 4
+	pcapngHeaderBlockSize = 28 + 20
+)
+
+type captureConfig struct {
+	Path     string `json:"path"`
+	MaxBytes int64  `json:"maxBytes,omitempty"`
+}
+
+var capture atomic.Pointer[pcapWriter]
+
+// pcapWriter records raw IP packets in pcapng. When the file would grow
+// past maxBytes it is moved to path.1, replacing an older one, and a new
+// file is started, so at most twice maxBytes is kept on disk.
+type pcapWriter struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	buf      *bufio.Writer
+	size     int64
+	flushed  time.Time
+}
+
+// StartCapture writes every packet crossing the TUN side to a rolling
+// pcapng file at path, replacing a capture already running. A zero
+// maxBytes uses 32 MB. It holds until StopCapture, the next start or a
+// reload.
+func StartCapture(path string, maxBytes int64) error {
+	if path == "" || maxBytes < 0 {
+		return ErrInvalidConfig
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultCaptureBytes
+	}
+	w := &pcapWriter{path: path, maxBytes: maxBytes}
+	if err := w.open(); err != nil {
+		return err
+	}
+	if old := capture.Swap(w); old != nil {
+		old.close()
+	}
+	logger.Info("packet capture started", "path", path)
+	return nil
+}
+
+// StopCapture flushes and closes the current capture file.
+func StopCapture() {
+	if old := capture.Swap(nil); old != nil {
+		old.close()
+		logger.Info("packet capture stopped", "path", old.path)
+	}
+}
+
+func configureCapture(cfg *captureConfig) error {
+	if cfg == nil {
+		StopCapture()
+		return nil
+	}
+	maxBytes := cfg.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultCaptureBytes
+	}
+	if current := capture.Load(); current != nil && current.path == cfg.Path && current.maxBytes == maxBytes {
+		return nil
+	}
+	return StartCapture(cfg.Path, cfg.MaxBytes)
+}
+
+// capturePacket records packet if a capture is running. outbound marks
+// packets sent by the device, i.e. read from the TUN interface.
+func capturePacket(packet []byte, outbound bool) {
+	w := capture.Load()
+	if w == nil {
+		return
+	}
+	if err := w.write(packet, outbound); err != nil {
+		logger.Warn("packet capture failed", "path", w.path, "error", err)
+		if capture.CompareAndSwap(w, nil) {
+			w.close()
+		}
+	}
+}
+
+func (w *pcapWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.buf = bufio.NewWriterSize(file, captureBufferSize)
+	w.size = 0
+	return w.writeHeader()
+}
+
+func (w *pcapWriter) writeHeader() error {
+	var b [pcapngHeaderBlockSize]byte
+	shb := b[:28]
+	binary.LittleEndian.PutUint32(shb[0:], pcapngSectionHeader)
+	binary.LittleEndian.PutUint32(shb[4:], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1)
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], uint32(len(shb)))
+
+	idb := b[28:]
+	binary.LittleEndian.PutUint32(idb[0:], pcapngInterface)
+	binary.LittleEndian.PutUint32(idb[4:], uint32(len(idb)))
+	binary.LittleEndian.PutUint16(idb[8:], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[12:], largePacket)
+	binary.LittleEndian.PutUint32(idb[16:], uint32(len(idb)))
+
+	n, err := w.buf.Write(b[:])
+	w.size += int64(n)
+	return err
+}
+
+func (w *pcapWriter) write(packet []byte, outbound bool) error {
+	padded := (len(packet) + 3) &^ 3
+	blockLen := pcapngPacketOverhead + padded
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	if w.size+int64(blockLen) > w.maxBytes && w.size > pcapngHeaderBlockSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UnixMicro()
+	var head [28]byte
+	binary.LittleEndian.PutUint32(head[0:], pcapngEnhancedPacket)
+	binary.LittleEndian.PutUint32(head[4:], uint32(blockLen))
+	binary.LittleEndian.PutUint32(head[12:], uint32(now>>32))
+	binary.LittleEndian.PutUint32(head[16:], uint32(now))
+	binary.LittleEndian.PutUint32(head[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(head[24:], uint32(len(packet)))
+
+	var tail [3 + 16]byte
+	pad := tail[:padded-len(packet)]
+	opts := tail[3:]
+	flags := uint32(pcapngInbound)
+	if outbound {
+		flags = pcapngOutbound
+	}
+	binary.LittleEndian.PutUint16(opts[0:], pcapngFlagsOption)
+	binary.LittleEndian.PutUint16(opts[2:], 4)
+	binary.LittleEndian.PutUint32(opts[4:], flags)
+	binary.LittleEndian.PutUint32(opts[12:], uint32(blockLen))
+
+	w.buf.Write(head[:])
+	w.buf.Write(packet)
+	w.buf.Write(pad)
+	if _, err := w.buf.Write(opts); err != nil {
+		return err
+	}
+	w.size += int64(blockLen)
+
+	if now := time.Now(); now.Sub(w.flushed) >= captureFlushInterval {
+		w.flushed = now
+		return w.buf.Flush()
+	}
+	return nil
+}
+
+func (w *pcapWriter) rotate() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	w.file.Close()
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		w.file = nil
+		return err
+	}
+	return w.open()
+}
+
+func (w *pcapWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return
+	}
+	w.buf.Flush()
+	w.file.Close()
+	w.file = nil
+}
@@ -0,0 +1,180 @@
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+typedef void (*tun2socks_output_fn)(void *context, const uint8_t *data, int length);
+
+typedef void (*tun2socks_conn_fn)(void *context, const char *json);
+
+typedef void (*tun2socks_log_fn)(void *context, int level, const char *line);
+
+typedef void (*tun2socks_event_fn)(void *context, const char *json);
+
+typedef void (*tun2socks_crash_fn)(void *context, const char *message, const char *stack);
+
+typedef void (*tun2socks_speedtest_fn)(void *context, const char *json);
+
+typedef void (*tun2socks_start_fn)(void *context, const char *json);
+
+typedef void (*tun2socks_drain_fn)(void *context, int remaining);
+
+typedef int (*tun2socks_flow_classifier_fn)(void *context, int src_port, const char *dst, const char *proto, char *tag, int tag_len);
+
+typedef int (*tun2socks_flow_redirector_fn)(void *context, int src_port, const char *dst, const char *host, const char *proto, char *addr, int addr_len);
+
+static inline void tun2socks_call_output(tun2socks_output_fn fn, void *context, const uint8_t *data, int length) {
+	fn(context, data, length);
+}
+
+static inline void tun2socks_call_conn(tun2socks_conn_fn fn, void *context, const char *json) {
+	fn(context, json);
+}
+
+static inline void tun2socks_call_log(tun2socks_log_fn fn, void *context, int level, const char *line) {
+	fn(context, level, line);
+}
+
+static inline void tun2socks_call_event(tun2socks_event_fn fn, void *context, const char *json) {
+	fn(context, json);
+}
+
+static inline void tun2socks_call_crash(tun2socks_crash_fn fn, void *context, const char *message, const char *stack) {
+	fn(context, message, stack);
+}
+
+static inline void tun2socks_call_speedtest(tun2socks_speedtest_fn fn, void *context, const char *json) {
+	fn(context, json);
+}
+
+static inline void tun2socks_call_start(tun2socks_start_fn fn, void *context, const char *json) {
+	fn(context, json);
+}
+
+static inline void tun2socks_call_drain(tun2socks_drain_fn fn, void *context, int remaining) {
+	fn(context, remaining);
+}
+
+static inline int tun2socks_call_flow_classifier(tun2socks_flow_classifier_fn fn, void *context, int src_port, const char *dst, const char *proto, char *tag, int tag_len) {
+	return fn(context, src_port, dst, proto, tag, tag_len);
+}
+
+static inline int tun2socks_call_flow_redirector(tun2socks_flow_redirector_fn fn, void *context, int src_port, const char *dst, const char *host, const char *proto, char *addr, int addr_len) {
+	return fn(context, src_port, dst, host, proto, addr, addr_len);
+}
+*/
+import "C"
+
+import "unsafe"
+
+func callOutput(fn C.tun2socks_output_fn, context unsafe.Pointer, data []byte) {
+	if fn == nil || len(data) == 0 {
+		return
+	}
+	C.tun2socks_call_output(fn, context, (*C.uint8_t)(unsafe.Pointer(&data[0])), C.int(len(data)))
+}
+
+func callConn(fn C.tun2socks_conn_fn, context unsafe.Pointer, json string) {
+	if fn == nil {
+		return
+	}
+	cJSON := C.CString(json)
+	defer C.free(unsafe.Pointer(cJSON))
+	C.tun2socks_call_conn(fn, context, cJSON)
+}
+
+func callLog(fn C.tun2socks_log_fn, context unsafe.Pointer, level int, line string) {
+	if fn == nil {
+		return
+	}
+	cLine := C.CString(line)
+	defer C.free(unsafe.Pointer(cLine))
+	C.tun2socks_call_log(fn, context, C.int(level), cLine)
+}
+
+func callEvent(fn C.tun2socks_event_fn, context unsafe.Pointer, json string) {
+	if fn == nil {
+		return
+	}
+	cJSON := C.CString(json)
+	defer C.free(unsafe.Pointer(cJSON))
+	C.tun2socks_call_event(fn, context, cJSON)
+}
+
+func callCrash(fn C.tun2socks_crash_fn, context unsafe.Pointer, message string, stack string) {
+	if fn == nil {
+		return
+	}
+	cMessage := C.CString(message)
+	defer C.free(unsafe.Pointer(cMessage))
+	cStack := C.CString(stack)
+	defer C.free(unsafe.Pointer(cStack))
+	C.tun2socks_call_crash(fn, context, cMessage, cStack)
+}
+
+func callSpeedTest(fn C.tun2socks_speedtest_fn, context unsafe.Pointer, json string) {
+	if fn == nil {
+		return
+	}
+	cJSON := C.CString(json)
+	defer C.free(unsafe.Pointer(cJSON))
+	C.tun2socks_call_speedtest(fn, context, cJSON)
+}
+
+func callStart(fn C.tun2socks_start_fn, context unsafe.Pointer, json string) {
+	if fn == nil {
+		return
+	}
+	cJSON := C.CString(json)
+	defer C.free(unsafe.Pointer(cJSON))
+	C.tun2socks_call_start(fn, context, cJSON)
+}
+
+func callDrain(fn C.tun2socks_drain_fn, context unsafe.Pointer, remaining int) {
+	if fn == nil {
+		return
+	}
+	C.tun2socks_call_drain(fn, context, C.int(remaining))
+}
+
+// flowTagMax is the size of the buffer the classifier writes a tag into.
+const flowTagMax = 256
+
+func callFlowClassifier(fn C.tun2socks_flow_classifier_fn, context unsafe.Pointer, srcPort int, dst string, proto string) string {
+	if fn == nil {
+		return ""
+	}
+	cDst := C.CString(dst)
+	defer C.free(unsafe.Pointer(cDst))
+	cProto := C.CString(proto)
+	defer C.free(unsafe.Pointer(cProto))
+	var tag [flowTagMax]C.char
+	n := int(C.tun2socks_call_flow_classifier(fn, context, C.int(srcPort), cDst, cProto, &tag[0], flowTagMax))
+	if n <= 0 {
+		return ""
+	}
+	return C.GoStringN(&tag[0], C.int(min(n, flowTagMax)))
+}
+
+// flowAddrMax is the size of the buffer the redirector writes an address
+// into.
+const flowAddrMax = 512
+
+func callFlowRedirector(fn C.tun2socks_flow_redirector_fn, context unsafe.Pointer, srcPort int, dst string, host string, proto string) string {
+	if fn == nil {
+		return ""
+	}
+	cDst := C.CString(dst)
+	defer C.free(unsafe.Pointer(cDst))
+	cHost := C.CString(host)
+	defer C.free(unsafe.Pointer(cHost))
+	cProto := C.CString(proto)
+	defer C.free(unsafe.Pointer(cProto))
+	var addr [flowAddrMax]C.char
+	n := int(C.tun2socks_call_flow_redirector(fn, context, C.int(srcPort), cDst, cHost, cProto, &addr[0], flowAddrMax))
+	if n <= 0 {
+		return ""
+	}
+	return C.GoStringN(&addr[0], C.int(min(n, flowAddrMax)))
+}
@@ -0,0 +1,659 @@
+// Command libtun2socks builds the stack as a C archive for the Network
+// Extension. It only converts between C and Go values; everything else
+// lives in the tun2socks package.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+typedef void (*tun2socks_output_fn)(void *context, const uint8_t *data, int length);
+
+typedef void (*tun2socks_conn_fn)(void *context, const char *json);
+
+typedef void (*tun2socks_log_fn)(void *context, int level, const char *line);
+
+typedef void (*tun2socks_event_fn)(void *context, const char *json);
+
+typedef void (*tun2socks_crash_fn)(void *context, const char *message, const char *stack);
+
+typedef void (*tun2socks_speedtest_fn)(void *context, const char *json);
+
+typedef void (*tun2socks_start_fn)(void *context, const char *json);
+
+typedef void (*tun2socks_drain_fn)(void *context, int remaining);
+
+typedef int (*tun2socks_flow_classifier_fn)(void *context, int src_port, const char *dst, const char *proto, char *tag, int tag_len);
+
+typedef int (*tun2socks_flow_redirector_fn)(void *context, int src_port, const char *dst, const char *host, const char *proto, char *addr, int addr_len);
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+
+	tun2socks "cbv-tun2socks"
+)
+
+func main() {}
+
+func init() {
+	tun2socks.SetMemoryProfile("low-memory")
+}
+
+// code maps an error to the status codes of the C API.
+func code(err error) C.int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, tun2socks.ErrInvalidConfig), errors.Is(err, tun2socks.ErrNoConnection):
+		return -1
+	case errors.Is(err, tun2socks.ErrNotRunning), errors.Is(err, tun2socks.ErrUnsupported):
+		return -3
+	case errors.Is(err, tun2socks.ErrAlreadyRunning):
+		return -4
+	default:
+		return -2
+	}
+}
+
+// crashed reports a panic recovered by an export. It is false when there
+// was none.
+func crashed(r any) bool {
+	if r == nil {
+		return false
+	}
+	tun2socks.ReportPanic(r)
+	return true
+}
+
+func goBytes(data *C.uint8_t, length C.int) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(data)), int(length))
+}
+
+func cStringOrNil(value string, ok bool) *C.char {
+	if !ok || value == "" {
+		return nil
+	}
+	return C.CString(value)
+}
+
+func cStringOrEmpty(value *C.char) string {
+	if value == nil {
+		return ""
+	}
+	return C.GoString(value)
+}
+
+//export Tun2SocksStart
+func Tun2SocksStart(proxyType *C.char, host *C.char, port C.int, username *C.char, password *C.char) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	if proxyType == nil || host == nil || port <= 0 {
+		return -1
+	}
+	return code(tun2socks.Start(C.GoString(proxyType), C.GoString(host), int(port), cStringOrEmpty(username), cStringOrEmpty(password)))
+}
+
+//export Tun2SocksStartWithConfig
+func Tun2SocksStartWithConfig(jsonConfig *C.char) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	if jsonConfig == nil {
+		return -1
+	}
+	return code(tun2socks.StartWithConfig(C.GoString(jsonConfig)))
+}
+
+//export Tun2SocksStartWithFD
+func Tun2SocksStartWithFD(fd C.int, jsonConfig *C.char) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	if jsonConfig == nil {
+		return -1
+	}
+	return code(tun2socks.StartWithFD(int(fd), C.GoString(jsonConfig)))
+}
+
+//export Tun2SocksStartEx
+func Tun2SocksStartEx(fd C.int, jsonConfig *C.char) (result *C.char) {
+	defer func() {
+		if r := recover(); crashed(r) {
+			result = C.CString(tun2socks.StartResult(fmt.Errorf("%w: %v", tun2socks.ErrPanic, r)))
+		}
+	}()
+	var err error
+	switch {
+	case jsonConfig == nil:
+		err = tun2socks.ErrInvalidConfig
+	case fd < 0:
+		err = tun2socks.StartWithConfig(C.GoString(jsonConfig))
+	default:
+		err = tun2socks.StartWithFD(int(fd), C.GoString(jsonConfig))
+	}
+	return C.CString(tun2socks.StartResult(err))
+}
+
+//export Tun2SocksStartAsync
+func Tun2SocksStartAsync(fd C.int, jsonConfig *C.char, fn C.tun2socks_start_fn, context unsafe.Pointer) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	if jsonConfig == nil {
+		return -1
+	}
+	tun2socks.StartAsync(int(fd), C.GoString(jsonConfig), func(json string) {
+		callStart(fn, context, json)
+	})
+	return 0
+}
+
+//export Tun2SocksStartH
+func Tun2SocksStartH(fd C.int, jsonConfig *C.char) (result C.longlong) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	if jsonConfig == nil {
+		return -1
+	}
+	t, err := tun2socks.NewTunnel(int(fd), C.GoString(jsonConfig))
+	if err != nil {
+		return C.longlong(code(err))
+	}
+	return C.longlong(t.Handle())
+}
+
+//export Tun2SocksStop
+func Tun2SocksStop() {
+	defer func() {
+		crashed(recover())
+	}()
+	tun2socks.Stop()
+}
+
+//export Tun2SocksDrain
+func Tun2SocksDrain(timeoutMs C.int, fn C.tun2socks_drain_fn, context unsafe.Pointer) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	remaining, err := tun2socks.Drain(time.Duration(timeoutMs)*time.Millisecond, func(remaining int) {
+		callDrain(fn, context, remaining)
+	})
+	if err != nil {
+		return code(err)
+	}
+	return C.int(remaining)
+}
+
+//export Tun2SocksStopH
+func Tun2SocksStopH(handle C.longlong) {
+	defer func() {
+		crashed(recover())
+	}()
+	tun2socks.TunnelFromHandle(uint64(handle)).Stop()
+}
+
+//export Tun2SocksInput
+func Tun2SocksInput(data *C.uint8_t, length C.int) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = 0
+		}
+	}()
+	if data == nil || length <= 0 {
+		return 0
+	}
+	if !tun2socks.Input(goBytes(data, length)) {
+		return 0
+	}
+	return 1
+}
+
+//export Tun2SocksInputH
+func Tun2SocksInputH(handle C.longlong, data *C.uint8_t, length C.int) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = 0
+		}
+	}()
+	if data == nil || length <= 0 {
+		return 0
+	}
+	if !tun2socks.TunnelFromHandle(uint64(handle)).Input(goBytes(data, length)) {
+		return 0
+	}
+	return 1
+}
+
+//export Tun2SocksInputBatch
+func Tun2SocksInputBatch(packets **C.uint8_t, lengths *C.int, count C.int) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = 0
+		}
+	}()
+	if packets == nil || lengths == nil || count <= 0 {
+		return 0
+	}
+
+	ptrs := unsafe.Slice(packets, int(count))
+	lens := unsafe.Slice(lengths, int(count))
+	batch := make([][]byte, 0, len(ptrs))
+	for i := range ptrs {
+		if ptrs[i] == nil || lens[i] <= 0 {
+			continue
+		}
+		batch = append(batch, goBytes(ptrs[i], lens[i]))
+	}
+	return C.int(tun2socks.InputBatch(batch))
+}
+
+//export Tun2SocksReadPacket
+func Tun2SocksReadPacket(buffer *C.uint8_t, bufferLen C.int) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = 0
+		}
+	}()
+	if buffer == nil || bufferLen <= 0 {
+		return 0
+	}
+	return C.int(tun2socks.ReadPacket(goBytes(buffer, bufferLen)))
+}
+
+//export Tun2SocksReadPacketH
+func Tun2SocksReadPacketH(handle C.longlong, buffer *C.uint8_t, bufferLen C.int) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = 0
+		}
+	}()
+	if buffer == nil || bufferLen <= 0 {
+		return 0
+	}
+	return C.int(tun2socks.TunnelFromHandle(uint64(handle)).ReadPacket(goBytes(buffer, bufferLen)))
+}
+
+//export Tun2SocksReadPacketTimeout
+func Tun2SocksReadPacketTimeout(buffer *C.uint8_t, bufferLen C.int, timeoutMs C.int) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = 0
+		}
+	}()
+	if buffer == nil || bufferLen <= 0 {
+		return 0
+	}
+	return C.int(tun2socks.ReadPacketTimeout(goBytes(buffer, bufferLen), time.Duration(timeoutMs)*time.Millisecond))
+}
+
+//export Tun2SocksReadPacketTimeoutH
+func Tun2SocksReadPacketTimeoutH(handle C.longlong, buffer *C.uint8_t, bufferLen C.int, timeoutMs C.int) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = 0
+		}
+	}()
+	if buffer == nil || bufferLen <= 0 {
+		return 0
+	}
+	t := tun2socks.TunnelFromHandle(uint64(handle))
+	return C.int(t.ReadPacketTimeout(goBytes(buffer, bufferLen), time.Duration(timeoutMs)*time.Millisecond))
+}
+
+//export Tun2SocksReadPackets
+func Tun2SocksReadPackets(buffers **C.uint8_t, bufferLens *C.int, packetLens *C.int, count C.int) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = 0
+		}
+	}()
+	if buffers == nil || bufferLens == nil || packetLens == nil || count <= 0 {
+		return 0
+	}
+
+	ptrs := unsafe.Slice(buffers, int(count))
+	caps := unsafe.Slice(bufferLens, int(count))
+	out := make([][]byte, 0, len(ptrs))
+	for i := range ptrs {
+		if ptrs[i] == nil || caps[i] <= 0 {
+			break
+		}
+		out = append(out, goBytes(ptrs[i], caps[i]))
+	}
+	lengths := make([]int, len(out))
+	read := tun2socks.ReadPackets(out, lengths)
+
+	lens := unsafe.Slice(packetLens, int(count))
+	for i := 0; i < read; i++ {
+		lens[i] = C.int(lengths[i])
+	}
+	return C.int(read)
+}
+
+//export Tun2SocksPeekPacketSize
+func Tun2SocksPeekPacketSize() (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = 0
+		}
+	}()
+	return C.int(tun2socks.PeekPacketSize())
+}
+
+//export Tun2SocksRegisterOutputCallback
+func Tun2SocksRegisterOutputCallback(fn C.tun2socks_output_fn, context unsafe.Pointer) {
+	if fn == nil {
+		tun2socks.SetOutputFunc(nil)
+		return
+	}
+	tun2socks.SetOutputFunc(func(packet []byte) {
+		callOutput(fn, context, packet)
+	})
+}
+
+//export Tun2SocksSetQueueConfig
+func Tun2SocksSetQueueConfig(size C.int, policy C.int, deadlineMs C.int) C.int {
+	return code(tun2socks.SetQueueConfig(int(size), int(policy), time.Duration(deadlineMs)*time.Millisecond))
+}
+
+//export Tun2SocksGetDroppedPackets
+func Tun2SocksGetDroppedPackets() C.ulonglong {
+	return C.ulonglong(tun2socks.DroppedPackets())
+}
+
+//export Tun2SocksReload
+func Tun2SocksReload(jsonConfig *C.char) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	if jsonConfig == nil {
+		return -1
+	}
+	return code(tun2socks.Reload(C.GoString(jsonConfig)))
+}
+
+//export Tun2SocksPrepareReload
+func Tun2SocksPrepareReload(jsonConfig *C.char) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	if jsonConfig == nil {
+		return -1
+	}
+	return code(tun2socks.PrepareReload(C.GoString(jsonConfig)))
+}
+
+//export Tun2SocksGetStats
+func Tun2SocksGetStats() *C.char {
+	return cStringOrNil(tun2socks.Stats(), true)
+}
+
+//export Tun2SocksGetUsageHistory
+func Tun2SocksGetUsageHistory() *C.char {
+	return cStringOrNil(tun2socks.UsageHistory(), true)
+}
+
+//export Tun2SocksFreeString
+func Tun2SocksFreeString(value *C.char) {
+	if value != nil {
+		C.free(unsafe.Pointer(value))
+	}
+}
+
+//export Tun2SocksSetBandwidthLimit
+func Tun2SocksSetBandwidthLimit(uploadKbps C.longlong, downloadKbps C.longlong) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	return code(tun2socks.SetBandwidthLimit(int64(uploadKbps), int64(downloadKbps)))
+}
+
+//export Tun2SocksRegisterConnCallback
+func Tun2SocksRegisterConnCallback(fn C.tun2socks_conn_fn, context unsafe.Pointer) {
+	if fn == nil {
+		tun2socks.SetConnFunc(nil)
+		return
+	}
+	tun2socks.SetConnFunc(func(json string) {
+		callConn(fn, context, json)
+	})
+}
+
+//export Tun2SocksListConnections
+func Tun2SocksListConnections() *C.char {
+	return cStringOrNil(tun2socks.ListConnections(), true)
+}
+
+//export Tun2SocksCloseConnection
+func Tun2SocksCloseConnection(id C.ulonglong) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	return code(tun2socks.CloseConnection(uint64(id)))
+}
+
+//export Tun2SocksStartCapture
+func Tun2SocksStartCapture(path *C.char, maxBytes C.longlong) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	if path == nil {
+		return -1
+	}
+	return code(tun2socks.StartCapture(C.GoString(path), int64(maxBytes)))
+}
+
+//export Tun2SocksStopCapture
+func Tun2SocksStopCapture() {
+	tun2socks.StopCapture()
+}
+
+//export Tun2SocksStartInbound
+func Tun2SocksStartInbound(socksAddr *C.char, httpAddr *C.char) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	return code(tun2socks.StartInbound(cStringOrEmpty(socksAddr), cStringOrEmpty(httpAddr)))
+}
+
+//export Tun2SocksStopInbound
+func Tun2SocksStopInbound() {
+	tun2socks.StopInbound()
+}
+
+//export Tun2SocksPollError
+func Tun2SocksPollError() *C.char {
+	return cStringOrNil(tun2socks.PollError())
+}
+
+//export Tun2SocksRegisterEventCallback
+func Tun2SocksRegisterEventCallback(fn C.tun2socks_event_fn, context unsafe.Pointer) {
+	if fn == nil {
+		tun2socks.SetEventFunc(nil)
+		return
+	}
+	tun2socks.SetEventFunc(func(json string) {
+		callEvent(fn, context, json)
+	})
+}
+
+//export Tun2SocksRegisterFlowClassifier
+func Tun2SocksRegisterFlowClassifier(fn C.tun2socks_flow_classifier_fn, context unsafe.Pointer) {
+	if fn == nil {
+		tun2socks.RegisterFlowClassifier(nil)
+		return
+	}
+	tun2socks.RegisterFlowClassifier(func(srcPort int, dst string, proto string) string {
+		return callFlowClassifier(fn, context, srcPort, dst, proto)
+	})
+}
+
+//export Tun2SocksRegisterFlowRedirector
+func Tun2SocksRegisterFlowRedirector(fn C.tun2socks_flow_redirector_fn, context unsafe.Pointer) {
+	if fn == nil {
+		tun2socks.RegisterFlowRedirector(nil)
+		return
+	}
+	tun2socks.RegisterFlowRedirector(func(srcPort int, dst string, host string, proto string) string {
+		return callFlowRedirector(fn, context, srcPort, dst, host, proto)
+	})
+}
+
+//export Tun2SocksRegisterCrashCallback
+func Tun2SocksRegisterCrashCallback(fn C.tun2socks_crash_fn, context unsafe.Pointer, crashFile *C.char) C.int {
+	if fn == nil {
+		tun2socks.SetCrashFunc(nil)
+	} else {
+		tun2socks.SetCrashFunc(func(message string, stack string) {
+			callCrash(fn, context, message, stack)
+		})
+	}
+	return code(tun2socks.SetCrashFile(cStringOrEmpty(crashFile)))
+}
+
+//export Tun2SocksRunSpeedTest
+func Tun2SocksRunSpeedTest(jsonConfig *C.char, fn C.tun2socks_speedtest_fn, context unsafe.Pointer) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	if jsonConfig == nil {
+		return -1
+	}
+	return code(tun2socks.RunSpeedTest(C.GoString(jsonConfig), func(json string) {
+		callSpeedTest(fn, context, json)
+	}))
+}
+
+//export Tun2SocksSetLogLevel
+func Tun2SocksSetLogLevel(level C.int) C.int {
+	return code(tun2socks.SetLogLevel(int(level)))
+}
+
+//export Tun2SocksRegisterLogCallback
+func Tun2SocksRegisterLogCallback(fn C.tun2socks_log_fn, context unsafe.Pointer) {
+	if fn == nil {
+		tun2socks.SetLogFunc(nil)
+		return
+	}
+	tun2socks.SetLogFunc(func(level int, line string) {
+		callLog(fn, context, level, line)
+	})
+}
+
+//export Tun2SocksGetMemoryStats
+func Tun2SocksGetMemoryStats() *C.char {
+	return cStringOrNil(tun2socks.MemoryStats(), true)
+}
+
+//export Tun2SocksOnMemoryPressure
+func Tun2SocksOnMemoryPressure() (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	return C.int(tun2socks.OnMemoryPressure())
+}
+
+//export Tun2SocksNotifyNetworkChange
+func Tun2SocksNotifyNetworkChange(networkType *C.char) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	return code(tun2socks.NotifyNetworkChange(cStringOrEmpty(networkType)))
+}
+
+//export Tun2SocksStartMetrics
+func Tun2SocksStartMetrics(listenAddr *C.char) (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	return code(tun2socks.StartMetrics(cStringOrEmpty(listenAddr)))
+}
+
+//export Tun2SocksStopMetrics
+func Tun2SocksStopMetrics() {
+	defer func() {
+		crashed(recover())
+	}()
+	tun2socks.StopMetrics()
+}
+
+//export Tun2SocksFlushDNSCache
+func Tun2SocksFlushDNSCache() {
+	defer func() {
+		crashed(recover())
+	}()
+	tun2socks.FlushDNSCache()
+}
+
+//export Tun2SocksSetHTTPPoolConfig
+func Tun2SocksSetHTTPPoolConfig(maxPerHost C.int, idleTimeoutMs C.int) C.int {
+	return code(tun2socks.SetHTTPPoolConfig(int(maxPerHost), time.Duration(idleTimeoutMs)*time.Millisecond))
+}
+
+//export Tun2SocksGetState
+func Tun2SocksGetState() *C.char {
+	return cStringOrNil(tun2socks.State(), true)
+}
+
+//export Tun2SocksReloadRuleSets
+func Tun2SocksReloadRuleSets() (result C.int) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	return code(tun2socks.ReloadRuleSets())
+}
+
+//export Tun2SocksTestOutbound
+func Tun2SocksTestOutbound(name *C.char) (result C.longlong) {
+	defer func() {
+		if crashed(recover()) {
+			result = -9
+		}
+	}()
+	rtt, err := tun2socks.TestOutbound(cStringOrEmpty(name))
+	if err != nil {
+		return C.longlong(code(err))
+	}
+	return C.longlong(rtt.Milliseconds())
+}
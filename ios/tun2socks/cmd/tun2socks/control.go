@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tun2socks "cbv-tun2socks"
+)
+
+const maxControlBody = 4 << 20
+
+// controller serves the control API on a unix socket, so scripts and UIs
+// can inspect and reconfigure the running tunnel.
+type controller struct {
+	configPath string
+	listener   net.Listener
+
+	mu     sync.Mutex
+	config string
+}
+
+func startControl(path string, configPath string, config string) (*controller, error) {
+	// A socket left behind by a previous run would fail the listen.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := listenControl(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &controller{configPath: configPath, listener: ln, config: config}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /state", c.serveString(tun2socks.State))
+	mux.HandleFunc("GET /stats", c.serveString(tun2socks.Stats))
+	mux.HandleFunc("GET /connections", c.serveString(tun2socks.ListConnections))
+	mux.HandleFunc("DELETE /connections/{id}", c.closeConnection)
+	mux.HandleFunc("GET /config", c.getConfig)
+	mux.HandleFunc("PUT /config", c.putConfig)
+	mux.HandleFunc("PUT /routing", c.putRouting)
+	mux.HandleFunc("POST /reload", c.reloadFile)
+	mux.HandleFunc("POST /rulesets/reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := tun2socks.ReloadRuleSets(); err != nil {
+			writeControlError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /dns/flush", func(w http.ResponseWriter, r *http.Request) {
+		tun2socks.FlushDNSCache()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+			fmt.Fprintln(os.Stderr, "tun2socks: control:", err)
+		}
+	}()
+	return c, nil
+}
+
+func (c *controller) close() {
+	c.listener.Close()
+}
+
+func (c *controller) serveString(fn func() string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, fn())
+	}
+}
+
+func (c *controller) closeConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := tun2socks.CloseConnection(id); err != nil {
+		writeControlError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getConfig returns the configuration in effect with its secrets
+// redacted.
+func (c *controller) getConfig(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	config := c.config
+	c.mu.Unlock()
+	var doc any
+	if err := json.Unmarshal([]byte(config), &doc); err != nil {
+		writeControlError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(redactSecrets(doc, ""))
+}
+
+const redacted = "<redacted>"
+
+// secretKeys are the configuration keys whose string values are
+// credentials: proxy passwords, VMess and VLESS ids, KCP keys and the
+// WireGuard document with its private keys.
+var secretKeys = map[string]bool{
+	"password":  true,
+	"uuid":      true,
+	"key":       true,
+	"wireguard": true,
+}
+
+// secretHeaders are the header names in a headers block that carry
+// credentials.
+var secretHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+}
+
+// redactSecrets replaces the credentials in a decoded configuration. parent
+// is the key v is held under.
+func redactSecrets(v any, parent string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			s, isString := child.(string)
+			secret := secretKeys[strings.ToLower(k)] ||
+				strings.EqualFold(parent, "headers") && secretHeaders[strings.ToLower(k)]
+			if isString && s != "" && secret {
+				v[k] = redacted
+				continue
+			}
+			v[k] = redactSecrets(child, k)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = redactSecrets(child, parent)
+		}
+	}
+	return v
+}
+
+func (c *controller) putConfig(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxControlBody))
+	if err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reload(w, string(body))
+}
+
+// putRouting replaces the routing block of the current configuration.
+func (c *controller) putRouting(w http.ResponseWriter, r *http.Request) {
+	var routing json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxControlBody)).Decode(&routing); err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(c.config), &doc); err != nil {
+		writeControlError(w, http.StatusInternalServerError, err)
+		return
+	}
+	doc["routing"] = routing
+	data, err := json.Marshal(doc)
+	if err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	c.reload(w, string(data))
+}
+
+// reloadFile applies the configuration file again, after it was edited.
+func (c *controller) reloadFile(w http.ResponseWriter, r *http.Request) {
+	if c.configPath == "" {
+		writeControlError(w, http.StatusConflict, errors.New("started without -config"))
+		return
+	}
+	data, err := os.ReadFile(c.configPath)
+	if err != nil {
+		writeControlError(w, http.StatusInternalServerError, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reload(w, string(data))
+}
+
+// reload applies config and keeps it as the current one. Called with c.mu
+// held.
+func (c *controller) reload(w http.ResponseWriter, config string) {
+	err := tun2socks.Reload(config)
+	switch {
+	case err == nil:
+		c.config = config
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, tun2socks.ErrInvalidConfig):
+		writeControlError(w, http.StatusBadRequest, err)
+	case errors.Is(err, tun2socks.ErrNotRunning), errors.Is(err, tun2socks.ErrUnsupported):
+		writeControlError(w, http.StatusConflict, err)
+	default:
+		writeControlError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeControlError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
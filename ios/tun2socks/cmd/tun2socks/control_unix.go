@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenControl creates the control socket with mode 0600. The umask is
+// narrowed around the listen so the socket never exists with a wider mode,
+// even for a moment.
+func listenControl(path string) (net.Listener, error) {
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
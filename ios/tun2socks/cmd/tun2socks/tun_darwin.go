@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultTunName = ""
+
+	sysprotoControl = 2
+	utunOptIfname   = 2
+)
+
+// openTun creates a utun interface. An empty name lets the kernel pick the
+// unit; "utunN" asks for that unit.
+func openTun(name string) (int, string, error) {
+	var unit uint32
+	if name != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(name, "utun"))
+		if err != nil || !strings.HasPrefix(name, "utun") {
+			return -1, "", fmt.Errorf("tun name must be utunN, got %q", name)
+		}
+		unit = uint32(n) + 1
+	}
+
+	fd, err := unix.Socket(unix.AF_SYSTEM, unix.SOCK_DGRAM, sysprotoControl)
+	if err != nil {
+		return -1, "", err
+	}
+	info := &unix.CtlInfo{}
+	copy(info.Name[:], "com.apple.net.utun_control")
+	if err := unix.IoctlCtlInfo(fd, info); err != nil {
+		unix.Close(fd)
+		return -1, "", err
+	}
+	if err := unix.Connect(fd, &unix.SockaddrCtl{ID: info.Id, Unit: unit}); err != nil {
+		unix.Close(fd)
+		return -1, "", err
+	}
+	ifname, err := unix.GetsockoptString(fd, sysprotoControl, utunOptIfname)
+	if err != nil {
+		unix.Close(fd)
+		return -1, "", err
+	}
+	return fd, ifname, nil
+}
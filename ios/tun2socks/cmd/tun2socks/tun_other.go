@@ -0,0 +1,11 @@
+//go:build !darwin && !linux
+
+package main
+
+import "errors"
+
+const defaultTunName = ""
+
+func openTun(name string) (int, string, error) {
+	return -1, "", errors.New("tun devices are not supported on this platform")
+}
@@ -0,0 +1,606 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"golang.org/x/net/http/httpguts"
+)
+
+type tunnelConfig struct {
+	Proxy     proxyConfig      `json:"proxy"`
+	Outbounds []proxyConfig    `json:"outbounds,omitempty"`
+	Timeouts  timeoutConfig    `json:"timeouts"`
+	DNS       dnsConfig        `json:"dns"`
+	Routing   routingConfig    `json:"routing"`
+	Queue     *queueConfig     `json:"queue,omitempty"`
+	HTTPPool  *poolConfig      `json:"httpPool,omitempty"`
+	IPv6      string           `json:"ipv6,omitempty"`
+	NAT64     string           `json:"nat64,omitempty"`
+	MTU       int              `json:"mtu,omitempty"`
+	QUIC      string           `json:"quic,omitempty"`
+	ICMP      string           `json:"icmp,omitempty"`
+	Multicast string           `json:"multicast,omitempty"`
+	QoS       *qosConfig       `json:"qos,omitempty"`
+	Bandwidth *bandwidthConfig `json:"bandwidth,omitempty"`
+	Capture   *captureConfig   `json:"capture,omitempty"`
+	Retry     *retryConfig     `json:"retry,omitempty"`
+	Inbound   *inboundConfig   `json:"inbound,omitempty"`
+	Forwards  []forwardConfig  `json:"forwards,omitempty"`
+	Keepalive *keepaliveConfig `json:"keepalive,omitempty"`
+	Usage     *usageConfig     `json:"usage,omitempty"`
+	Socket    *socketConfig    `json:"socket,omitempty"`
+	Stack     *stackConfig     `json:"stack,omitempty"`
+	UDP       *udpConfig       `json:"udp,omitempty"`
+	Memory    *memoryConfig    `json:"memory,omitempty"`
+	Watchdog  *watchdogConfig  `json:"watchdog,omitempty"`
+	TTL       *ttlConfig       `json:"ttl,omitempty"`
+	Reject    string           `json:"reject,omitempty"`
+	Remote    *remoteConfig    `json:"remote,omitempty"`
+}
+
+type proxyConfig struct {
+	Name     string `json:"name,omitempty"`
+	Type     string `json:"type"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	UUID      string            `json:"uuid,omitempty"`
+	Security  string            `json:"security,omitempty"`
+	Transport *transportConfig  `json:"transport,omitempty"`
+	TLS       *tlsConfig        `json:"tls,omitempty"`
+	HTTP2     bool              `json:"http2,omitempty"`
+	HTTPAuth  string            `json:"httpAuth,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Via       string            `json:"via,omitempty"`
+
+	UDPOverTCP bool       `json:"udpOverTCP,omitempty"`
+	Mux        *muxConfig `json:"mux,omitempty"`
+	HalfClose  *bool      `json:"halfClose,omitempty"`
+
+	WireGuard string `json:"wireguard,omitempty"`
+
+	Members     []string           `json:"members,omitempty"`
+	Strategy    string             `json:"strategy,omitempty"`
+	HealthCheck *healthCheckConfig `json:"healthCheck,omitempty"`
+}
+
+type timeoutConfig struct {
+	ConnectMs   int `json:"connectMs,omitempty"`
+	UDPIdleMs   int `json:"udpIdleMs,omitempty"`
+	TCPIdleMs   int `json:"tcpIdleMs,omitempty"`
+	DrainMs     int `json:"drainMs,omitempty"`
+	HandshakeMs int `json:"handshakeMs,omitempty"`
+	LingerMs    int `json:"lingerMs,omitempty"`
+
+	TCPIdleByClass map[string]int `json:"tcpIdleByClass,omitempty"`
+}
+
+type dnsConfig struct {
+	Intercept   bool   `json:"intercept"`
+	Mode        string `json:"mode,omitempty"`
+	Server      string `json:"server,omitempty"`
+	ServerName  string `json:"serverName,omitempty"`
+	FakeIP      bool   `json:"fakeIP,omitempty"`
+	FakeIPRange string `json:"fakeIPRange,omitempty"`
+	ReverseMap  bool   `json:"reverseMap,omitempty"`
+
+	Rules []dnsRuleConfig `json:"rules,omitempty"`
+	Cache *dnsCacheConfig `json:"cache,omitempty"`
+
+	Bootstrap  string              `json:"bootstrap,omitempty"`
+	ProxyHosts map[string][]string `json:"proxyHosts,omitempty"`
+
+	Hosts map[string][]string `json:"hosts,omitempty"`
+}
+
+type routingConfig struct {
+	GeoIPPath   string       `json:"geoipPath,omitempty"`
+	Final       string       `json:"final,omitempty"`
+	Rules       []ruleConfig `json:"rules,omitempty"`
+	Bypass      []string     `json:"bypass,omitempty"`
+	BypassLAN   bool         `json:"bypassLAN,omitempty"`
+	LANOutbound string       `json:"lanOutbound,omitempty"`
+	Blocklist   []string     `json:"blocklist,omitempty"`
+
+	Providers map[string]ruleProviderConfig `json:"providers,omitempty"`
+}
+
+type ruleConfig struct {
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Outbound string `json:"outbound"`
+}
+
+type queueConfig struct {
+	Size       int    `json:"size,omitempty"`
+	Policy     string `json:"policy,omitempty"`
+	DeadlineMs int    `json:"deadlineMs,omitempty"`
+}
+
+type poolConfig struct {
+	MaxPerHost    int `json:"maxPerHost"`
+	IdleTimeoutMs int `json:"idleTimeoutMs,omitempty"`
+}
+
+func parseConfig(data string) (*tunnelConfig, error) {
+	cfg := &tunnelConfig{}
+	if err := json.Unmarshal([]byte(data), cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *tunnelConfig) validate() error {
+	if err := c.Proxy.validate(); err != nil {
+		return err
+	}
+	names := map[string]bool{outboundProxy: true, outboundDirect: true, outboundBlock: true}
+	for i := range c.Outbounds {
+		ob := &c.Outbounds[i]
+		if ob.Name == "" || names[ob.Name] {
+			return fmt.Errorf("outbound %d needs a unique name", i)
+		}
+		if err := ob.validate(); err != nil {
+			return fmt.Errorf("outbound %q: %w", ob.Name, err)
+		}
+		names[ob.Name] = true
+	}
+	if c.Timeouts.ConnectMs < 0 || c.Timeouts.UDPIdleMs < 0 || c.Timeouts.TCPIdleMs < 0 || c.Timeouts.DrainMs < 0 || c.Timeouts.HandshakeMs < 0 || c.Timeouts.LingerMs < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	for class, ms := range c.Timeouts.TCPIdleByClass {
+		if _, ok := defaultClassIdle[class]; !ok {
+			return fmt.Errorf("unknown traffic class %q", class)
+		}
+		if ms < 0 {
+			return errors.New("timeouts must not be negative")
+		}
+	}
+	if c.Queue != nil {
+		if c.Queue.Size < 0 || c.Queue.DeadlineMs < 0 {
+			return errors.New("queue size and deadline must not be negative")
+		}
+		if _, ok := queuePolicies[c.Queue.Policy]; !ok {
+			return errors.New("unknown queue policy")
+		}
+	}
+	groups := []*proxyConfig{&c.Proxy}
+	for i := range c.Outbounds {
+		groups = append(groups, &c.Outbounds[i])
+	}
+	for _, p := range groups {
+		if p.Via == "" {
+			continue
+		}
+		if groupTypes[p.Type] || p.Type == "wireguard" {
+			return errors.New("via needs a proxy outbound")
+		}
+		if err := c.checkChain(p); err != nil {
+			return err
+		}
+	}
+	for _, g := range groups {
+		if !groupTypes[g.Type] {
+			continue
+		}
+		for _, m := range g.Members {
+			if m == outboundProxy || !names[m] || c.isGroup(m) {
+				return fmt.Errorf("group member %q must be a named outbound or direct", m)
+			}
+		}
+	}
+	for _, r := range c.Routing.Rules {
+		if !names[r.Outbound] {
+			return fmt.Errorf("rule %s %s: unknown outbound %q", r.Type, r.Value, r.Outbound)
+		}
+		if _, ok := c.Routing.Providers[r.Value]; strings.EqualFold(r.Type, "rule-set") && !ok {
+			return fmt.Errorf("rule set %q is not among the providers", r.Value)
+		}
+	}
+	for name, p := range c.Routing.Providers {
+		if name == "" || p.Path == "" {
+			return errors.New("rule providers need a name and a path")
+		}
+		if !ruleSetFormats[strings.ToLower(p.Format)] {
+			return fmt.Errorf("rule set %s: unsupported format %q", name, p.Format)
+		}
+		if (strings.ToLower(p.Format) == "geosite") != (p.Category != "") {
+			return fmt.Errorf("rule set %s: a category is needed for the geosite format only", name)
+		}
+	}
+	switch c.Routing.LANOutbound {
+	case "", outboundDirect, outboundBlock:
+	default:
+		return fmt.Errorf("lanOutbound must be %s or %s", outboundDirect, outboundBlock)
+	}
+	for _, entry := range c.Routing.Bypass {
+		if _, err := parseBypass(entry); err != nil {
+			return fmt.Errorf("bypass entry %q: %w", entry, err)
+		}
+	}
+	for _, rule := range c.DNS.Rules {
+		if rule.Server == "" || len(rule.Domains) == 0 {
+			return errors.New("dns rules need domains and a server")
+		}
+		if !names[rule.outbound()] {
+			return fmt.Errorf("dns rule for %s: unknown outbound %q", rule.Server, rule.Outbound)
+		}
+		for _, entry := range rule.Domains {
+			if _, err := parseDNSDomain(entry); err != nil {
+				return fmt.Errorf("dns rule domain %q: %w", entry, err)
+			}
+		}
+	}
+	if cache := c.DNS.Cache; cache != nil {
+		if cache.MaxEntries < 0 || cache.MinTTL < 0 || cache.MaxTTL < 0 || (cache.MaxTTL > 0 && cache.MinTTL > cache.MaxTTL) {
+			return errors.New("dns cache sizes and ttls must not be negative and minTTL must not exceed maxTTL")
+		}
+	}
+	if c.DNS.Bootstrap != "" {
+		if _, err := netip.ParseAddrPort(withDefaultPort(c.DNS.Bootstrap, "53")); err != nil {
+			return fmt.Errorf("dns bootstrap %q must be an ip address with an optional port", c.DNS.Bootstrap)
+		}
+	}
+	for host, addrs := range c.DNS.ProxyHosts {
+		if host == "" || len(addrs) == 0 {
+			return errors.New("dns proxyHosts need a name and addresses")
+		}
+		for _, addr := range addrs {
+			if _, err := netip.ParseAddr(addr); err != nil {
+				return fmt.Errorf("dns proxyHosts address %q for %s: %w", addr, host, err)
+			}
+		}
+	}
+	if _, err := newHostsResolver(c.DNS.Hosts, nil); err != nil {
+		return err
+	}
+	if c.Routing.Final != "" && !names[c.Routing.Final] {
+		return fmt.Errorf("unknown final outbound %q", c.Routing.Final)
+	}
+	if c.Proxy.Type == "wireguard" && (c.Routing.enabled() || c.DNS.enabled()) {
+		return errors.New("routing and dns interception are not available in wireguard mode")
+	}
+	if c.Proxy.Type == "wireguard" && c.Inbound != nil {
+		return errors.New("inbound listeners are not available in wireguard mode")
+	}
+	listens := make(map[string]bool, len(c.Forwards))
+	for i := range c.Forwards {
+		f := &c.Forwards[i]
+		if err := f.validate(names); err != nil {
+			return err
+		}
+		if listens[f.Listen] {
+			return fmt.Errorf("forward listen %q is used twice", f.Listen)
+		}
+		listens[f.Listen] = true
+	}
+	if c.Proxy.Type == "wireguard" && len(c.Forwards) > 0 {
+		return errors.New("forwards are not available in wireguard mode")
+	}
+	if c.Proxy.Type == "wireguard" && c.Keepalive != nil {
+		return errors.New("keepalive probing is not available in wireguard mode")
+	}
+	if _, ok := rejectModes[c.Reject]; !ok {
+		return fmt.Errorf("unknown reject mode %q", c.Reject)
+	}
+	if c.TTL != nil {
+		if c.Proxy.Type == "wireguard" {
+			return errors.New("ttl is not available in wireguard mode")
+		}
+		if c.TTL.Outgoing < 0 || c.TTL.Outgoing > 255 || c.TTL.MinIncoming < 0 || c.TTL.MinIncoming > 255 {
+			return errors.New("ttl values must be between 0 and 255")
+		}
+	}
+	if c.MTU != 0 && (c.MTU < minMTU || c.MTU > 65535) {
+		return fmt.Errorf("mtu must be between %d and 65535", minMTU)
+	}
+	if b := c.Bandwidth; b != nil && (b.UploadKbps < 0 || b.DownloadKbps < 0 || b.ConnUploadKbps < 0 || b.ConnDownloadKbps < 0) {
+		return errors.New("bandwidth limits must not be negative")
+	}
+	if c.Remote != nil {
+		if err := c.Remote.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Memory != nil {
+		if _, ok := memoryProfiles[strings.ToLower(c.Memory.Profile)]; !ok || c.Memory.Profile == "" {
+			return fmt.Errorf("unknown memory profile %q", c.Memory.Profile)
+		}
+	}
+	if c.Capture != nil && (c.Capture.Path == "" || c.Capture.MaxBytes < 0) {
+		return errors.New("capture needs a path and a non-negative maxBytes")
+	}
+	if c.UDP != nil {
+		if _, ok := udpFilterModes[c.UDP.Filtering]; !ok {
+			return fmt.Errorf("unknown udp filtering %q", c.UDP.Filtering)
+		}
+		if c.UDP.MaxSessions < 0 || c.UDP.UnrepliedMs < 0 {
+			return errors.New("udp session limits must not be negative")
+		}
+		if c.Proxy.Type == "wireguard" {
+			return errors.New("udp session settings are not available in wireguard mode")
+		}
+	}
+	if c.Stack != nil && c.Stack.MaxConnections < 0 {
+		return errors.New("maxConnections must not be negative")
+	}
+	if c.Stack != nil && c.Stack.TCPWindow != 0 && (c.Stack.TCPWindow < core.TCPMSS || c.Stack.TCPWindow > 0xFFFF) {
+		return fmt.Errorf("tcpWindow must be between %d and 65535", core.TCPMSS)
+	}
+	if c.Stack != nil && c.Stack.TCPSendBuffer != 0 && (c.Stack.TCPSendBuffer < 2*core.TCPMSS || c.Stack.TCPSendBuffer > 0xFFFF) {
+		return fmt.Errorf("tcpSendBuffer must be between %d and 65535", 2*core.TCPMSS)
+	}
+	if c.Proxy.Type == "wireguard" && c.Stack != nil {
+		return errors.New("stack limits are not available in wireguard mode")
+	}
+	if c.Socket != nil && (c.Socket.SendBuffer < 0 || c.Socket.ReceiveBuffer < 0) {
+		return errors.New("socket buffer sizes must not be negative")
+	}
+	if c.Socket != nil {
+		if err := c.Socket.FlowKeepalive.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Retry != nil && (c.Retry.Attempts < 0 || c.Retry.Attempts > 10 || c.Retry.BackoffMs < 0) {
+		return errors.New("retry attempts must be between 0 and 10 and backoff must not be negative")
+	}
+	if !quicModes[c.QUIC] {
+		return fmt.Errorf("unknown quic mode %q", c.QUIC)
+	}
+	if !icmpModes[c.ICMP] {
+		return fmt.Errorf("unknown icmp mode %q", c.ICMP)
+	}
+	if _, ok := multicastModes[c.Multicast]; !ok {
+		return fmt.Errorf("unknown multicast mode %q", c.Multicast)
+	}
+	if c.Proxy.Type == "wireguard" && c.Multicast != "" {
+		return errors.New("multicast handling is not available in wireguard mode")
+	}
+	if err := c.QoS.validate(); err != nil {
+		return err
+	}
+	if c.Proxy.Type == "wireguard" && c.QoS != nil {
+		return errors.New("qos is not available in wireguard mode")
+	}
+	// Classes are paced against a tunnel-wide cap; without one QoS would
+	// do nothing.
+	if c.QoS != nil && (c.Bandwidth == nil || c.Bandwidth.UploadKbps == 0 && c.Bandwidth.DownloadKbps == 0) {
+		return errors.New("qos needs a tunnel-wide bandwidth cap")
+	}
+	if _, ok := ipv6Modes[c.IPv6]; !ok {
+		return fmt.Errorf("unknown ipv6 mode %q", c.IPv6)
+	}
+	if c.NAT64 != "" && c.NAT64 != "auto" {
+		if prefix, err := netip.ParsePrefix(c.NAT64); err != nil || !prefix.Addr().Is6() || prefix.Bits() != 96 {
+			return errors.New("nat64 prefix must be an ipv6 /96")
+		}
+	}
+	if c.HTTPPool != nil && (c.HTTPPool.MaxPerHost < 0 || c.HTTPPool.IdleTimeoutMs < 0) {
+		return errors.New("http pool settings must not be negative")
+	}
+	return nil
+}
+
+func (c *proxyConfig) validate() error {
+	c.Type = strings.ToLower(c.Type)
+	if c.Mux != nil && (groupTypes[c.Type] || c.Type == "wireguard") {
+		return errors.New("mux needs a proxy outbound")
+	}
+	if c.HalfClose != nil && groupTypes[c.Type] {
+		return errors.New("halfClose is set on the member outbounds of a group")
+	}
+	if !httpAuthSchemes[strings.ToLower(c.HTTPAuth)] {
+		return fmt.Errorf("unknown http auth scheme %q", c.HTTPAuth)
+	}
+	if c.HTTP2 && c.HTTPAuth != "" && !strings.EqualFold(c.HTTPAuth, "basic") {
+		return errors.New("http2 proxies only support basic auth")
+	}
+	if c.TLS != nil {
+		if err := validatePins(c.TLS.Pins); err != nil {
+			return err
+		}
+	}
+	if c.Transport != nil {
+		if err := validatePins(c.Transport.Pins); err != nil {
+			return err
+		}
+		if err := c.Transport.KCP.validate(); err != nil {
+			return err
+		}
+		if c.Transport.KCP != nil && !c.Transport.isKCP() {
+			return errors.New("kcp settings need a kcp transport")
+		}
+		if c.Transport.isKCP() && c.Via != "" {
+			return errors.New("a kcp transport runs over UDP and cannot go through via")
+		}
+	}
+	if len(c.Headers) > 0 && c.Type != "http" && c.Type != "https" {
+		return errors.New("headers only apply to http and https proxies")
+	}
+	for name, value := range c.Headers {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid header %q", name)
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "Host", "Content-Length", "Transfer-Encoding":
+			return fmt.Errorf("header %q cannot be set", name)
+		case "Proxy-Authorization":
+			if c.Username != "" || c.Password != "" {
+				return errors.New("a proxy-authorization header conflicts with username and password")
+			}
+		}
+	}
+	if c.Mux != nil && (c.Mux.Connections < 0 || c.Mux.Streams < 0) {
+		return errors.New("mux limits must not be negative")
+	}
+	if groupTypes[c.Type] {
+		if len(c.Members) == 0 {
+			return errors.New("group members are required")
+		}
+		return nil
+	}
+	if c.Type == "wireguard" {
+		if c.WireGuard == "" {
+			return errors.New("wireguard config text is required")
+		}
+		return nil
+	}
+	if isUnixSocket(c.Host) {
+		if c.Type != "socks5" && c.Type != "socks" {
+			return errors.New("only socks5 proxies can be reached over a unix socket")
+		}
+		if c.Transport != nil || c.Via != "" {
+			return errors.New("a unix socket proxy takes no transport or via")
+		}
+		return nil
+	}
+	if c.Type == "" || c.Host == "" || c.Port <= 0 || c.Port > 65535 {
+		return errors.New("proxy type, host and port are required")
+	}
+	return nil
+}
+
+// checkChain follows the via links from p and fails on an unknown hop,
+// one that is not a proxy, or a loop.
+func (c *tunnelConfig) checkChain(p *proxyConfig) error {
+	seen := map[string]bool{p.Name: true}
+	for hop := p.Via; hop != ""; {
+		if seen[hop] {
+			return fmt.Errorf("via chain through %q loops", hop)
+		}
+		seen[hop] = true
+		next := c.outbound(hop)
+		if next == nil || groupTypes[next.Type] || next.Type == "wireguard" {
+			return fmt.Errorf("via %q must be a named proxy outbound", hop)
+		}
+		hop = next.Via
+	}
+	return nil
+}
+
+func (c *tunnelConfig) outbound(name string) *proxyConfig {
+	for i := range c.Outbounds {
+		if c.Outbounds[i].Name == name {
+			return &c.Outbounds[i]
+		}
+	}
+	return nil
+}
+
+func (c *tunnelConfig) isGroup(name string) bool {
+	for _, ob := range c.Outbounds {
+		if ob.Name == name {
+			return groupTypes[ob.Type]
+		}
+	}
+	return false
+}
+
+func (c *proxyConfig) uuid() string {
+	if c.UUID != "" {
+		return c.UUID
+	}
+	return c.Username
+}
+
+// connectHeader returns the extra headers sent with every CONNECT.
+func (c *proxyConfig) connectHeader() http.Header {
+	if len(c.Headers) == 0 {
+		return nil
+	}
+	header := make(http.Header, len(c.Headers))
+	for name, value := range c.Headers {
+		header.Set(name, value)
+	}
+	return header
+}
+
+// relaysUDP reports whether the outbound carries UDP itself rather than
+// answering only DNS through the fallback handler, as newOutbound decides.
+// Groups need the other outbounds; see tunnelConfig.relaysUDP.
+func (c *proxyConfig) relaysUDP() bool {
+	if c.UDPOverTCP {
+		return true
+	}
+	switch c.Type {
+	case "socks5", "socks", "shadowsocks", "ss":
+		// UDP ASSOCIATE needs a relay address a Unix socket cannot give,
+		// and only TCP crosses a transport or a chain.
+		return c.Transport == nil && c.Via == "" && !isUnixSocket(c.Host)
+	case "wireguard":
+		return true
+	}
+	return false
+}
+
+// relaysUDP reports whether p, the main proxy or a named outbound, carries
+// UDP. A group does only when all of its members do.
+func (c *tunnelConfig) relaysUDP(p *proxyConfig) bool {
+	if !groupTypes[p.Type] {
+		return p.relaysUDP()
+	}
+	for _, m := range p.Members {
+		if m == outboundDirect {
+			continue
+		}
+		if ob := c.outbound(m); ob == nil || !ob.relaysUDP() {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *routingConfig) enabled() bool {
+	return len(c.Rules) > 0 || len(c.Bypass) > 0 || len(c.Blocklist) > 0 || c.Final != "" || c.BypassLAN
+}
+
+func (c *dnsConfig) enabled() bool {
+	return c.Intercept || c.Mode != "" || c.FakeIP || c.ReverseMap || len(c.Rules) > 0 || len(c.Hosts) > 0
+}
+
+func (c *timeoutConfig) connect() time.Duration {
+	if c.ConnectMs > 0 {
+		return time.Duration(c.ConnectMs) * time.Millisecond
+	}
+	return 10 * time.Second
+}
+
+func (c *timeoutConfig) handshake() time.Duration {
+	if c.HandshakeMs > 0 {
+		return time.Duration(c.HandshakeMs) * time.Millisecond
+	}
+	return 10 * time.Second
+}
+
+func (c *timeoutConfig) udpIdle() time.Duration {
+	if c.UDPIdleMs > 0 {
+		return time.Duration(c.UDPIdleMs) * time.Millisecond
+	}
+	return 30 * time.Second
+}
+
+func (c *timeoutConfig) tcpIdle() time.Duration {
+	if c.TCPIdleMs > 0 {
+		return time.Duration(c.TCPIdleMs) * time.Millisecond
+	}
+	return 10 * time.Minute
+}
+
+var queuePolicies = map[string]int{
+	"":            QueueDropNewest,
+	"drop-newest": QueueDropNewest,
+	"drop-oldest": QueueDropOldest,
+	"block":       QueueBlock,
+}
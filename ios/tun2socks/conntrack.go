@@ -0,0 +1,537 @@
+package tun2socks
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+type connRecord struct {
+	id      uint64
+	network string
+	source  string
+	target  string
+	started time.Time
+
+	mu     sync.Mutex
+	host   string
+	class  string
+	socket *net.TCPConn
+
+	tag    string
+	tagged *tagCounters
+
+	idleLimit atomic.Int64
+	// priority is the QoS class plus one, 0 while none is assigned.
+	priority atomic.Int32
+
+	uplink   atomic.Uint64
+	downlink atomic.Uint64
+	active   atomic.Int64
+	closed   atomic.Bool
+	abort    func()
+}
+
+type connEvent struct {
+	Event      string `json:"event,omitempty"`
+	ID         uint64 `json:"id"`
+	Network    string `json:"network"`
+	Source     string `json:"source"`
+	Target     string `json:"target"`
+	Host       string `json:"host,omitempty"`
+	Class      string `json:"class,omitempty"`
+	Priority   string `json:"priority,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Uplink     uint64 `json:"uplinkBytes"`
+	Downlink   uint64 `json:"downlinkBytes"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+var (
+	connIDs     atomic.Uint64
+	connMu      sync.Mutex
+	connections = make(map[uint64]*connRecord)
+
+	connFn func(json string)
+)
+
+// ErrNoConnection is returned for a flow id that is not open.
+var ErrNoConnection = errors.New("no such connection")
+
+// SetConnFunc registers fn to receive a JSON event whenever a flow opens or
+// closes. A nil fn stops the events.
+func SetConnFunc(fn func(json string)) {
+	connMu.Lock()
+	defer connMu.Unlock()
+
+	connFn = fn
+}
+
+// ListConnections returns the open flows as a JSON array, oldest first.
+// Each entry has the fields of a connection event except the event name.
+func ListConnections() string {
+	connMu.Lock()
+	records := make([]*connRecord, 0, len(connections))
+	for _, r := range connections {
+		records = append(records, r)
+	}
+	connMu.Unlock()
+
+	slices.SortFunc(records, func(a, b *connRecord) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	list := make([]connEvent, len(records))
+	for i, r := range records {
+		list[i] = r.event("")
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// CloseConnection tears down the flow with the given id, as reported in
+// connection events and by ListConnections.
+func CloseConnection(id uint64) error {
+	connMu.Lock()
+	r := connections[id]
+	connMu.Unlock()
+	if r == nil {
+		return ErrNoConnection
+	}
+
+	r.mu.Lock()
+	abort := r.abort
+	r.mu.Unlock()
+	if abort == nil {
+		return ErrNoConnection
+	}
+	abort()
+	logger.Info("connection closed by host", "id", id, "target", r.target)
+	return nil
+}
+
+func openConn(network string, source net.Addr, target net.Addr) *connRecord {
+	r := &connRecord{
+		id:      connIDs.Add(1),
+		network: network,
+		started: time.Now(),
+	}
+	r.active.Store(monotonic())
+	if source != nil {
+		r.source = source.String()
+	}
+	if target != nil {
+		r.target = target.String()
+	}
+	r.tag, r.tagged = classifyFlow(network, source, target)
+
+	connMu.Lock()
+	connections[r.id] = r
+	connMu.Unlock()
+
+	switch network {
+	case "tcp":
+		stats.tcpConns.Add(1)
+	case "udp":
+		stats.udpConns.Add(1)
+	}
+
+	r.emit("open")
+	return r
+}
+
+func (r *connRecord) close() {
+	if r.closed.Swap(true) {
+		return
+	}
+
+	connMu.Lock()
+	delete(connections, r.id)
+	connMu.Unlock()
+
+	switch r.network {
+	case "tcp":
+		stats.tcpConns.Add(-1)
+	case "udp":
+		stats.udpConns.Add(-1)
+	}
+
+	r.emit("close")
+}
+
+// abortFlows tears down every flow of network, or of any network when it is
+// empty, that has been idle for at least minIdle and returns how many were
+// aborted.
+func abortFlows(network string, minIdle time.Duration) int {
+	var aborts []func()
+	connMu.Lock()
+	for _, r := range connections {
+		if (network != "" && r.network != network) || r.idle() < minIdle {
+			continue
+		}
+		r.mu.Lock()
+		if r.abort != nil {
+			aborts = append(aborts, r.abort)
+		}
+		r.mu.Unlock()
+	}
+	connMu.Unlock()
+
+	for _, abort := range aborts {
+		abort()
+	}
+	return len(aborts)
+}
+
+func (r *connRecord) addUplink(n int) {
+	r.uplink.Add(uint64(n))
+	if r.tagged != nil {
+		r.tagged.uplink.Add(uint64(n))
+	}
+	r.active.Store(monotonic())
+}
+
+func (r *connRecord) addDownlink(n int) {
+	r.downlink.Add(uint64(n))
+	if r.tagged != nil {
+		r.tagged.downlink.Add(uint64(n))
+	}
+	r.active.Store(monotonic())
+}
+
+// idle returns how long no bytes have moved in either direction.
+func (r *connRecord) idle() time.Duration {
+	return time.Duration(monotonic() - r.active.Load())
+}
+
+// setAbort registers how the flow is torn down when memory runs low or the
+// host closes it.
+func (r *connRecord) setAbort(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.abort = fn
+}
+
+func (r *connRecord) setHost(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.host == "" {
+		r.host = host
+	}
+}
+
+// setClass records the traffic class of a TCP flow, which sets its idle
+// timeout and whether its upstream socket sends keepalives.
+func (r *connRecord) setClass(class string) {
+	r.mu.Lock()
+	r.class = class
+	socket := r.socket
+	r.mu.Unlock()
+	r.idleLimit.Store(int64(tcpIdleFor(class)))
+	keepAliveFlow(socket, class)
+}
+
+// setSocket records the TCP socket a flow is relayed over, before its
+// class is known.
+func (r *connRecord) setSocket(socket *net.TCPConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.socket = socket
+}
+
+func (r *connRecord) getClass() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.class
+}
+
+// setPriority assigns the flow to a QoS class.
+func (r *connRecord) setPriority(prio int) {
+	r.priority.Store(int32(prio) + 1)
+}
+
+func (r *connRecord) getPriority() int {
+	if p := r.priority.Load(); p > 0 {
+		return int(p - 1)
+	}
+	return priorityStreaming
+}
+
+func (r *connRecord) priorityLabel() string {
+	if p := r.priority.Load(); p > 0 {
+		return priorityLabels[p-1]
+	}
+	return ""
+}
+
+func (r *connRecord) setIdleTimeout(d time.Duration) {
+	r.idleLimit.Store(int64(d))
+}
+
+func (r *connRecord) idleTimeout() time.Duration {
+	return time.Duration(r.idleLimit.Load())
+}
+
+func (r *connRecord) event(name string) connEvent {
+	r.mu.Lock()
+	host, class := r.host, r.class
+	r.mu.Unlock()
+
+	return connEvent{
+		Event:      name,
+		ID:         r.id,
+		Network:    r.network,
+		Source:     r.source,
+		Target:     r.target,
+		Host:       host,
+		Class:      class,
+		Priority:   r.priorityLabel(),
+		Tag:        r.tag,
+		Uplink:     r.uplink.Load(),
+		Downlink:   r.downlink.Load(),
+		DurationMs: time.Since(r.started).Milliseconds(),
+	}
+}
+
+func (r *connRecord) emit(name string) {
+	connMu.Lock()
+	fn := connFn
+	connMu.Unlock()
+
+	if fn == nil {
+		return
+	}
+	data, err := json.Marshal(r.event(name))
+	if err != nil {
+		return
+	}
+	fn(string(data))
+}
+
+type sniffingReader struct {
+	io.Reader
+	record  *connRecord
+	sniffed bool
+}
+
+func (s *sniffingReader) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	if n > 0 {
+		s.record.addUplink(n)
+		stats.relayUplink.Add(uint64(n))
+		if !s.sniffed {
+			s.sniffed = true
+			if host := sniffHost(p[:n]); host != "" {
+				s.record.setHost(host)
+				if activeQoS.Load() != nil {
+					s.record.setPriority(flowPriority(s.record.target, host))
+				}
+			}
+			if s.record.getClass() == "" {
+				if class := classifyPayload(p[:n]); class != "" {
+					s.record.setClass(class)
+				}
+			}
+		}
+	}
+	return n, err
+}
+
+type countingWriter struct {
+	io.Writer
+	record *connRecord
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.record.addDownlink(n)
+	stats.relayDownlink.Add(uint64(n))
+	return n, err
+}
+
+type trackedUDPHandler struct {
+	sync.Mutex
+
+	inner core.UDPConnHandler
+	conns map[core.UDPConn]*trackedUDPConn
+}
+
+type trackedUDPConn struct {
+	core.UDPConn
+	handler *trackedUDPHandler
+	inner   core.UDPConnHandler
+	record  *connRecord
+	up      limiter
+	down    limiter
+	stop    func()
+	once    sync.Once
+
+	closeMu sync.Mutex
+	closed  bool
+	closers []func()
+
+	filtering int32
+	peerMu    sync.Mutex
+	peers     map[netip.AddrPort]struct{}
+}
+
+func newTrackedUDPHandler(inner core.UDPConnHandler) *trackedUDPHandler {
+	return &trackedUDPHandler{
+		inner: inner,
+		conns: make(map[core.UDPConn]*trackedUDPConn, 8),
+	}
+}
+
+func (h *trackedUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	if draining.Load() {
+		return errDraining
+	}
+	if ipv6Disabled() && target != nil && target.IP.To4() == nil {
+		return errIPv6Disabled
+	}
+	var targetAddr net.Addr
+	if target != nil {
+		if err := rejectLoop("udp", target.AddrPort()); err != nil {
+			return err
+		}
+		targetAddr = target
+	}
+	h.evictIdlest()
+	h.Lock()
+	tracked := &trackedUDPConn{
+		UDPConn:   conn,
+		handler:   h,
+		inner:     h.inner,
+		record:    openConn("udp", conn.LocalAddr(), targetAddr),
+		up:        uplinkLimiter(),
+		down:      downlinkLimiter(),
+		filtering: udpFiltering.Load(),
+		peers:     make(map[netip.AddrPort]struct{}),
+	}
+	tracked.record.setAbort(func() {
+		tracked.Close()
+	})
+	tracked.record.setIdleTimeout(time.Duration(udpIdleTimeout.Load()))
+	stopIdle := watchIdle(tracked.record, func() {
+		tracked.Close()
+	})
+	stopUnreplied := watchUnreplied(tracked)
+	tracked.stop = func() {
+		stopIdle()
+		stopUnreplied()
+	}
+	h.conns[conn] = tracked
+	h.Unlock()
+
+	if err := tracked.inner.Connect(tracked, target); err != nil {
+		if errors.Is(err, errBlocked) {
+			tracked.Close()
+			return err
+		}
+		logger.Warn("udp connect failed", "target", targetAddr, "error", err)
+		reportError("udp", target.String(), err)
+		tracked.Close()
+		return err
+	}
+	return nil
+}
+
+func (h *trackedUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	tracked, ok := h.conns[conn]
+	inner := h.inner
+	h.Unlock()
+
+	if !ok {
+		return inner.ReceiveTo(conn, data, addr)
+	}
+	if !tracked.up.allow(len(data)) {
+		return nil
+	}
+	tracked.addPeer(addr)
+	tracked.record.addUplink(len(data))
+	return tracked.inner.ReceiveTo(tracked, data, addr)
+}
+
+// setInner switches the handler used for new sessions. Existing sessions
+// keep the handler they were connected with.
+func (h *trackedUDPHandler) setInner(inner core.UDPConnHandler) {
+	h.Lock()
+	defer h.Unlock()
+	h.inner = inner
+}
+
+func (c *trackedUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	if !c.allowFrom(addr) {
+		stats.udpFiltered.Add(1)
+		return len(data), nil
+	}
+	if !c.down.allow(len(data)) {
+		return len(data), nil
+	}
+	n, err := c.UDPConn.WriteFrom(data, addr)
+	c.record.addDownlink(n)
+	return n, err
+}
+
+func (c *trackedUDPConn) Close() error {
+	c.once.Do(func() {
+		c.stop()
+		c.handler.Lock()
+		delete(c.handler.conns, c.UDPConn)
+		c.handler.Unlock()
+		c.record.close()
+		c.closeMu.Lock()
+		c.closed = true
+		closers := c.closers
+		c.closers = nil
+		c.closeMu.Unlock()
+		for _, fn := range closers {
+			fn()
+		}
+	})
+	return c.UDPConn.Close()
+}
+
+// udpConnWrapper is a UDP session as a handler hands it on, wrapping the
+// one it was given.
+type udpConnWrapper interface {
+	unwrapUDP() core.UDPConn
+}
+
+// onSessionClose calls fn once the tracked session under conn is closed.
+// Sessions mostly end there, on idle or eviction, without passing through
+// the wrappers of the handlers behind it, so a handler that maps conn to
+// its own wrapper drops the entry with this.
+func onSessionClose(conn core.UDPConn, fn func()) {
+	for {
+		switch c := conn.(type) {
+		case *trackedUDPConn:
+			c.closeMu.Lock()
+			closed := c.closed
+			if !closed {
+				c.closers = append(c.closers, fn)
+			}
+			c.closeMu.Unlock()
+			if closed {
+				fn()
+			}
+			return
+		case udpConnWrapper:
+			conn = c.unwrapUDP()
+		default:
+			return
+		}
+	}
+}
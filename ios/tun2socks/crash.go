@@ -0,0 +1,71 @@
+package tun2socks
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var (
+	crashMu   sync.Mutex
+	crashFn   func(message string, stack string)
+	crashPath string
+)
+
+// SetCrashFunc registers fn to receive the message and goroutine stack of
+// every panic reported with ReportPanic. A nil fn stops the reports.
+func SetCrashFunc(fn func(message string, stack string)) {
+	crashMu.Lock()
+	defer crashMu.Unlock()
+
+	crashFn = fn
+}
+
+// SetCrashFile appends panic reports to the file at path. The runtime also
+// writes there when the process dies of a panic nobody recovered, in any
+// goroutine, so the report survives the crash. An empty path turns the
+// file off.
+func SetCrashFile(path string) error {
+	crashMu.Lock()
+	defer crashMu.Unlock()
+
+	if path == "" {
+		crashPath = ""
+		return debug.SetCrashOutput(nil, debug.CrashOptions{})
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := debug.SetCrashOutput(f, debug.CrashOptions{}); err != nil {
+		return err
+	}
+	crashPath = path
+	return nil
+}
+
+// ReportPanic logs a recovered panic value and hands it, with the stack of
+// the calling goroutine, to the crash callback and the crash file. Call it
+// from the deferred function that recovered.
+func ReportPanic(value any) {
+	message := fmt.Sprint(value)
+	stack := string(debug.Stack())
+	logger.Error("panic recovered", "message", message)
+
+	crashMu.Lock()
+	fn, path := crashFn, crashPath
+	crashMu.Unlock()
+
+	if path != "" {
+		if f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err == nil {
+			fmt.Fprintf(f, "%s panic: %s\n\n%s\n", time.Now().UTC().Format(time.RFC3339), message, stack)
+			f.Close()
+		}
+	}
+	if fn != nil {
+		fn(message, stack)
+	}
+}
@@ -0,0 +1,111 @@
+package tun2socks
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// StartWithFD runs the tunnel on a duplicate of a TUN file descriptor,
+// reading and writing packets directly instead of through Input and the
+// output queue. The caller keeps ownership of fd.
+func StartWithFD(fd int, jsonConfig string) error {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	return startWithFD(fd, jsonConfig)
+}
+
+// startWithFD is StartWithFD with lifecycleMu held.
+func startWithFD(fd int, jsonConfig string) error {
+	if isRunning() {
+		return nil
+	}
+	if fd < 0 {
+		return ErrInvalidConfig
+	}
+	reportStep("config")
+	jsonConfig, remote := withRemote(jsonConfig)
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	cfg, err := parseConfig(jsonConfig)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	reportStep("device")
+	dev, err := newFDDevice(fd)
+	if err != nil {
+		return startFailure("device", fmt.Errorf("%w: %v", ErrUnsupported, err))
+	}
+	if err := startDeviceLocked(dev, cfg); err != nil {
+		dev.Close()
+		return err
+	}
+	setRemote(remote)
+	return nil
+}
+
+// StartWithDevice runs the tunnel on dev, which yields and accepts one raw
+// IP packet per Read and Write. Stop closes dev.
+func StartWithDevice(dev io.ReadWriteCloser, jsonConfig string) error {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	if isRunning() {
+		return nil
+	}
+	jsonConfig, remote := withRemote(jsonConfig)
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	cfg, err := parseConfig(jsonConfig)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	if err := startDeviceLocked(dev, cfg); err != nil {
+		return err
+	}
+	setRemote(remote)
+	return nil
+}
+
+func startDeviceLocked(dev io.ReadWriteCloser, cfg *tunnelConfig) error {
+	tunDevice = dev
+	if err := startLocked(cfg); err != nil {
+		tunDevice = nil
+		return err
+	}
+
+	stack := lwipStack
+	go func() {
+		if err := runDevice(dev, stack); err != nil {
+			logger.Debug("tun read stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// runDevice feeds packets read from dev into the stack until dev fails or
+// is closed. One buffer is reused for every packet.
+func runDevice(dev io.Reader, stack core.LWIPStack) error {
+	buf := make([]byte, largePacket)
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			return err
+		}
+		err = inputPacket(stack, buf[:n])
+		if err != nil {
+			// The watchdog may have replaced the stack.
+			if s := currentStack(); s != nil && s != stack {
+				stack = s
+				err = inputPacket(stack, buf[:n])
+			}
+		}
+		if err != nil {
+			logger.Debug("stack write failed", "error", err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const utunHeaderSize = 4
+
+// newFDDevice wraps a duplicate of a utun descriptor, which is what a packet
+// tunnel provider exposes on iOS and macOS.
+func newFDDevice(fd int) (io.ReadWriteCloser, error) {
+	fd, err := unix.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+	unix.CloseOnExec(fd)
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return newUtunDevice(fd, "utun"), nil
+}
+
+func newUtunDevice(fd int, name string) *utunDevice {
+	return &utunDevice{file: os.NewFile(uintptr(fd), name)}
+}
+
+// utunDevice strips and adds the address family header utun puts in front
+// of every packet.
+type utunDevice struct {
+	file *os.File
+}
+
+func (d *utunDevice) Read(p []byte) (int, error) {
+	n, err := d.file.Read(p)
+	if err != nil {
+		return 0, err
+	}
+	if n < utunHeaderSize {
+		return 0, errors.New("short utun packet")
+	}
+	return copy(p, p[utunHeaderSize:n]), nil
+}
+
+func (d *utunDevice) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	buf := getPacket(utunHeaderSize + len(p))
+	defer putPacket(buf)
+
+	family := uint32(unix.AF_INET)
+	if p[0]>>4 == 6 {
+		family = unix.AF_INET6
+	}
+	binary.BigEndian.PutUint32(buf, family)
+	copy(buf[utunHeaderSize:], p)
+	if _, err := d.file.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (d *utunDevice) Close() error {
+	return d.file.Close()
+}
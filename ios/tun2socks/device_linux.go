@@ -0,0 +1,23 @@
+package tun2socks
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// newFDDevice wraps a duplicate of a TUN descriptor opened without packet
+// information, as handed out by Android's VpnService and /dev/net/tun.
+func newFDDevice(fd int) (io.ReadWriteCloser, error) {
+	fd, err := unix.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+	unix.CloseOnExec(fd)
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "tun"), nil
+}
@@ -0,0 +1,12 @@
+//go:build !darwin && !linux
+
+package tun2socks
+
+import (
+	"errors"
+	"io"
+)
+
+func newFDDevice(fd int) (io.ReadWriteCloser, error) {
+	return nil, errors.New("tun file descriptors are not supported on this platform")
+}
@@ -0,0 +1,24 @@
+package tun2socks
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// DialFunc opens a connection to addr. The context only bounds connecting.
+type DialFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+
+var customDialer atomic.Pointer[DialFunc]
+
+// RegisterDialer routes every TCP connection to a proxy server through fn,
+// so embedders can add their own transport or authentication underneath
+// the proxy protocol. Direct connections and UDP datagrams keep using the
+// system. A nil fn restores the system dialer.
+func RegisterDialer(fn DialFunc) {
+	if fn == nil {
+		customDialer.Store(nil)
+		return
+	}
+	customDialer.Store(&fn)
+}
@@ -0,0 +1,102 @@
+package tun2socks
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+type directOutbound struct {
+	dialTimeout time.Duration
+}
+
+func newDirectOutbound(dialTimeout time.Duration) outbound {
+	return &directOutbound{dialTimeout: dialTimeout}
+}
+
+func (o *directOutbound) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(o, conn, target)
+}
+
+func (o *directOutbound) Dial(network string, addr string) (net.Conn, error) {
+	return (&upstreamDialer{timeout: o.dialTimeout, direct: true}).Dial(network, addr)
+}
+
+type directUDPHandler struct {
+	sync.Mutex
+
+	timeout time.Duration
+	conns   map[core.UDPConn]net.PacketConn
+}
+
+func newDirectUDPHandler(timeout time.Duration) core.UDPConnHandler {
+	return &directUDPHandler{
+		timeout: timeout,
+		conns:   make(map[core.UDPConn]net.PacketConn, 8),
+	}
+}
+
+func (h *directUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return err
+	}
+
+	h.Lock()
+	h.conns[conn] = pc
+	h.Unlock()
+
+	go h.fetchInput(conn, pc)
+	return nil
+}
+
+func (h *directUDPHandler) fetchInput(conn core.UDPConn, pc net.PacketConn) {
+	buf := make([]byte, socks5MaxUDPPayload)
+	defer h.Close(conn)
+
+	for {
+		pc.SetReadDeadline(time.Now().Add(h.timeout))
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		src, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if _, err := conn.WriteFrom(buf[:n], src); err != nil {
+			return
+		}
+	}
+}
+
+func (h *directUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	pc, ok := h.conns[conn]
+	h.Unlock()
+
+	if !ok {
+		h.Close(conn)
+		return fmt.Errorf("direct connection %v->%v does not exist", conn.LocalAddr(), addr)
+	}
+	if _, err := pc.WriteTo(data, addr); err != nil {
+		h.Close(conn)
+		return fmt.Errorf("write remote failed: %v", err)
+	}
+	return nil
+}
+
+func (h *directUDPHandler) Close(conn core.UDPConn) {
+	conn.Close()
+
+	h.Lock()
+	defer h.Unlock()
+
+	if pc, ok := h.conns[conn]; ok {
+		pc.Close()
+		delete(h.conns, conn)
+	}
+}
@@ -0,0 +1,314 @@
+package tun2socks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	dnsPort           = 53
+	defaultDNSServer  = "1.1.1.1:53"
+	defaultDoTServer  = "1.1.1.1:853"
+	defaultDoHServer  = "https://1.1.1.1/dns-query"
+	maxDNSMessageSize = 65535
+)
+
+type dnsUpstream interface {
+	Exchange(query []byte) ([]byte, error)
+}
+
+// newDNSUpstream builds the resolver for cfg behind the answer cache, which
+// only takes effect while one is configured.
+func newDNSUpstream(cfg dnsConfig, dialer proxy.Dialer, timeout time.Duration) (dnsUpstream, error) {
+	var u dnsUpstream
+	switch strings.ToLower(cfg.Mode) {
+	case "", "tcp":
+		u = newTCPDNSUpstream(dialer, cfg.Server, timeout)
+	case "dot", "tls":
+		u = newDoTUpstream(dialer, cfg.Server, cfg.ServerName, timeout)
+	case "doh", "https":
+		doh, err := newDoHUpstream(dialer, cfg.Server, timeout)
+		if err != nil {
+			return nil, err
+		}
+		u = doh
+	default:
+		return nil, fmt.Errorf("unsupported dns mode %q", cfg.Mode)
+	}
+	return &cachingUpstream{inner: u}, nil
+}
+
+type tcpDNSUpstream struct {
+	dialer  proxy.Dialer
+	server  string
+	timeout time.Duration
+}
+
+func newTCPDNSUpstream(dialer proxy.Dialer, server string, timeout time.Duration) *tcpDNSUpstream {
+	if server == "" {
+		server = defaultDNSServer
+	}
+	return &tcpDNSUpstream{
+		dialer:  dialer,
+		server:  withDefaultPort(server, "53"),
+		timeout: timeout,
+	}
+}
+
+func (u *tcpDNSUpstream) Exchange(query []byte) ([]byte, error) {
+	conn, err := u.dialer.Dial("tcp", u.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(u.timeout))
+	if err := writeDNSFrame(conn, query); err != nil {
+		return nil, err
+	}
+	return readDNSFrame(conn)
+}
+
+type dotUpstream struct {
+	dialer     proxy.Dialer
+	server     string
+	serverName string
+	timeout    time.Duration
+}
+
+func newDoTUpstream(dialer proxy.Dialer, server string, serverName string, timeout time.Duration) *dotUpstream {
+	if server == "" {
+		server = defaultDoTServer
+	}
+	server = withDefaultPort(server, "853")
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(server)
+	}
+	return &dotUpstream{
+		dialer:     dialer,
+		server:     server,
+		serverName: serverName,
+		timeout:    timeout,
+	}
+}
+
+func (u *dotUpstream) Exchange(query []byte) ([]byte, error) {
+	raw, err := u.dialer.Dial("tcp", u.server)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, &tls.Config{ServerName: u.serverName})
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(u.timeout))
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	if err := writeDNSFrame(conn, query); err != nil {
+		return nil, err
+	}
+	return readDNSFrame(conn)
+}
+
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHUpstream(dialer proxy.Dialer, server string, timeout time.Duration) (*dohUpstream, error) {
+	if server == "" {
+		server = defaultDoHServer
+	}
+	if _, err := url.Parse(server); err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        2,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: timeout,
+	}
+	return &dohUpstream{
+		url:    server,
+		client: &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+func (u *dohUpstream) Exchange(query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh server returned status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+}
+
+func withDefaultPort(server string, port string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, port)
+	}
+	return server
+}
+
+func writeDNSFrame(w io.Writer, msg []byte) error {
+	if len(msg) > maxDNSMessageSize {
+		return errors.New("dns message too large")
+	}
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readDNSFrame(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+type dnsTCPHandler struct {
+	outbound
+	resolver dnsUpstream
+}
+
+func newDNSTCPHandler(inner outbound, resolver dnsUpstream) outbound {
+	return &dnsTCPHandler{outbound: inner, resolver: resolver}
+}
+
+func (h *dnsTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	if target == nil || target.Port != dnsPort {
+		return h.outbound.Handle(conn, target)
+	}
+
+	go func() {
+		record := openConn("tcp", conn.LocalAddr(), target)
+		defer record.close()
+		defer conn.Close()
+
+		for {
+			query, err := readDNSFrame(conn)
+			if err != nil {
+				return
+			}
+			record.addUplink(len(query) + 2)
+			answer, err := h.resolver.Exchange(query)
+			if err != nil {
+				logger.Warn("dns query failed", "error", err)
+				reportError("dns", "", &net.DNSError{Err: err.Error(), UnwrapErr: err})
+				return
+			}
+			if err := writeDNSFrame(conn, answer); err != nil {
+				return
+			}
+			record.addDownlink(len(answer) + 2)
+		}
+	}()
+	return nil
+}
+
+func (h *dnsTCPHandler) Bind(target string) (*binding, error) {
+	return bindThrough(h.outbound, target)
+}
+
+func (h *dnsTCPHandler) CanBind(target string) bool {
+	return canBindThrough(h.outbound, target)
+}
+
+type dnsUDPHandler struct {
+	sync.Mutex
+
+	inner    core.UDPConnHandler
+	resolver dnsUpstream
+	timeout  time.Duration
+	timers   map[core.UDPConn]*time.Timer
+}
+
+func newDNSUDPHandler(inner core.UDPConnHandler, resolver dnsUpstream, timeout time.Duration) core.UDPConnHandler {
+	return &dnsUDPHandler{
+		inner:    inner,
+		resolver: resolver,
+		timeout:  timeout,
+		timers:   make(map[core.UDPConn]*time.Timer, 8),
+	}
+}
+
+func (h *dnsUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	if target == nil || target.Port != dnsPort {
+		return h.inner.Connect(conn, target)
+	}
+
+	h.Lock()
+	h.timers[conn] = time.AfterFunc(h.timeout, func() { h.Close(conn) })
+	h.Unlock()
+	return nil
+}
+
+func (h *dnsUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	timer, ok := h.timers[conn]
+	h.Unlock()
+
+	if !ok {
+		return h.inner.ReceiveTo(conn, data, addr)
+	}
+	timer.Reset(h.timeout)
+
+	query := make([]byte, len(data))
+	copy(query, data)
+	go func() {
+		answer, err := h.resolver.Exchange(query)
+		if err != nil {
+			logger.Warn("dns query failed", "error", err)
+			reportError("dns", "", &net.DNSError{Err: err.Error(), UnwrapErr: err})
+			return
+		}
+		conn.WriteFrom(answer, addr)
+	}()
+	return nil
+}
+
+func (h *dnsUDPHandler) Close(conn core.UDPConn) {
+	h.Lock()
+	if timer, ok := h.timers[conn]; ok {
+		timer.Stop()
+		delete(h.timers, conn)
+	}
+	h.Unlock()
+
+	conn.Close()
+}
@@ -0,0 +1,254 @@
+package tun2socks
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSCacheEntries = 4096
+	defaultDNSMaxTTL       = 24 * 60 * 60
+	defaultDNSNegativeTTL  = 60
+)
+
+// dnsCacheConfig bounds the answer cache. TTLs are in seconds. A negative
+// negativeTTL turns off caching of NXDOMAIN and empty answers.
+type dnsCacheConfig struct {
+	MaxEntries  int `json:"maxEntries,omitempty"`
+	MinTTL      int `json:"minTTL,omitempty"`
+	MaxTTL      int `json:"maxTTL,omitempty"`
+	NegativeTTL int `json:"negativeTTL,omitempty"`
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+type dnsCache struct {
+	config dnsCacheConfig
+
+	mu      sync.Mutex
+	entries map[dnsCacheKey]*dnsCacheEntry
+}
+
+var activeDNSCache atomic.Pointer[dnsCache]
+
+// configureDNSCache starts with an empty cache, since the upstreams may
+// have changed, or turns caching off when cfg is nil.
+func configureDNSCache(cfg *dnsCacheConfig) {
+	if cfg == nil {
+		activeDNSCache.Store(nil)
+		return
+	}
+	c := &dnsCache{config: *cfg, entries: make(map[dnsCacheKey]*dnsCacheEntry)}
+	if c.config.MaxEntries == 0 {
+		c.config.MaxEntries = defaultDNSCacheEntries
+	}
+	if c.config.MaxTTL == 0 {
+		c.config.MaxTTL = defaultDNSMaxTTL
+	}
+	if c.config.NegativeTTL == 0 {
+		c.config.NegativeTTL = defaultDNSNegativeTTL
+	}
+	activeDNSCache.Store(c)
+}
+
+// FlushDNSCache drops every cached answer.
+func FlushDNSCache() {
+	if c := activeDNSCache.Load(); c != nil {
+		c.mu.Lock()
+		clear(c.entries)
+		c.mu.Unlock()
+		logger.Debug("dns cache flushed")
+	}
+}
+
+// cachingUpstream answers repeated questions from the cache until their
+// TTL runs out instead of asking inner again. Identical questions asked
+// while one is in flight wait for its answer, with or without the cache:
+// browsers look a name up several times at once on page load.
+type cachingUpstream struct {
+	inner dnsUpstream
+
+	mu       sync.Mutex
+	inflight map[dnsCacheKey]*dnsCall
+}
+
+// dnsCall is a question sent upstream, answered for everyone waiting on
+// it once done is closed.
+type dnsCall struct {
+	done   chan struct{}
+	answer []byte
+	err    error
+}
+
+func (u *cachingUpstream) Exchange(query []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return u.inner.Exchange(query)
+	}
+	q := msg.Questions[0]
+	key := dnsCacheKey{name: strings.ToLower(q.Name.String()), qtype: q.Type, class: q.Class}
+	cache := activeDNSCache.Load()
+	if cache != nil {
+		if answer, ok := cache.get(key, &msg); ok {
+			stats.dnsCacheHits.Add(1)
+			return answer, nil
+		}
+	}
+
+	u.mu.Lock()
+	if call, ok := u.inflight[key]; ok {
+		u.mu.Unlock()
+		stats.dnsCoalesced.Add(1)
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		return replyTo(call.answer, &msg)
+	}
+	call := &dnsCall{done: make(chan struct{})}
+	if u.inflight == nil {
+		u.inflight = make(map[dnsCacheKey]*dnsCall)
+	}
+	u.inflight[key] = call
+	u.mu.Unlock()
+
+	if cache != nil {
+		stats.dnsCacheMisses.Add(1)
+	}
+	call.answer, call.err = u.inner.Exchange(query)
+	if call.err == nil && cache != nil {
+		cache.put(key, call.answer)
+	}
+	u.mu.Lock()
+	delete(u.inflight, key)
+	u.mu.Unlock()
+	close(call.done)
+	return call.answer, call.err
+}
+
+// replyTo turns an answer to an identical question into a reply to query,
+// with its ID and the exact spelling of its name.
+func replyTo(answer []byte, query *dnsmessage.Message) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil {
+		return nil, err
+	}
+	msg.ID = query.ID
+	msg.RecursionDesired = query.RecursionDesired
+	msg.Questions = query.Questions
+	return msg.Pack()
+}
+
+// get returns the cached answer for key as a reply to query, with the TTLs
+// counted down by the time spent in the cache.
+func (c *dnsCache) get(key dnsCacheKey, query *dnsmessage.Message) ([]byte, bool) {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !now.Before(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	msg := e.msg
+	msg.Answers = slices.Clone(msg.Answers)
+	msg.Authorities = slices.Clone(msg.Authorities)
+	msg.Additionals = slices.Clone(msg.Additionals)
+	elapsed := int64(now.Sub(e.stored) / time.Second)
+	remaining := int64((e.expires.Sub(now) + time.Second - 1) / time.Second)
+	c.mu.Unlock()
+
+	msg.ID = query.ID
+	msg.RecursionDesired = query.RecursionDesired
+	msg.Questions = query.Questions
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			h := &section[i].Header
+			if h.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			ttl := remaining
+			if rest := int64(h.TTL) - elapsed; rest > 0 && rest < ttl {
+				ttl = rest
+			}
+			h.TTL = uint32(ttl)
+		}
+	}
+	answer, err := msg.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return answer, true
+}
+
+// put stores answer for the lowest TTL of its records, within the
+// configured bounds. NXDOMAIN and empty answers are kept as RFC 2308
+// describes, for the SOA's negative TTL but no longer than negativeTTL.
+// Failures and truncated answers are not cached.
+func (c *dnsCache) put(key dnsCacheKey, answer []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil || msg.Truncated {
+		return
+	}
+
+	var ttl int64
+	switch {
+	case msg.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) > 0:
+		ttl = int64(msg.Answers[0].Header.TTL)
+		for _, r := range msg.Answers[1:] {
+			ttl = min(ttl, int64(r.Header.TTL))
+		}
+		ttl = min(max(ttl, int64(c.config.MinTTL)), int64(c.config.MaxTTL))
+	case msg.RCode == dnsmessage.RCodeSuccess || msg.RCode == dnsmessage.RCodeNameError:
+		if c.config.NegativeTTL < 0 {
+			return
+		}
+		for _, r := range msg.Authorities {
+			if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+				ttl = min(int64(r.Header.TTL), int64(soa.MinTTL), int64(c.config.NegativeTTL))
+				break
+			}
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.config.MaxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full: drop an arbitrary entry.
+		for k := range c.entries {
+			if len(c.entries) < c.config.MaxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &dnsCacheEntry{msg: msg, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
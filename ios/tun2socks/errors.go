@@ -0,0 +1,150 @@
+package tun2socks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	errCodeUnknown = iota
+	errCodeProxyUnreachable
+	errCodeAuthFailed
+	errCodeTimeout
+	errCodeDNSFailure
+	errCodeRejected
+	errCodeTLSFailure
+	errCodePinMismatch
+)
+
+const maxPendingErrors = 64
+
+var errCodeNames = map[int]string{
+	errCodeUnknown:          "unknown",
+	errCodeProxyUnreachable: "proxy-unreachable",
+	errCodeAuthFailed:       "auth-failed",
+	errCodeTimeout:          "timeout",
+	errCodeDNSFailure:       "dns-failure",
+	errCodeRejected:         "rejected",
+	errCodeTLSFailure:       "tls-failure",
+	errCodePinMismatch:      "pin-mismatch",
+}
+
+var (
+	errProxyAuth       = errors.New("proxy authentication failed")
+	errConnectRejected = errors.New("proxy rejected connect")
+)
+
+type connectStatusError struct {
+	status int
+}
+
+func (e *connectStatusError) Error() string {
+	return fmt.Sprintf("%v with status %d", errConnectRejected, e.status)
+}
+
+func (e *connectStatusError) Is(target error) bool {
+	return target == errConnectRejected || (target == errProxyAuth && e.status == 407)
+}
+
+type flowError struct {
+	Code    int    `json:"code"`
+	Kind    string `json:"kind"`
+	Network string `json:"network"`
+	Target  string `json:"target,omitempty"`
+	Message string `json:"message"`
+	Time    int64  `json:"time"`
+}
+
+var (
+	errorsMu      sync.Mutex
+	pendingErrors []flowError
+
+	// errorCounts counts the reported flow errors by code.
+	errorCounts [errCodePinMismatch + 1]atomic.Uint64
+)
+
+// PollError returns the oldest queued flow error as JSON, or false when
+// there is none.
+func PollError() (string, bool) {
+	errorsMu.Lock()
+	if len(pendingErrors) == 0 {
+		errorsMu.Unlock()
+		return "", false
+	}
+	e := pendingErrors[0]
+	pendingErrors = pendingErrors[1:]
+	errorsMu.Unlock()
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+func reportError(network string, target string, err error) {
+	code := classifyError(err)
+	errorCounts[code].Add(1)
+	e := flowError{
+		Code:    code,
+		Kind:    errCodeNames[code],
+		Network: network,
+		Target:  target,
+		Message: err.Error(),
+		Time:    time.Now().UnixMilli(),
+	}
+
+	errorsMu.Lock()
+	defer errorsMu.Unlock()
+
+	if len(pendingErrors) >= maxPendingErrors {
+		pendingErrors = pendingErrors[1:]
+	}
+	pendingErrors = append(pendingErrors, e)
+}
+
+func resetErrors() {
+	errorsMu.Lock()
+	defer errorsMu.Unlock()
+
+	pendingErrors = nil
+}
+
+func classifyError(err error) int {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var recordErr tls.RecordHeaderError
+
+	switch {
+	case errors.Is(err, errProxyAuth) || strings.Contains(err.Error(), "authentication failed"):
+		return errCodeAuthFailed
+	case errors.Is(err, errConnectRejected):
+		return errCodeRejected
+	case errors.Is(err, errPinMismatch):
+		return errCodePinMismatch
+	case errors.As(err, &dnsErr):
+		return errCodeDNSFailure
+	case errors.As(err, &certErr) || errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &recordErr):
+		return errCodeTLSFailure
+	case errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return errCodeTimeout
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return errCodeProxyUnreachable
+	default:
+		return errCodeUnknown
+	}
+}
@@ -0,0 +1,35 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+var (
+	eventMu sync.Mutex
+	eventFn func(json string)
+)
+
+// SetEventFunc registers fn to receive tunnel events such as outbound
+// failovers as JSON. A nil fn stops the events.
+func SetEventFunc(fn func(json string)) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+
+	eventFn = fn
+}
+
+func emitEvent(event any) {
+	eventMu.Lock()
+	fn := eventFn
+	eventMu.Unlock()
+
+	if fn == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fn(string(data))
+}
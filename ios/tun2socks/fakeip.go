@@ -0,0 +1,327 @@
+package tun2socks
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const defaultFakeIPRange = "198.18.0.0/15"
+
+type fakeIPPool struct {
+	mu     sync.Mutex
+	prefix netip.Prefix
+	first  uint32
+	size   uint32
+	next   uint32
+	byIP   map[netip.Addr]string
+	byName map[string]netip.Addr
+}
+
+var (
+	activeFakeIPPool  *fakeIPPool
+	activeFakeIPRange string
+)
+
+// sharedFakeIPPool keeps the same pool across reloads so addresses already
+// handed out to apps keep resolving to their hostnames.
+func sharedFakeIPPool(cidr string) (*fakeIPPool, error) {
+	if activeFakeIPPool != nil && activeFakeIPRange == cidr {
+		return activeFakeIPPool, nil
+	}
+	pool, err := newFakeIPPool(cidr)
+	if err != nil {
+		return nil, err
+	}
+	activeFakeIPPool = pool
+	activeFakeIPRange = cidr
+	return pool, nil
+}
+
+func newFakeIPPool(cidr string) (*fakeIPPool, error) {
+	if cidr == "" {
+		cidr = defaultFakeIPRange
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	prefix = prefix.Masked()
+	if !prefix.Addr().Is4() || prefix.Bits() > 30 {
+		return nil, errors.New("fake-ip range must be an IPv4 prefix of /30 or larger")
+	}
+
+	base := prefix.Addr().As4()
+	return &fakeIPPool{
+		prefix: prefix,
+		// Skip the network address and the first host, which is commonly the
+		// TUN gateway.
+		first:  (uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])) + 2,
+		size:   1<<(32-prefix.Bits()) - 3,
+		byIP:   make(map[netip.Addr]string),
+		byName: make(map[string]netip.Addr),
+	}, nil
+}
+
+func (p *fakeIPPool) contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	return ok && p.prefix.Contains(addr.Unmap())
+}
+
+func (p *fakeIPPool) allocate(name string) netip.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if addr, ok := p.byName[name]; ok {
+		return addr
+	}
+
+	v := p.first + p.next
+	p.next = (p.next + 1) % p.size
+	addr := netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+	if old, ok := p.byIP[addr]; ok {
+		delete(p.byName, old)
+	}
+	p.byIP[addr] = name
+	p.byName[name] = addr
+	return addr
+}
+
+func (p *fakeIPPool) lookup(ip net.IP) (string, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name, ok := p.byIP[addr.Unmap()]
+	return name, ok
+}
+
+type fakeIPResolver struct {
+	pool  *fakeIPPool
+	inner dnsUpstream
+}
+
+func newFakeIPResolver(pool *fakeIPPool, inner dnsUpstream) dnsUpstream {
+	return &fakeIPResolver{pool: pool, inner: inner}
+}
+
+func (r *fakeIPResolver) Exchange(query []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return r.inner.Exchange(query)
+	}
+	q := msg.Questions[0]
+	if q.Class != dnsmessage.ClassINET || (q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA) {
+		return r.inner.Exchange(query)
+	}
+
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 msg.ID,
+			Response:           true,
+			RecursionDesired:   msg.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: msg.Questions,
+	}
+	if q.Type == dnsmessage.TypeA {
+		addr := r.pool.allocate(normalizeDomain(q.Name.String()))
+		resp.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 1},
+			Body:   &dnsmessage.AResource{A: addr.As4()},
+		}}
+	}
+	return resp.Pack()
+}
+
+func normalizeDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+type fakeIPOutbound struct {
+	outbound
+	pool *fakeIPPool
+}
+
+func newFakeIPOutbound(inner outbound, pool *fakeIPPool) outbound {
+	return &fakeIPOutbound{outbound: inner, pool: pool}
+}
+
+func (o *fakeIPOutbound) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(o, conn, target)
+}
+
+func (o *fakeIPOutbound) Dial(network string, addr string) (net.Conn, error) {
+	return o.outbound.Dial(network, o.pool.restore(addr))
+}
+
+func (o *fakeIPOutbound) Bind(target string) (*binding, error) {
+	return bindThrough(o.outbound, o.pool.restore(target))
+}
+
+func (o *fakeIPOutbound) CanBind(target string) bool {
+	return canBindThrough(o.outbound, o.pool.restore(target))
+}
+
+func (p *fakeIPPool) restore(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if name, ok := p.lookup(net.ParseIP(host)); ok {
+		return net.JoinHostPort(name, port)
+	}
+	return addr
+}
+
+type fakeIPUDPHandler struct {
+	sync.Mutex
+
+	inner    core.UDPConnHandler
+	pool     *fakeIPPool
+	resolver dnsUpstream
+	conns    map[core.UDPConn]*fakeIPUDPConn
+}
+
+type fakeIPUDPConn struct {
+	core.UDPConn
+	owner *fakeIPUDPHandler
+
+	mu    sync.Mutex
+	fakes map[string]*net.UDPAddr
+}
+
+func newFakeIPUDPHandler(inner core.UDPConnHandler, pool *fakeIPPool, resolver dnsUpstream) core.UDPConnHandler {
+	return &fakeIPUDPHandler{
+		inner:    inner,
+		pool:     pool,
+		resolver: resolver,
+		conns:    make(map[core.UDPConn]*fakeIPUDPConn, 8),
+	}
+}
+
+func (h *fakeIPUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	wrapped := &fakeIPUDPConn{UDPConn: conn, owner: h, fakes: make(map[string]*net.UDPAddr)}
+	h.Lock()
+	h.conns[conn] = wrapped
+	h.Unlock()
+	onSessionClose(conn, func() { h.remove(conn) })
+
+	if target != nil && h.pool.contains(target.IP) {
+		real, err := h.realAddr(wrapped, target)
+		if err != nil {
+			h.remove(conn)
+			return err
+		}
+		target = real
+	}
+	if err := h.inner.Connect(wrapped, target); err != nil {
+		h.remove(conn)
+		return err
+	}
+	return nil
+}
+
+func (h *fakeIPUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	wrapped, ok := h.conns[conn]
+	h.Unlock()
+	if !ok {
+		return h.inner.ReceiveTo(conn, data, addr)
+	}
+
+	if addr != nil && h.pool.contains(addr.IP) {
+		real, err := h.realAddr(wrapped, addr)
+		if err != nil {
+			return err
+		}
+		addr = real
+	}
+	return h.inner.ReceiveTo(wrapped, data, addr)
+}
+
+func (h *fakeIPUDPHandler) remove(conn core.UDPConn) {
+	h.Lock()
+	delete(h.conns, conn)
+	h.Unlock()
+}
+
+func (h *fakeIPUDPHandler) realAddr(conn *fakeIPUDPConn, fake *net.UDPAddr) (*net.UDPAddr, error) {
+	name, ok := h.pool.lookup(fake.IP)
+	if !ok {
+		return nil, errors.New("unknown fake-ip address")
+	}
+	ip, err := resolveWith(h.resolver, name)
+	if err != nil {
+		return nil, err
+	}
+	real := &net.UDPAddr{IP: ip, Port: fake.Port}
+
+	conn.mu.Lock()
+	conn.fakes[real.String()] = fake
+	conn.mu.Unlock()
+	return real, nil
+}
+
+func (c *fakeIPUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	if addr != nil {
+		c.mu.Lock()
+		fake, ok := c.fakes[addr.String()]
+		c.mu.Unlock()
+		if ok {
+			addr = fake
+		}
+	}
+	return c.UDPConn.WriteFrom(data, addr)
+}
+
+func (c *fakeIPUDPConn) Close() error {
+	c.owner.remove(c.UDPConn)
+	return c.UDPConn.Close()
+}
+
+func (c *fakeIPUDPConn) unwrapUDP() core.UDPConn {
+	return c.UDPConn
+}
+
+func resolveWith(upstream dnsUpstream, name string) (net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ip, nil
+	}
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	answer, err := upstream.Exchange(packed)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil {
+		return nil, err
+	}
+	for _, rr := range msg.Answers {
+		if a, ok := rr.Body.(*dnsmessage.AResource); ok {
+			return net.IP(a.A[:]), nil
+		}
+	}
+	return nil, errors.New("no address for " + strconv.Quote(name))
+}
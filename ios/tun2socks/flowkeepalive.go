@@ -0,0 +1,134 @@
+package tun2socks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+	"weak"
+)
+
+const (
+	defaultFlowKeepaliveIdle     = time.Minute
+	defaultFlowKeepaliveInterval = 30 * time.Second
+)
+
+// defaultFlowKeepaliveClasses are the classes of flows that sit idle for
+// long stretches waiting for the server: interactive shells, IMAP IDLE and
+// MQTT subscriptions.
+var defaultFlowKeepaliveClasses = []string{classSSH, classMail, classMQTT}
+
+// flowKeepaliveConfig turns on TCP keepalives on the upstream sockets of
+// long-lived flows, so carrier NAT does not silently drop their mappings
+// while they are idle. Probes start after IdleMs without traffic and repeat
+// every IntervalMs.
+type flowKeepaliveConfig struct {
+	IdleMs     int      `json:"idleMs,omitempty"`
+	IntervalMs int      `json:"intervalMs,omitempty"`
+	Classes    []string `json:"classes,omitempty"`
+}
+
+func (c *flowKeepaliveConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.IdleMs < 0 || c.IntervalMs < 0 {
+		return errors.New("flowKeepalive idleMs and intervalMs must not be negative")
+	}
+	for _, class := range c.Classes {
+		if _, ok := defaultClassIdle[class]; !ok {
+			return fmt.Errorf("unknown flowKeepalive class %q", class)
+		}
+	}
+	return nil
+}
+
+// keepaliveFor returns the keepalive settings of flows of class, or false
+// when they get none.
+func (c *flowKeepaliveConfig) keepaliveFor(class string) (net.KeepAliveConfig, bool) {
+	if c == nil || class == "" {
+		return net.KeepAliveConfig{}, false
+	}
+	classes := c.Classes
+	if len(classes) == 0 {
+		classes = defaultFlowKeepaliveClasses
+	}
+	for _, cl := range classes {
+		if cl != class {
+			continue
+		}
+		cfg := net.KeepAliveConfig{Enable: true, Idle: defaultFlowKeepaliveIdle, Interval: defaultFlowKeepaliveInterval}
+		if c.IdleMs > 0 {
+			cfg.Idle = time.Duration(c.IdleMs) * time.Millisecond
+		}
+		if c.IntervalMs > 0 {
+			cfg.Interval = time.Duration(c.IntervalMs) * time.Millisecond
+		}
+		return cfg, true
+	}
+	return net.KeepAliveConfig{}, false
+}
+
+// upstreamSockets finds the TCP socket under a proxy or direct connection
+// by its local address, which the connections wrapping it report as
+// theirs. The sockets are held weakly and leave once collected.
+var (
+	socketMu        sync.Mutex
+	upstreamSockets = make(map[string]weak.Pointer[net.TCPConn])
+)
+
+// registerSocket makes c findable by the flows relayed over it.
+func registerSocket(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	key := connKey(tc)
+	if key == "" {
+		return
+	}
+	ptr := weak.Make(tc)
+	socketMu.Lock()
+	upstreamSockets[key] = ptr
+	socketMu.Unlock()
+	runtime.AddCleanup(tc, func(key string) {
+		socketMu.Lock()
+		if p, ok := upstreamSockets[key]; ok && p.Value() == nil {
+			delete(upstreamSockets, key)
+		}
+		socketMu.Unlock()
+	}, key)
+}
+
+// upstreamSocket returns the TCP socket c was dialed over, or nil when it
+// is not known, as for a registered DialFunc.
+func upstreamSocket(c net.Conn) *net.TCPConn {
+	if tc, ok := c.(*net.TCPConn); ok {
+		return tc
+	}
+	key := connKey(c)
+	if key == "" {
+		return nil
+	}
+	socketMu.Lock()
+	defer socketMu.Unlock()
+	return upstreamSockets[key].Value()
+}
+
+// keepAliveFlow turns on keepalives on socket if flows of class get them.
+// A socket shared by multiplexed flows keeps them for all of them.
+func keepAliveFlow(socket *net.TCPConn, class string) {
+	opts := socketOptions.Load()
+	if socket == nil || opts == nil {
+		return
+	}
+	cfg, ok := opts.FlowKeepalive.keepaliveFor(class)
+	if !ok {
+		return
+	}
+	if err := socket.SetKeepAliveConfig(cfg); err != nil {
+		logger.Debug("flow keepalive not set", "class", class, "error", err)
+	}
+}
@@ -0,0 +1,106 @@
+package tun2socks
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// maxFlowTags bounds the per-tag counters; flows with further tags are
+// not attributed.
+const maxFlowTags = 1024
+
+// FlowClassifier returns the tag a flow's traffic is accounted under, such
+// as the app it belongs to, or "" to leave it untagged. srcPort is the
+// local port of the flow, dst its target address and proto "tcp" or "udp".
+type FlowClassifier func(srcPort int, dst string, proto string) string
+
+type tagCounters struct {
+	uplink   atomic.Uint64
+	downlink atomic.Uint64
+	flows    atomic.Uint64
+}
+
+type tagSnapshot struct {
+	UplinkBytes   uint64 `json:"uplinkBytes"`
+	DownlinkBytes uint64 `json:"downlinkBytes"`
+	Flows         uint64 `json:"flows"`
+}
+
+var (
+	flowClassifier atomic.Pointer[FlowClassifier]
+
+	tagMu     sync.Mutex
+	tagTotals = make(map[string]*tagCounters)
+)
+
+// RegisterFlowClassifier makes fn tag every TCP connection and UDP session
+// when it opens. It is called on the packet path, so it has to return
+// quickly. A nil fn stops tagging.
+func RegisterFlowClassifier(fn FlowClassifier) {
+	if fn == nil {
+		flowClassifier.Store(nil)
+		return
+	}
+	flowClassifier.Store(&fn)
+}
+
+// classifyFlow asks the classifier for the tag of a new flow and returns
+// it with the counters its bytes go to, or nil when it is untagged.
+func classifyFlow(network string, source net.Addr, target net.Addr) (string, *tagCounters) {
+	fn := flowClassifier.Load()
+	if fn == nil {
+		return "", nil
+	}
+	srcPort := 0
+	if source != nil {
+		if _, port, err := net.SplitHostPort(source.String()); err == nil {
+			srcPort, _ = strconv.Atoi(port)
+		}
+	}
+	dst := ""
+	if target != nil {
+		dst = target.String()
+	}
+	tag := (*fn)(srcPort, dst, network)
+	if tag == "" {
+		return "", nil
+	}
+
+	tagMu.Lock()
+	defer tagMu.Unlock()
+	c, ok := tagTotals[tag]
+	if !ok {
+		if len(tagTotals) >= maxFlowTags {
+			return tag, nil
+		}
+		c = &tagCounters{}
+		tagTotals[tag] = c
+	}
+	c.flows.Add(1)
+	return tag, c
+}
+
+func tagSnapshots() map[string]tagSnapshot {
+	tagMu.Lock()
+	defer tagMu.Unlock()
+	if len(tagTotals) == 0 {
+		return nil
+	}
+	tags := make(map[string]tagSnapshot, len(tagTotals))
+	for tag, c := range tagTotals {
+		tags[tag] = tagSnapshot{
+			UplinkBytes:   c.uplink.Load(),
+			DownlinkBytes: c.downlink.Load(),
+			Flows:         c.flows.Load(),
+		}
+	}
+	return tags
+}
+
+func resetTags() {
+	tagMu.Lock()
+	defer tagMu.Unlock()
+	clear(tagTotals)
+}
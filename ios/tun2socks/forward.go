@@ -0,0 +1,131 @@
+package tun2socks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// forwardConfig exposes a service through an outbound: connections
+// accepted on Listen are relayed to Target.
+type forwardConfig struct {
+	Listen   string `json:"listen"`
+	Target   string `json:"target"`
+	Outbound string `json:"outbound,omitempty"`
+}
+
+type forwarder struct {
+	config forwardConfig
+	ln     net.Listener
+}
+
+// forwarders is guarded by stateMu.
+var forwarders []*forwarder
+
+func (c *forwardConfig) outbound() string {
+	if c.Outbound == "" {
+		return outboundProxy
+	}
+	return c.Outbound
+}
+
+func (c *forwardConfig) validate(names map[string]bool) error {
+	if err := checkHostPort(c.Listen); err != nil {
+		return fmt.Errorf("forward listen %q: %w", c.Listen, err)
+	}
+	if err := checkHostPort(c.Target); err != nil {
+		return fmt.Errorf("forward target %q: %w", c.Target, err)
+	}
+	if name := c.outbound(); !names[name] || name == outboundBlock {
+		return fmt.Errorf("forward %s: unknown outbound %q", c.Listen, c.Outbound)
+	}
+	return nil
+}
+
+func checkHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return errors.New("invalid port")
+	}
+	return nil
+}
+
+// configureForwards opens the listeners of cfgs, keeping them when the
+// rules did not change. Called with stateMu held.
+func configureForwards(cfgs []forwardConfig) error {
+	if slices.EqualFunc(forwarders, cfgs, func(f *forwarder, c forwardConfig) bool {
+		return f.config == c
+	}) {
+		return nil
+	}
+	stopForwardsLocked()
+
+	for _, cfg := range cfgs {
+		ln, err := net.Listen("tcp", cfg.Listen)
+		if err != nil {
+			stopForwardsLocked()
+			return fmt.Errorf("forward %s: %w", cfg.Listen, err)
+		}
+		f := &forwarder{config: cfg, ln: ln}
+		forwarders = append(forwarders, f)
+		go f.serve()
+		logger.Info("forward started", "listen", cfg.Listen, "target", cfg.Target, "outbound", cfg.outbound())
+	}
+	return nil
+}
+
+// stopForwardsLocked closes the listeners. Forwarded connections keep
+// running until they finish or the tunnel stops.
+func stopForwardsLocked() {
+	for _, f := range forwarders {
+		f.ln.Close()
+	}
+	forwarders = nil
+}
+
+func (f *forwarder) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Debug("forward accept failed", "listen", f.config.Listen, "error", err)
+			time.Sleep(inboundAcceptRetryDelay)
+			continue
+		}
+		if draining.Load() {
+			conn.Close()
+			continue
+		}
+		go f.handle(conn)
+	}
+}
+
+// handle relays conn through the outbound named by the rule in the
+// configuration now in effect.
+func (f *forwarder) handle(conn net.Conn) {
+	stateMu.Lock()
+	ob, ok := namedOutbounds[f.config.outbound()]
+	stateMu.Unlock()
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	target := f.config.Target
+	upstream, err := dialWithRetry(ob, "tcp", target)
+	if err != nil {
+		logger.Warn("forward dial failed", "listen", f.config.Listen, "target", target, "error", err)
+		reportError("tcp", target, err)
+		conn.Close()
+		return
+	}
+	relayConn(conn, upstream, openConn("tcp", conn.RemoteAddr(), hostAddr(target)))
+}
@@ -0,0 +1,224 @@
+package tun2socks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ftpControlPort = "21"
+	// ftpMaxCommand bounds a partial PORT or EPRT line held back until its
+	// end arrives.
+	ftpMaxCommand = 128
+)
+
+// ftpOutbound carries active-mode FTP. The app announces a listener on its
+// TUN address in PORT or EPRT, which the server cannot reach, so the
+// command is rewritten to an address the proxy binds for the server, and
+// the data connection the server opens there is connected to the app's
+// listener from the device.
+type ftpOutbound struct {
+	outbound
+	dialTimeout time.Duration
+}
+
+func newFTPOutbound(inner outbound, dialTimeout time.Duration) outbound {
+	return &ftpOutbound{outbound: inner, dialTimeout: dialTimeout}
+}
+
+func (o *ftpOutbound) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(o, conn, target)
+}
+
+func (o *ftpOutbound) Dial(network string, addr string) (net.Conn, error) {
+	c, err := o.outbound.Dial(network, addr)
+	if err != nil || network != "tcp" {
+		return c, err
+	}
+	// Only a control connection through an outbound that can bind is
+	// rewritten; any other carries the commands as the app sent them.
+	if _, port, _ := net.SplitHostPort(addr); port != ftpControlPort || !canBindThrough(o.outbound, addr) {
+		return c, nil
+	}
+	return &ftpControlConn{halfCloser: halfCloser{c}, owner: o, server: addr}, nil
+}
+
+func (o *ftpOutbound) Bind(target string) (*binding, error) {
+	return bindThrough(o.outbound, target)
+}
+
+func (o *ftpOutbound) CanBind(target string) bool {
+	return canBindThrough(o.outbound, target)
+}
+
+// ftpControlConn rewrites the data port commands the app sends on an FTP
+// control connection through an outbound that can bind. Writes come from
+// the relay's uplink only.
+type ftpControlConn struct {
+	halfCloser
+	owner   *ftpOutbound
+	server  string
+	pending []byte
+	// secure is set once the session switches to TLS, after which the
+	// commands cannot be seen.
+	secure bool
+}
+
+func (c *ftpControlConn) Write(p []byte) (int, error) {
+	if c.secure {
+		return c.Conn.Write(p)
+	}
+	data := append(c.pending, p...)
+	c.pending = nil
+
+	var out []byte
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			if len(data) < ftpMaxCommand && ftpDataPortCommand(data) {
+				c.pending = data
+			} else {
+				out = append(out, data...)
+			}
+			break
+		}
+		out = append(out, c.rewrite(data[:i+1])...)
+		data = data[i+1:]
+	}
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// ftpDataPortCommand reports whether data may be the start of a PORT or
+// EPRT command.
+func ftpDataPortCommand(data []byte) bool {
+	prefix := strings.ToUpper(string(data[:min(len(data), 5)]))
+	return strings.HasPrefix("PORT ", prefix) || strings.HasPrefix("EPRT ", prefix)
+}
+
+// rewrite returns line, or the command announcing a bound address in
+// place of the app's listener.
+func (c *ftpControlConn) rewrite(line []byte) []byte {
+	cmd, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+	cmd = strings.ToUpper(cmd)
+	switch cmd {
+	case "AUTH":
+		c.secure = true
+		return line
+	case "PORT", "EPRT":
+	default:
+		return line
+	}
+
+	listener, err := parseFTPDataPort(cmd, arg)
+	if err != nil {
+		return line
+	}
+	if !isLocalAddr(listener.Addr()) {
+		logger.Warn("active ftp to a foreign address refused", "target", c.server, "address", listener)
+		return line
+	}
+	b, err := bindThrough(c.owner.outbound, c.server)
+	if err != nil {
+		logger.Warn("active ftp bind failed; use passive mode", "target", c.server, "error", err)
+		reportError("tcp", c.server, err)
+		return line
+	}
+	rewritten, err := formatFTPDataPort(cmd, b.bound)
+	if err != nil {
+		logger.Warn("active ftp bind unusable", "target", c.server, "bound", b.bound, "error", err)
+		b.Close()
+		return line
+	}
+	go relayBound(b, func(string) (net.Conn, error) {
+		return net.DialTimeout("tcp", listener.String(), c.owner.dialTimeout)
+	})
+	return []byte(rewritten)
+}
+
+// parseFTPDataPort parses the argument of PORT (h1,h2,h3,h4,p1,p2) or
+// EPRT (|1|addr|port|, RFC 2428).
+func parseFTPDataPort(cmd string, arg string) (netip.AddrPort, error) {
+	if cmd == "PORT" {
+		fields := strings.Split(strings.TrimSpace(arg), ",")
+		if len(fields) != 6 {
+			return netip.AddrPort{}, errors.New("malformed PORT")
+		}
+		var b [6]byte
+		for i, f := range fields {
+			n, err := strconv.ParseUint(f, 10, 8)
+			if err != nil {
+				return netip.AddrPort{}, errors.New("malformed PORT")
+			}
+			b[i] = byte(n)
+		}
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[:4])), uint16(b[4])<<8|uint16(b[5])), nil
+	}
+
+	arg = strings.TrimSpace(arg)
+	if len(arg) < 2 {
+		return netip.AddrPort{}, errors.New("malformed EPRT")
+	}
+	fields := strings.Split(arg[1:], arg[:1])
+	if len(fields) != 4 || fields[3] != "" {
+		return netip.AddrPort{}, errors.New("malformed EPRT")
+	}
+	ip, err := netip.ParseAddr(fields[1])
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, err := strconv.ParseUint(fields[2], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ip.Unmap(), uint16(port)), nil
+}
+
+// formatFTPDataPort announces bound with the command the app used, or
+// with EPRT when PORT cannot carry it.
+func formatFTPDataPort(cmd string, bound string) (string, error) {
+	ap, err := netip.ParseAddrPort(bound)
+	if err != nil {
+		return "", err
+	}
+	ip := ap.Addr().Unmap()
+	if cmd == "PORT" && ip.Is4() {
+		a := ip.As4()
+		return fmt.Sprintf("PORT %d,%d,%d,%d,%d,%d\r\n", a[0], a[1], a[2], a[3], ap.Port()>>8, ap.Port()&0xff), nil
+	}
+	family := 1
+	if !ip.Is4() {
+		family = 2
+	}
+	return fmt.Sprintf("EPRT |%d|%s|%d|\r\n", family, ip, ap.Port()), nil
+}
+
+// isLocalAddr reports whether ip belongs to this device, so a data port
+// command cannot make the tunnel connect elsewhere.
+func isLocalAddr(ip netip.Addr) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			if addr, ok := netip.AddrFromSlice(n.IP); ok && addr.Unmap() == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -4,5 +4,28 @@ go 1.24.0
 
 require (
 	github.com/eycorsican/go-tun2socks v1.16.11
+	github.com/golang/snappy v1.0.0
+	github.com/hashicorp/yamux v0.1.2
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/shadowsocks/go-shadowsocks2 v0.1.5
+	github.com/xtaci/kcp-go/v5 v5.6.18
+	github.com/xtaci/smux v1.5.34
+	golang.org/x/crypto v0.47.0
 	golang.org/x/net v0.49.0
+	golang.org/x/sys v0.40.0
+	golang.zx2c4.com/wireguard v0.0.0-20250521234502-f333402bd9cb
 )
+
+require (
+	github.com/klauspost/cpuid/v2 v2.2.6 // indirect
+	github.com/klauspost/reedsolomon v1.12.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/riobard/go-bloom v0.0.0-20200614022211-cdc8013cb5b3 // indirect
+	github.com/templexxx/cpu v0.1.1 // indirect
+	github.com/templexxx/xorsimd v0.4.3 // indirect
+	github.com/tjfoc/gmsm v1.4.1 // indirect
+	golang.org/x/text v0.33.0 // indirect
+	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
+)
+
+replace github.com/eycorsican/go-tun2socks => ./third_party/go-tun2socks
@@ -0,0 +1,536 @@
+package tun2socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+const (
+	defaultProbeURL      = "http://cp.cloudflare.com/generate_204"
+	defaultProbeInterval = 60 * time.Second
+	defaultProbeTimeout  = 5 * time.Second
+	defaultTolerance     = 50 * time.Millisecond
+)
+
+const (
+	groupFallback      = "fallback"
+	groupURLTest       = "url-test"
+	groupLoadBalance   = "load-balance"
+	strategyHashing    = "consistent-hashing"
+	strategyRoundRobin = "round-robin"
+)
+
+var groupTypes = map[string]bool{
+	groupFallback:    true,
+	groupURLTest:     true,
+	groupLoadBalance: true,
+}
+
+type healthCheckConfig struct {
+	Type        string `json:"type,omitempty"`
+	URL         string `json:"url,omitempty"`
+	IntervalMs  int    `json:"intervalMs,omitempty"`
+	TimeoutMs   int    `json:"timeoutMs,omitempty"`
+	ToleranceMs int    `json:"toleranceMs,omitempty"`
+}
+
+type groupMember struct {
+	name  string
+	tcp   outbound
+	udp   core.UDPConnHandler
+	alive atomic.Bool
+	rtt   atomic.Int64
+}
+
+type groupEvent struct {
+	Event  string `json:"event"`
+	Group  string `json:"group"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// outboundGroup spreads flows over member outbounds and health checks them
+// in the background. A fallback group uses the first healthy member, a
+// url-test group the one with the lowest probe RTT, and a load-balance
+// group spreads targets over all healthy members.
+type outboundGroup struct {
+	name      string
+	kind      string
+	strategy  string
+	members   []*groupMember
+	probe     string
+	probeURL  *url.URL
+	interval  time.Duration
+	timeout   time.Duration
+	tolerance time.Duration
+	counter   atomic.Uint64
+
+	mu       sync.Mutex
+	selected int
+
+	recheck   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newOutboundGroup(name string, cfg proxyConfig, tcpOutbounds map[string]outbound, udpOutbounds map[string]core.UDPConnHandler) (*outboundGroup, error) {
+	hc := cfg.HealthCheck
+	if hc == nil {
+		hc = &healthCheckConfig{}
+	}
+	g := &outboundGroup{
+		name:      name,
+		kind:      cfg.Type,
+		strategy:  strings.ToLower(cfg.Strategy),
+		probe:     strings.ToLower(hc.Type),
+		interval:  defaultProbeInterval,
+		timeout:   defaultProbeTimeout,
+		tolerance: defaultTolerance,
+		recheck:   make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if hc.ToleranceMs > 0 {
+		g.tolerance = time.Duration(hc.ToleranceMs) * time.Millisecond
+	}
+	switch g.strategy {
+	case "":
+		g.strategy = strategyHashing
+	case strategyHashing, strategyRoundRobin:
+	default:
+		return nil, fmt.Errorf("unsupported load-balance strategy %q", cfg.Strategy)
+	}
+	if hc.IntervalMs > 0 {
+		g.interval = time.Duration(hc.IntervalMs) * time.Millisecond
+	}
+	if hc.TimeoutMs > 0 {
+		g.timeout = time.Duration(hc.TimeoutMs) * time.Millisecond
+	}
+	switch g.probe {
+	case "", "http", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported health check %q", hc.Type)
+	}
+
+	u, err := parseProbeURL(hc.URL)
+	if err != nil {
+		return nil, err
+	}
+	g.probeURL = u
+
+	for _, memberName := range cfg.Members {
+		tcp, ok := tcpOutbounds[memberName]
+		if !ok {
+			return nil, fmt.Errorf("unknown group member %q", memberName)
+		}
+		m := &groupMember{name: memberName, tcp: tcp, udp: udpOutbounds[memberName]}
+		m.alive.Store(true)
+		g.members = append(g.members, m)
+	}
+	if len(g.members) == 0 {
+		return nil, errors.New("group needs at least one member")
+	}
+	return g, nil
+}
+
+// start begins the health checks once the group's configuration is the
+// active one, so a prepared configuration neither probes nor reports failovers.
+func (g *outboundGroup) start() {
+	go g.run()
+}
+
+func (g *outboundGroup) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(g, conn, target)
+}
+
+// Dial tries the member addr goes to and then each other one once.
+func (g *outboundGroup) Dial(network string, addr string) (net.Conn, error) {
+	var lastErr error
+	for _, m := range g.dialOrder(g.pick(addr)) {
+		c, err := m.tcp.Dial(network, addr)
+		if err == nil {
+			return c, nil
+		}
+		lastErr = err
+		if errors.Is(err, errConnectRejected) {
+			return nil, err
+		}
+		g.markDown(m, err.Error())
+	}
+	return nil, lastErr
+}
+
+// dialOrder returns first and then the other members, healthy ones ahead
+// of those marked down, which may have come back since their last check.
+func (g *outboundGroup) dialOrder(first *groupMember) []*groupMember {
+	var up, down []*groupMember
+	for _, m := range g.members {
+		switch {
+		case m == first:
+		case m.alive.Load():
+			up = append(up, m)
+		default:
+			down = append(down, m)
+		}
+	}
+	return append(append([]*groupMember{first}, up...), down...)
+}
+
+func (g *outboundGroup) Bind(target string) (*binding, error) {
+	return bindThrough(g.pick(target).tcp, target)
+}
+
+func (g *outboundGroup) CanBind(target string) bool {
+	return canBindThrough(g.pick(target).tcp, target)
+}
+
+func (g *outboundGroup) pick(addr string) *groupMember {
+	if g.kind == groupLoadBalance {
+		return g.balance(addr)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.members[g.selected]
+}
+
+func (g *outboundGroup) balance(addr string) *groupMember {
+	candidates := make([]*groupMember, 0, len(g.members))
+	for _, m := range g.members {
+		if m.alive.Load() {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = g.members
+	}
+
+	if g.strategy == strategyRoundRobin {
+		return candidates[g.counter.Add(1)%uint64(len(candidates))]
+	}
+
+	// Rendezvous hashing keeps a host on the same member while the set of
+	// healthy members is unchanged, and only moves hosts of a failed one.
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	var best *groupMember
+	var bestScore uint32
+	for _, m := range candidates {
+		h := fnv.New32a()
+		h.Write([]byte(m.name))
+		h.Write([]byte(host))
+		if score := h.Sum32(); best == nil || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	return best
+}
+
+func (g *outboundGroup) markDown(m *groupMember, reason string) {
+	if m.alive.Swap(false) {
+		logger.Warn("outbound down", "group", g.name, "outbound", m.name, "reason", reason)
+	}
+	g.reselect(reason)
+	updateState()
+}
+
+// healthy reports whether any member passed its last check.
+func (g *outboundGroup) healthy() bool {
+	for _, m := range g.members {
+		if m.alive.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// active returns the member new flows go to, or the group's name when it
+// spreads them.
+func (g *outboundGroup) active() string {
+	if g.kind == groupLoadBalance {
+		return g.name
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.members[g.selected].name
+}
+
+// reselect points the group at the best member and reports a change.
+func (g *outboundGroup) reselect(reason string) {
+	if g.kind == groupLoadBalance {
+		return
+	}
+
+	g.mu.Lock()
+	previous := g.selected
+	next := previous
+	if g.kind == groupURLTest {
+		next = g.fastestLocked()
+	} else {
+		for i, m := range g.members {
+			if m.alive.Load() {
+				next = i
+				break
+			}
+		}
+	}
+	g.selected = next
+	g.mu.Unlock()
+
+	if next != previous {
+		event := "failover"
+		if g.members[previous].alive.Load() {
+			event = "switch"
+		}
+		from, to := g.members[previous].name, g.members[next].name
+		logger.Info("outbound switched", "group", g.name, "from", from, "to", to)
+		emitEvent(groupEvent{Event: event, Group: g.name, From: from, To: to, Reason: reason})
+	}
+}
+
+// fastestLocked returns the healthy member with the lowest RTT, staying on
+// the current one unless another is faster by more than the tolerance.
+func (g *outboundGroup) fastestLocked() int {
+	best := -1
+	for i, m := range g.members {
+		if !m.alive.Load() || m.rtt.Load() == 0 {
+			continue
+		}
+		if best < 0 || m.rtt.Load() < g.members[best].rtt.Load() {
+			best = i
+		}
+	}
+	current := g.members[g.selected]
+	if best < 0 {
+		return g.selected
+	}
+	if current.alive.Load() && current.rtt.Load() > 0 &&
+		time.Duration(current.rtt.Load()-g.members[best].rtt.Load()) <= g.tolerance {
+		return g.selected
+	}
+	return best
+}
+
+func (g *outboundGroup) run() {
+	g.checkAll()
+
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			g.checkAll()
+		case <-g.recheck:
+			g.checkAll()
+			ticker.Reset(g.interval)
+		}
+	}
+}
+
+// networkChanged checks every member again right away, since results from
+// the previous network no longer say much.
+func (g *outboundGroup) networkChanged() {
+	select {
+	case g.recheck <- struct{}{}:
+	default:
+	}
+}
+
+func (g *outboundGroup) checkAll() {
+	var wg sync.WaitGroup
+	for _, m := range g.members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rtt, err := g.check(m)
+			if err != nil {
+				if m.alive.Swap(false) {
+					logger.Warn("health check failed", "group", g.name, "outbound", m.name, "error", err)
+				}
+				return
+			}
+			m.rtt.Store(int64(rtt))
+			if !m.alive.Swap(true) {
+				logger.Info("outbound recovered", "group", g.name, "outbound", m.name)
+			}
+		}()
+	}
+	wg.Wait()
+	g.reselect("health check")
+	updateState()
+}
+
+func (g *outboundGroup) check(m *groupMember) (time.Duration, error) {
+	return probe(m.tcp, g.probe, g.probeURL, g.timeout)
+}
+
+func parseProbeURL(rawURL string) (*url.URL, error) {
+	if rawURL == "" {
+		rawURL = defaultProbeURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid health check url %q", rawURL)
+	}
+	return u, nil
+}
+
+// probe runs one health check through ob and returns its round trip time.
+// A tcp probe connects to the host of u; otherwise u is fetched and must
+// not answer with an error status.
+func probe(ob outbound, kind string, u *url.URL, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	if kind == "tcp" {
+		c, err := dialWithin(ob, "tcp", addr, timeout)
+		if err != nil {
+			return 0, err
+		}
+		c.Close()
+		return time.Since(start), nil
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return ob.Dial(network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return 0, fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	return time.Since(start), nil
+}
+
+// dialWithin dials addr through ob but gives up after timeout, since
+// outbounds dial without a deadline of their own. A connection that
+// arrives late is closed.
+func dialWithin(ob outbound, network, addr string, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := ob.Dial(network, addr)
+		done <- result{c, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("dial %s timed out after %v", addr, timeout)
+	}
+}
+
+func (g *outboundGroup) Close() error {
+	g.closeOnce.Do(func() {
+		close(g.done)
+	})
+	return nil
+}
+
+func (g *outboundGroup) udpHandler() core.UDPConnHandler {
+	return &groupUDPHandler{group: g, conns: make(map[core.UDPConn]*groupUDPConn, 8)}
+}
+
+type groupUDPHandler struct {
+	sync.Mutex
+
+	group *outboundGroup
+	conns map[core.UDPConn]*groupUDPConn
+}
+
+type groupUDPConn struct {
+	core.UDPConn
+	owner   *groupUDPHandler
+	handler core.UDPConnHandler
+}
+
+func (h *groupUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	var addr string
+	if target != nil {
+		addr = target.String()
+	}
+	m := h.group.pick(addr)
+	if m.udp == nil {
+		return fmt.Errorf("outbound %q does not relay udp", m.name)
+	}
+
+	wrapped := &groupUDPConn{UDPConn: conn, owner: h, handler: m.udp}
+	h.Lock()
+	h.conns[conn] = wrapped
+	h.Unlock()
+	onSessionClose(conn, func() { h.forget(conn) })
+
+	if err := m.udp.Connect(wrapped, target); err != nil {
+		h.forget(conn)
+		return err
+	}
+	return nil
+}
+
+func (h *groupUDPHandler) forget(conn core.UDPConn) {
+	h.Lock()
+	delete(h.conns, conn)
+	h.Unlock()
+}
+
+func (h *groupUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	wrapped, ok := h.conns[conn]
+	h.Unlock()
+
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("group connection %v->%v does not exist", conn.LocalAddr(), addr)
+	}
+	return wrapped.handler.ReceiveTo(wrapped, data, addr)
+}
+
+func (c *groupUDPConn) Close() error {
+	c.owner.forget(c.UDPConn)
+	return c.UDPConn.Close()
+}
+
+func (c *groupUDPConn) unwrapUDP() core.UDPConn {
+	return c.UDPConn
+}
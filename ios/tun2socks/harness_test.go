@@ -0,0 +1,1327 @@
+package tun2socks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+	sscore "github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/md4"
+)
+
+// This file holds the harness of the integration tests: proxy servers that
+// run in the test process and a TUN feeder that speaks IPv4 TCP and UDP to
+// the stack through Input and SetOutputFunc, so a flow can be followed from
+// the app's packets through the proxy and back without a device.
+
+const testTimeout = 5 * time.Second
+
+// testServer is an in-process proxy. Every target the tunnel asks for is
+// served by echoing the stream back, and recorded.
+type testServer struct {
+	ln       net.Listener
+	username string
+	password string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func (s *testServer) port() int {
+	return int(netip.MustParseAddrPort(s.ln.Addr().String()).Port())
+}
+
+func (s *testServer) record(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targets = append(s.targets, target)
+}
+
+// seen returns the targets asked for so far.
+func (s *testServer) seen() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.targets...)
+}
+
+func listenTestServer(t *testing.T, username string, password string, serve func(*testServer, net.Conn)) *testServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{ln: ln, username: username, password: password}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(testTimeout))
+				serve(s, conn)
+			}()
+		}
+	}()
+	return s
+}
+
+// newSOCKS5Server starts a SOCKS5 server with CONNECT and UDP ASSOCIATE,
+// and username/password authentication when username is set.
+func newSOCKS5Server(t *testing.T, username string, password string) *testServer {
+	return listenTestServer(t, username, password, (*testServer).serveSOCKS5)
+}
+
+// newSOCKS5TLSServer starts a SOCKS5 server inside TLS with a fresh
+// self-signed certificate, and returns it with the pin of its key.
+func newSOCKS5TLSServer(t *testing.T) (*testServer, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy.test"},
+		DNSNames:     []string{"proxy.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	s := listenTestServer(t, "", "", func(s *testServer, conn net.Conn) {
+		s.serveSOCKS5(tls.Server(conn, config))
+	})
+	return s, "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// newKCPServer starts a SOCKS5 server behind a KCP listener that takes
+// streams as kcptun does, with the default crypt and FEC keyed by key.
+func newKCPServer(t *testing.T, key string) *testServer {
+	t.Helper()
+	block, err := (&kcpConfig{Key: key}).block()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := kcp.ListenWithOptions("127.0.0.1:0", block, kcpDataShards, kcpParityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.AcceptKCP()
+			if err != nil {
+				return
+			}
+			conn.SetStreamMode(true)
+			go func() {
+				session, err := smux.Server(newSnappyStream(conn), smux.DefaultConfig())
+				if err != nil {
+					conn.Close()
+					return
+				}
+				defer session.Close()
+				for {
+					stream, err := session.AcceptStream()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer stream.Close()
+						stream.SetDeadline(time.Now().Add(testTimeout))
+						s.serveSOCKS5(stream)
+					}()
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *testServer) serveSOCKS5(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil || head[0] != 5 {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	if s.username == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		if !s.socks5Auth(r, conn) {
+			return
+		}
+	}
+
+	var req [3]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return
+	}
+	target, err := readSocksAddr(r)
+	if err != nil {
+		return
+	}
+	switch req[1] {
+	case socks5CmdConnect:
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		if host, _, _ := net.SplitHostPort(target.String()); host == "sp.v2.udp-over-tcp.arpa" {
+			s.serveUoT(conn, r)
+			return
+		}
+		s.record(target.String())
+		echo(conn, r)
+	case socks5CmdUDPAssoc:
+		s.associate(conn)
+	default:
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+func (s *testServer) socks5Auth(r *bufio.Reader, conn net.Conn) bool {
+	read := func() string {
+		n, err := r.ReadByte()
+		if err != nil {
+			return ""
+		}
+		b := make([]byte, n)
+		io.ReadFull(r, b)
+		return string(b)
+	}
+	if v, err := r.ReadByte(); err != nil || v != 1 {
+		return false
+	}
+	if read() != s.username || read() != s.password {
+		conn.Write([]byte{1, 1})
+		return false
+	}
+	conn.Write([]byte{1, 0})
+	return true
+}
+
+// associate relays datagrams by echoing each one to its sender, with the
+// SOCKS5 UDP header it came with, until the control connection closes.
+func (s *testServer) associate(conn net.Conn) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	defer pc.Close()
+	relay := pc.LocalAddr().(*net.UDPAddr)
+	reply := []byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(reply[8:], uint16(relay.Port))
+	conn.Write(reply)
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 3 {
+				continue
+			}
+			if target := socks.SplitAddr(buf[3:n]); target != nil {
+				s.record("udp/" + target.String())
+			}
+			pc.WriteTo(buf[:n], from)
+		}
+	}()
+	conn.SetDeadline(time.Time{})
+	io.Copy(io.Discard, conn)
+}
+
+// newShadowsocksServer starts a go-shadowsocks2 server for method and
+// password, on TCP and on UDP at the same port. Its username is the method,
+// as in the proxy configuration.
+func newShadowsocksServer(t *testing.T, method string, password string) *testServer {
+	t.Helper()
+	ciph, err := sscore.PickCipher(method, nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := listenTestServer(t, method, password, func(s *testServer, conn net.Conn) {
+		conn = ciph.StreamConn(conn)
+		target, err := readSocksAddr(conn)
+		if err != nil {
+			return
+		}
+		s.record(target.String())
+		echo(conn, conn)
+	})
+
+	pc, err := net.ListenPacket("udp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	pc = ciph.PacketConn(pc)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// Replies carry the address of the target they come from,
+			// which is what the datagram was sent to.
+			if target := socks.SplitAddr(buf[:n]); target != nil {
+				s.record("udp/" + target.String())
+			}
+			pc.WriteTo(buf[:n], from)
+		}
+	}()
+	return s
+}
+
+// newVLESSServer starts a VLESS server for the UUID in username.
+func newVLESSServer(t *testing.T, username string, password string) *testServer {
+	return listenTestServer(t, username, password, (*testServer).serveVLESS)
+}
+
+func (s *testServer) serveVLESS(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	var head [18]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil || head[0] != 0 {
+		return
+	}
+	if id, _ := parseUUID(s.username); id != [16]byte(head[1:17]) {
+		return
+	}
+	if _, err := r.Discard(int(head[17])); err != nil {
+		return
+	}
+	if cmd, err := r.ReadByte(); err != nil || cmd != 1 {
+		return
+	}
+	target, err := readV2RayAddr(r)
+	if err != nil {
+		return
+	}
+	s.record(target)
+	conn.Write([]byte{0, 0})
+	echo(conn, r)
+}
+
+// readV2RayAddr reads a target in the port-then-address form of VMess
+// and VLESS.
+func readV2RayAddr(r io.Reader) (string, error) {
+	var head [3]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", err
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(head[:2])))
+	var host []byte
+	switch head[2] {
+	case 1:
+		host = make([]byte, 4)
+	case 3:
+		host = make([]byte, 16)
+	case 2:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		host = make([]byte, n[0])
+	default:
+		return "", fmt.Errorf("address type %d", head[2])
+	}
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	if head[2] == 2 {
+		return net.JoinHostPort(string(host), port), nil
+	}
+	return net.JoinHostPort(net.IP(host).String(), port), nil
+}
+
+// newVMessServer starts a VMess AEAD server for the UUID in username. It
+// takes the body security from each request, and derives keys with its own
+// KDF written from the HMAC definition.
+func newVMessServer(t *testing.T, username string, password string) *testServer {
+	return listenTestServer(t, username, password, (*testServer).serveVMess)
+}
+
+func (s *testServer) serveVMess(conn net.Conn) {
+	id, err := parseUUID(s.username)
+	if err != nil {
+		return
+	}
+	cmdKey := md5.Sum(append(id[:], "c48619fe-8f02-49e0-b9e9-edf763e17e21"...))
+	header, err := openVMessRequest(conn, cmdKey[:])
+	if err != nil {
+		return
+	}
+	sum := fnv.New32a()
+	sum.Write(header[:len(header)-4])
+	if len(header) < 42 || header[0] != 1 || !bytes.Equal(sum.Sum(nil), header[len(header)-4:]) {
+		return
+	}
+	reqIV, reqKey := header[1:17], header[17:33]
+	respV, security := header[33], header[35]&0x0f
+	if header[37] != 1 {
+		return
+	}
+	target, err := readV2RayAddr(bytes.NewReader(header[38:]))
+	if err != nil {
+		return
+	}
+	s.record(target)
+
+	respKey := sha256.Sum256(reqKey)
+	respIV := sha256.Sum256(reqIV)
+	if err := sealVMessResponse(conn, respKey[:16], respIV[:16], []byte{respV, 0, 0, 0}); err != nil {
+		return
+	}
+	in := &vmessTestBody{conn: conn, aead: vmessTestBodyAEAD(security, reqKey), iv: reqIV}
+	out := &vmessTestBody{conn: conn, aead: vmessTestBodyAEAD(security, respKey[:16]), iv: respIV[:16]}
+	for {
+		chunk, err := in.read()
+		if err != nil {
+			return
+		}
+		if err := out.write(chunk); err != nil || len(chunk) == 0 {
+			return
+		}
+	}
+}
+
+func openVMessRequest(r io.Reader, cmdKey []byte) ([]byte, error) {
+	var authID [16]byte
+	if _, err := io.ReadFull(r, authID[:]); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(vmessTestKDF(cmdKey, "AES Auth ID Encryption")[:16])
+	if err != nil {
+		return nil, err
+	}
+	var plain [16]byte
+	block.Decrypt(plain[:], authID[:])
+	if crc32.ChecksumIEEE(plain[:12]) != binary.BigEndian.Uint32(plain[12:]) {
+		return nil, errors.New("bad auth id")
+	}
+	if age := time.Since(time.Unix(int64(binary.BigEndian.Uint64(plain[:8])), 0)); age > time.Minute || age < -time.Minute {
+		return nil, errors.New("stale auth id")
+	}
+
+	sealedLength := make([]byte, 2+16)
+	nonce := make([]byte, 8)
+	if _, err := io.ReadFull(r, sealedLength); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, err
+	}
+	open := func(keyPath string, ivPath string, sealed []byte) ([]byte, error) {
+		aead := vmessTestGCM(vmessTestKDF(cmdKey, keyPath, string(authID[:]), string(nonce))[:16])
+		return aead.Open(nil, vmessTestKDF(cmdKey, ivPath, string(authID[:]), string(nonce))[:12], sealed, authID[:])
+	}
+	length, err := open("VMess Header AEAD Key_Length", "VMess Header AEAD Nonce_Length", sealedLength)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, int(binary.BigEndian.Uint16(length))+16)
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, err
+	}
+	return open("VMess Header AEAD Key", "VMess Header AEAD Nonce", sealed)
+}
+
+func sealVMessResponse(w io.Writer, key []byte, iv []byte, header []byte) error {
+	length := binary.BigEndian.AppendUint16(nil, uint16(len(header)))
+	out := vmessTestGCM(vmessTestKDF(key, "AEAD Resp Header Len Key")[:16]).Seal(nil, vmessTestKDF(iv, "AEAD Resp Header Len IV")[:12], length, nil)
+	out = vmessTestGCM(vmessTestKDF(key, "AEAD Resp Header Key")[:16]).Seal(out, vmessTestKDF(iv, "AEAD Resp Header IV")[:12], header, nil)
+	_, err := w.Write(out)
+	return err
+}
+
+// vmessTestKDF is the VMess AEAD KDF spelled out: each path element keys an
+// HMAC whose hash is the HMAC of the elements before it, starting from
+// HMAC-SHA256 keyed with "VMess AEAD KDF".
+func vmessTestKDF(key []byte, path ...string) []byte {
+	h := func(m []byte) []byte {
+		sum := sha256.Sum256(m)
+		return sum[:]
+	}
+	for _, k := range append([]string{"VMess AEAD KDF"}, path...) {
+		h = testHMAC(h, []byte(k))
+	}
+	return h(key)
+}
+
+// testHMAC returns HMAC keyed with key over the hash h, which has the block
+// size of SHA-256. Keys here are never longer than a block.
+func testHMAC(h func([]byte) []byte, key []byte) func([]byte) []byte {
+	return func(m []byte) []byte {
+		ipad := make([]byte, sha256.BlockSize)
+		opad := make([]byte, sha256.BlockSize)
+		copy(ipad, key)
+		copy(opad, key)
+		for i := range ipad {
+			ipad[i] ^= 0x36
+			opad[i] ^= 0x5c
+		}
+		return h(append(opad, h(append(ipad, m...))...))
+	}
+}
+
+func vmessTestGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func vmessTestBodyAEAD(security byte, key []byte) cipher.AEAD {
+	switch security {
+	case 3:
+		return vmessTestGCM(key)
+	case 4:
+		k1 := md5.Sum(key)
+		k2 := md5.Sum(k1[:])
+		aead, err := chacha20poly1305.New(append(k1[:], k2[:]...))
+		if err != nil {
+			panic(err)
+		}
+		return aead
+	default:
+		return nil
+	}
+}
+
+// vmessTestBody is one direction of a VMess chunk stream. An empty chunk
+// ends it.
+type vmessTestBody struct {
+	conn  net.Conn
+	aead  cipher.AEAD
+	iv    []byte
+	count uint16
+}
+
+func (b *vmessTestBody) nonce() []byte {
+	nonce := binary.BigEndian.AppendUint16(nil, b.count)
+	b.count++
+	return append(nonce, b.iv[2:12]...)
+}
+
+func (b *vmessTestBody) read() ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(b.conn, size[:]); err != nil {
+		return nil, err
+	}
+	chunk := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(b.conn, chunk); err != nil {
+		return nil, err
+	}
+	if b.aead == nil {
+		return chunk, nil
+	}
+	return b.aead.Open(nil, b.nonce(), chunk, nil)
+}
+
+func (b *vmessTestBody) write(p []byte) error {
+	if b.aead != nil {
+		p = b.aead.Seal(nil, b.nonce(), p, nil)
+	}
+	_, err := b.conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(p))), p...))
+	return err
+}
+
+// serveUoT relays datagrams framed as UDP-over-TCP v2 by echoing each one
+// from the address it was sent to. A datagram from a hostname goes first,
+// which the client has to skip.
+func (s *testServer) serveUoT(conn net.Conn, r io.Reader) {
+	var isConnect [1]byte
+	if _, err := io.ReadFull(r, isConnect[:]); err != nil || isConnect[0] != 0 {
+		return
+	}
+	if _, err := readTestUoTAddr(r); err != nil {
+		return
+	}
+	host := "example.com"
+	frame := append([]byte{2, byte(len(host))}, host...)
+	frame = append(frame, 0, 53, 0, 4)
+	conn.Write(append(frame, "skip"...))
+	for {
+		addr, err := readTestUoTAddr(r)
+		if err != nil {
+			return
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		s.record("udp/" + netip.AddrPortFrom(netip.AddrFrom4([4]byte(addr[1:5])), binary.BigEndian.Uint16(addr[5:])).String())
+		conn.Write(append(append(addr, length[:]...), payload...))
+	}
+}
+
+// readTestUoTAddr reads the IPv4 address and port of a frame, with its
+// family byte.
+func readTestUoTAddr(r io.Reader) ([]byte, error) {
+	addr := make([]byte, 1+4+2)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, err
+	}
+	if addr[0] != 0 {
+		return nil, fmt.Errorf("address family %d", addr[0])
+	}
+	return addr, nil
+}
+
+// newHTTPServer starts an HTTP CONNECT proxy, requiring Basic credentials
+// when username is set.
+func newHTTPServer(t *testing.T, username string, password string) *testServer {
+	return listenTestServer(t, username, password, (*testServer).serveHTTP)
+}
+
+func (s *testServer) serveHTTP(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+		return
+	}
+	if s.username != "" {
+		req.Header.Set("Authorization", req.Header.Get("Proxy-Authorization"))
+		if u, p, ok := req.BasicAuth(); !ok || u != s.username || p != s.password {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"test\"\r\nContent-Length: 0\r\n\r\n"))
+			return
+		}
+	}
+	s.record(req.Host)
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	echo(conn, r)
+}
+
+// newHTTPAuthServer starts an HTTP CONNECT proxy that asks for scheme,
+// "ntlm" or a Digest algorithm such as "digest SHA-256", and keeps the
+// connection open across the challenge.
+func newHTTPAuthServer(t *testing.T, scheme string, username string, password string) *testServer {
+	return listenTestServer(t, username, password, func(s *testServer, conn net.Conn) {
+		s.serveHTTPAuth(conn, scheme)
+	})
+}
+
+func (s *testServer) serveHTTPAuth(conn net.Conn, scheme string) {
+	const nonce = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	serverChallenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	r := bufio.NewReader(conn)
+	for range 4 {
+		req, err := http.ReadRequest(r)
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		authScheme, token, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+		var challenge string
+		switch strings.ToLower(authScheme) {
+		case "digest":
+			algorithm := strings.TrimPrefix(scheme, "digest ")
+			p := parseAuthParams(token)
+			want := testDigest(algorithm, p["username"], p["realm"], s.password, req.Method, p["uri"], nonce, p["nc"], p["cnonce"], p["qop"])
+			if p["username"] == s.username && p["nonce"] == nonce && p["uri"] == req.Host && p["response"] == want {
+				s.record(req.Host)
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				echo(conn, r)
+				return
+			}
+		case "ntlm":
+			msg, err := base64.StdEncoding.DecodeString(token)
+			if err != nil || len(msg) < 12 {
+				return
+			}
+			switch binary.LittleEndian.Uint32(msg[8:]) {
+			case 1:
+				challenge = "NTLM " + base64.StdEncoding.EncodeToString(testNTLMChallenge(serverChallenge))
+			case 3:
+				if testNTLMValid(msg, serverChallenge, s.username, s.password) {
+					s.record(req.Host)
+					conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+					echo(conn, r)
+				}
+				return
+			}
+		}
+		if challenge == "" {
+			if scheme == "ntlm" {
+				challenge = "NTLM"
+			} else {
+				challenge = fmt.Sprintf(`Digest realm="test", qop="auth", nonce=%q, algorithm=%s`, nonce, strings.TrimPrefix(scheme, "digest "))
+			}
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: %s\r\nContent-Length: 0\r\n\r\n", challenge)
+	}
+}
+
+// testDigest computes a Digest response as RFC 7616 defines it.
+func testDigest(algorithm, username, realm, password, method, uri, nonce, nc, cnonce, qop string) string {
+	h := func(parts ...string) string {
+		data := []byte(strings.Join(parts, ":"))
+		if strings.HasPrefix(strings.ToUpper(algorithm), "SHA-256") {
+			sum := sha256.Sum256(data)
+			return hex.EncodeToString(sum[:])
+		}
+		sum := md5.Sum(data)
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := h(username, realm, password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1, nonce, cnonce)
+	}
+	return h(ha1, nonce, nc, cnonce, qop, h(method, uri))
+}
+
+// testNTLMChallenge is a CHALLENGE_MESSAGE with target info that carries
+// a domain name and a timestamp.
+func testNTLMChallenge(serverChallenge []byte) []byte {
+	var info []byte
+	av := func(id uint16, value []byte) {
+		info = binary.LittleEndian.AppendUint16(info, id)
+		info = binary.LittleEndian.AppendUint16(info, uint16(len(value)))
+		info = append(info, value...)
+	}
+	av(2, utf16LE("DOMAIN"))
+	av(7, binary.LittleEndian.AppendUint64(nil, 133000000000000000))
+	av(0, nil)
+
+	msg := make([]byte, 48)
+	copy(msg, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[16:], 48)
+	binary.LittleEndian.PutUint32(msg[20:], 0x00000001|0x00000200|0x00080000|0x00800000)
+	copy(msg[24:], serverChallenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(info)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(info)))
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+	return append(msg, info...)
+}
+
+// testNTLMValid checks the NTLMv2 response of an AUTHENTICATE_MESSAGE.
+func testNTLMValid(msg []byte, serverChallenge []byte, username string, password string) bool {
+	field := func(at int) []byte {
+		length := int(binary.LittleEndian.Uint16(msg[at:]))
+		offset := int(binary.LittleEndian.Uint32(msg[at+4:]))
+		if offset+length > len(msg) {
+			return nil
+		}
+		return msg[offset : offset+length]
+	}
+	if len(msg) < 64 {
+		return false
+	}
+	nt, domain, user := field(20), field(28), field(36)
+	if len(nt) < 16+28 {
+		return false
+	}
+	wantDomain, wantUser, _ := strings.Cut(username, `\`)
+	if !bytes.Equal(domain, utf16LE(wantDomain)) || !bytes.Equal(user, utf16LE(wantUser)) {
+		return false
+	}
+	proof := testNTProofStr(password, wantUser, wantDomain, serverChallenge, nt[16:])
+	return bytes.Equal(nt[:16], proof)
+}
+
+// testNTProofStr computes NTOWFv2 and the NTLMv2 proof over temp as
+// MS-NLMP 3.3.2 defines them.
+func testNTProofStr(password string, user string, domain string, serverChallenge []byte, temp []byte) []byte {
+	h := md4.New()
+	h.Write(utf16LE(password))
+	mac := hmac.New(md5.New, h.Sum(nil))
+	mac.Write(utf16LE(strings.ToUpper(user) + domain))
+	mac = hmac.New(md5.New, mac.Sum(nil))
+	mac.Write(serverChallenge)
+	mac.Write(temp)
+	return mac.Sum(nil)
+}
+
+// remoteServer serves remote configuration documents over HTTPS with a
+// certificate that remote fetches trust for the test.
+type remoteServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newRemoteServer(t *testing.T) *remoteServer {
+	s := &remoteServer{files: map[string][]byte{}}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		data, ok := s.files[r.URL.Path]
+		s.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(s.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+	remoteRootCAs = pool
+	t.Cleanup(func() { remoteRootCAs = nil })
+	return s
+}
+
+// publish serves body at path and its base64 signature by key at path
+// plus ".sig", or no signature for a nil key.
+func (s *remoteServer) publish(path string, body string, key ed25519.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = []byte(body)
+	delete(s.files, path+".sig")
+	if key != nil {
+		s.files[path+".sig"] = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(body))))
+	}
+}
+
+// echo writes back what arrives on conn, read through r, until EOF.
+func echo(conn net.Conn, r io.Reader) {
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	io.Copy(conn, r)
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// startTestTunnel starts the tunnel with jsonConfig in packet mode and
+// stops it when the test ends.
+func startTestTunnel(t *testing.T, jsonConfig string) {
+	t.Helper()
+	if err := StartWithConfig(jsonConfig); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(Stop)
+}
+
+// proxyJSON is the proxy object of a configuration for s.
+func proxyJSON(proxyType string, s *testServer) string {
+	return fmt.Sprintf(`{"type": %q, "host": "127.0.0.1", "port": %d, "username": %q, "password": %q}`,
+		proxyType, s.port(), s.username, s.password)
+}
+
+// tunFeeder plays the app side of the TUN device.
+type tunFeeder struct {
+	t       *testing.T
+	packets chan []byte
+	nextSrc uint16
+	// wait bounds how long a read waits for the stack to answer.
+	wait time.Duration
+	// mss, when set, is announced in the SYNs of dialTCP.
+	mss uint16
+}
+
+var tunAppAddr = netip.MustParseAddr("10.0.0.2")
+
+func newTunFeeder(t *testing.T) *tunFeeder {
+	f := &tunFeeder{t: t, packets: make(chan []byte, 256), nextSrc: 40000, wait: testTimeout}
+	SetOutputFunc(func(packet []byte) {
+		select {
+		case f.packets <- append([]byte(nil), packet...):
+		default:
+		}
+	})
+	t.Cleanup(func() { SetOutputFunc(nil) })
+	return f
+}
+
+func (f *tunFeeder) input(packet []byte) {
+	f.t.Helper()
+	if !Input(packet) {
+		f.t.Fatal("tunnel not running")
+	}
+}
+
+// next returns the next packet of the flow between the app's src and dst
+// that the stack sends, skipping others.
+func (f *tunFeeder) next(proto byte, src netip.AddrPort, dst netip.AddrPort) (testPacket, error) {
+	timer := time.NewTimer(f.wait)
+	defer timer.Stop()
+	for {
+		select {
+		case data := <-f.packets:
+			p, ok := parseTestPacket(data)
+			if ok && p.proto == proto && p.src == dst && p.dst == src {
+				return p, nil
+			}
+			if ok && p.proto == ipProtoICMP && p.dst.Addr() == src.Addr() && p.quoted == src {
+				return p, nil
+			}
+		case <-timer.C:
+			return testPacket{}, fmt.Errorf("no %d packet from %s", proto, dst)
+		}
+	}
+}
+
+// nextFrom returns the next raw packet from addr, of any protocol.
+func (f *tunFeeder) nextFrom(addr netip.Addr) ([]byte, error) {
+	timer := time.NewTimer(f.wait)
+	defer timer.Stop()
+	for {
+		select {
+		case data := <-f.packets:
+			var src netip.Addr
+			switch {
+			case len(data) >= 20 && data[0]>>4 == 4:
+				src = netip.AddrFrom4([4]byte(data[12:16]))
+			case len(data) >= 40 && data[0]>>4 == 6:
+				src = netip.AddrFrom16([16]byte(data[8:24]))
+			}
+			if src == addr {
+				return data, nil
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("no packet from %s", addr)
+		}
+	}
+}
+
+func (f *tunFeeder) source() netip.AddrPort {
+	f.nextSrc++
+	return netip.AddrPortFrom(tunAppAddr, f.nextSrc)
+}
+
+// tunTCP is a TCP connection of the app, kept just far enough to move a
+// few segments in order.
+type tunTCP struct {
+	f        *tunFeeder
+	src, dst netip.AddrPort
+	seq, ack uint32
+	finished bool
+	// window is the receive window the stack announced in its SYN-ACK.
+	window uint16
+}
+
+var errReset = errors.New("connection reset")
+
+// dialTCP completes a handshake with the stack for dst.
+func (f *tunFeeder) dialTCP(dst string) (*tunTCP, error) {
+	c := &tunTCP{f: f, src: f.source(), dst: netip.MustParseAddrPort(dst), seq: 1000}
+	var options []byte
+	if f.mss != 0 {
+		options = []byte{2, 4, byte(f.mss >> 8), byte(f.mss)}
+	}
+	f.input(buildTCPOptions(c.src, c.dst, c.seq, 0, tcpFlagSYN, options, nil))
+	c.seq++
+	p, err := f.next(ipProtoTCP, c.src, c.dst)
+	if err != nil {
+		return nil, err
+	}
+	if p.proto == ipProtoICMP {
+		return nil, &icmpError{typ: p.icmpType, code: p.icmpCode}
+	}
+	if p.flags&tcpFlagRST != 0 {
+		return nil, errReset
+	}
+	if p.flags&(tcpFlagSYN|tcpFlagACK) != tcpFlagSYN|tcpFlagACK || p.ackNum != c.seq {
+		return nil, fmt.Errorf("unexpected handshake reply, flags %#x", p.flags)
+	}
+	c.ack = p.seq + 1
+	c.window = p.window
+	c.send(tcpFlagACK, nil)
+	return c, nil
+}
+
+func (c *tunTCP) send(flags byte, payload []byte) {
+	c.f.input(buildTCP(c.src, c.dst, c.seq, c.ack, flags, payload))
+}
+
+func (c *tunTCP) write(payload []byte) {
+	c.send(tcpFlagPSH|tcpFlagACK, payload)
+	c.seq += uint32(len(payload))
+}
+
+// read returns n bytes of the stream from the stack, acknowledging them.
+func (c *tunTCP) read(n int) ([]byte, error) {
+	var data []byte
+	for len(data) < n {
+		if c.finished {
+			return data, io.EOF
+		}
+		p, err := c.f.next(ipProtoTCP, c.src, c.dst)
+		if err != nil {
+			return data, err
+		}
+		if p.proto == ipProtoICMP {
+			return data, &icmpError{typ: p.icmpType, code: p.icmpCode}
+		}
+		if p.flags&tcpFlagRST != 0 {
+			return data, errReset
+		}
+		if p.seq != c.ack {
+			// Out of order or a retransmission; the stack sends it again.
+			continue
+		}
+		data = append(data, p.payload...)
+		c.ack += uint32(len(p.payload))
+		if p.flags&tcpFlagFIN != 0 {
+			c.ack++
+			c.finished = true
+		}
+		if len(p.payload) > 0 || c.finished {
+			c.send(tcpFlagACK, nil)
+		}
+	}
+	return data, nil
+}
+
+func (c *tunTCP) close() {
+	c.send(tcpFlagFIN|tcpFlagACK, nil)
+	c.seq++
+}
+
+// exchangeUDP sends payload from a new source port to dst and returns the
+// first datagram back.
+func (f *tunFeeder) exchangeUDP(dst string, payload []byte) ([]byte, error) {
+	src, to := f.source(), netip.MustParseAddrPort(dst)
+	f.input(buildUDP(src, to, payload))
+	p, err := f.next(ipProtoUDP, src, to)
+	if err != nil {
+		return nil, err
+	}
+	if p.proto == ipProtoICMP {
+		return nil, &icmpError{typ: p.icmpType, code: p.icmpCode}
+	}
+	return p.payload, nil
+}
+
+// icmpError is an ICMP error the stack sent for a flow.
+type icmpError struct {
+	typ, code byte
+}
+
+func (e *icmpError) Error() string {
+	return fmt.Sprintf("icmp type %d code %d", e.typ, e.code)
+}
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+)
+
+type testPacket struct {
+	proto    byte
+	src, dst netip.AddrPort
+	seq      uint32
+	ackNum   uint32
+	flags    byte
+	window   uint16
+	payload  []byte
+
+	// For ICMP errors: the type, the code and the source of the packet
+	// they quote.
+	icmpType, icmpCode byte
+	quoted             netip.AddrPort
+}
+
+func parseTestPacket(data []byte) (testPacket, bool) {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return testPacket{}, false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(data[2:4]))
+	if total > len(data) || ihl+8 > total {
+		return testPacket{}, false
+	}
+	p := testPacket{proto: data[9]}
+	l4 := data[ihl:total]
+	srcIP := netip.AddrFrom4([4]byte(data[12:16]))
+	dstIP := netip.AddrFrom4([4]byte(data[16:20]))
+	p.src = netip.AddrPortFrom(srcIP, binary.BigEndian.Uint16(l4[0:2]))
+	p.dst = netip.AddrPortFrom(dstIP, binary.BigEndian.Uint16(l4[2:4]))
+	switch p.proto {
+	case ipProtoTCP:
+		if len(l4) < 20 || int(l4[12]>>4)*4 > len(l4) {
+			return testPacket{}, false
+		}
+		p.seq = binary.BigEndian.Uint32(l4[4:8])
+		p.ackNum = binary.BigEndian.Uint32(l4[8:12])
+		p.flags = l4[13]
+		p.window = binary.BigEndian.Uint16(l4[14:16])
+		p.payload = l4[int(l4[12]>>4)*4:]
+	case ipProtoUDP:
+		p.payload = l4[8:]
+	case ipProtoICMP:
+		p.icmpType, p.icmpCode = l4[0], l4[1]
+		if inner := l4[8:]; len(inner) >= 20+4 {
+			at := int(inner[0]&0x0f) * 4
+			if len(inner) >= at+4 {
+				p.quoted = netip.AddrPortFrom(netip.AddrFrom4([4]byte(inner[12:16])), binary.BigEndian.Uint16(inner[at:]))
+			}
+		}
+	default:
+		return testPacket{}, false
+	}
+	return p, true
+}
+
+func buildTCP(src netip.AddrPort, dst netip.AddrPort, seq uint32, ack uint32, flags byte, payload []byte) []byte {
+	return buildTCPOptions(src, dst, seq, ack, flags, nil, payload)
+}
+
+// buildTCPOptions is buildTCP with TCP options, padded to a multiple of four
+// bytes.
+func buildTCPOptions(src netip.AddrPort, dst netip.AddrPort, seq uint32, ack uint32, flags byte, options []byte, payload []byte) []byte {
+	hlen := 20 + (len(options)+3)/4*4
+	seg := make([]byte, hlen+len(payload))
+	binary.BigEndian.PutUint16(seg[0:], src.Port())
+	binary.BigEndian.PutUint16(seg[2:], dst.Port())
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	binary.BigEndian.PutUint32(seg[8:], ack)
+	seg[12] = byte(hlen/4) << 4
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:], 65535)
+	copy(seg[20:], options)
+	copy(seg[hlen:], payload)
+	if src.Addr().Is6() {
+		return buildIPv6(src.Addr(), dst.Addr(), ipProtoTCP, seg, 16)
+	}
+	return buildIPv4(src.Addr(), dst.Addr(), ipProtoTCP, seg, 16)
+}
+
+func buildUDP(src netip.AddrPort, dst netip.AddrPort, payload []byte) []byte {
+	dgram := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(dgram[0:], src.Port())
+	binary.BigEndian.PutUint16(dgram[2:], dst.Port())
+	binary.BigEndian.PutUint16(dgram[4:], uint16(len(dgram)))
+	copy(dgram[8:], payload)
+	return buildIPv4(src.Addr(), dst.Addr(), ipProtoUDP, dgram, 6)
+}
+
+// buildIPv4 wraps l4 in an IPv4 header and fills in both checksums; the
+// transport checksum is at sumAt in l4.
+func buildIPv4(src netip.Addr, dst netip.Addr, proto byte, l4 []byte, sumAt int) []byte {
+	packet := make([]byte, 20+len(l4))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = proto
+	s, d := src.As4(), dst.As4()
+	copy(packet[12:], s[:])
+	copy(packet[16:], d[:])
+	binary.BigEndian.PutUint16(packet[10:], testChecksum(packet[:20], 0))
+
+	pseudo := uint32(proto) + uint32(len(l4))
+	for _, b := range [][]byte{s[:], d[:]} {
+		pseudo += uint32(binary.BigEndian.Uint16(b[0:])) + uint32(binary.BigEndian.Uint16(b[2:]))
+	}
+	binary.BigEndian.PutUint16(l4[sumAt:], testChecksum(l4, pseudo))
+	copy(packet[20:], l4)
+	return packet
+}
+
+// buildIPv6 is buildIPv4 for IPv6.
+func buildIPv6(src netip.Addr, dst netip.Addr, proto byte, l4 []byte, sumAt int) []byte {
+	packet := make([]byte, 40+len(l4))
+	packet[0] = 6 << 4
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(l4)))
+	packet[6] = proto
+	packet[7] = 64
+	s, d := src.As16(), dst.As16()
+	copy(packet[8:], s[:])
+	copy(packet[24:], d[:])
+	binary.BigEndian.PutUint16(l4[sumAt:], testChecksum(l4, testPseudoSum6(packet)))
+	copy(packet[40:], l4)
+	return packet
+}
+
+// testTransportSumOK reports whether the transport checksum of an IPv4 or
+// IPv6 packet without extension headers is valid.
+func testTransportSumOK(packet []byte) bool {
+	if packet[0]>>4 == 6 {
+		return testChecksum(packet[40:], testPseudoSum6(packet)) == 0
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	sum := uint32(packet[9]) + uint32(len(packet)-ihl)
+	for i := 12; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+	}
+	return testChecksum(packet[ihl:], sum) == 0
+}
+
+// buildEchoRequest builds an ICMP or ICMPv6 echo request from src to dst.
+func buildEchoRequest(src netip.Addr, dst netip.Addr, id uint16, seq uint16, payload []byte) []byte {
+	icmp := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(icmp[4:], id)
+	binary.BigEndian.PutUint16(icmp[6:], seq)
+	copy(icmp[8:], payload)
+	if src.Is4() {
+		icmp[0] = 8
+		binary.BigEndian.PutUint16(icmp[2:], testChecksum(icmp, 0))
+		packet := make([]byte, 20+len(icmp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		packet[8] = 64
+		packet[9] = ipProtoICMP
+		s, d := src.As4(), dst.As4()
+		copy(packet[12:], s[:])
+		copy(packet[16:], d[:])
+		binary.BigEndian.PutUint16(packet[10:], testChecksum(packet[:20], 0))
+		copy(packet[20:], icmp)
+		return packet
+	}
+	icmp[0] = 128
+	packet := make([]byte, 40+len(icmp))
+	packet[0] = 6 << 4
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(icmp)))
+	packet[6] = ipProtoICMPv6
+	packet[7] = 64
+	s, d := src.As16(), dst.As16()
+	copy(packet[8:], s[:])
+	copy(packet[24:], d[:])
+	binary.BigEndian.PutUint16(icmp[2:], testChecksum(icmp, testPseudoSum6(packet)))
+	copy(packet[40:], icmp)
+	return packet
+}
+
+// testPseudoSum6 sums the IPv6 pseudo-header of packet for its payload.
+func testPseudoSum6(packet []byte) uint32 {
+	sum := uint32(packet[6]) + uint32(binary.BigEndian.Uint16(packet[4:6]))
+	for i := 8; i < 40; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+	}
+	return sum
+}
+
+func testChecksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// testTarget returns an address in TEST-NET-2 for port; the in-process
+// proxies answer for any target.
+func testTarget(port int) string {
+	return net.JoinHostPort("198.51.100.1", strconv.Itoa(port))
+}
+
+// pipeOutbound dials every target into the far end of a pipe, which it
+// hands to the test, and can claim to bind without a proxy behind it.
+type pipeOutbound struct {
+	peers chan net.Conn
+	bind  bool
+}
+
+func newPipeOutbound(bind bool) *pipeOutbound {
+	return &pipeOutbound{peers: make(chan net.Conn, 1), bind: bind}
+}
+
+func (o *pipeOutbound) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(o, conn, target)
+}
+
+func (o *pipeOutbound) Dial(network string, addr string) (net.Conn, error) {
+	c, peer := net.Pipe()
+	o.peers <- peer
+	return c, nil
+}
+
+func (o *pipeOutbound) Bind(target string) (*binding, error) {
+	return nil, errBindUnsupported
+}
+
+func (o *pipeOutbound) CanBind(target string) bool {
+	return o.bind
+}
+
+// testGeoDomain is a Domain entry of a geosite file.
+type testGeoDomain struct {
+	kind  int
+	value string
+	attrs []string
+}
+
+// buildGeosite encodes a V2Ray GeoSiteList with a GeoSite per category.
+func buildGeosite(sites map[string][]testGeoDomain) []byte {
+	var list []byte
+	for code, domains := range sites {
+		site := testProtoField(1, []byte(code))
+		for _, d := range domains {
+			domain := binary.AppendUvarint(binary.AppendUvarint(nil, 1<<3), uint64(d.kind))
+			domain = append(domain, testProtoField(2, []byte(d.value))...)
+			for _, attr := range d.attrs {
+				// Attribute{key, bool_value: true}.
+				value := append(testProtoField(1, []byte(attr)), 2<<3, 1)
+				domain = append(domain, testProtoField(3, value)...)
+			}
+			site = append(site, testProtoField(2, domain)...)
+		}
+		list = append(list, testProtoField(1, site)...)
+	}
+	return list
+}
+
+// testProtoField encodes a length-delimited protobuf field.
+func testProtoField(num int, data []byte) []byte {
+	field := binary.AppendUvarint(nil, uint64(num)<<3|2)
+	field = binary.AppendUvarint(field, uint64(len(data)))
+	return append(field, data...)
+}
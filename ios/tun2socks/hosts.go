@@ -0,0 +1,194 @@
+package tun2socks
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	hostsTTL = 60
+	// hostsMaxAliases bounds a chain of names mapped to names.
+	hostsMaxAliases = 8
+)
+
+// hostsEntry is what a name is rewritten to: addresses, or another name.
+type hostsEntry struct {
+	addrs []netip.Addr
+	alias string
+}
+
+type hostsPattern struct {
+	rule  routeRule
+	entry hostsEntry
+}
+
+// hostsResolver answers queries for names in the hosts map of the
+// configuration itself, before any other resolver sees them.
+type hostsResolver struct {
+	inner    dnsUpstream
+	exact    map[string]hostsEntry
+	patterns []hostsPattern
+}
+
+func newHostsResolver(hosts map[string][]string, inner dnsUpstream) (dnsUpstream, error) {
+	r := &hostsResolver{inner: inner, exact: make(map[string]hostsEntry)}
+	keys := make([]string, 0, len(hosts))
+	for name := range hosts {
+		keys = append(keys, name)
+	}
+	// The longest pattern is the most specific, so it is tried first.
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	for _, name := range keys {
+		entry, err := parseHostsEntry(hosts[name])
+		if err != nil {
+			return nil, fmt.Errorf("dns hosts %q: %w", name, err)
+		}
+		if !strings.HasPrefix(name, ".") && !strings.Contains(name, "*") {
+			r.exact[normalizeDomain(name)] = entry
+			continue
+		}
+		rule, err := parseDNSDomain(name)
+		if err != nil {
+			return nil, fmt.Errorf("dns hosts %q: %w", name, err)
+		}
+		r.patterns = append(r.patterns, hostsPattern{rule: rule, entry: entry})
+	}
+	return r, nil
+}
+
+// parseHostsEntry accepts addresses of either family, or a single name.
+func parseHostsEntry(values []string) (hostsEntry, error) {
+	if len(values) == 0 {
+		return hostsEntry{}, errors.New("no addresses or name")
+	}
+	if _, err := netip.ParseAddr(values[0]); err != nil {
+		if len(values) > 1 {
+			return hostsEntry{}, errors.New("a name cannot be mixed with other values")
+		}
+		alias := normalizeDomain(values[0])
+		if alias == "" || strings.ContainsAny(alias, "* ") {
+			return hostsEntry{}, fmt.Errorf("invalid name %q", values[0])
+		}
+		return hostsEntry{alias: alias}, nil
+	}
+	var entry hostsEntry
+	for _, v := range values {
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return hostsEntry{}, err
+		}
+		entry.addrs = append(entry.addrs, addr.Unmap())
+	}
+	return entry, nil
+}
+
+func (r *hostsResolver) lookup(name string) (hostsEntry, bool) {
+	if entry, ok := r.exact[name]; ok {
+		return entry, true
+	}
+	for _, p := range r.patterns {
+		if matchDomain(p.rule, name) {
+			return p.entry, true
+		}
+	}
+	return hostsEntry{}, false
+}
+
+func (r *hostsResolver) Exchange(query []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 || msg.Questions[0].Class != dnsmessage.ClassINET {
+		return r.inner.Exchange(query)
+	}
+	q := msg.Questions[0]
+	if _, ok := r.lookup(normalizeDomain(q.Name.String())); !ok {
+		return r.inner.Exchange(query)
+	}
+	answers, rcode, err := r.resolve(q, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 msg.ID,
+			Response:           true,
+			RecursionDesired:   msg.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: msg.Questions,
+		Answers:   answers,
+	}
+	return resp.Pack()
+}
+
+// resolve answers q from the hosts map, following aliases. A name mapped
+// to addresses has only A and AAAA records, so the upstream's other
+// records, such as HTTPS with its address hints, cannot contradict it.
+func (r *hostsResolver) resolve(q dnsmessage.Question, depth int) ([]dnsmessage.Resource, dnsmessage.RCode, error) {
+	entry, ok := r.lookup(normalizeDomain(q.Name.String()))
+	if !ok {
+		return r.resolveUpstream(q)
+	}
+	header := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: hostsTTL}
+
+	if entry.alias != "" {
+		if depth >= hostsMaxAliases {
+			return nil, dnsmessage.RCodeServerFailure, nil
+		}
+		target, err := dnsmessage.NewName(entry.alias + ".")
+		if err != nil {
+			return nil, dnsmessage.RCodeServerFailure, nil
+		}
+		header.Type = dnsmessage.TypeCNAME
+		cname := dnsmessage.Resource{Header: header, Body: &dnsmessage.CNAMEResource{CNAME: target}}
+		if q.Type == dnsmessage.TypeCNAME {
+			return []dnsmessage.Resource{cname}, dnsmessage.RCodeSuccess, nil
+		}
+		rest, rcode, err := r.resolve(dnsmessage.Question{Name: target, Type: q.Type, Class: q.Class}, depth+1)
+		return append([]dnsmessage.Resource{cname}, rest...), rcode, err
+	}
+
+	var answers []dnsmessage.Resource
+	for _, addr := range entry.addrs {
+		switch {
+		case q.Type == dnsmessage.TypeA && addr.Is4():
+			header.Type = dnsmessage.TypeA
+			answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}})
+		case q.Type == dnsmessage.TypeAAAA && addr.Is6():
+			header.Type = dnsmessage.TypeAAAA
+			answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	return answers, dnsmessage.RCodeSuccess, nil
+}
+
+// resolveUpstream asks the inner resolver for q, the target of an alias.
+func (r *hostsResolver) resolveUpstream(q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode, error) {
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, dnsmessage.RCodeServerFailure, nil
+	}
+	answer, err := r.inner.Exchange(packed)
+	if err != nil {
+		return nil, 0, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(answer); err != nil {
+		return nil, 0, err
+	}
+	return resp.Answers, resp.RCode, nil
+}
@@ -0,0 +1,234 @@
+package tun2socks
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+// h2ConnectHandler tunnels every flow as a CONNECT stream over a shared
+// HTTP/2 connection to the proxy.
+type h2ConnectHandler struct {
+	proxyAddr   string
+	auth        string
+	header      http.Header
+	tlsConfig   *tls.Config
+	via         proxy.Dialer
+	dialTimeout time.Duration
+	transport   *http2.Transport
+
+	mu    sync.Mutex
+	conns []*http2.ClientConn
+	raw   map[*http2.ClientConn]net.Conn
+}
+
+func newH2ConnectHandler(host string, port uint16, username string, password string, header http.Header, tlsConfig *tls.Config, via proxy.Dialer, dialTimeout time.Duration) outbound {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+
+	var auth string
+	if username != "" || password != "" {
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	// HTTP/2 has no connection-specific headers.
+	header = header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	for _, name := range []string{"Connection", "Proxy-Connection", "Keep-Alive", "Upgrade"} {
+		header.Del(name)
+	}
+
+	return &h2ConnectHandler{
+		proxyAddr:   net.JoinHostPort(host, strconv.Itoa(int(port))),
+		auth:        auth,
+		header:      header,
+		tlsConfig:   tlsConfig,
+		via:         via,
+		dialTimeout: dialTimeout,
+		transport: &http2.Transport{
+			ReadIdleTimeout: 30 * time.Second,
+			PingTimeout:     15 * time.Second,
+		},
+		raw: make(map[*http2.ClientConn]net.Conn),
+	}
+}
+
+func (h *h2ConnectHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(h, conn, target)
+}
+
+func (h *h2ConnectHandler) clientConn() (*http2.ClientConn, net.Conn, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	live := h.conns[:0]
+	for _, cc := range h.conns {
+		if cc.State().Closed {
+			delete(h.raw, cc)
+			continue
+		}
+		live = append(live, cc)
+	}
+	h.conns = live
+	for _, cc := range h.conns {
+		if cc.CanTakeNewRequest() {
+			return cc, h.raw[cc], nil
+		}
+	}
+
+	rc, err := dialServer(h.via, h.proxyAddr, h.dialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := tlsHandshake(rc, h.tlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conn.(*tls.Conn).ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		conn.Close()
+		return nil, nil, errors.New("proxy does not support http/2")
+	}
+	cc, err := h.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	h.conns = append(h.conns, cc)
+	h.raw[cc] = conn
+	return cc, conn, nil
+}
+
+func (h *h2ConnectHandler) Dial(network string, addr string) (net.Conn, error) {
+	cc, raw, err := h.clientConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	req := (&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: h.header.Clone(),
+		Body:   pr,
+	}).WithContext(ctx)
+	if h.auth != "" {
+		req.Header.Set("Proxy-Authorization", h.auth)
+	}
+
+	timer := time.AfterFunc(time.Duration(handshakeTimeout.Load()), cancel)
+	resp, err := cc.RoundTrip(req)
+	if !timer.Stop() && err != nil {
+		err = fmt.Errorf("connect %s: %w", addr, os.ErrDeadlineExceeded)
+	}
+	if err != nil {
+		cancel()
+		pw.Close()
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		cancel()
+		pw.Close()
+		return nil, &connectStatusError{status: resp.StatusCode}
+	}
+
+	return &h2Conn{
+		reader: resp.Body,
+		writer: pw,
+		cancel: cancel,
+		local:  raw.LocalAddr(),
+		remote: raw.RemoteAddr(),
+	}, nil
+}
+
+func (h *h2ConnectHandler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, cc := range h.conns {
+		cc.Close()
+	}
+	h.conns = nil
+	clear(h.raw)
+	return nil
+}
+
+func (h *h2ConnectHandler) shutdown() {
+	h.mu.Lock()
+	conns := h.conns
+	h.mu.Unlock()
+
+	for _, cc := range conns {
+		go cc.Shutdown(context.Background())
+	}
+}
+
+// networkChanged retires the connections opened on the previous network.
+// Their streams may finish, but new ones go over a fresh connection.
+func (h *h2ConnectHandler) networkChanged() {
+	h.mu.Lock()
+	conns := h.conns
+	h.conns = nil
+	for _, cc := range conns {
+		delete(h.raw, cc)
+	}
+	h.mu.Unlock()
+
+	for _, cc := range conns {
+		go cc.Shutdown(context.Background())
+	}
+}
+
+type h2Conn struct {
+	reader io.ReadCloser
+	writer *io.PipeWriter
+	cancel context.CancelFunc
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *h2Conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *h2Conn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+func (c *h2Conn) Close() error {
+	c.writer.Close()
+	c.reader.Close()
+	c.cancel()
+	return nil
+}
+
+func (c *h2Conn) CloseRead() error {
+	return c.reader.Close()
+}
+
+func (c *h2Conn) CloseWrite() error {
+	return c.writer.Close()
+}
+
+func (c *h2Conn) LocalAddr() net.Addr                { return c.local }
+func (c *h2Conn) RemoteAddr() net.Addr               { return c.remote }
+func (c *h2Conn) SetDeadline(t time.Time) error      { return nil }
+func (c *h2Conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *h2Conn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,240 @@
+package tun2socks
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	maxAuthRounds    = 4
+	maxChallengeBody = 64 << 10
+)
+
+var httpAuthSchemes = map[string]bool{"": true, "basic": true, "digest": true, "ntlm": true, "negotiate": true}
+
+// proxyAuth answers the 407 challenges of an HTTP proxy for one CONNECT.
+// Without a fixed scheme Basic credentials are sent up front, as before,
+// and whatever scheme the proxy asks for next is answered. A fixed scheme
+// never sends Basic, so the password does not cross the network in clear.
+type proxyAuth struct {
+	username string
+	password string
+	scheme   string
+	rounds   int
+	sent     string
+}
+
+func newProxyAuth(username string, password string, scheme string) *proxyAuth {
+	return &proxyAuth{username: username, password: password, scheme: strings.ToLower(scheme)}
+}
+
+// first returns the Proxy-Authorization value of the initial request.
+func (a *proxyAuth) first() string {
+	if a.username == "" && a.password == "" {
+		return ""
+	}
+	switch a.scheme {
+	case "", "basic":
+		a.sent = "basic"
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.username+":"+a.password))
+	case "ntlm", "negotiate":
+		// NTLM starts with the client, which saves a round trip.
+		a.sent = "ntlm"
+		return ntlmScheme(a.scheme) + " " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage())
+	}
+	return ""
+}
+
+// next answers a failed CONNECT. Anything but a 407 the credentials can
+// answer is returned as the proxy's error.
+func (a *proxyAuth) next(resp *http.Response, target string) (string, error) {
+	failed := &connectStatusError{status: resp.StatusCode}
+	a.rounds++
+	if resp.StatusCode != http.StatusProxyAuthRequired || a.rounds >= maxAuthRounds || (a.username == "" && a.password == "") {
+		return "", failed
+	}
+
+	challenges := map[string]string{}
+	for _, value := range resp.Header.Values("Proxy-Authenticate") {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(value), " ")
+		challenges[strings.ToLower(scheme)] = strings.TrimSpace(params)
+	}
+
+	switch a.sent {
+	case "ntlm":
+		token, ok := challenges[a.scheme]
+		if !ok || token == "" {
+			return "", failed
+		}
+		return a.ntlm(token)
+	case "ntlm-done":
+		return "", failed
+	}
+	for _, scheme := range []string{"ntlm", "negotiate", "digest", "basic"} {
+		params, ok := challenges[scheme]
+		if !ok || (a.scheme != "" && a.scheme != scheme) {
+			continue
+		}
+		switch scheme {
+		case "ntlm", "negotiate":
+			// Negotiate is answered with raw NTLM tokens, which proxies
+			// accept in place of Kerberos.
+			a.scheme, a.sent = scheme, "ntlm"
+			return ntlmScheme(scheme) + " " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()), nil
+		case "digest":
+			p := parseAuthParams(params)
+			if a.sent == "digest" && !strings.EqualFold(p["stale"], "true") {
+				return "", failed
+			}
+			a.sent = "digest"
+			return digestAuthorization(p, a.username, a.password, http.MethodConnect, target)
+		case "basic":
+			if a.sent == "basic" {
+				return "", failed
+			}
+			a.sent = "basic"
+			return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.username+":"+a.password)), nil
+		}
+	}
+	return "", failed
+}
+
+func (a *proxyAuth) ntlm(token string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid ntlm challenge", errProxyAuth)
+	}
+	challenge, err := parseNTLMChallenge(data)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errProxyAuth, err)
+	}
+	msg, err := ntlmAuthenticateMessage(challenge, a.username, a.password)
+	if err != nil {
+		return "", err
+	}
+	a.sent = "ntlm-done"
+	return ntlmScheme(a.scheme) + " " + base64.StdEncoding.EncodeToString(msg), nil
+}
+
+func ntlmScheme(scheme string) string {
+	if scheme == "negotiate" {
+		return "Negotiate"
+	}
+	return "NTLM"
+}
+
+// digestAuthorization answers a Digest challenge as in RFC 7616, with the
+// MD5 and SHA-256 algorithms and qop auth.
+func digestAuthorization(p map[string]string, username string, password string, method string, uri string) (string, error) {
+	algorithm := p["algorithm"]
+	sess := strings.HasSuffix(strings.ToUpper(algorithm), "-SESS")
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("%w: unsupported digest algorithm %q", errProxyAuth, algorithm)
+	}
+	digest := func(parts ...string) string {
+		h := newHash()
+		io.WriteString(h, strings.Join(parts, ":"))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	var raw [12]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(raw[:])
+	nonce := p["nonce"]
+	ha1 := digest(username, p["realm"], password)
+	if sess {
+		ha1 = digest(ha1, nonce, cnonce)
+	}
+	ha2 := digest(method, uri)
+
+	qop := ""
+	for _, q := range strings.Split(p["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	var response string
+	if qop != "" {
+		response = digest(ha1, nonce, "00000001", cnonce, qop, ha2)
+	} else {
+		response = digest(ha1, nonce, ha2)
+	}
+
+	fields := []string{
+		fmt.Sprintf("username=%q", username),
+		fmt.Sprintf("realm=%q", p["realm"]),
+		fmt.Sprintf("nonce=%q", nonce),
+		fmt.Sprintf("uri=%q", uri),
+		fmt.Sprintf("response=%q", response),
+	}
+	if algorithm != "" {
+		fields = append(fields, "algorithm="+algorithm)
+	}
+	if opaque, ok := p["opaque"]; ok {
+		fields = append(fields, fmt.Sprintf("opaque=%q", opaque))
+	}
+	if qop != "" {
+		fields = append(fields, "qop="+qop, "nc=00000001", fmt.Sprintf("cnonce=%q", cnonce))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
+
+// parseAuthParams splits the comma separated key=value pairs of a
+// challenge. Values may be quoted.
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimSpace(rest)
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value, s = b.String(), rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// drainChallenge reads the body of a 407 so the connection can carry the
+// next attempt. It reports false when the proxy is closing the connection
+// or the body only ends with it.
+func drainChallenge(resp *http.Response) bool {
+	if resp.Close || (resp.ContentLength < 0 && len(resp.TransferEncoding) == 0) {
+		return false
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxChallengeBody+1))
+	return err == nil && n <= maxChallengeBody
+}
@@ -0,0 +1,159 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	icmpOff   = "off"
+	icmpLocal = "local"
+	icmpProxy = "proxy"
+
+	maxPingProbes = 16
+)
+
+var icmpModes = map[string]bool{
+	"":        true,
+	icmpOff:   true,
+	icmpLocal: true,
+	icmpProxy: true,
+}
+
+// pingSettings says how echo requests are answered. drop swallows them
+// unanswered, since lwIP would answer every one itself. A nil value, with
+// WireGuard, hands them on.
+type pingSettings struct {
+	drop    bool
+	target  string
+	timeout time.Duration
+}
+
+var (
+	pingConfig atomic.Pointer[pingSettings]
+	pingProbes = make(chan struct{}, maxPingProbes)
+)
+
+// configureICMP decides how echo requests from the TUN side are answered.
+// By default they are not. Locally every destination looks reachable; in
+// proxy mode a reply is only sent once a TCP connection to the proxy server
+// succeeds, so ping measures the path to the proxy. WireGuard carries ICMP
+// itself.
+func configureICMP(mode string, proxy proxyConfig, timeout time.Duration) {
+	if proxy.Type == "wireguard" {
+		pingConfig.Store(nil)
+		return
+	}
+	settings := &pingSettings{timeout: timeout}
+	switch mode {
+	case icmpLocal:
+	case icmpProxy:
+		if proxy.Host != "" && proxy.Port > 0 {
+			settings.target = net.JoinHostPort(proxy.Host, strconv.Itoa(proxy.Port))
+		}
+	default:
+		settings.drop = true
+	}
+	pingConfig.Store(settings)
+}
+
+// handlePing reports whether packet is an echo request that was handled
+// here, answered or dropped, and must not enter the stack. Requests
+// between other than unicast addresses are dropped, since a reply would
+// claim to come from a group or broadcast address.
+func handlePing(packet []byte) bool {
+	settings := pingConfig.Load()
+	if settings == nil || len(packet) < 1 {
+		return false
+	}
+
+	var reply []byte
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < 20 || len(packet) < ihl+8 || packet[9] != ipProtoICMP || binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 {
+			return false
+		}
+		if packet[ihl] != 8 {
+			return false
+		}
+		if settings.drop || !unicastPing(netip.AddrFrom4([4]byte(packet[12:16])), netip.AddrFrom4([4]byte(packet[16:20]))) {
+			return true
+		}
+		reply = echoReplyV4(packet, ihl)
+	case 6:
+		if len(packet) < 48 || packet[6] != ipProtoICMPv6 || packet[40] != 128 {
+			return false
+		}
+		if settings.drop || !unicastPing(netip.AddrFrom16([16]byte(packet[8:24])), netip.AddrFrom16([16]byte(packet[24:40]))) {
+			return true
+		}
+		reply = echoReplyV6(packet)
+	default:
+		return false
+	}
+
+	if settings.target == "" {
+		writeOutput(reply)
+		return true
+	}
+	select {
+	case pingProbes <- struct{}{}:
+	default:
+		return true
+	}
+	go func() {
+		defer func() { <-pingProbes }()
+		conn, err := dialTCP(settings.target, settings.timeout)
+		if err != nil {
+			logger.Debug("ping probe failed", "proxy", settings.target, "error", err)
+			return
+		}
+		conn.Close()
+		writeOutput(reply)
+	}()
+	return true
+}
+
+func unicastPing(src netip.Addr, dst netip.Addr) bool {
+	for _, addr := range []netip.Addr{src, dst} {
+		if addr.IsUnspecified() || isMulticastAddr(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func echoReplyV4(packet []byte, ihl int) []byte {
+	out := make([]byte, len(packet))
+	copy(out, packet)
+	copy(out[12:16], packet[16:20])
+	copy(out[16:20], packet[12:16])
+	out[8] = 64
+	out[10], out[11] = 0, 0
+	binary.BigEndian.PutUint16(out[10:], checksum(out[:ihl], 0))
+
+	icmp := out[ihl:]
+	icmp[0] = 0 // echo reply
+	icmp[2], icmp[3] = 0, 0
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, 0))
+	return out
+}
+
+func echoReplyV6(packet []byte) []byte {
+	out := make([]byte, len(packet))
+	copy(out, packet)
+	copy(out[8:24], packet[24:40])
+	copy(out[24:40], packet[8:24])
+	out[7] = 64
+
+	icmp := out[40:]
+	icmp[0] = 129 // echo reply
+	icmp[2], icmp[3] = 0, 0
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, ipv6PseudoSum(out, len(icmp))))
+	return out
+}
@@ -0,0 +1,171 @@
+package tun2socks
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	tcpIdleTimeout   atomic.Int64
+	udpIdleTimeout   atomic.Int64
+	handshakeTimeout atomic.Int64
+	tcpLingerTimeout atomic.Int64
+
+	classIdleTimeouts atomic.Pointer[map[string]time.Duration]
+
+	clockBase = time.Now()
+)
+
+// monotonic returns nanoseconds on the monotonic clock, unaffected by wall
+// clock changes.
+func monotonic() int64 {
+	return int64(time.Since(clockBase))
+}
+
+func configureIdle(cfg timeoutConfig) {
+	tcpIdleTimeout.Store(int64(cfg.tcpIdle()))
+	classes := make(map[string]time.Duration, len(defaultClassIdle))
+	for class, d := range defaultClassIdle {
+		classes[class] = d
+		if ms := cfg.TCPIdleByClass[class]; ms > 0 {
+			classes[class] = time.Duration(ms) * time.Millisecond
+		}
+	}
+	classIdleTimeouts.Store(&classes)
+	udpIdleTimeout.Store(int64(cfg.udpIdle()))
+	handshakeTimeout.Store(int64(cfg.handshake()))
+	tcpLingerTimeout.Store(int64(time.Duration(cfg.LingerMs) * time.Millisecond))
+}
+
+// handshakeDeadline is when a proxy handshake started now must be done.
+func handshakeDeadline() time.Time {
+	return time.Now().Add(time.Duration(handshakeTimeout.Load()))
+}
+
+// watchIdle calls onIdle once no bytes have moved through record in either
+// direction for its idle timeout, which may change while the flow runs.
+// The returned function stops the watch.
+func watchIdle(record *connRecord, onIdle func()) func() {
+	timeout := record.idleTimeout()
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	var stopped atomic.Bool
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		if stopped.Load() {
+			return
+		}
+		timeout := record.idleTimeout()
+		if idle := record.idle(); idle < timeout {
+			timer.Reset(timeout - idle)
+			return
+		}
+		onIdle()
+	})
+
+	return func() {
+		stopped.Store(true)
+		timer.Stop()
+	}
+}
+
+// abortConn resets an lwIP connection so its PCB is freed right away
+// instead of lingering in a FIN handshake with an idle app.
+func abortConn(conn net.Conn) {
+	if a, ok := conn.(interface{ Abort() }); ok {
+		a.Abort()
+		return
+	}
+	conn.Close()
+}
+
+// Traffic classes of TCP flows, which get their own idle timeouts: a
+// single one either cuts long-lived sessions or keeps short ones open.
+const (
+	classHTTPS = "https"
+	classHTTP  = "http"
+	classSSH   = "ssh"
+	classMail  = "mail"
+	classDNS   = "dns"
+	classMQTT  = "mqtt"
+)
+
+// defaultClassIdle are the idle timeouts of the classes unless configured.
+// Flows of no class use tcpIdleMs.
+var defaultClassIdle = map[string]time.Duration{
+	classHTTPS: 5 * time.Minute,
+	classHTTP:  5 * time.Minute,
+	classSSH:   30 * time.Minute,
+	classMail:  30 * time.Minute,
+	classDNS:   time.Minute,
+	classMQTT:  30 * time.Minute,
+}
+
+var portClasses = map[uint16]string{
+	443: classHTTPS, 8443: classHTTPS,
+	80: classHTTP, 8080: classHTTP,
+	22: classSSH,
+	25: classMail, 110: classMail, 143: classMail, 465: classMail, 587: classMail, 993: classMail, 995: classMail,
+	53: classDNS, 853: classDNS,
+	1883: classMQTT, 8883: classMQTT,
+}
+
+// classifyPort returns the class of a flow to target by its well-known
+// port, or "".
+func classifyPort(target string) string {
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return ""
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return ""
+	}
+	return portClasses[uint16(n)]
+}
+
+// classifyPayload returns the class of a flow on another port from the
+// first bytes the app sent, or "".
+func classifyPayload(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("SSH-")):
+		return classSSH
+	case isMQTTConnect(data):
+		return classMQTT
+	case len(data) > 1 && data[0] == 0x16 && data[1] == 0x03:
+		return classHTTPS
+	case sniffHTTPHost(data) != "":
+		return classHTTP
+	}
+	return ""
+}
+
+// tcpIdleFor returns the idle timeout of a TCP flow of class.
+func tcpIdleFor(class string) time.Duration {
+	if classes := classIdleTimeouts.Load(); classes != nil {
+		if d, ok := (*classes)[class]; ok {
+			return d
+		}
+	}
+	return time.Duration(tcpIdleTimeout.Load())
+}
+
+// isMQTTConnect reports whether data starts with an MQTT CONNECT packet:
+// its fixed header, a remaining length of up to four bytes and the
+// protocol name of MQTT 3.1 or later.
+func isMQTTConnect(data []byte) bool {
+	if len(data) < 2 || data[0] != 0x10 {
+		return false
+	}
+	i := 1
+	for i < len(data) && i <= 4 && data[i]&0x80 != 0 {
+		i++
+	}
+	rest := data[min(i+1, len(data)):]
+	return bytes.HasPrefix(rest, []byte("\x00\x04MQTT")) || bytes.HasPrefix(rest, []byte("\x00\x06MQIsdp"))
+}
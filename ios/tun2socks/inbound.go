@@ -0,0 +1,333 @@
+package tun2socks
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+)
+
+const (
+	socks5CmdConnect        = 1
+	socks5ReplyUnreachable  = 4
+	socks5ReplyRefused      = 5
+	socks5ReplyUnsupported  = 7
+	socks5AuthNoAcceptable  = 0xff
+	inboundAcceptRetryDelay = 100 * time.Millisecond
+)
+
+type inboundConfig struct {
+	SOCKS string `json:"socks,omitempty"`
+	HTTP  string `json:"http,omitempty"`
+}
+
+// inboundServer accepts proxy clients on local listeners and sends their
+// connections through the same outbounds and routing as the TUN side.
+type inboundServer struct {
+	config    inboundConfig
+	dialer    *switchTCPHandler
+	listeners []net.Listener
+}
+
+// inbound is guarded by stateMu.
+var inbound *inboundServer
+
+// hostAddr is a target named by an inbound client, possibly a domain.
+type hostAddr string
+
+func (a hostAddr) Network() string { return "tcp" }
+func (a hostAddr) String() string  { return string(a) }
+
+// StartInbound serves SOCKS5 and HTTP proxy clients on the given listen
+// addresses, replacing listeners already running. Either address may be
+// empty. It holds until StopInbound, the next start or a reload.
+func StartInbound(socksAddr string, httpAddr string) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if !running {
+		return ErrNotRunning
+	}
+	return startInboundLocked(inboundConfig{SOCKS: socksAddr, HTTP: httpAddr})
+}
+
+// StopInbound closes the local listeners. Accepted connections keep
+// running until they finish or the tunnel stops.
+func StopInbound() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	stopInboundLocked()
+}
+
+func configureInbound(cfg *inboundConfig) error {
+	if cfg == nil {
+		stopInboundLocked()
+		return nil
+	}
+	if inbound != nil && inbound.config == *cfg {
+		return nil
+	}
+	return startInboundLocked(*cfg)
+}
+
+func startInboundLocked(cfg inboundConfig) error {
+	if tcpSwitch == nil {
+		return ErrUnsupported
+	}
+	stopInboundLocked()
+
+	s := &inboundServer{config: cfg, dialer: tcpSwitch}
+	for _, l := range []struct {
+		addr   string
+		handle func(net.Conn)
+	}{
+		{cfg.SOCKS, s.serveSOCKS},
+		{cfg.HTTP, s.serveHTTP},
+	} {
+		if l.addr == "" {
+			continue
+		}
+		ln, err := net.Listen("tcp", l.addr)
+		if err != nil {
+			s.close()
+			return err
+		}
+		s.listeners = append(s.listeners, ln)
+		go s.serve(ln, l.handle)
+	}
+	inbound = s
+	logger.Info("inbound started", "socks", cfg.SOCKS, "http", cfg.HTTP)
+	return nil
+}
+
+func stopInboundLocked() {
+	if inbound != nil {
+		inbound.close()
+		inbound = nil
+		logger.Info("inbound stopped")
+	}
+}
+
+func (s *inboundServer) close() {
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+}
+
+func (s *inboundServer) serve(ln net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Debug("inbound accept failed", "listen", ln.Addr(), "error", err)
+			time.Sleep(inboundAcceptRetryDelay)
+			continue
+		}
+		if draining.Load() {
+			conn.Close()
+			continue
+		}
+		go handle(conn)
+	}
+}
+
+func (s *inboundServer) serveSOCKS(conn net.Conn) {
+	conn.SetDeadline(handshakeDeadline())
+	cmd, target, err := acceptSOCKS5(conn)
+	if err != nil {
+		logger.Debug("inbound socks handshake failed", "client", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+	if cmd == socks5CmdBind {
+		s.serveBind(conn, target)
+		return
+	}
+
+	upstream, err := s.dial(target)
+	if err != nil {
+		reply := byte(socks5ReplyUnreachable)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			reply = socks5ReplyRefused
+		}
+		conn.Write([]byte{socks5Version, reply, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write([]byte{socks5Version, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.relay(conn, upstream, target)
+}
+
+// serveBind has the outbound accept a connection from target for the
+// client. The client gets one reply with the bound address and another
+// with the peer's once it connected.
+func (s *inboundServer) serveBind(conn net.Conn, target string) {
+	b, err := s.dialer.Bind(target)
+	if err != nil {
+		logger.Warn("bind failed", "target", target, "error", err)
+		reportError("tcp", target, err)
+		reply := byte(socks5ReplyUnreachable)
+		if errors.Is(err, errBindUnsupported) {
+			reply = socks5ReplyUnsupported
+		}
+		conn.Write(socks5Reply(reply, ""))
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write(socks5Reply(0, b.bound)); err != nil {
+		conn.Close()
+		b.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	upstream, peer, err := b.accept(bindAcceptTimeout)
+	if err != nil {
+		conn.Write(socks5Reply(socks5ReplyUnreachable, ""))
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write(socks5Reply(0, peer)); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	s.relay(conn, upstream, peer)
+}
+
+// socks5Reply builds a reply carrying addr, or the unspecified IPv4
+// address when addr is empty or unparsable.
+func socks5Reply(reply byte, addr string) []byte {
+	a := socks.ParseAddr(addr)
+	if a == nil {
+		a = socks.Addr{1, 0, 0, 0, 0, 0, 0}
+	}
+	return append([]byte{socks5Version, reply, 0}, a...)
+}
+
+// acceptSOCKS5 runs the server side of a SOCKS5 handshake without
+// authentication and returns the requested command and target.
+func acceptSOCKS5(conn net.Conn) (byte, string, error) {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return 0, "", err
+	}
+	if buf[0] != socks5Version {
+		return 0, "", errors.New("unexpected socks version")
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return 0, "", err
+	}
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if m == socks5AuthNone {
+			method = socks5AuthNone
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return 0, "", err
+	}
+	if method != socks5AuthNone {
+		return 0, "", errors.New("client offers no usable authentication method")
+	}
+
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return 0, "", err
+	}
+	addr, err := readSocksAddr(conn)
+	if err != nil {
+		return 0, "", err
+	}
+	if buf[1] != socks5CmdConnect && buf[1] != socks5CmdBind {
+		conn.Write([]byte{socks5Version, socks5ReplyUnsupported, 0, 1, 0, 0, 0, 0, 0, 0})
+		return 0, "", errors.New("only socks5 connect and bind are supported")
+	}
+	return buf[1], addr.String(), nil
+}
+
+func (s *inboundServer) serveHTTP(conn net.Conn) {
+	conn.SetDeadline(handshakeDeadline())
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	target := req.Host
+	if req.Method != http.MethodConnect {
+		if req.URL.Host == "" {
+			io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+			conn.Close()
+			return
+		}
+		target = req.URL.Host
+		if req.URL.Port() == "" {
+			target = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	}
+
+	upstream, err := s.dial(target)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		conn.Close()
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	} else {
+		// One request per connection: the next one may be for another
+		// host, so the origin is asked to close after its response.
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// Keeps Request.Write from adding its own.
+			req.Header["User-Agent"] = nil
+		}
+		req.Close = true
+		err = req.Write(upstream)
+	}
+	if err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.relay(&bufferedConn{halfCloser: halfCloser{conn}, reader: reader}, upstream, target)
+}
+
+func (s *inboundServer) dial(target string) (net.Conn, error) {
+	upstream, err := dialWithRetry(s.dialer, "tcp", target)
+	if err != nil {
+		logger.Warn("dial failed", "target", target, "error", err)
+		reportError("tcp", target, err)
+		return nil, err
+	}
+	return upstream, nil
+}
+
+func (s *inboundServer) relay(conn net.Conn, upstream net.Conn, target string) {
+	record := openConn("tcp", conn.RemoteAddr(), hostAddr(target))
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		if _, err := netip.ParseAddr(host); err != nil {
+			record.setHost(host)
+		}
+	}
+	relayConn(conn, upstream, record)
+}
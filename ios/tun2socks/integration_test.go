@@ -0,0 +1,1911 @@
+package tun2socks
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestTCPThroughProxy(t *testing.T) {
+	tests := []struct {
+		name      string
+		proxyType string
+		server    func(t *testing.T, username string, password string) *testServer
+		username  string
+		password  string
+	}{
+		{name: "socks5", proxyType: "socks5", server: newSOCKS5Server},
+		{name: "socks5 auth", proxyType: "socks5", server: newSOCKS5Server, username: "user", password: "secret"},
+		{name: "http", proxyType: "http", server: newHTTPServer},
+		{name: "http auth", proxyType: "http", server: newHTTPServer, username: "user", password: "secret"},
+		{name: "shadowsocks aes-256-gcm", proxyType: "shadowsocks", server: newShadowsocksServer, username: "aes-256-gcm", password: "secret"},
+		{name: "shadowsocks chacha20", proxyType: "shadowsocks", server: newShadowsocksServer, username: "chacha20-ietf-poly1305", password: "secret"},
+		{name: "vmess", proxyType: "vmess", server: newVMessServer, username: testUUID},
+		{name: "vless", proxyType: "vless", server: newVLESSServer, username: testUUID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := tt.server(t, tt.username, tt.password)
+			feeder := newTunFeeder(t)
+			startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, proxyJSON(tt.proxyType, server)))
+
+			target := testTarget(8080)
+			conn, err := feeder.dialTCP(target)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			for _, msg := range []string{"hello", "through the tunnel"} {
+				conn.write([]byte(msg))
+				got, err := conn.read(len(msg))
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				if !bytes.Equal(got, []byte(msg)) {
+					t.Fatalf("echo = %q, want %q", got, msg)
+				}
+			}
+			conn.close()
+			if seen := server.seen(); !slices.Equal(seen, []string{target}) {
+				t.Errorf("proxy saw %v, want [%s]", seen, target)
+			}
+		})
+	}
+}
+
+func TestStackTCPBuffers(t *testing.T) {
+	tests := []struct {
+		name     string
+		stack    string
+		window   uint16
+		inFlight int
+	}{
+		{name: "default", window: 32 * 1024, inFlight: 4380},
+		{name: "small", stack: `, "stack": {"tcpWindow": 8192, "tcpSendBuffer": 2920}`, window: 8192, inFlight: 2920},
+		{name: "large", stack: `, "stack": {"tcpWindow": 65535, "tcpSendBuffer": 65535}`, window: 65535, inFlight: 4380},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newSOCKS5Server(t, "", "")
+			feeder := newTunFeeder(t)
+			// A 1460-byte MSS opens the congestion window to 4380 bytes,
+			// three full segments.
+			feeder.mss = 1460
+			startTestTunnel(t, fmt.Sprintf(`{"proxy": %s%s}`, proxyJSON("socks5", server), tt.stack))
+
+			conn, err := feeder.dialTCP(testTarget(8080))
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			if conn.window != tt.window {
+				t.Errorf("SYN-ACK window = %d, want %d", conn.window, tt.window)
+			}
+
+			// Send 4380 bytes and leave the echo unacknowledged: the stack
+			// keeps at most its send buffer in flight.
+			conn.write(bytes.Repeat([]byte("x"), 4380))
+			feeder.wait = 500 * time.Millisecond
+			start, end := conn.ack, conn.ack
+			for {
+				p, err := feeder.next(ipProtoTCP, conn.src, conn.dst)
+				if err != nil {
+					break
+				}
+				if p.seq == end {
+					end += uint32(len(p.payload))
+				}
+			}
+			if got := int(end - start); got != tt.inFlight {
+				t.Errorf("unacknowledged bytes = %d, want %d", got, tt.inFlight)
+			}
+
+			conn.ack = end
+			conn.send(tcpFlagACK, nil)
+			feeder.wait = testTimeout
+			if _, err := conn.read(4380 - int(end-start)); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			conn.close()
+		})
+	}
+}
+
+func TestKCPTransport(t *testing.T) {
+	server := newKCPServer(t, "secret")
+	feeder := newTunFeeder(t)
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": {"type": "socks5", "host": "127.0.0.1", "port": %d, "transport": {"type": "kcp", "kcp": {"key": "secret", "mode": "fast3"}}}}`, server.port()))
+
+	targets := []string{testTarget(8080), testTarget(8081)}
+	for _, target := range targets {
+		conn, err := feeder.dialTCP(target)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.write([]byte("over kcp"))
+		got, err := conn.read(8)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(got) != "over kcp" {
+			t.Fatalf("echo = %q", got)
+		}
+		conn.close()
+	}
+	if seen := server.seen(); !slices.Equal(seen, targets) {
+		t.Errorf("proxy saw %v, want %v", seen, targets)
+	}
+}
+
+func TestTCPRejectedByProxy(t *testing.T) {
+	server := newSOCKS5Server(t, "user", "secret")
+	feeder := newTunFeeder(t)
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": {"type": "socks5", "host": "127.0.0.1", "port": %d, "username": "user", "password": "wrong"}}`, server.port()))
+
+	conn, err := feeder.dialTCP(testTarget(8080))
+	if err != nil {
+		// The stack may refuse the handshake once the proxy has failed.
+		if !errors.Is(err, errReset) {
+			t.Fatalf("dial: %v", err)
+		}
+		return
+	}
+	conn.write([]byte("hello"))
+	if _, err := conn.read(1); err == nil {
+		t.Fatal("read succeeded through a proxy that refused the credentials")
+	}
+	if len(server.seen()) != 0 {
+		t.Errorf("proxy connected %v", server.seen())
+	}
+}
+
+func TestRoutingBlock(t *testing.T) {
+	server := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	startTestTunnel(t, fmt.Sprintf(`{
+		"proxy": %s,
+		"routing": {"rules": [{"type": "ip-cidr", "value": "198.51.100.0/24", "outbound": "block"}]}
+	}`, proxyJSON("socks5", server)))
+
+	conn, err := feeder.dialTCP(testTarget(8080))
+	if err == nil {
+		conn.write([]byte("hello"))
+		_, err = conn.read(1)
+	}
+	if err == nil {
+		t.Fatal("blocked flow relayed data")
+	}
+	if len(server.seen()) != 0 {
+		t.Errorf("proxy saw blocked flow %v", server.seen())
+	}
+	if n := stats.blockedFlows.Load(); n != 1 {
+		t.Errorf("blockedFlows = %d, want 1", n)
+	}
+}
+
+func TestUDPThroughSOCKS5(t *testing.T) {
+	server := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", server)))
+
+	target := testTarget(7000)
+	for _, msg := range []string{"ping", "pong"} {
+		got, err := feeder.exchangeUDP(target, []byte(msg))
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		if string(got) != msg {
+			t.Fatalf("echo = %q, want %q", got, msg)
+		}
+	}
+	if seen := server.seen(); !slices.Contains(seen, "udp/"+target) {
+		t.Errorf("proxy saw %v, want udp/%s", seen, target)
+	}
+}
+
+func TestShadowsocks(t *testing.T) {
+	for _, method := range []string{"aes-256-gcm", "chacha20-ietf-poly1305"} {
+		t.Run(method, func(t *testing.T) {
+			server := newShadowsocksServer(t, method, "secret")
+			feeder := newTunFeeder(t)
+			startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, proxyJSON("shadowsocks", server)))
+
+			target := testTarget(7000)
+			for _, msg := range []string{"ping", "pong"} {
+				got, err := feeder.exchangeUDP(target, []byte(msg))
+				if err != nil {
+					t.Fatalf("exchange: %v", err)
+				}
+				if string(got) != msg {
+					t.Fatalf("echo = %q, want %q", got, msg)
+				}
+			}
+			if seen := server.seen(); !slices.Contains(seen, "udp/"+target) {
+				t.Errorf("server saw %v, want udp/%s", seen, target)
+			}
+
+			// A stream longer than one chunk is split and read back whole.
+			c, err := newSSCipher(method, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := newShadowsocksTCPHandler("127.0.0.1", uint16(server.port()), c, nil, nil, testTimeout).Dial("tcp", testTarget(8080))
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			payload := make([]byte, 3*ssMaxPayload+100)
+			rand.Read(payload)
+			go conn.Write(payload)
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatal("stream came back changed")
+			}
+		})
+	}
+}
+
+const testUUID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+func TestVMess(t *testing.T) {
+	for _, security := range []string{"aes-128-gcm", "chacha20-poly1305", "none"} {
+		t.Run(security, func(t *testing.T) {
+			server := newVMessServer(t, testUUID, "")
+			ob, err := newVMessTCPHandler("127.0.0.1", uint16(server.port()), testUUID, security, nil, nil, testTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := "example.com:443"
+			conn, err := ob.Dial("tcp", target)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+
+			// More than one chunk each way, then the end of the stream.
+			payload := make([]byte, 3*vmessMaxChunk+100)
+			rand.Read(payload)
+			go func() {
+				conn.Write(payload)
+				conn.(interface{ CloseWrite() error }).CloseWrite()
+			}()
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("stream came back with %d bytes, want the %d sent", len(got), len(payload))
+			}
+			if seen := server.seen(); !slices.Equal(seen, []string{target}) {
+				t.Errorf("server saw %v, want [%s]", seen, target)
+			}
+		})
+	}
+}
+
+func TestHTTPProxyAuth(t *testing.T) {
+	// The server side is checked against the examples of RFC 7616 3.9.1
+	// and MS-NLMP 4.2.4 first.
+	const (
+		nonce  = "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+		cnonce = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+	)
+	for algorithm, want := range map[string]string{
+		"MD5":     "8ca523f5e9506fed4657c9700eebdbec",
+		"SHA-256": "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+	} {
+		got := testDigest(algorithm, "Mufasa", "http-auth@example.org", "Circle of Life", "GET", "/dir/index.html", nonce, "00000001", cnonce, "auth")
+		if got != want {
+			t.Fatalf("%s digest = %s, want %s", algorithm, got, want)
+		}
+	}
+	temp, _ := hex.DecodeString("0101000000000000" + "0000000000000000" + "aaaaaaaaaaaaaaaa" + "00000000" +
+		"02000c0044006f006d00610069006e00" + "01000c0053006500720076006500720000000000" + "00000000")
+	challenge, _ := hex.DecodeString("0123456789abcdef")
+	if got := hex.EncodeToString(testNTProofStr("Password", "User", "Domain", challenge, temp)); got != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Fatalf("NTProofStr = %s", got)
+	}
+
+	tests := []struct {
+		name     string
+		scheme   string
+		httpAuth string
+		username string
+	}{
+		{name: "digest md5", scheme: "digest MD5", httpAuth: "digest", username: "user"},
+		{name: "digest sha-256", scheme: "digest SHA-256", httpAuth: "digest", username: "user"},
+		{name: "digest md5-sess", scheme: "digest MD5-sess", username: "user"},
+		{name: "ntlm", scheme: "ntlm", httpAuth: "ntlm", username: `CORP\user`},
+		{name: "ntlm answered", scheme: "ntlm", username: `CORP\user`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newHTTPAuthServer(t, tt.scheme, tt.username, "secret")
+			ob := strings.TrimSuffix(proxyJSON("http", server), "}") + fmt.Sprintf(`, "httpAuth": %q}`, tt.httpAuth)
+			feeder := newTunFeeder(t)
+			startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, ob))
+
+			target := testTarget(8080)
+			conn, err := feeder.dialTCP(target)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			conn.write([]byte("hello"))
+			if got, err := conn.read(5); err != nil || string(got) != "hello" {
+				t.Fatalf("echo = %q, %v", got, err)
+			}
+			conn.close()
+			if seen := server.seen(); !slices.Equal(seen, []string{target}) {
+				t.Errorf("proxy saw %v, want [%s]", seen, target)
+			}
+		})
+	}
+}
+
+func TestUDPOverTCP(t *testing.T) {
+	// 198.51.100.1:7000 is framed as family 0, the address and the port.
+	if got := hex.EncodeToString(uotAddr(net.UDPAddrFromAddrPort(netip.MustParseAddrPort(testTarget(7000))))); got != "00c63364011b58" {
+		t.Fatalf("framed address = %s", got)
+	}
+
+	server := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	ob := strings.TrimSuffix(proxyJSON("socks5", server), "}") + `, "udpOverTCP": true}`
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, ob))
+
+	target := testTarget(7000)
+	for _, msg := range []string{"ping", "pong"} {
+		got, err := feeder.exchangeUDP(target, []byte(msg))
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		if string(got) != msg {
+			t.Fatalf("echo = %q, want %q", got, msg)
+		}
+	}
+	if seen := server.seen(); !slices.Equal(seen, []string{"udp/" + target, "udp/" + target}) {
+		t.Errorf("server saw %v, want udp/%s twice", seen, target)
+	}
+}
+
+func TestQUICBlockedWithoutUDPRelay(t *testing.T) {
+	server := newSOCKS5Server(t, "", "")
+	socks := proxyJSON("socks5", server)
+	ws := strings.TrimSuffix(socks, "}") + `, "transport": {"type": "ws", "path": "/"}}`
+	named := func(name string, ob string) string {
+		return strings.Replace(ob, "{", fmt.Sprintf(`{"name": %q, `, name), 1)
+	}
+	tests := []struct {
+		name    string
+		config  string
+		blocked bool
+	}{
+		{name: "socks5", config: fmt.Sprintf(`{"proxy": %s}`, socks)},
+		{name: "transport", config: fmt.Sprintf(`{"proxy": %s}`, ws), blocked: true},
+		{name: "udp over tcp", config: fmt.Sprintf(`{"proxy": %s}`, strings.TrimSuffix(ws, "}")+`, "udpOverTCP": true}`)},
+		{name: "group", config: fmt.Sprintf(`{"proxy": {"type": "fallback", "members": ["a", "direct"]}, "outbounds": [%s]}`, named("a", socks))},
+		{name: "group with transport member", config: fmt.Sprintf(`{"proxy": {"type": "fallback", "members": ["a", "b"]}, "outbounds": [%s, %s]}`,
+			named("a", socks), named("b", ws)), blocked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feeder := newTunFeeder(t)
+			startTestTunnel(t, tt.config)
+			if !tt.blocked {
+				if blockQUIC.Load() {
+					t.Error("QUIC blocked")
+				}
+				return
+			}
+			_, err := feeder.exchangeUDP("203.0.113.1:443", []byte("quic"))
+			var icmp *icmpError
+			if !errors.As(err, &icmp) || icmp.code != icmpv4PortUnreachable {
+				t.Errorf("got %v, want port unreachable", err)
+			}
+		})
+	}
+}
+
+func TestWireGuard(t *testing.T) {
+	clientKey, clientPub := wgTestKeys(t)
+	serverKey, serverPub := wgTestKeys(t)
+
+	// The peer is wireguard-go itself, echoing UDP back from behind its
+	// channel TUN.
+	peer := tuntest.NewChannelTUN()
+	server := device.NewDevice(peer.TUN(), conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(server.Close)
+	if err := server.IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=0\npublic_key=%s\nallowed_ip=%s/32\n",
+		hex.EncodeToString(serverKey), hex.EncodeToString(clientPub), tunAppAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Up(); err != nil {
+		t.Fatal(err)
+	}
+	uapi, err := server.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := strings.Cut(uapi, "listen_port=")
+	port, _, _ = strings.Cut(port, "\n")
+	go func() {
+		for data := range peer.Inbound {
+			p, ok := parseTestPacket(data)
+			if !ok || p.proto != ipProtoUDP {
+				continue
+			}
+			select {
+			case peer.Outbound <- buildUDP(p.dst, p.src, p.payload):
+			case <-t.Context().Done():
+				return
+			}
+		}
+	}()
+
+	feeder := newTunFeeder(t)
+	text := fmt.Sprintf("[Interface]\nPrivateKey = %s\n\n[Peer]\nPublicKey = %s\nEndpoint = 127.0.0.1:%s\n",
+		base64.StdEncoding.EncodeToString(clientKey), base64.StdEncoding.EncodeToString(serverPub), port)
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": {"type": "wireguard", "wireguard": %q}}`, text))
+
+	got, err := feeder.exchangeUDP("10.9.0.1:7000", []byte("ping"))
+	if err != nil || string(got) != "ping" {
+		t.Fatalf("exchange = %q, %v", got, err)
+	}
+
+	// After a network change the tunnel rebinds and the peer follows it.
+	if err := NotifyNetworkChange("wifi"); err != nil {
+		t.Fatal(err)
+	}
+	feeder.wait = time.Second
+	for attempt := 0; ; attempt++ {
+		got, err = feeder.exchangeUDP("10.9.0.1:7000", []byte("again"))
+		if err == nil && string(got) == "again" {
+			break
+		}
+		if attempt == 4 {
+			t.Fatalf("exchange after rebind = %q, %v", got, err)
+		}
+	}
+}
+
+// wgTestKeys returns a new WireGuard private key and its public key.
+func wgTestKeys(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	private := make([]byte, curve25519.ScalarSize)
+	rand.Read(private)
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private, public
+}
+
+func TestGroupDialTriesEachMemberOnce(t *testing.T) {
+	for _, kind := range []string{groupFallback, groupURLTest, groupLoadBalance} {
+		t.Run(kind, func(t *testing.T) {
+			g := &outboundGroup{name: "test", kind: kind, strategy: strategyHashing}
+			var members []*failingOutbound
+			for i := range 3 {
+				ob := &failingOutbound{}
+				members = append(members, ob)
+				// All members start down, as when every check failed.
+				g.members = append(g.members, &groupMember{name: fmt.Sprint(i), tcp: ob})
+			}
+			if _, err := g.Dial("tcp", "example.com:443"); err == nil {
+				t.Fatal("dial succeeded")
+			}
+			for i, ob := range members {
+				if n := ob.dials.Load(); n != 1 {
+					t.Errorf("member %d dialed %d times, want 1", i, n)
+				}
+			}
+		})
+	}
+}
+
+func TestTCPProbeTimeout(t *testing.T) {
+	ob := &stalledOutbound{release: make(chan struct{})}
+	defer close(ob.release)
+	u, err := parseProbeURL("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := probe(ob, "tcp", u, 100*time.Millisecond); err == nil {
+		t.Fatal("probe through a stalled outbound succeeded")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("probe took %v, want about the 100ms timeout", d)
+	}
+}
+
+// stalledOutbound never finishes a dial until released.
+type stalledOutbound struct {
+	release chan struct{}
+}
+
+func (o *stalledOutbound) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(o, conn, target)
+}
+
+func (o *stalledOutbound) Dial(network string, addr string) (net.Conn, error) {
+	<-o.release
+	return nil, errors.New("unreachable")
+}
+
+// failingOutbound fails every dial and counts them.
+type failingOutbound struct {
+	dials atomic.Int32
+}
+
+func (o *failingOutbound) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(o, conn, target)
+}
+
+func (o *failingOutbound) Dial(network string, addr string) (net.Conn, error) {
+	o.dials.Add(1)
+	return nil, errors.New("unreachable")
+}
+
+func TestUDPSessionsForgotten(t *testing.T) {
+	live := newSOCKS5Server(t, "", "")
+	dead := newSOCKS5Server(t, "", "")
+	dead.ln.Close()
+	tests := []struct {
+		name    string
+		server  *testServer
+		routing string
+	}{
+		{name: "fake-ip", server: live, routing: `"dns": {"intercept": true, "fakeIP": true}`},
+		{name: "closed", server: live},
+		{name: "connect failed", server: dead},
+		{name: "routed", server: live, routing: `"routing": {"final": "g"}`},
+		{name: "routed connect failed", server: dead, routing: `"routing": {"final": "g"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feeder := newTunFeeder(t)
+			config := fmt.Sprintf(`{
+				"proxy": {"type": "fallback", "members": ["a"]},
+				"outbounds": [
+					{"name": "a", "type": "socks5", "host": "127.0.0.1", "port": %d},
+					{"name": "g", "type": "fallback", "members": ["a"]}
+				]`, tt.server.port())
+			if tt.routing != "" {
+				config += ", " + tt.routing
+			}
+			startTestTunnel(t, config+"}")
+
+			feeder.wait = 3 * time.Second
+			feeder.exchangeUDP(testTarget(7000), []byte("ping"))
+			// Closing the flow ends the tracked session, not the wrappers
+			// of the handlers behind it.
+			var open []struct {
+				ID uint64 `json:"id"`
+			}
+			if err := json.Unmarshal([]byte(ListConnections()), &open); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range open {
+				CloseConnection(c.ID)
+			}
+			deadline := time.Now().Add(testTimeout)
+			for {
+				n := mappedUDPSessions()
+				if n == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("handlers still map %d sessions", n)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// mappedUDPSessions counts the sessions the handlers behind the tracking
+// layer keep wrappers for.
+func mappedUDPSessions() int {
+	udpSwitch.Lock()
+	handlers := []core.UDPConnHandler{udpSwitch.inner}
+	udpSwitch.Unlock()
+	n := 0
+	for len(handlers) > 0 {
+		h := handlers[0]
+		handlers = handlers[1:]
+		switch h := h.(type) {
+		case *multicastUDPHandler:
+			h.Lock()
+			n += len(h.conns)
+			h.Unlock()
+			handlers = append(handlers, h.inner)
+		case *dnsUDPHandler:
+			handlers = append(handlers, h.inner)
+		case *fakeIPUDPHandler:
+			h.Lock()
+			n += len(h.conns)
+			h.Unlock()
+			handlers = append(handlers, h.inner)
+		case *routedUDPHandler:
+			h.Lock()
+			n += len(h.conns)
+			h.Unlock()
+			for _, inner := range h.handlers {
+				handlers = append(handlers, inner)
+			}
+		case *groupUDPHandler:
+			h.Lock()
+			n += len(h.conns)
+			h.Unlock()
+		}
+	}
+	return n
+}
+
+func TestQueueConfigPerStart(t *testing.T) {
+	server := newSOCKS5Server(t, "", "")
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": %s, "queue": {"size": 16, "policy": "block", "deadlineMs": 5}}`, proxyJSON("socks5", server)))
+	stateMu.Lock()
+	size, policy, deadline := cap(outputQueue), queuePolicy, queueDeadline
+	stateMu.Unlock()
+	if size != 16 || policy != QueueBlock || deadline != 5*time.Millisecond {
+		t.Errorf("queue = %d, %d, %v; want the document's", size, policy, deadline)
+	}
+
+	// The next start without a queue block is back to the defaults.
+	Stop()
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", server)))
+	stateMu.Lock()
+	size, policy, deadline = cap(outputQueue), queuePolicy, queueDeadline
+	stateMu.Unlock()
+	if size != defaultQueueSize || policy != QueueDropNewest || deadline != defaultQueueDeadline {
+		t.Errorf("queue = %d, %d, %v; want the defaults", size, policy, deadline)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	server := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", server)))
+
+	conn, err := feeder.dialTCP(testTarget(8080))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.write([]byte("hello"))
+	if _, err := conn.read(5); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var reports []int
+	remaining, err := Drain(100*time.Millisecond, func(n int) { reports = append(reports, n) })
+	if err != nil || remaining != 1 {
+		t.Fatalf("drain = %d, %v; want 1 flow left", remaining, err)
+	}
+	if !slices.Equal(reports, []int{1}) {
+		t.Errorf("reports = %v, want [1]", reports)
+	}
+
+	// The open flow still relays, new ones are refused.
+	conn.write([]byte("again"))
+	if got, err := conn.read(5); err != nil || string(got) != "again" {
+		t.Fatalf("read = %q, %v", got, err)
+	}
+	refused, err := feeder.dialTCP(testTarget(8081))
+	if err == nil {
+		refused.write([]byte("hello"))
+		_, err = refused.read(1)
+	}
+	if err == nil {
+		t.Error("a new flow was relayed while draining")
+	}
+
+	conn.close()
+	remaining, err = Drain(testTimeout, func(n int) { reports = append(reports, n) })
+	if err != nil || remaining != 0 {
+		t.Fatalf("drain = %d, %v; want none left", remaining, err)
+	}
+	if last := reports[len(reports)-1]; last != 0 {
+		t.Errorf("last report = %d, want 0", last)
+	}
+}
+
+func TestTunnelHandles(t *testing.T) {
+	server := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	config := fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", server))
+
+	first, err := NewTunnel(-1, config)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(Stop)
+	if _, err := NewTunnel(-1, config); !errors.Is(err, ErrAlreadyRunning) {
+		t.Fatalf("second start = %v, want ErrAlreadyRunning", err)
+	}
+	if got := TunnelFromHandle(first.Handle()); !got.Running() {
+		t.Fatal("handle does not find its running tunnel")
+	}
+	if got, err := feeder.exchangeUDP(testTarget(7000), []byte("ping")); err != nil || string(got) != "ping" {
+		t.Fatalf("exchange = %q, %v", got, err)
+	}
+
+	first.Stop()
+	second, err := NewTunnel(-1, config)
+	if err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	// The stale handle neither feeds nor stops the new tunnel.
+	if first.Running() || first.Input(buildUDP(netip.MustParseAddrPort("10.0.0.2:40000"), netip.MustParseAddrPort(testTarget(7000)), []byte("x"))) {
+		t.Fatal("stale handle acts on the new tunnel")
+	}
+	first.Stop()
+	if !second.Running() {
+		t.Fatal("stale handle stopped the new tunnel")
+	}
+	second.Stop()
+	if isRunning() {
+		t.Fatal("tunnel still running after stop")
+	}
+}
+
+func TestDrainThenReload(t *testing.T) {
+	first := newSOCKS5Server(t, "", "")
+	second := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", first)))
+
+	if _, err := Drain(10*time.Millisecond, nil); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	if err := Reload(fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", second))); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !strings.Contains(State(), `"state":"running"`) {
+		t.Errorf("state = %s, want running", State())
+	}
+
+	conn, err := feeder.dialTCP(testTarget(8080))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.close()
+	conn.write([]byte("hello"))
+	if got, err := conn.read(5); err != nil || string(got) != "hello" {
+		t.Fatalf("read = %q, %v", got, err)
+	}
+	if len(second.seen()) != 1 {
+		t.Errorf("new proxy saw %v, want the flow", second.seen())
+	}
+}
+
+func TestPingReplies(t *testing.T) {
+	server := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	payload := []byte("ping payload")
+	v4Dst := netip.MustParseAddr("198.51.100.1")
+
+	t.Run("off by default", func(t *testing.T) {
+		startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", server)))
+		feeder.wait = 300 * time.Millisecond
+		defer func() { feeder.wait = testTimeout }()
+		feeder.input(buildEchoRequest(tunAppAddr, v4Dst, 1, 1, payload))
+		if reply, err := feeder.nextFrom(v4Dst); err == nil {
+			t.Errorf("ping answered: % x", reply)
+		}
+	})
+
+	t.Run("local", func(t *testing.T) {
+		startTestTunnel(t, fmt.Sprintf(`{"proxy": %s, "icmp": "local"}`, proxyJSON("socks5", server)))
+		tests := []struct {
+			name     string
+			src, dst netip.Addr
+		}{
+			{name: "ipv4", src: tunAppAddr, dst: v4Dst},
+			{name: "ipv6", src: netip.MustParseAddr("fd00::2"), dst: netip.MustParseAddr("2001:db8::1")},
+		}
+		for _, tt := range tests {
+			request := buildEchoRequest(tt.src, tt.dst, 0x1234, 7, payload)
+			feeder.input(request)
+			reply, err := feeder.nextFrom(tt.dst)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if len(reply) != len(request) {
+				t.Fatalf("%s: reply of %d bytes, want %d", tt.name, len(reply), len(request))
+			}
+			var icmp, echoed []byte
+			if tt.src.Is4() {
+				if netip.AddrFrom4([4]byte(reply[16:20])) != tt.src || reply[8] != 64 || reply[9] != ipProtoICMP {
+					t.Errorf("%s: header % x", tt.name, reply[:20])
+				}
+				if sum := testChecksum(reply[:20], 0); sum != 0 {
+					t.Errorf("%s: ip header checksum off by %#x", tt.name, sum)
+				}
+				icmp, echoed = reply[20:], request[20:]
+				if icmp[0] != 0 || testChecksum(icmp, 0) != 0 {
+					t.Errorf("%s: icmp type %d, checksum off by %#x", tt.name, icmp[0], testChecksum(icmp, 0))
+				}
+			} else {
+				if netip.AddrFrom16([16]byte(reply[24:40])) != tt.src || reply[6] != ipProtoICMPv6 || reply[7] != 64 {
+					t.Errorf("%s: header % x", tt.name, reply[:40])
+				}
+				icmp, echoed = reply[40:], request[40:]
+				if icmp[0] != 129 || testChecksum(icmp, testPseudoSum6(reply)) != 0 {
+					t.Errorf("%s: icmp type %d, checksum off by %#x", tt.name, icmp[0], testChecksum(icmp, testPseudoSum6(reply)))
+				}
+			}
+			// Code, identifier, sequence number and data come back as sent.
+			if icmp[1] != 0 || !bytes.Equal(icmp[4:], echoed[4:]) {
+				t.Errorf("%s: reply body % x, want % x", tt.name, icmp[4:], echoed[4:])
+			}
+		}
+
+		// Requests to or from non-unicast addresses are dropped, even when
+		// the multicast filter lets them through.
+		feeder.wait = 300 * time.Millisecond
+		defer func() { feeder.wait = testTimeout }()
+		for _, addrs := range [][2]string{
+			{"10.0.0.2", "224.0.0.1"},
+			{"10.0.0.2", "255.255.255.255"},
+			{"0.0.0.0", "198.51.100.1"},
+			{"fd00::2", "ff02::1"},
+		} {
+			src, dst := netip.MustParseAddr(addrs[0]), netip.MustParseAddr(addrs[1])
+			if !handlePing(buildEchoRequest(src, dst, 1, 1, payload)) {
+				t.Errorf("ping from %s to %s passed to the stack", src, dst)
+			}
+			if reply, err := feeder.nextFrom(dst); err == nil {
+				t.Errorf("ping from %s to %s answered: % x", src, dst, reply)
+			}
+		}
+	})
+}
+
+func TestRejectModes(t *testing.T) {
+	tests := []struct {
+		mode    string
+		network string
+		// want is "reset", "icmp" or "" for no answer.
+		want string
+	}{
+		{mode: "reset", network: "tcp", want: "reset"},
+		{mode: "icmp", network: "tcp", want: "icmp"},
+		{mode: "drop", network: "tcp"},
+		{mode: "reset", network: "udp"},
+		{mode: "icmp", network: "udp", want: "icmp"},
+		{mode: "drop", network: "udp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.network, func(t *testing.T) {
+			server := newSOCKS5Server(t, "", "")
+			feeder := newTunFeeder(t)
+			startTestTunnel(t, fmt.Sprintf(`{
+				"proxy": %s,
+				"reject": %q,
+				"routing": {"rules": [{"type": "ip-cidr", "value": "198.51.100.0/24", "outbound": "block"}]}
+			}`, proxyJSON("socks5", server), tt.mode))
+			if tt.want == "" {
+				feeder.wait = 300 * time.Millisecond
+			}
+
+			var err error
+			if tt.network == "tcp" {
+				var conn *tunTCP
+				if conn, err = feeder.dialTCP(testTarget(8080)); err == nil {
+					conn.write([]byte("hello"))
+					_, err = conn.read(1)
+				}
+			} else {
+				_, err = feeder.exchangeUDP(testTarget(7000), []byte("hello"))
+			}
+
+			var icmp *icmpError
+			switch {
+			case tt.want == "reset" && !errors.Is(err, errReset):
+				t.Fatalf("got %v, want a reset", err)
+			case tt.want == "icmp" && (!errors.As(err, &icmp) || icmp.typ != 3 || icmp.code != icmpv4Prohibited):
+				t.Fatalf("got %v, want administratively prohibited", err)
+			case tt.want == "" && (err == nil || errors.Is(err, errReset) || errors.As(err, &icmp)):
+				t.Fatalf("got %v, want no answer", err)
+			}
+			if len(server.seen()) != 0 {
+				t.Errorf("proxy saw blocked flow %v", server.seen())
+			}
+		})
+	}
+}
+
+func TestDNSHosts(t *testing.T) {
+	server := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	startTestTunnel(t, fmt.Sprintf(`{
+		"proxy": %s,
+		"dns": {"intercept": true, "hosts": {
+			"staging.example.com": ["203.0.113.5", "2001:db8::5"],
+			"api.example.com": ["staging.example.com"],
+			"*.dev.example.com": ["10.0.0.5"],
+			"*.x.dev.example.com": ["10.0.0.6"]
+		}}
+	}`, proxyJSON("socks5", server)))
+
+	tests := []struct {
+		name  string
+		qtype dnsmessage.Type
+		want  []string
+	}{
+		{name: "staging.example.com", qtype: dnsmessage.TypeA, want: []string{"203.0.113.5"}},
+		{name: "Staging.Example.com", qtype: dnsmessage.TypeAAAA, want: []string{"2001:db8::5"}},
+		{name: "staging.example.com", qtype: dnsmessage.TypeTXT},
+		{name: "api.example.com", qtype: dnsmessage.TypeA, want: []string{"staging.example.com.", "203.0.113.5"}},
+		{name: "a.dev.example.com", qtype: dnsmessage.TypeA, want: []string{"10.0.0.5"}},
+		{name: "a.x.dev.example.com", qtype: dnsmessage.TypeA, want: []string{"10.0.0.6"}},
+	}
+	for i, tt := range tests {
+		query := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: uint16(i + 1), RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(tt.name + "."), Type: tt.qtype, Class: dnsmessage.ClassINET}},
+		}
+		packed, err := query.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer, err := feeder.exchangeUDP(testTarget(53), packed)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(answer); err != nil || resp.ID != query.ID || resp.RCode != dnsmessage.RCodeSuccess {
+			t.Fatalf("%s: bad response %v %v", tt.name, resp.Header, err)
+		}
+		var got []string
+		for _, a := range resp.Answers {
+			switch body := a.Body.(type) {
+			case *dnsmessage.AResource:
+				got = append(got, netip.AddrFrom4(body.A).String())
+			case *dnsmessage.AAAAResource:
+				got = append(got, netip.AddrFrom16(body.AAAA).String())
+			case *dnsmessage.CNAMEResource:
+				got = append(got, body.CNAME.String())
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s %v = %v, want %v", tt.name, tt.qtype, got, tt.want)
+		}
+	}
+	if len(server.seen()) != 0 {
+		t.Errorf("queries reached the proxy: %v", server.seen())
+	}
+}
+
+func TestOutboundLatencyStats(t *testing.T) {
+	server := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", server)))
+
+	conn, err := feeder.dialTCP(testTarget(8080))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.write([]byte("hello"))
+	if _, err := conn.read(5); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	conn.close()
+
+	var s struct {
+		Outbounds map[string]outboundTimingSnapshot `json:"outbounds"`
+	}
+	if err := json.Unmarshal([]byte(Stats()), &s); err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	got, ok := s.Outbounds[outboundProxy]
+	if !ok {
+		t.Fatalf("no timings for %q in %v", outboundProxy, s.Outbounds)
+	}
+	for phase, l := range map[string]latencySnapshot{"connect": got.Connect, "handshake": got.Handshake, "firstByte": got.FirstByte} {
+		if l.Count != 1 {
+			t.Errorf("%s count = %d, want 1", phase, l.Count)
+		}
+		if l.P50Ms <= 0 || l.P50Ms > l.P99Ms {
+			t.Errorf("%s percentiles = %+v", phase, l)
+		}
+	}
+}
+
+func TestFlowRedirector(t *testing.T) {
+	server := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", server)))
+
+	hosts := make(chan string, 2)
+	RegisterFlowRedirector(func(srcPort int, dst string, host string, proto string) string {
+		if srcPort == 0 || proto != "tcp" {
+			t.Errorf("redirector got port %d proto %q", srcPort, proto)
+		}
+		hosts <- host
+		if host == "portal.example" {
+			return testTarget(9090)
+		}
+		return ""
+	})
+	t.Cleanup(func() { RegisterFlowRedirector(nil) })
+
+	tests := []struct {
+		request string
+		host    string
+		want    string
+	}{
+		{request: "GET / HTTP/1.1\r\nHost: portal.example\r\n\r\n", host: "portal.example", want: testTarget(9090)},
+		{request: "GET / HTTP/1.1\r\nHost: other.example\r\n\r\n", host: "other.example", want: testTarget(8080)},
+	}
+	for _, tt := range tests {
+		conn, err := feeder.dialTCP(testTarget(8080))
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.write([]byte(tt.request))
+		got, err := conn.read(len(tt.request))
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(got) != tt.request {
+			t.Fatalf("echo = %q, want %q", got, tt.request)
+		}
+		conn.close()
+		if host := <-hosts; host != tt.host {
+			t.Errorf("redirector got host %q, want %q", host, tt.host)
+		}
+		if seen := server.seen(); seen[len(seen)-1] != tt.want {
+			t.Errorf("proxy saw %v, want %s last", seen, tt.want)
+		}
+	}
+}
+
+func TestFlowKeepalive(t *testing.T) {
+	server := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	startTestTunnel(t, fmt.Sprintf(`{
+		"proxy": %s,
+		"socket": {"flowKeepalive": {"idleMs": 45000, "intervalMs": 5000}}
+	}`, proxyJSON("socks5", server)))
+
+	tests := []struct {
+		target string
+		first  string
+		class  string
+	}{
+		{target: testTarget(1883), first: "ping", class: classMQTT},
+		{target: testTarget(9000), first: "\x10\x10\x00\x04MQTT\x04\x02\x00\x3c\x00\x04test", class: classMQTT},
+		{target: testTarget(8080), first: "GET / HTTP/1.1\r\nHost: a.example\r\n\r\n", class: classHTTP},
+	}
+	for _, tt := range tests {
+		conn, err := feeder.dialTCP(tt.target)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.write([]byte(tt.first))
+		if _, err := conn.read(len(tt.first)); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+
+		connMu.Lock()
+		var record *connRecord
+		for _, r := range connections {
+			if r.target == tt.target {
+				record = r
+			}
+		}
+		connMu.Unlock()
+		if record == nil {
+			t.Fatalf("%s: no record", tt.target)
+		}
+		record.mu.Lock()
+		class, socket := record.class, record.socket
+		record.mu.Unlock()
+		if class != tt.class || socket == nil {
+			t.Errorf("%s: class %q, socket %v; want %q and the proxy socket", tt.target, class, socket, tt.class)
+		}
+		conn.close()
+	}
+
+	cfg := &flowKeepaliveConfig{IdleMs: 45000}
+	if ka, ok := cfg.keepaliveFor(classSSH); !ok || ka.Idle != 45*time.Second || ka.Interval != defaultFlowKeepaliveInterval {
+		t.Errorf("ssh keepalive = %+v %v", ka, ok)
+	}
+	if _, ok := cfg.keepaliveFor(classHTTPS); ok {
+		t.Error("https flows got keepalives")
+	}
+}
+
+func TestMulticastPolicy(t *testing.T) {
+	const ssdp = "239.255.255.250:1900"
+	tests := []struct {
+		name    string
+		mode    string
+		dropped bool
+	}{
+		{name: "default", dropped: true},
+		{name: "log", mode: "log", dropped: true},
+		{name: "direct", mode: "direct"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newSOCKS5Server(t, "", "")
+			feeder := newTunFeeder(t)
+			startTestTunnel(t, fmt.Sprintf(`{"proxy": %s, "multicast": %q}`, proxyJSON("socks5", server), tt.mode))
+			feeder.wait = 300 * time.Millisecond
+
+			for _, dst := range []string{ssdp, "255.255.255.255:67"} {
+				if _, err := feeder.exchangeUDP(dst, []byte("M-SEARCH * HTTP/1.1\r\n\r\n")); err == nil {
+					t.Errorf("%s: got an answer", dst)
+				}
+			}
+			var got struct {
+				MulticastDrops uint64 `json:"multicastDroppedPackets"`
+			}
+			if err := json.Unmarshal([]byte(Stats()), &got); err != nil {
+				t.Fatal(err)
+			}
+			if want := map[bool]uint64{true: 2}[tt.dropped]; got.MulticastDrops != want {
+				t.Errorf("multicastDroppedPackets = %d, want %d", got.MulticastDrops, want)
+			}
+			if tt.mode == "direct" && !strings.Contains(ListConnections(), ssdp) {
+				t.Errorf("no direct session to %s: %s", ssdp, ListConnections())
+			}
+			if tt.mode == "direct" {
+				abortFlows("udp", 0)
+				if n := mappedUDPSessions(); n != 0 {
+					t.Errorf("handlers still map %d sessions after close", n)
+				}
+			}
+			if len(server.seen()) != 0 {
+				t.Errorf("proxy saw %v", server.seen())
+			}
+		})
+	}
+}
+
+func TestPrepareReload(t *testing.T) {
+	first := newSOCKS5Server(t, "", "")
+	second := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", first)))
+
+	echo := func(target string) {
+		t.Helper()
+		conn, err := feeder.dialTCP(target)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.write([]byte("hello"))
+		if _, err := conn.read(5); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		conn.close()
+	}
+
+	if err := PrepareReload(`{"proxy": {"type": "socks5"}}`); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("prepare invalid = %v", err)
+	}
+	next := fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", second))
+	if err := PrepareReload(next); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	echo(testTarget(8080))
+	if len(first.seen()) != 1 || len(second.seen()) != 0 {
+		t.Fatalf("before the switch: first saw %v, second %v", first.seen(), second.seen())
+	}
+
+	if err := Reload(next); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	echo(testTarget(8081))
+	if !slices.Equal(second.seen(), []string{testTarget(8081)}) {
+		t.Fatalf("after the switch: second saw %v", second.seen())
+	}
+
+	// A reload of another document discards the prepared one.
+	if err := PrepareReload(fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", first))); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	if err := Reload(next); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	stateMu.Lock()
+	left := prepared
+	stateMu.Unlock()
+	if left != nil {
+		t.Error("prepared configuration kept after reloading another one")
+	}
+	echo(testTarget(8082))
+	if len(first.seen()) != 1 {
+		t.Errorf("first saw %v after reloading away from it", first.seen())
+	}
+}
+
+func TestPreparedGroupsIdle(t *testing.T) {
+	first := newSOCKS5Server(t, "", "")
+	server := newSOCKS5Server(t, "", "")
+	newTunFeeder(t)
+	startTestTunnel(t, fmt.Sprintf(`{"proxy": %s}`, proxyJSON("socks5", first)))
+
+	probeTarget := testTarget(9)
+	next := fmt.Sprintf(`{
+		"proxy": {"type": "fallback", "members": ["a"],
+			"healthCheck": {"type": "tcp", "url": "http://%s/", "intervalMs": 50}},
+		"outbounds": [{"name": "a", "type": "socks5", "host": "127.0.0.1", "port": %d}]
+	}`, probeTarget, server.port())
+	if err := PrepareReload(next); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if seen := server.seen(); len(seen) != 0 {
+		t.Fatalf("prepared group probed %v", seen)
+	}
+
+	if err := Reload(next); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	deadline := time.Now().Add(testTimeout)
+	for !slices.Contains(server.seen(), probeTarget) {
+		if time.Now().After(deadline) {
+			t.Fatal("no health check after the switch")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestQoSPriorities(t *testing.T) {
+	server := newSOCKS5Server(t, "", "")
+	feeder := newTunFeeder(t)
+	if err := StartWithConfig(fmt.Sprintf(`{"proxy": %s, "qos": {}}`, proxyJSON("socks5", server))); !errors.Is(err, ErrInvalidConfig) {
+		Stop()
+		t.Fatalf("qos without a bandwidth cap: %v, want ErrInvalidConfig", err)
+	}
+	startTestTunnel(t, fmt.Sprintf(`{
+		"proxy": %s,
+		"bandwidth": {"downloadKbps": 1000000},
+		"qos": {"default": "bulk", "rules": [
+			{"type": "dst-port", "value": "3478", "priority": "interactive"},
+			{"type": "domain-suffix", "value": "video.example", "priority": "streaming"}
+		]}
+	}`, proxyJSON("socks5", server)))
+
+	tests := []struct {
+		target string
+		first  string
+		want   string
+	}{
+		{target: testTarget(3478), first: "ping", want: "interactive"},
+		{target: testTarget(8080), first: "GET / HTTP/1.1\r\nHost: cdn.video.example\r\n\r\n", want: "streaming"},
+		{target: testTarget(8081), first: "GET / HTTP/1.1\r\nHost: backup.example\r\n\r\n", want: "bulk"},
+	}
+	for _, tt := range tests {
+		conn, err := feeder.dialTCP(tt.target)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.write([]byte(tt.first))
+		if _, err := conn.read(len(tt.first)); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var flows []connEvent
+		if err := json.Unmarshal([]byte(ListConnections()), &flows); err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		for _, f := range flows {
+			if f.Target == tt.target {
+				got = f.Priority
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%s: priority %q, want %q", tt.target, got, tt.want)
+		}
+		conn.close()
+	}
+
+	// Two classes saturating a capped direction share it by their weights.
+	bucket := &tokenBucket{}
+	bucket.setRate(400 << 10)
+	queue := &priorityQueue{bucket: bucket}
+	var sent [numPriorities]atomic.Int64
+	deadline := time.Now().Add(500 * time.Millisecond)
+	var wg sync.WaitGroup
+	for _, prio := range []int{priorityInteractive, priorityBulk} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				queue.wait(4096, prio, defaultPriorityWeights)
+				sent[prio].Add(4096)
+			}
+		}()
+	}
+	wg.Wait()
+	if hi, lo := sent[priorityInteractive].Load(), sent[priorityBulk].Load(); hi < 4*lo {
+		t.Errorf("interactive sent %d bytes and bulk %d, want at least 4 times as much", hi, lo)
+	}
+}
+
+func TestRemoteConfig(t *testing.T) {
+	local := newSOCKS5Server(t, "", "")
+	managed := newSOCKS5Server(t, "", "")
+	remote := newRemoteServer(t)
+	feeder := newTunFeeder(t)
+
+	document := func(version int) string {
+		return fmt.Sprintf(`{"version": %d, "proxy": %s}`, version, proxyJSON("socks5", managed))
+	}
+	newKey := func(t *testing.T) (string, ed25519.PrivateKey) {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(pub), priv
+	}
+	start := func(t *testing.T, publicKey string) {
+		startTestTunnel(t, fmt.Sprintf(`{"proxy": %s, "remote": {"url": %q, "publicKey": %q}}`,
+			proxyJSON("socks5", local), remote.URL+"/config.json", publicKey))
+	}
+	remoteOf := func(t *testing.T) remoteStatus {
+		t.Helper()
+		var status tunnelStatus
+		if err := json.Unmarshal([]byte(State()), &status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Remote == nil {
+			t.Fatalf("state %s has no remote", State())
+		}
+		return *status.Remote
+	}
+	// relaysThrough checks that a new flow goes to server.
+	relaysThrough := func(t *testing.T, server *testServer, port int) {
+		t.Helper()
+		conn, err := feeder.dialTCP(testTarget(port))
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.write([]byte("hello"))
+		if _, err := conn.read(5); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		conn.close()
+		if !slices.Contains(server.seen(), testTarget(port)) {
+			t.Errorf("%s did not go through the expected proxy", testTarget(port))
+		}
+	}
+
+	t.Run("good signature", func(t *testing.T) {
+		publicKey, key := newKey(t)
+		remote.publish("/config.json", document(1), key)
+		start(t, publicKey)
+		if st := remoteOf(t); st.State != remoteApplied || st.Version != 1 || st.Error != "" {
+			t.Errorf("remote = %+v, want applied version 1", st)
+		}
+		relaysThrough(t, managed, 8101)
+	})
+
+	t.Run("bad signature", func(t *testing.T) {
+		publicKey, _ := newKey(t)
+		_, other := newKey(t)
+		remote.publish("/config.json", document(1), other)
+		start(t, publicKey)
+		if st := remoteOf(t); st.State != remoteFallback || !strings.Contains(st.Error, "signature") {
+			t.Errorf("remote = %+v, want fallback for the signature", st)
+		}
+		relaysThrough(t, local, 8102)
+	})
+
+	t.Run("missing signature", func(t *testing.T) {
+		publicKey, _ := newKey(t)
+		remote.publish("/config.json", document(1), nil)
+		start(t, publicKey)
+		if st := remoteOf(t); st.State != remoteFallback || !strings.Contains(st.Error, ".sig") {
+			t.Errorf("remote = %+v, want fallback for the missing signature", st)
+		}
+		relaysThrough(t, local, 8103)
+	})
+
+	t.Run("replayed older body", func(t *testing.T) {
+		publicKey, key := newKey(t)
+		remote.publish("/config.json", document(2), key)
+		start(t, publicKey)
+		if st := remoteOf(t); st.State != remoteApplied || st.Version != 2 {
+			t.Fatalf("remote = %+v, want applied version 2", st)
+		}
+
+		// An older document, or another one with the same version, is
+		// refused by a refresh and the applied one stays in effect.
+		for _, body := range []string{document(1), document(2) + " "} {
+			remote.publish("/config.json", body, key)
+			refreshRemote(activeRemote.Load())
+			if st := remoteOf(t); st.State != remoteApplied || st.Version != 2 || !strings.Contains(st.Error, "not newer") {
+				t.Errorf("remote after %q = %+v, want version 2 kept", body, st)
+			}
+		}
+		relaysThrough(t, managed, 8104)
+
+		// A new start does not go back either.
+		Stop()
+		remote.publish("/config.json", document(1), key)
+		start(t, publicKey)
+		if st := remoteOf(t); st.State != remoteFallback || !strings.Contains(st.Error, "not newer") {
+			t.Errorf("remote = %+v, want fallback for the older version", st)
+		}
+		relaysThrough(t, local, 8105)
+	})
+}
+
+func TestFTPRewriteNeedsBind(t *testing.T) {
+	const port = "PORT 127,0,0,1,4,1\r\n"
+	tests := []struct {
+		name    string
+		bind    bool
+		rewrite bool
+	}{
+		{name: "direct", bind: false, rewrite: false},
+		{name: "bind", bind: true, rewrite: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newPipeOutbound(tt.bind)
+			ob := newFTPOutbound(newTimedOutbound("proxy", inner), testTimeout)
+			conn, err := ob.Dial("tcp", testTarget(21))
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			peer := <-inner.peers
+			defer peer.Close()
+
+			if _, ok := conn.(*ftpControlConn); ok != tt.rewrite {
+				t.Fatalf("control connection rewritten = %v, want %v", ok, tt.rewrite)
+			}
+			if tt.rewrite {
+				return
+			}
+			go conn.Write([]byte(port))
+			got := make([]byte, len(port))
+			peer.SetReadDeadline(time.Now().Add(testTimeout))
+			if _, err := io.ReadFull(peer, got); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if string(got) != port {
+				t.Errorf("server got %q, want %q", got, port)
+			}
+		})
+	}
+}
+
+func TestClampMSS(t *testing.T) {
+	src4 := netip.MustParseAddrPort("10.0.0.2:40000")
+	dst4 := netip.MustParseAddrPort("198.51.100.1:443")
+	src6 := netip.MustParseAddrPort("[fd00::2]:40000")
+	dst6 := netip.MustParseAddrPort("[2001:db8::1]:443")
+	mssOpt := func(mss uint16) []byte {
+		return []byte{tcpOptMSS, 4, byte(mss >> 8), byte(mss)}
+	}
+	tests := []struct {
+		name    string
+		mtu     int
+		packet  func() []byte
+		want    uint16
+		optAt   int
+		changed bool
+	}{
+		{
+			name:    "ipv4 syn",
+			mtu:     1400,
+			packet:  func() []byte { return buildTCPOptions(src4, dst4, 1, 0, tcpFlagSYN, mssOpt(1460), nil) },
+			want:    1360,
+			optAt:   40,
+			changed: true,
+		},
+		{
+			name:    "ipv6 syn",
+			mtu:     1400,
+			packet:  func() []byte { return buildTCPOptions(src6, dst6, 1, 0, tcpFlagSYN, mssOpt(1460), nil) },
+			want:    1340,
+			optAt:   60,
+			changed: true,
+		},
+		{
+			name:    "syn-ack",
+			mtu:     1400,
+			packet:  func() []byte { return buildTCPOptions(dst4, src4, 1, 2, tcpFlagSYN|tcpFlagACK, mssOpt(1460), nil) },
+			want:    1360,
+			optAt:   40,
+			changed: true,
+		},
+		{
+			name:   "smaller mss kept",
+			mtu:    1400,
+			packet: func() []byte { return buildTCPOptions(src4, dst4, 1, 0, tcpFlagSYN, mssOpt(1200), nil) },
+			want:   1200,
+			optAt:  40,
+		},
+		{
+			name:   "no mtu",
+			mtu:    0,
+			packet: func() []byte { return buildTCPOptions(src4, dst4, 1, 0, tcpFlagSYN, mssOpt(1460), nil) },
+			want:   1460,
+			optAt:  40,
+		},
+		{
+			name:   "not a syn",
+			mtu:    1400,
+			packet: func() []byte { return buildTCPOptions(src4, dst4, 1, 2, tcpFlagACK, mssOpt(1460), nil) },
+			want:   1460,
+			optAt:  40,
+		},
+		{
+			name: "after nop and window scale",
+			mtu:  1400,
+			packet: func() []byte {
+				opts := append([]byte{1, 3, 3, 7, 1, 1, 1, 1}, mssOpt(1460)...)
+				return buildTCPOptions(src4, dst4, 1, 0, tcpFlagSYN, opts, nil)
+			},
+			want:    1360,
+			optAt:   48,
+			changed: true,
+		},
+		{
+			name: "after end of options",
+			mtu:  1400,
+			packet: func() []byte {
+				return buildTCPOptions(src4, dst4, 1, 0, tcpFlagSYN, append([]byte{0, 1, 1, 1}, mssOpt(1460)...), nil)
+			},
+			want:  1460,
+			optAt: 44,
+		},
+		{
+			name: "after a zero length option",
+			mtu:  1400,
+			packet: func() []byte {
+				return buildTCPOptions(src4, dst4, 1, 0, tcpFlagSYN, append([]byte{8, 0, 1, 1}, mssOpt(1460)...), nil)
+			},
+			want:  1460,
+			optAt: 44,
+		},
+		{
+			name: "bad mss length",
+			mtu:  1400,
+			packet: func() []byte {
+				return buildTCPOptions(src4, dst4, 1, 0, tcpFlagSYN, []byte{tcpOptMSS, 3, 0x05, 0xb4}, nil)
+			},
+			want:  1460,
+			optAt: 40,
+		},
+		{
+			name: "mss past the header",
+			mtu:  1400,
+			packet: func() []byte {
+				packet := buildTCPOptions(src4, dst4, 1, 0, tcpFlagSYN, []byte{1, 1, tcpOptMSS, 4, 0x05, 0xb4}, nil)
+				// Cut the data offset to 24 so the option straddles its end.
+				packet[32] = 6 << 4
+				return packet
+			},
+			want:  1460,
+			optAt: 42,
+		},
+		{
+			name: "ipv4 fragment",
+			mtu:  1400,
+			packet: func() []byte {
+				packet := buildTCPOptions(src4, dst4, 1, 0, tcpFlagSYN, mssOpt(1460), nil)
+				binary.BigEndian.PutUint16(packet[6:], 8)
+				return packet
+			},
+			want:  1460,
+			optAt: 40,
+		},
+	}
+	t.Cleanup(func() { configureMTU(0) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configureMTU(tt.mtu)
+			packet := tt.packet()
+			orig := bytes.Clone(packet)
+			clampMSS(packet)
+			if got := binary.BigEndian.Uint16(packet[tt.optAt+2:]); got != tt.want {
+				t.Errorf("mss = %d, want %d", got, tt.want)
+			}
+			if !tt.changed {
+				if !bytes.Equal(packet, orig) {
+					t.Errorf("packet changed:\n got %x\nwant %x", packet, orig)
+				}
+				return
+			}
+			if !testTransportSumOK(packet) {
+				t.Error("tcp checksum invalid after clamping")
+			}
+		})
+	}
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		old  uint16
+		new  uint16
+	}{
+		{name: "lower", old: 0x05b4, new: 0x0550},
+		{name: "higher", old: 0x0550, new: 0x05b4},
+		{name: "wraps", old: 0x0001, new: 0xffff},
+		{name: "to zero", old: 0xffff, new: 0x0000},
+		{name: "from zero", old: 0x0000, new: 0x8000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte{0x45, 0x00, 0x00, 0x3c, 0, 0, 0x40, 0x00, 0x40, 0x06, 0, 0, 0x0a, 0x00, 0x00, 0x02, 0xc6, 0x33, 0x64, 0x01}
+			binary.BigEndian.PutUint16(data[4:], tt.old)
+			binary.BigEndian.PutUint16(data[10:], testChecksum(data, 0))
+
+			binary.BigEndian.PutUint16(data[4:], tt.new)
+			updateChecksum(data[10:12], tt.old, tt.new)
+			got := binary.BigEndian.Uint16(data[10:])
+			binary.BigEndian.PutUint16(data[10:], 0)
+			if want := testChecksum(data, 0); got != want {
+				t.Errorf("updated checksum %#04x, recomputed %#04x", got, want)
+			}
+		})
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	src4 := netip.MustParseAddrPort("198.51.100.1:443")
+	dst4 := netip.MustParseAddrPort("10.0.0.2:40000")
+	src6 := netip.MustParseAddrPort("[2001:db8::1]:443")
+	dst6 := netip.MustParseAddrPort("[fd00::2]:40000")
+	tests := []struct {
+		name     string
+		outgoing int
+		packet   []byte
+		want     byte
+	}{
+		{name: "ipv4", outgoing: 128, packet: buildTCP(src4, dst4, 1, 2, tcpFlagACK, []byte("data")), want: 128},
+		{name: "ipv4 udp", outgoing: 1, packet: buildUDP(src4, dst4, []byte("data")), want: 1},
+		{name: "ipv4 unchanged", outgoing: 0, packet: buildTCP(src4, dst4, 1, 2, tcpFlagACK, nil), want: 64},
+		{name: "ipv6", outgoing: 255, packet: buildTCP(src6, dst6, 1, 2, tcpFlagACK, []byte("data")), want: 255},
+		{name: "ipv6 unchanged", outgoing: 0, packet: buildTCP(src6, dst6, 1, 2, tcpFlagACK, nil), want: 64},
+	}
+	t.Cleanup(func() { configureTTL(nil) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configureTTL(&ttlConfig{Outgoing: tt.outgoing})
+			orig := bytes.Clone(tt.packet)
+			setTTL(tt.packet)
+			if tt.packet[0]>>4 == 4 {
+				if tt.packet[8] != tt.want {
+					t.Errorf("ttl = %d, want %d", tt.packet[8], tt.want)
+				}
+				if testChecksum(tt.packet[:20], 0) != 0 {
+					t.Error("ipv4 header checksum invalid")
+				}
+				orig[8], orig[10], orig[11] = tt.packet[8], tt.packet[10], tt.packet[11]
+			} else {
+				if tt.packet[7] != tt.want {
+					t.Errorf("hop limit = %d, want %d", tt.packet[7], tt.want)
+				}
+				orig[7] = tt.packet[7]
+			}
+			// Only the TTL or hop limit, and the IPv4 header checksum, change.
+			if !bytes.Equal(tt.packet, orig) {
+				t.Errorf("packet changed beyond the ttl:\n got %x\nwant %x", tt.packet, orig)
+			}
+			if !testTransportSumOK(tt.packet) {
+				t.Error("transport checksum invalid")
+			}
+		})
+	}
+}
+
+func TestTTLExpired(t *testing.T) {
+	src4 := netip.MustParseAddrPort("10.0.0.2:40000")
+	dst4 := netip.MustParseAddrPort("198.51.100.1:443")
+	src6 := netip.MustParseAddrPort("[fd00::2]:40000")
+	dst6 := netip.MustParseAddrPort("[2001:db8::1]:443")
+	withTTL := func(packet []byte, ttl byte) []byte {
+		if packet[0]>>4 == 4 {
+			packet[8] = ttl
+			binary.BigEndian.PutUint16(packet[10:], 0)
+			binary.BigEndian.PutUint16(packet[10:], testChecksum(packet[:20], 0))
+		} else {
+			packet[7] = ttl
+		}
+		return packet
+	}
+	tests := []struct {
+		name    string
+		min     int
+		packet  []byte
+		expired bool
+	}{
+		{name: "ipv4 above", min: 10, packet: withTTL(buildTCP(src4, dst4, 1, 0, tcpFlagSYN, nil), 11)},
+		{name: "ipv4 at limit", min: 10, packet: withTTL(buildTCP(src4, dst4, 1, 0, tcpFlagSYN, nil), 10)},
+		{name: "ipv4 below", min: 10, packet: withTTL(buildUDP(src4, dst4, []byte("loop")), 9), expired: true},
+		{name: "ipv6 at limit", min: 10, packet: withTTL(buildTCP(src6, dst6, 1, 0, tcpFlagSYN, nil), 10)},
+		{name: "ipv6 below", min: 10, packet: withTTL(buildTCP(src6, dst6, 1, 0, tcpFlagSYN, nil), 1), expired: true},
+		{name: "no limit", min: 0, packet: withTTL(buildTCP(src4, dst4, 1, 0, tcpFlagSYN, nil), 0)},
+		{name: "truncated", min: 10, packet: []byte{0x45, 0, 0, 20}},
+	}
+	t.Cleanup(func() { configureTTL(nil) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configureTTL(&ttlConfig{MinIncoming: tt.min})
+			dropped := stats.ttlDropped.Load()
+			if got := ttlExpired(tt.packet); got != tt.expired {
+				t.Errorf("ttlExpired = %v, want %v", got, tt.expired)
+			}
+			want := 0
+			if tt.expired {
+				want = 1
+			}
+			if got := int(stats.ttlDropped.Load() - dropped); got != want {
+				t.Errorf("ttlDropped grew by %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestTLSPins(t *testing.T) {
+	proxyWithPins := func(server *testServer, pins ...string) string {
+		data, _ := json.Marshal(pins)
+		return fmt.Sprintf(`{"proxy": {"type": "socks5-tls", "host": "127.0.0.1", "port": %d, "tls": {"serverName": "proxy.test", "insecure": true, "pins": %s}}}`,
+			server.port(), data)
+	}
+
+	t.Run("match", func(t *testing.T) {
+		server, pin := newSOCKS5TLSServer(t)
+		feeder := newTunFeeder(t)
+		other := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+		startTestTunnel(t, proxyWithPins(server, other, pin))
+
+		conn, err := feeder.dialTCP(testTarget(8080))
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.write([]byte("pinned"))
+		got, err := conn.read(len("pinned"))
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(got) != "pinned" {
+			t.Errorf("echo = %q, want %q", got, "pinned")
+		}
+		conn.close()
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		server, _ := newSOCKS5TLSServer(t)
+		feeder := newTunFeeder(t)
+		mismatches := errorCounts[errCodePinMismatch].Load()
+		startTestTunnel(t, proxyWithPins(server, "sha256/"+base64.StdEncoding.EncodeToString(make([]byte, 32))))
+
+		conn, err := feeder.dialTCP(testTarget(8080))
+		if err == nil {
+			conn.write([]byte("hello"))
+			_, err = conn.read(1)
+		}
+		if err == nil {
+			t.Fatal("read succeeded through a proxy whose certificate matches no pin")
+		}
+		deadline := time.Now().Add(testTimeout)
+		for errorCounts[errCodePinMismatch].Load() == mismatches {
+			if time.Now().After(deadline) {
+				t.Fatal("no pin-mismatch flow error reported")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(server.seen()) != 0 {
+			t.Errorf("proxy connected %v", server.seen())
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		server, _ := newSOCKS5TLSServer(t)
+		for _, pin := range []string{"sha256/not base64", "sha256/AAAA", ""} {
+			if err := StartWithConfig(proxyWithPins(server, pin)); !errors.Is(err, ErrInvalidConfig) {
+				if err == nil {
+					Stop()
+				}
+				t.Errorf("pin %q: %v, want ErrInvalidConfig", pin, err)
+			}
+		}
+	})
+}
+
+func TestGeositeRuleSet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geosite.dat")
+	data := buildGeosite(map[string][]testGeoDomain{
+		"GOOGLE": {
+			{kind: geositeDomain, value: "google.com"},
+			{kind: geositeFull, value: "www.google.cn", attrs: []string{"cn"}},
+			{kind: geositeFull, value: "ads.google.cn", attrs: []string{"CN", "ads"}},
+			{kind: geositeRegex, value: `^ads\d+\.google\.com$`},
+			{kind: geositeRegex, value: `^(?!mail)\w+\.google\.com$`},
+			{kind: geositePlain, value: "googleapis"},
+		},
+		"BAIDU": {{kind: geositeDomain, value: "baidu.com", attrs: []string{"cn"}}},
+	})
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		category string
+		skipped  int
+		match    []string
+		miss     []string
+	}{
+		{
+			category: "google",
+			skipped:  1,
+			match:    []string{"google.com", "mail.google.com", "www.google.cn", "ads12.google.com", "x.googleapis.com"},
+			miss:     []string{"baidu.com", "google.cn"},
+		},
+		{
+			category: "google@cn",
+			match:    []string{"www.google.cn", "ads.google.cn"},
+			miss:     []string{"google.com", "ads12.google.com", "x.googleapis.com"},
+		},
+		{
+			category: "Google@cn@Ads",
+			match:    []string{"ads.google.cn"},
+			miss:     []string{"www.google.cn", "google.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.category, func(t *testing.T) {
+			p, err := newRuleProvider("geo", ruleProviderConfig{Path: path, Format: "geosite", Category: tt.category})
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			set := p.set.Load()
+			if len(set.skipped) != tt.skipped {
+				t.Errorf("skipped %v, want %d entries", set.skipped, tt.skipped)
+			}
+			for _, domain := range tt.match {
+				if !set.matches(nil, &routeTarget{domain: domain}) {
+					t.Errorf("%s does not match", domain)
+				}
+			}
+			for _, domain := range tt.miss {
+				if set.matches(nil, &routeTarget{domain: domain}) {
+					t.Errorf("%s matches", domain)
+				}
+			}
+		})
+	}
+
+	if _, err := newRuleProvider("geo", ruleProviderConfig{Path: path, Format: "geosite", Category: "missing"}); err == nil {
+		t.Error("loaded a missing category")
+	}
+}
@@ -0,0 +1,357 @@
+package tun2socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	ipv6Enable = iota
+	ipv6Prefer
+	ipv6Disable
+)
+
+// connectAttemptDelay is the RFC 8305 recommended wait before racing the
+// next address.
+const connectAttemptDelay = 250 * time.Millisecond
+
+var ipv6Modes = map[string]int32{
+	"":        ipv6Enable,
+	"enable":  ipv6Enable,
+	"prefer":  ipv6Prefer,
+	"disable": ipv6Disable,
+}
+
+var (
+	ipv6Mode    atomic.Int32
+	nat64Prefix atomic.Pointer[netip.Prefix]
+	nat64Auto   atomic.Bool
+
+	errIPv6Disabled = errors.New("ipv6 is disabled")
+)
+
+func configureIPv6(mode string, nat64 string) error {
+	m, ok := ipv6Modes[mode]
+	if !ok {
+		return fmt.Errorf("unknown ipv6 mode %q", mode)
+	}
+	ipv6Mode.Store(m)
+
+	nat64Prefix.Store(nil)
+	nat64Auto.Store(nat64 == "auto")
+	switch nat64 {
+	case "":
+	case "auto":
+		refreshNAT64()
+	default:
+		prefix, err := netip.ParsePrefix(nat64)
+		if err != nil {
+			return err
+		}
+		if !prefix.Addr().Is6() || prefix.Bits() != 96 {
+			return errors.New("nat64 prefix must be an ipv6 /96")
+		}
+		nat64Prefix.Store(&prefix)
+	}
+	return nil
+}
+
+// refreshNAT64 looks for the prefix of the current network again when it
+// is discovered automatically.
+func refreshNAT64() {
+	if !nat64Auto.Load() {
+		return
+	}
+	if prefix, ok := discoverNAT64(); ok {
+		nat64Prefix.Store(&prefix)
+	} else {
+		nat64Prefix.Store(nil)
+	}
+}
+
+// discoverNAT64 finds the network's NAT64 prefix as described in RFC 7050 by
+// resolving ipv4only.arpa, which only has A records, through DNS64.
+func discoverNAT64() (netip.Prefix, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip6", "ipv4only.arpa")
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	for _, addr := range addrs {
+		b := addr.As16()
+		if addr.Is6() && !addr.Is4In6() && (b[15] == 170 || b[15] == 171) && b[12] == 192 && b[13] == 0 && b[14] == 0 {
+			prefix, err := addr.Prefix(96)
+			if err == nil {
+				return prefix, true
+			}
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+func synthesizeNAT64(addr netip.Addr) netip.Addr {
+	prefix := nat64Prefix.Load()
+	if prefix == nil || !addr.Unmap().Is4() {
+		return addr
+	}
+	b := prefix.Addr().As16()
+	v4 := addr.Unmap().As4()
+	copy(b[12:], v4[:])
+	return netip.AddrFrom16(b)
+}
+
+func ipv6Disabled() bool {
+	return ipv6Mode.Load() == ipv6Disable
+}
+
+// orderAddrs applies the ipv6 mode and NAT64 synthesis to the resolved
+// addresses of an upstream. Without a preference the resolver order is
+// kept.
+func orderAddrs(addrs []netip.Addr) []netip.Addr {
+	var all, v4, v6 []netip.Addr
+	for _, addr := range addrs {
+		addr = synthesizeNAT64(addr).Unmap()
+		all = append(all, addr)
+		if addr.Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	switch ipv6Mode.Load() {
+	case ipv6Prefer:
+		return append(v6, v4...)
+	case ipv6Disable:
+		return v4
+	default:
+		return all
+	}
+}
+
+func customDialing() bool {
+	return ipv6Mode.Load() != ipv6Enable || nat64Prefix.Load() != nil
+}
+
+// upstreamDialer dials proxy servers and direct targets according to the
+// ipv6 mode, racing the resolved addresses as described in RFC 8305.
+// Proxy servers go through the registered DialFunc, if any, except those
+// on a Unix domain socket.
+type upstreamDialer struct {
+	timeout time.Duration
+	direct  bool
+}
+
+func dialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	return (&upstreamDialer{timeout: timeout}).Dial("tcp", addr)
+}
+
+// Dial traces the time a connection to a proxy server took for the
+// outbound being dialed, and registers its socket for the flows over it.
+func (d *upstreamDialer) Dial(network string, addr string) (net.Conn, error) {
+	start := time.Now()
+	c, err := d.dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	registerSocket(c)
+	if !d.direct {
+		traceConnect(c, start)
+	}
+	return c, nil
+}
+
+func (d *upstreamDialer) dial(network string, addr string) (net.Conn, error) {
+	if path, ok := unixSocketPath(addr); ok {
+		return (&net.Dialer{Timeout: d.timeout}).Dial("unix", path)
+	}
+	if fn := customDialer.Load(); fn != nil && !d.direct {
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		defer cancel()
+		return (*fn)(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	var addrs []netip.Addr
+	if d.direct {
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	} else {
+		addrs, err = lookupServer(ctx, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	addrs = interleaveFamilies(orderAddrs(addrs))
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no usable address for %s", host)
+	}
+	return dialHappyEyeballs(ctx, addrs, port)
+}
+
+// unixScheme marks a proxy host that is the path of a Unix domain socket,
+// as in unix:///var/run/helper.sock.
+const unixScheme = "unix://"
+
+func isUnixSocket(host string) bool {
+	return strings.HasPrefix(host, unixScheme) && len(host) > len(unixScheme)
+}
+
+// unixSocketPath returns the socket path of a host:port whose host is a
+// unix:// URL; the port is ignored.
+func unixSocketPath(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || !isUnixSocket(host) {
+		return "", false
+	}
+	return strings.TrimPrefix(host, unixScheme), true
+}
+
+// interleaveFamilies alternates IPv4 and IPv6 addresses, starting with the
+// family of the first one, as RFC 8305 section 4 describes.
+func interleaveFamilies(addrs []netip.Addr) []netip.Addr {
+	if len(addrs) < 2 {
+		return addrs
+	}
+	var first, second []netip.Addr
+	for _, addr := range addrs {
+		if addr.Is4() == addrs[0].Is4() {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	out := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// dialHappyEyeballs starts a connection attempt to each address in turn,
+// the next one after connectAttemptDelay or as soon as the previous one
+// fails, and returns the first connection established. Later winners are
+// closed.
+func dialHappyEyeballs(ctx context.Context, addrs []netip.Addr, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, len(addrs))
+	dialer := socketDialer()
+	next, pending := 0, 0
+	start := func() {
+		target := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", target)
+			results <- attempt{conn: conn, err: err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(connectAttemptDelay)
+	defer timer.Stop()
+
+	var err error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				tuneConn(r.conn)
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			err = r.err
+			if next < len(addrs) {
+				start()
+				timer.Reset(connectAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(connectAttemptDelay)
+			}
+		}
+	}
+	return nil, err
+}
+
+// resolveUDPAddr resolves the UDP address of a proxy server. Without an
+// ipv6 preference IPv4 goes first, as with net.ResolveUDPAddr.
+func resolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := lookupServer(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	addrs = orderAddrs(addrs)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no usable address for %s", host)
+	}
+	target := addrs[0]
+	if i := slices.IndexFunc(addrs, netip.Addr.Is4); i >= 0 && !customDialing() {
+		target = addrs[i]
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(target.String(), port))
+}
+
+type noAAAAResolver struct {
+	inner dnsUpstream
+}
+
+func newNoAAAAResolver(inner dnsUpstream) dnsUpstream {
+	return &noAAAAResolver{inner: inner}
+}
+
+func (r *noAAAAResolver) Exchange(query []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 || msg.Questions[0].Type != dnsmessage.TypeAAAA {
+		return r.inner.Exchange(query)
+	}
+
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 msg.ID,
+			Response:           true,
+			RecursionDesired:   msg.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: msg.Questions,
+	}
+	return resp.Pack()
+}
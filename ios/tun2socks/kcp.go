@@ -0,0 +1,380 @@
+package tun2socks
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// KCP as done by kcptun: an smux session over a KCP connection on UDP,
+// optionally snappy-compressed, with Reed-Solomon FEC and packet
+// encryption keyed by PBKDF2 of a shared secret. Every flow is an smux
+// stream, so retransmissions are paced by KCP instead of stacking up in
+// TCP over a lossy path. The defaults are kcptun's, except for smaller
+// buffers to fit the memory of a network extension.
+const (
+	kcpSalt          = "kcp-go"
+	kcpDefaultKey    = "it's a secrect"
+	kcpDefaultCrypt  = "aes"
+	kcpDefaultMode   = "fast"
+	kcpDefaultMTU    = 1350
+	kcpDefaultSndWnd = 128
+	kcpDefaultRcvWnd = 512
+	kcpDataShards    = 10
+	kcpParityShards  = 3
+
+	kcpSessionBuffer = 1 << 20
+	kcpStreamBuffer  = 256 << 10
+	kcpKeepAlive     = 10 * time.Second
+	kcpIdleTimeout   = time.Minute
+)
+
+type kcpConfig struct {
+	Key           string     `json:"key,omitempty"`
+	Crypt         string     `json:"crypt,omitempty"`
+	Mode          string     `json:"mode,omitempty"`
+	MTU           int        `json:"mtu,omitempty"`
+	SendWindow    int        `json:"sendWindow,omitempty"`
+	ReceiveWindow int        `json:"receiveWindow,omitempty"`
+	FEC           *fecConfig `json:"fec,omitempty"`
+	NoCompression bool       `json:"noCompression,omitempty"`
+	SmuxVersion   int        `json:"smuxVersion,omitempty"`
+}
+
+// fecConfig sets the Reed-Solomon shards; both zero turns FEC off.
+type fecConfig struct {
+	DataShards   int `json:"dataShards"`
+	ParityShards int `json:"parityShards"`
+}
+
+// kcpModes are the nodelay, interval, resend and no-congestion settings
+// of kcptun's modes.
+var kcpModes = map[string][4]int{
+	"normal": {0, 40, 2, 1},
+	"fast":   {0, 30, 2, 1},
+	"fast2":  {1, 20, 2, 1},
+	"fast3":  {1, 10, 2, 1},
+}
+
+// kcpKeySizes are the key lengths of the ciphers, 0 for the whole derived
+// key.
+var kcpKeySizes = map[string]int{
+	"aes":      32,
+	"aes-128":  16,
+	"aes-192":  24,
+	"salsa20":  0,
+	"blowfish": 0,
+	"twofish":  0,
+	"cast5":    16,
+	"3des":     24,
+	"tea":      16,
+	"xtea":     16,
+	"xor":      0,
+	"sm4":      16,
+	"none":     0,
+	"null":     0,
+}
+
+func (c *kcpConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if _, ok := kcpKeySizes[strings.ToLower(c.crypt())]; !ok {
+		return fmt.Errorf("unknown kcp crypt %q", c.Crypt)
+	}
+	if _, ok := kcpModes[strings.ToLower(c.mode())]; !ok {
+		return fmt.Errorf("unknown kcp mode %q", c.Mode)
+	}
+	if c.MTU < 0 || c.MTU > 1500 || c.SendWindow < 0 || c.ReceiveWindow < 0 {
+		return errors.New("kcp mtu must be at most 1500 and windows not negative")
+	}
+	if c.FEC != nil && (c.FEC.DataShards < 0 || c.FEC.ParityShards < 0 || (c.FEC.DataShards == 0) != (c.FEC.ParityShards == 0)) {
+		return errors.New("kcp fec needs both data and parity shards, or neither")
+	}
+	if c.SmuxVersion < 0 || c.SmuxVersion > 2 {
+		return errors.New("kcp smuxVersion is 1 or 2")
+	}
+	return nil
+}
+
+func (c *kcpConfig) crypt() string {
+	if c == nil || c.Crypt == "" {
+		return kcpDefaultCrypt
+	}
+	return c.Crypt
+}
+
+func (c *kcpConfig) mode() string {
+	if c == nil || c.Mode == "" {
+		return kcpDefaultMode
+	}
+	return c.Mode
+}
+
+func (c *kcpConfig) block() (kcp.BlockCrypt, error) {
+	key := kcpDefaultKey
+	if c != nil && c.Key != "" {
+		key = c.Key
+	}
+	pass, err := pbkdf2.Key(sha1.New, key, []byte(kcpSalt), 4096, 32)
+	if err != nil {
+		return nil, err
+	}
+	crypt := strings.ToLower(c.crypt())
+	if n := kcpKeySizes[crypt]; n > 0 {
+		pass = pass[:n]
+	}
+	switch crypt {
+	case "aes", "aes-128", "aes-192":
+		return kcp.NewAESBlockCrypt(pass)
+	case "salsa20":
+		return kcp.NewSalsa20BlockCrypt(pass)
+	case "blowfish":
+		return kcp.NewBlowfishBlockCrypt(pass)
+	case "twofish":
+		return kcp.NewTwofishBlockCrypt(pass)
+	case "cast5":
+		return kcp.NewCast5BlockCrypt(pass)
+	case "3des":
+		return kcp.NewTripleDESBlockCrypt(pass)
+	case "tea":
+		return kcp.NewTEABlockCrypt(pass)
+	case "xtea":
+		return kcp.NewXTEABlockCrypt(pass)
+	case "xor":
+		return kcp.NewSimpleXORBlockCrypt(pass)
+	case "sm4":
+		return kcp.NewSM4BlockCrypt(pass)
+	case "none":
+		return kcp.NewNoneBlockCrypt(pass)
+	default:
+		return nil, nil
+	}
+}
+
+type kcpKey struct {
+	config *transportConfig
+	addr   string
+}
+
+// kcpPool holds one session per server and transport. Streams are opened
+// on it until it dies; a reload or network change retires it for new
+// streams and closes it once its streams are done.
+type kcpPool struct {
+	mu       sync.Mutex
+	sessions map[kcpKey]*smux.Session
+}
+
+var kcpSessions = &kcpPool{sessions: make(map[kcpKey]*smux.Session)}
+
+// dialKCP opens a stream to the server at addr through the kcp transport
+// of cfg.
+func dialKCP(cfg *transportConfig, addr string) (net.Conn, error) {
+	key := kcpKey{config: cfg, addr: addr}
+	var err error
+	// A session found dead when opening the stream is dropped and the
+	// stream is tried once more on a new one.
+	for range 2 {
+		var session *smux.Session
+		session, err = kcpSessions.session(key)
+		if err != nil {
+			return nil, err
+		}
+		var stream *smux.Stream
+		stream, err = session.OpenStream()
+		if err != nil {
+			kcpSessions.drop(key, session)
+			continue
+		}
+		return &kcpConn{Stream: stream, session: session}, nil
+	}
+	return nil, err
+}
+
+func (p *kcpPool) session(key kcpKey) (*smux.Session, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s, ok := p.sessions[key]; ok && !s.IsClosed() {
+		return s, nil
+	}
+	s, err := newKCPSession(key.config.KCP, key.addr)
+	if err != nil {
+		return nil, err
+	}
+	p.sessions[key] = s
+	return s, nil
+}
+
+func (p *kcpPool) drop(key kcpKey, session *smux.Session) {
+	p.mu.Lock()
+	if p.sessions[key] == session {
+		delete(p.sessions, key)
+	}
+	p.mu.Unlock()
+	session.Close()
+}
+
+// retire leaves the current sessions to the streams they carry and opens
+// new ones for later streams.
+func (p *kcpPool) retire() {
+	p.mu.Lock()
+	sessions := p.sessions
+	p.sessions = make(map[kcpKey]*smux.Session)
+	p.mu.Unlock()
+
+	for _, s := range sessions {
+		go func() {
+			for s.NumStreams() > 0 && !s.IsClosed() {
+				time.Sleep(time.Second)
+			}
+			s.Close()
+		}()
+	}
+}
+
+func (p *kcpPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, s := range p.sessions {
+		s.Close()
+		delete(p.sessions, key)
+	}
+}
+
+func newKCPSession(cfg *kcpConfig, addr string) (*smux.Session, error) {
+	remote, err := resolveUDPAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	block, err := cfg.block()
+	if err != nil {
+		return nil, err
+	}
+	dataShards, parityShards := kcpDataShards, kcpParityShards
+	if cfg != nil && cfg.FEC != nil {
+		dataShards, parityShards = cfg.FEC.DataShards, cfg.FEC.ParityShards
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	var conv [4]byte
+	rand.Read(conv[:])
+	conn, err := kcp.NewConn4(binary.LittleEndian.Uint32(conv[:]), remote, block, dataShards, parityShards, true, pc)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	mode := kcpModes[strings.ToLower(cfg.mode())]
+	mtu, sndWnd, rcvWnd := kcpDefaultMTU, kcpDefaultSndWnd, kcpDefaultRcvWnd
+	version := 1
+	var stream io.ReadWriteCloser = conn
+	if cfg != nil {
+		if cfg.MTU > 0 {
+			mtu = cfg.MTU
+		}
+		if cfg.SendWindow > 0 {
+			sndWnd = cfg.SendWindow
+		}
+		if cfg.ReceiveWindow > 0 {
+			rcvWnd = cfg.ReceiveWindow
+		}
+		if cfg.SmuxVersion > 0 {
+			version = cfg.SmuxVersion
+		}
+	}
+	conn.SetStreamMode(true)
+	conn.SetWriteDelay(false)
+	conn.SetNoDelay(mode[0], mode[1], mode[2], mode[3])
+	conn.SetWindowSize(sndWnd, rcvWnd)
+	conn.SetMtu(mtu)
+	if cfg == nil || !cfg.NoCompression {
+		stream = newSnappyStream(conn)
+	}
+
+	config := smux.DefaultConfig()
+	config.Version = version
+	config.MaxReceiveBuffer = kcpSessionBuffer
+	config.MaxStreamBuffer = kcpStreamBuffer
+	config.KeepAliveInterval = kcpKeepAlive
+	session, err := smux.Client(stream, config)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	logger.Debug("kcp session opened", "server", addr)
+	return session, nil
+}
+
+// snappyStream compresses like kcptun: a snappy framed stream, flushed on
+// every write.
+type snappyStream struct {
+	conn io.ReadWriteCloser
+	w    *snappy.Writer
+	r    *snappy.Reader
+}
+
+func newSnappyStream(conn io.ReadWriteCloser) *snappyStream {
+	return &snappyStream{conn: conn, w: snappy.NewBufferedWriter(conn), r: snappy.NewReader(conn)}
+}
+
+func (s *snappyStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *snappyStream) Write(p []byte) (int, error) {
+	if _, err := s.w.Write(p); err != nil {
+		return 0, err
+	}
+	if err := s.w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *snappyStream) Close() error {
+	return s.conn.Close()
+}
+
+// kcpConn is a flow's stream, closing the session it was opened on once
+// it has carried no stream for kcpIdleTimeout.
+type kcpConn struct {
+	*smux.Stream
+	session *smux.Session
+}
+
+func (c *kcpConn) Close() error {
+	err := c.Stream.Close()
+	session := c.session
+	time.AfterFunc(kcpIdleTimeout, func() {
+		if session.NumStreams() == 0 {
+			session.Close()
+		}
+	})
+	return err
+}
+
+// CloseWrite does nothing: kcptun ends both directions of a stream when
+// one finishes, so the relay closes it once the response is done.
+func (c *kcpConn) CloseWrite() error {
+	return nil
+}
+
+func (c *kcpConn) CloseRead() error {
+	return nil
+}
@@ -0,0 +1,188 @@
+package tun2socks
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKeepaliveInterval = 30 * time.Second
+	defaultKeepaliveFailures = 2
+)
+
+type keepaliveConfig struct {
+	Type       string `json:"type,omitempty"`
+	URL        string `json:"url,omitempty"`
+	IntervalMs int    `json:"intervalMs,omitempty"`
+	TimeoutMs  int    `json:"timeoutMs,omitempty"`
+	Failures   int    `json:"failures,omitempty"`
+}
+
+type reachabilityEvent struct {
+	Event     string `json:"event"`
+	Target    string `json:"target"`
+	LatencyMs int64  `json:"latencyMs,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// keepalive probes the main outbound periodically and reports when the
+// upstream becomes reachable or unreachable. The TUN stays up either way,
+// so this is the only sign that the proxy has gone away.
+type keepalive struct {
+	config   keepaliveConfig
+	dialer   *switchTCPHandler
+	kind     string
+	url      *url.URL
+	interval time.Duration
+	timeout  time.Duration
+	failures int
+
+	recheck   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// keepaliveProbe is guarded by stateMu.
+var keepaliveProbe *keepalive
+
+func configureKeepalive(cfg *keepaliveConfig) error {
+	if cfg == nil {
+		stopKeepaliveLocked()
+		return nil
+	}
+	if keepaliveProbe != nil && keepaliveProbe.config == *cfg {
+		return nil
+	}
+	if tcpSwitch == nil {
+		return ErrUnsupported
+	}
+
+	k := &keepalive{
+		config:   *cfg,
+		dialer:   tcpSwitch,
+		kind:     strings.ToLower(cfg.Type),
+		interval: defaultKeepaliveInterval,
+		timeout:  defaultProbeTimeout,
+		failures: defaultKeepaliveFailures,
+		recheck:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	switch k.kind {
+	case "", "http", "tcp":
+	default:
+		return fmt.Errorf("unsupported keepalive probe %q", cfg.Type)
+	}
+	u, err := parseProbeURL(cfg.URL)
+	if err != nil {
+		return err
+	}
+	k.url = u
+	if cfg.IntervalMs > 0 {
+		k.interval = time.Duration(cfg.IntervalMs) * time.Millisecond
+	}
+	if cfg.TimeoutMs > 0 {
+		k.timeout = time.Duration(cfg.TimeoutMs) * time.Millisecond
+	}
+	if cfg.Failures > 0 {
+		k.failures = cfg.Failures
+	}
+
+	stopKeepaliveLocked()
+	keepaliveProbe = k
+	go k.run()
+	return nil
+}
+
+func stopKeepaliveLocked() {
+	if keepaliveProbe != nil {
+		keepaliveProbe.close()
+		keepaliveProbe = nil
+		setUpstreamError(nil)
+	}
+}
+
+func (k *keepalive) close() {
+	k.closeOnce.Do(func() {
+		close(k.done)
+	})
+}
+
+// run reports the first result right away. Later on the upstream is only
+// declared unreachable after k.failures probes in a row have failed, so a
+// single lost probe during a handover does not flip the status.
+func (k *keepalive) run() {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	reported, reachable, failed := false, false, 0
+	for {
+		rtt, err := k.check()
+		select {
+		case <-k.done:
+			return
+		default:
+		}
+
+		if err == nil {
+			failed = 0
+			if !reported || !reachable {
+				reported, reachable = true, true
+				logger.Info("upstream reachable", "target", k.url.String(), "rtt", rtt)
+				setUpstreamError(nil)
+				emitEvent(reachabilityEvent{Event: "reachable", Target: k.url.String(), LatencyMs: rtt.Milliseconds()})
+			}
+		} else {
+			failed++
+			if !reported || (reachable && failed >= k.failures) {
+				reported, reachable = true, false
+				logger.Warn("upstream unreachable", "target", k.url.String(), "error", err)
+				setUpstreamError(err)
+				emitEvent(reachabilityEvent{Event: "unreachable", Target: k.url.String(), Error: err.Error()})
+			}
+		}
+
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+		case <-k.recheck:
+			ticker.Reset(k.interval)
+		}
+	}
+}
+
+func (k *keepalive) networkChanged() {
+	select {
+	case k.recheck <- struct{}{}:
+	default:
+	}
+}
+
+func (k *keepalive) check() (time.Duration, error) {
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+	// The outbound's dial may outlast the probe timeout, e.g. for a tcp
+	// probe, so the result is awaited separately.
+	ch := make(chan result, 1)
+	go func() {
+		rtt, err := probe(k.dialer, k.kind, k.url, k.timeout)
+		ch <- result{rtt, err}
+	}()
+
+	timer := time.NewTimer(k.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.rtt, r.err
+	case <-timer.C:
+		return 0, fmt.Errorf("keepalive probe timed out after %s", k.timeout)
+	case <-k.done:
+		return 0, errors.New("keepalive stopped")
+	}
+}
@@ -0,0 +1,42 @@
+package tun2socks
+
+import (
+	"fmt"
+	"time"
+)
+
+// namedOutbounds maps the outbound names of the configuration in effect,
+// proxy and direct included, to their outbounds. It is guarded by stateMu.
+var namedOutbounds map[string]outbound
+
+// TestOutbound measures the path through one outbound of the running
+// tunnel, bypassing routing: an HTTP request for the health check URL,
+// which includes the proxy handshake, must complete within the probe
+// timeout. An empty name tests the main proxy. Groups test the member they
+// would pick for the URL.
+func TestOutbound(name string) (time.Duration, error) {
+	if name == "" {
+		name = outboundProxy
+	}
+	stateMu.Lock()
+	ob, ok := namedOutbounds[name]
+	isRunning := running
+	stateMu.Unlock()
+	if !isRunning {
+		return 0, ErrNotRunning
+	}
+	if !ok || name == outboundBlock {
+		return 0, fmt.Errorf("%w: unknown outbound %q", ErrInvalidConfig, name)
+	}
+
+	u, err := parseProbeURL("")
+	if err != nil {
+		return 0, err
+	}
+	rtt, err := probe(ob, "http", u, defaultProbeTimeout)
+	if err != nil {
+		logger.Debug("outbound test failed", "outbound", name, "error", err)
+		return 0, err
+	}
+	return rtt, nil
+}
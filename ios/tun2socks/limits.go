@@ -0,0 +1,61 @@
+package tun2socks
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// stackConfig holds the stack limits. TCPWindow and TCPSendBuffer set
+// lwIP's TCP_WND and TCP_SND_BUF, in bytes, through the copy of
+// go-tun2socks in third_party; 0 keeps the 32 KiB default.
+type stackConfig struct {
+	MaxConnections int `json:"maxConnections,omitempty"`
+	TCPWindow      int `json:"tcpWindow,omitempty"`
+	TCPSendBuffer  int `json:"tcpSendBuffer,omitempty"`
+}
+
+const defaultTCPBuffer = 32 * 1024
+
+var (
+	maxConnections atomic.Int64
+
+	errTooManyConns = errors.New("too many tcp connections")
+)
+
+func configureLimits(cfg *stackConfig) {
+	if cfg == nil {
+		maxConnections.Store(0)
+		return
+	}
+	maxConnections.Store(int64(cfg.MaxConnections))
+}
+
+// configureTCPBuffers sets the lwIP TCP window and send buffer. It runs at
+// start only: lwIP checks a connection's window against the current value
+// when it closes, so changing it under open connections would reset them.
+func configureTCPBuffers(cfg *stackConfig) error {
+	window, sendBuffer := defaultTCPBuffer, defaultTCPBuffer
+	if cfg != nil && cfg.TCPWindow > 0 {
+		window = cfg.TCPWindow
+	}
+	if cfg != nil && cfg.TCPSendBuffer > 0 {
+		sendBuffer = cfg.TCPSendBuffer
+	}
+	return core.SetTCPBuffers(window, sendBuffer)
+}
+
+// admitTCP refuses a new TCP flow once the configured number of
+// connections is open. lwIP allocates PCBs without a limit, so this is
+// what bounds the stack's memory under a connection storm; the refused
+// app connection is reset and its PCB freed right away.
+func admitTCP() error {
+	limit := maxConnections.Load()
+	if limit <= 0 || stats.tcpConns.Load() < limit {
+		return nil
+	}
+	stats.rejectedFlows.Add(1)
+	logger.Debug("tcp connection refused", "limit", limit)
+	return errTooManyConns
+}
@@ -0,0 +1,106 @@
+package tun2socks
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// Log levels accepted by SetLogLevel and passed to the log function.
+const (
+	LogDebug = iota
+	LogInfo
+	LogWarn
+	LogError
+	LogNone
+)
+
+var (
+	logMu sync.Mutex
+	logFn func(level int, line string)
+
+	logLevel = new(slog.LevelVar)
+	logger   = slog.New(&logHandler{})
+)
+
+// SetLogLevel sets the lowest level that is logged.
+func SetLogLevel(level int) error {
+	switch level {
+	case LogDebug:
+		logLevel.Set(slog.LevelDebug)
+	case LogInfo:
+		logLevel.Set(slog.LevelInfo)
+	case LogWarn:
+		logLevel.Set(slog.LevelWarn)
+	case LogError:
+		logLevel.Set(slog.LevelError)
+	case LogNone:
+		logLevel.Set(slog.LevelError + 4)
+	default:
+		return ErrInvalidConfig
+	}
+	return nil
+}
+
+// SetLogFunc registers fn to receive each log record as one JSON line. A
+// nil fn stops logging.
+func SetLogFunc(fn func(level int, line string)) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	logFn = fn
+}
+
+// logHandler formats each record as a single JSON line and hands it to the
+// registered callback. Nothing is formatted while no callback is set.
+type logHandler struct {
+	attrs []slog.Attr
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if level < logLevel.Level() {
+		return false
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	return logFn != nil
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	logMu.Lock()
+	fn := logFn
+	logMu.Unlock()
+
+	if fn == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := slog.NewJSONHandler(&buf, nil).WithAttrs(h.attrs).Handle(ctx, r); err != nil {
+		return err
+	}
+	fn(levelOf(r.Level), string(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))))
+	return nil
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...)}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+func levelOf(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return LogError
+	case level >= slog.LevelWarn:
+		return LogWarn
+	case level >= slog.LevelInfo:
+		return LogInfo
+	default:
+		return LogDebug
+	}
+}
@@ -0,0 +1,53 @@
+package tun2socks
+
+import (
+	"errors"
+	"net/netip"
+)
+
+var errRoutingLoop = errors.New("destination is a proxy server, the tunnel would carry its own traffic")
+
+type serverEndpoint struct {
+	host string
+	port uint16
+}
+
+// rejectLoop refuses a flow from the TUN to a proxy server. Such a flow is
+// almost always the tunnel's own connection to the server, sent back into
+// the TUN by a route table that does not exclude it; relaying it would dial
+// the server again and loop until the stack runs out of connections.
+func rejectLoop(network string, target netip.AddrPort) error {
+	r := activeServerResolver.Load()
+	if r == nil || !r.isServer(target) {
+		return nil
+	}
+	stats.loopedFlows.Add(1)
+	logger.Warn("flow to proxy server refused, exclude it from the tunnel routes", "network", network, "target", target.String())
+	return errRoutingLoop
+}
+
+// isServer reports whether addr is a proxy server's port on one of the
+// addresses its name resolved to so far, NAT64 synthesis included. It does
+// not start lookups.
+func (r *serverResolver) isServer(addr netip.AddrPort) bool {
+	ip := addr.Addr().Unmap()
+	for _, s := range r.servers {
+		if s.port != addr.Port() {
+			continue
+		}
+		addrs, ok := r.fixed(s.host)
+		if !ok {
+			r.mu.Lock()
+			if e := r.entries[s.host]; e != nil {
+				addrs = e.addrs
+			}
+			r.mu.Unlock()
+		}
+		for _, a := range addrs {
+			if a.Unmap() == ip || synthesizeNAT64(a) == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pressureIdle is how long a flow must have been quiet to be closed when
+// the extension is asked to free memory.
+const pressureIdle = 10 * time.Second
+
+type memoryConfig struct {
+	Profile string `json:"profile"`
+}
+
+// memoryProfile trades memory for throughput: how often the GC runs, how
+// often freed memory is returned to the OS and how much a relay copies at
+// a time.
+type memoryProfile struct {
+	gcPercent    int
+	freeInterval time.Duration
+	relayBuffer  int
+}
+
+// memoryProfiles are the presets a configuration can pick. The unnamed one
+// leaves the Go runtime defaults; low-memory fits the Network Extension
+// limit on iOS.
+var memoryProfiles = map[string]memoryProfile{
+	"":            {gcPercent: 100, relayBuffer: 32 << 10},
+	"low-memory":  {gcPercent: 10, freeInterval: time.Minute, relayBuffer: 32 << 10},
+	"balanced":    {gcPercent: 50, freeInterval: 5 * time.Minute, relayBuffer: 32 << 10},
+	"performance": {gcPercent: 200, relayBuffer: 64 << 10},
+}
+
+var (
+	memoryMu             sync.Mutex
+	defaultMemoryProfile string
+	freeStop             chan struct{}
+)
+
+// SetMemoryProfile applies a memory profile now and makes it the one used
+// by configurations without a memory block. The C library starts with
+// low-memory.
+func SetMemoryProfile(name string) error {
+	name = strings.ToLower(name)
+	p, ok := memoryProfiles[name]
+	if !ok {
+		return fmt.Errorf("%w: unknown memory profile %q", ErrInvalidConfig, name)
+	}
+	memoryMu.Lock()
+	defer memoryMu.Unlock()
+	defaultMemoryProfile = name
+	applyMemoryProfileLocked(p)
+	return nil
+}
+
+func configureMemory(cfg *memoryConfig) {
+	memoryMu.Lock()
+	defer memoryMu.Unlock()
+
+	name := defaultMemoryProfile
+	if cfg != nil {
+		name = strings.ToLower(cfg.Profile)
+	}
+	applyMemoryProfileLocked(memoryProfiles[name])
+	logger.Debug("memory profile", "profile", name)
+}
+
+func applyMemoryProfileLocked(p memoryProfile) {
+	debug.SetGCPercent(p.gcPercent)
+	relayBufferSize.Store(int64(p.relayBuffer))
+	if freeStop != nil {
+		close(freeStop)
+		freeStop = nil
+	}
+	if p.freeInterval > 0 {
+		freeStop = make(chan struct{})
+		go freeMemoryEvery(p.freeInterval, freeStop)
+	}
+}
+
+// freeMemoryEvery returns freed memory to the OS every interval until stop
+// is closed, instead of when the scavenger gets to it.
+func freeMemoryEvery(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			debug.FreeOSMemory()
+		case <-stop:
+			return
+		}
+	}
+}
+
+type memoryStats struct {
+	HeapInUse       uint64 `json:"heapInUse"`
+	HeapIdle        uint64 `json:"heapIdle"`
+	HeapReleased    uint64 `json:"heapReleased"`
+	Sys             uint64 `json:"sys"`
+	Goroutines      int    `json:"goroutines"`
+	BufferedPackets int    `json:"bufferedPackets"`
+	Connections     int    `json:"connections"`
+	NumGC           uint32 `json:"numGC"`
+}
+
+// MemoryStats returns heap, goroutine and buffer usage as JSON.
+func MemoryStats() string {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	stateMu.Lock()
+	buffered := len(outputQueue)
+	stateMu.Unlock()
+	connMu.Lock()
+	conns := len(connections)
+	connMu.Unlock()
+
+	data, err := json.Marshal(memoryStats{
+		HeapInUse:       m.HeapInuse,
+		HeapIdle:        m.HeapIdle,
+		HeapReleased:    m.HeapReleased,
+		Sys:             m.Sys,
+		Goroutines:      runtime.NumGoroutine(),
+		BufferedPackets: buffered,
+		Connections:     conns,
+		NumGC:           m.NumGC,
+	})
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// OnMemoryPressure closes quiet flows and pooled proxy connections, drops
+// queued output packets and returns freed memory to the OS. It returns the
+// number of flows closed.
+func OnMemoryPressure() int {
+	closed := abortFlows("", pressureIdle)
+
+	httpProxyPool.closeAll()
+
+	stateMu.Lock()
+	queue := outputQueue
+	stateMu.Unlock()
+	if queue != nil {
+	drain:
+		for {
+			select {
+			case packet := <-queue:
+				putPacket(packet)
+				droppedPackets.Add(1)
+			default:
+				break drain
+			}
+		}
+	}
+
+	debug.FreeOSMemory()
+	logger.Info("memory pressure handled", "closed", closed)
+	return closed
+}
@@ -0,0 +1,243 @@
+package tun2socks
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dialBuckets are the upper bounds, in seconds, of the dial latency
+// histogram. They span a LAN proxy to a slow handshake on a congested
+// cellular link.
+var dialBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a cumulative Prometheus histogram with fixed buckets.
+type histogram struct {
+	bounds []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	sumNs  atomic.Int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds))}
+}
+
+// observe counts d. The total goes first, so a concurrent scrape never sees
+// a bucket above the +Inf one.
+func (h *histogram) observe(d time.Duration) {
+	h.count.Add(1)
+	h.sumNs.Add(int64(d))
+	for i, bound := range h.bounds {
+		if d.Seconds() <= bound {
+			h.counts[i].Add(1)
+		}
+	}
+}
+
+// quantile estimates the q-quantile of the observations, interpolating
+// within its bucket as Prometheus does. Observations above the last bound
+// are reported as that bound.
+func (h *histogram) quantile(q float64) time.Duration {
+	count := h.count.Load()
+	if count == 0 {
+		return 0
+	}
+	rank := q * float64(count)
+	lower, below := 0.0, uint64(0)
+	for i, bound := range h.bounds {
+		n := h.counts[i].Load()
+		if float64(n) >= rank {
+			return seconds(lower + (bound-lower)*(rank-float64(below))/float64(n-below))
+		}
+		lower, below = bound, n
+	}
+	return seconds(lower)
+}
+
+func (h *histogram) latency() latencySnapshot {
+	ms := func(d time.Duration) float64 {
+		return float64(d.Microseconds()) / 1000
+	}
+	return latencySnapshot{
+		Count: h.count.Load(),
+		P50Ms: ms(h.quantile(0.5)),
+		P90Ms: ms(h.quantile(0.9)),
+		P99Ms: ms(h.quantile(0.99)),
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// dialLatency times how long flows take to get a connection through their
+// outbound, proxy handshakes and retries included.
+var dialLatency = newHistogram(dialBuckets)
+
+var (
+	metricsMu       sync.Mutex
+	metricsListener net.Listener
+)
+
+// StartMetrics serves the counters in the Prometheus text format at
+// /metrics on addr, replacing a server already running. It does not need
+// the tunnel to run, so a scraper sees it go down and up across restarts.
+func StartMetrics(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("%w: metrics need a listen address", ErrInvalidConfig)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	if metricsListener != nil {
+		metricsListener.Close()
+	}
+	metricsListener = ln
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Warn("metrics server stopped", "error", err)
+		}
+	}()
+	logger.Info("metrics started", "listen", ln.Addr().String())
+	return nil
+}
+
+// StopMetrics closes the metrics listener.
+func StopMetrics() {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	if metricsListener != nil {
+		metricsListener.Close()
+		metricsListener = nil
+		logger.Info("metrics stopped")
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	writeMetrics(bw)
+	bw.Flush()
+}
+
+func writeMetrics(w io.Writer) {
+	stateMu.Lock()
+	up := 0
+	if running {
+		up = 1
+	}
+	stateMu.Unlock()
+	s := stats.snapshot()
+
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("tun2socks_up", "gauge", "Whether the tunnel is running.")
+	fmt.Fprintf(w, "tun2socks_up %d\n", up)
+	metric("tun2socks_tcp_connections", "gauge", "Open TCP flows.")
+	fmt.Fprintf(w, "tun2socks_tcp_connections %d\n", s.TCPConnections)
+	metric("tun2socks_udp_sessions", "gauge", "Open UDP sessions.")
+	fmt.Fprintf(w, "tun2socks_udp_sessions %d\n", s.UDPSessions)
+
+	metric("tun2socks_bytes_total", "counter", "IP bytes crossing the TUN interface since start.")
+	for _, proto := range []string{"tcp", "udp", "other"} {
+		p := s.Protocols[proto]
+		fmt.Fprintf(w, "tun2socks_bytes_total{protocol=%q,direction=\"uplink\"} %d\n", proto, p.UplinkBytes)
+		fmt.Fprintf(w, "tun2socks_bytes_total{protocol=%q,direction=\"downlink\"} %d\n", proto, p.DownlinkBytes)
+	}
+	metric("tun2socks_packets_total", "counter", "IP packets crossing the TUN interface since start.")
+	for _, proto := range []string{"tcp", "udp", "other"} {
+		p := s.Protocols[proto]
+		fmt.Fprintf(w, "tun2socks_packets_total{protocol=%q,direction=\"uplink\"} %d\n", proto, p.UplinkPackets)
+		fmt.Fprintf(w, "tun2socks_packets_total{protocol=%q,direction=\"downlink\"} %d\n", proto, p.DownlinkPackets)
+	}
+	metric("tun2socks_tcp_payload_bytes_total", "counter", "TCP payload bytes relayed since start.")
+	fmt.Fprintf(w, "tun2socks_tcp_payload_bytes_total{direction=\"uplink\"} %d\n", s.RelayUplink)
+	fmt.Fprintf(w, "tun2socks_tcp_payload_bytes_total{direction=\"downlink\"} %d\n", s.RelayDownlink)
+
+	for _, c := range []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"tun2socks_dropped_packets_total", "Output packets dropped by the queue.", s.DroppedPackets},
+		{"tun2socks_blocked_flows_total", "Flows refused by blocking rules since start.", s.BlockedFlows},
+		{"tun2socks_blocked_queries_total", "DNS queries answered by blocking rules since start.", s.BlockedQueries},
+		{"tun2socks_rejected_flows_total", "Flows refused at the connection limit since start.", s.RejectedFlows},
+		{"tun2socks_looped_flows_total", "Flows to a proxy server refused as routing loops since start.", s.LoopedFlows},
+		{"tun2socks_dns_cache_hits_total", "DNS queries answered from the cache since start.", s.DNSCacheHits},
+		{"tun2socks_dns_cache_misses_total", "DNS queries sent upstream with the cache on since start.", s.DNSCacheMisses},
+		{"tun2socks_dns_coalesced_queries_total", "DNS queries answered by an identical query in flight since start.", s.DNSCoalesced},
+		{"tun2socks_udp_evicted_sessions_total", "UDP sessions closed to stay under the session limit since start.", s.UDPEvicted},
+		{"tun2socks_udp_filtered_packets_total", "UDP datagrams dropped by NAT filtering since start.", s.UDPFiltered},
+		{"tun2socks_stack_recoveries_total", "Times the watchdog rebuilt a wedged stack since start.", s.StackRecovered},
+		{"tun2socks_ttl_dropped_packets_total", "Packets from the device dropped for a low TTL or hop limit since start.", s.TTLDropped},
+		{"tun2socks_multicast_dropped_packets_total", "Multicast and broadcast packets from the device dropped since start.", s.MulticastDrops},
+	} {
+		metric(c.name, "counter", c.help)
+		fmt.Fprintf(w, "%s %d\n", c.name, c.value)
+	}
+
+	metric("tun2socks_flow_errors_total", "counter", "Flows that failed to connect, by kind.")
+	for code := range errorCounts {
+		fmt.Fprintf(w, "tun2socks_flow_errors_total{kind=%q} %d\n", errCodeNames[code], errorCounts[code].Load())
+	}
+
+	metric("tun2socks_dial_duration_seconds", "histogram", "Time to connect a flow through its outbound, including proxy handshakes and retries.")
+	writeHistogram(w, "tun2socks_dial_duration_seconds", "", dialLatency)
+
+	metric("tun2socks_outbound_latency_seconds", "histogram", "Time to connect to a proxy server, complete its handshake and receive the first byte of an answer, by outbound and phase.")
+	timings := outboundTimingList()
+	for _, t := range timings {
+		for _, phase := range []struct {
+			name string
+			h    *histogram
+		}{{"connect", t.connect}, {"handshake", t.handshake}, {"first_byte", t.firstByte}} {
+			labels := fmt.Sprintf("outbound=%q,phase=%q", t.name, phase.name)
+			writeHistogram(w, "tun2socks_outbound_latency_seconds", labels, phase.h)
+		}
+	}
+	metric("tun2socks_outbound_no_response_total", "counter", "Flows closed without an answer after sending data, by outbound.")
+	for _, t := range timings {
+		fmt.Fprintf(w, "tun2socks_outbound_no_response_total{outbound=%q} %d\n", t.name, t.noResponse.Load())
+	}
+
+	metric("tun2socks_goroutines", "gauge", "Running goroutines.")
+	fmt.Fprintf(w, "tun2socks_goroutines %d\n", runtime.NumGoroutine())
+}
+
+// writeHistogram writes the samples of h, with labels added to each.
+func writeHistogram(w io.Writer, name string, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, bound, h.counts[i].Load())
+	}
+	count := h.count.Load()
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, time.Duration(h.sumNs.Load()).Seconds())
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, count)
+}
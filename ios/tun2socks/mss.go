@@ -0,0 +1,94 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+const (
+	defaultMTU  = 1500
+	minMTU      = 576
+	tcpOptMSS   = 2
+	tcpFlagSYN  = 0x02
+	tcpFlagACK  = 0x10
+	ipv4TCPOver = 40
+	ipv6TCPOver = 60
+)
+
+var clampMTU atomic.Int32
+
+func configureMTU(mtu int) {
+	if mtu <= 0 || mtu >= defaultMTU {
+		clampMTU.Store(0)
+		return
+	}
+	clampMTU.Store(int32(mtu))
+}
+
+// clampMSS lowers the MSS option of a TCP SYN so that neither side sends
+// segments larger than the tunnel MTU. The packet is rewritten in place.
+func clampMSS(packet []byte) {
+	mtu := int(clampMTU.Load())
+	if mtu == 0 || len(packet) < 1 {
+		return
+	}
+
+	var tcp []byte
+	var mss int
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if len(packet) < ihl+20 || packet[9] != ipProtoTCP || binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return
+		}
+		tcp = packet[ihl:]
+		mss = mtu - ipv4TCPOver
+	case 6:
+		if len(packet) < 60 || packet[6] != ipProtoTCP {
+			return
+		}
+		tcp = packet[40:]
+		mss = mtu - ipv6TCPOver
+	default:
+		return
+	}
+
+	if tcp[13]&tcpFlagSYN == 0 {
+		return
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset > len(tcp) {
+		return
+	}
+	for i := 20; i < dataOffset; {
+		switch tcp[i] {
+		case 0:
+			return
+		case 1:
+			i++
+			continue
+		}
+		if i+1 >= dataOffset || tcp[i+1] < 2 {
+			return
+		}
+		if tcp[i] == tcpOptMSS && tcp[i+1] == 4 && i+4 <= dataOffset {
+			old := binary.BigEndian.Uint16(tcp[i+2:])
+			if int(old) > mss {
+				binary.BigEndian.PutUint16(tcp[i+2:], uint16(mss))
+				updateChecksum(tcp[16:18], old, uint16(mss))
+			}
+			return
+		}
+		i += int(tcp[i+1])
+	}
+}
+
+// updateChecksum adjusts an internet checksum for a changed 16-bit word
+// (RFC 1624).
+func updateChecksum(field []byte, old uint16, new uint16) {
+	sum := uint32(^binary.BigEndian.Uint16(field)) + uint32(^old) + uint32(new)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	binary.BigEndian.PutUint16(field, ^uint16(sum))
+}
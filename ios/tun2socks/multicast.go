@@ -0,0 +1,186 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// What happens to packets from the device sent to a multicast or broadcast
+// address. No proxy can carry them, so SSDP and mDNS announcements would
+// otherwise open a session and a doomed proxy dial each.
+const (
+	multicastPass = iota
+	multicastDrop
+	multicastDirect
+	multicastLog
+)
+
+var multicastModes = map[string]int32{
+	"":       multicastDrop,
+	"drop":   multicastDrop,
+	"direct": multicastDirect,
+	"log":    multicastLog,
+}
+
+// multicastLogInterval is how often the log mode reports packets to the
+// same group and port; discovery protocols repeat every few seconds.
+const (
+	multicastLogInterval = time.Minute
+	maxMulticastLogged   = 256
+)
+
+var (
+	multicastMode atomic.Int32
+
+	multicastLogMu sync.Mutex
+	multicastSeen  = make(map[netip.AddrPort]time.Time)
+)
+
+// configureMulticast sets the policy. WireGuard carries any packet to its
+// peer, so there they pass untouched.
+func configureMulticast(mode string, proxy proxyConfig) {
+	if proxy.Type == "wireguard" {
+		multicastMode.Store(multicastPass)
+		return
+	}
+	multicastMode.Store(multicastModes[mode])
+}
+
+func isMulticastAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsMulticast() || addr == netip.AddrFrom4([4]byte{255, 255, 255, 255})
+}
+
+// filterMulticast reports whether packet is sent to a multicast or
+// broadcast address and must not enter the stack. In direct mode UDP ones
+// enter it and go out through the direct outbound.
+func filterMulticast(packet []byte) bool {
+	mode := multicastMode.Load()
+	if mode == multicastPass || len(packet) < 1 {
+		return false
+	}
+	var dst netip.Addr
+	var proto byte
+	var l4 []byte
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < 20 || len(packet) < ihl {
+			return false
+		}
+		dst = netip.AddrFrom4([4]byte(packet[16:20]))
+		proto, l4 = packet[9], packet[ihl:]
+	case 6:
+		if len(packet) < 40 {
+			return false
+		}
+		dst = netip.AddrFrom16([16]byte(packet[24:40]))
+		proto, l4 = packet[6], packet[40:]
+	default:
+		return false
+	}
+	if !isMulticastAddr(dst) {
+		return false
+	}
+	if mode == multicastDirect && proto == ipProtoUDP {
+		return false
+	}
+	if mode == multicastLog {
+		var port uint16
+		if (proto == ipProtoUDP || proto == ipProtoTCP) && len(l4) >= 4 {
+			port = binary.BigEndian.Uint16(l4[2:])
+		}
+		logMulticast(netip.AddrPortFrom(dst, port), proto)
+	}
+	stats.multicastDropped.Add(1)
+	return true
+}
+
+// logMulticast reports a dropped packet to target, once per
+// multicastLogInterval.
+func logMulticast(target netip.AddrPort, proto byte) {
+	now := time.Now()
+	multicastLogMu.Lock()
+	if last, ok := multicastSeen[target]; ok && now.Sub(last) < multicastLogInterval {
+		multicastLogMu.Unlock()
+		return
+	}
+	if len(multicastSeen) >= maxMulticastLogged {
+		clear(multicastSeen)
+	}
+	multicastSeen[target] = now
+	multicastLogMu.Unlock()
+	logger.Info("multicast dropped", "target", target.String(), "proto", proto)
+}
+
+// multicastUDPHandler sends the UDP sessions to multicast and broadcast
+// addresses that direct mode lets into the stack through the direct
+// outbound, whatever the rules say.
+type multicastUDPHandler struct {
+	sync.Mutex
+
+	inner  core.UDPConnHandler
+	direct core.UDPConnHandler
+	conns  map[core.UDPConn]*multicastUDPConn
+}
+
+type multicastUDPConn struct {
+	core.UDPConn
+	owner *multicastUDPHandler
+}
+
+func newMulticastUDPHandler(inner core.UDPConnHandler, direct core.UDPConnHandler) core.UDPConnHandler {
+	return &multicastUDPHandler{
+		inner:  inner,
+		direct: direct,
+		conns:  make(map[core.UDPConn]*multicastUDPConn),
+	}
+}
+
+func (h *multicastUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	if target == nil || multicastMode.Load() != multicastDirect || !isMulticastAddr(target.AddrPort().Addr()) {
+		return h.inner.Connect(conn, target)
+	}
+	mc := &multicastUDPConn{UDPConn: conn, owner: h}
+	h.Lock()
+	h.conns[conn] = mc
+	h.Unlock()
+	onSessionClose(conn, func() { h.forget(conn) })
+
+	if err := h.direct.Connect(mc, target); err != nil {
+		h.forget(conn)
+		return err
+	}
+	return nil
+}
+
+func (h *multicastUDPHandler) forget(conn core.UDPConn) {
+	h.Lock()
+	delete(h.conns, conn)
+	h.Unlock()
+}
+
+func (h *multicastUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	mc, ok := h.conns[conn]
+	h.Unlock()
+	if ok {
+		return h.direct.ReceiveTo(mc, data, addr)
+	}
+	return h.inner.ReceiveTo(conn, data, addr)
+}
+
+func (c *multicastUDPConn) Close() error {
+	c.owner.forget(c.UDPConn)
+	return c.UDPConn.Close()
+}
+
+func (c *multicastUDPConn) unwrapUDP() core.UDPConn {
+	return c.UDPConn
+}
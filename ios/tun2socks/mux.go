@@ -0,0 +1,258 @@
+package tun2socks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+	"github.com/hashicorp/yamux"
+)
+
+// Multiplexing as done by sing-box: the proxy is asked to CONNECT to a
+// magic hostname, that stream starts with a version and protocol byte and
+// then carries a yamux session. Every yamux stream opens with flags and the
+// target as a SOCKS address, and the server answers with a status byte
+// before the first data.
+const (
+	muxMagicAddress  = "sp.mux.sing-box.arpa:444"
+	muxVersion       = 0
+	muxProtocolYAMux = 1
+	muxStatusSuccess = 0
+
+	defaultMuxConnections = 4
+	defaultMuxStreams     = 16
+	muxStreamTimeout      = 5 * time.Second
+	muxIdleTimeout        = time.Minute
+)
+
+type muxConfig struct {
+	Connections int `json:"connections,omitempty"`
+	Streams     int `json:"streams,omitempty"`
+}
+
+// muxOutbound carries the TCP flows of an outbound as streams over a few
+// long-lived proxy connections. A new connection is only opened once every
+// existing one carries the stream limit; at the connection limit streams
+// go to the least busy one regardless.
+type muxOutbound struct {
+	inner       outbound
+	connections int
+	streams     int
+	config      *yamux.Config
+
+	mu       sync.Mutex
+	sessions []*yamux.Session
+}
+
+func newMuxOutbound(inner outbound, cfg *muxConfig) outbound {
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	config.StreamOpenTimeout = muxStreamTimeout
+	config.StreamCloseTimeout = muxStreamTimeout
+
+	m := &muxOutbound{
+		inner:       inner,
+		connections: defaultMuxConnections,
+		streams:     defaultMuxStreams,
+		config:      config,
+	}
+	if cfg.Connections > 0 {
+		m.connections = cfg.Connections
+	}
+	if cfg.Streams > 0 {
+		m.streams = cfg.Streams
+	}
+	return m
+}
+
+func (m *muxOutbound) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(m, conn, target)
+}
+
+func (m *muxOutbound) Dial(network string, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return m.inner.Dial(network, addr)
+	}
+	target := socks.ParseAddr(addr)
+	if target == nil {
+		return nil, fmt.Errorf("invalid target address %q", addr)
+	}
+
+	var err error
+	// A session found dead when opening the stream is dropped and the
+	// stream is tried once more on another.
+	for range 2 {
+		var session *yamux.Session
+		session, err = m.session()
+		if err != nil {
+			return nil, err
+		}
+		var stream *yamux.Stream
+		stream, err = session.OpenStream()
+		if err != nil {
+			session.Close()
+			continue
+		}
+		if _, err := stream.Write(append([]byte{0, 0}, target...)); err != nil {
+			stream.Close()
+			return nil, err
+		}
+		return &muxConn{Stream: stream, owner: m}, nil
+	}
+	return nil, err
+}
+
+func (m *muxOutbound) session() (*yamux.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	live := m.sessions[:0]
+	var best *yamux.Session
+	for _, s := range m.sessions {
+		if s.IsClosed() {
+			continue
+		}
+		live = append(live, s)
+		if best == nil || s.NumStreams() < best.NumStreams() {
+			best = s
+		}
+	}
+	m.sessions = live
+	if best != nil && (best.NumStreams() < m.streams || len(m.sessions) >= m.connections) {
+		return best, nil
+	}
+
+	conn, err := m.inner.Dial("tcp", muxMagicAddress)
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{muxVersion, muxProtocolYAMux}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	session, err := yamux.Client(conn, m.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	m.sessions = append(m.sessions, session)
+	return session, nil
+}
+
+// release closes session once it has carried no stream for muxIdleTimeout,
+// so an idle tunnel does not keep proxy connections open.
+func (m *muxOutbound) release(session *yamux.Session) {
+	time.AfterFunc(muxIdleTimeout, func() {
+		if session.NumStreams() == 0 {
+			session.Close()
+		}
+	})
+}
+
+func (m *muxOutbound) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.sessions {
+		s.Close()
+	}
+	m.sessions = nil
+	if c, ok := m.inner.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// shutdown lets every session finish its streams before closing it.
+func (m *muxOutbound) shutdown() {
+	m.retireSessions()
+	if g, ok := m.inner.(interface{ shutdown() }); ok {
+		g.shutdown()
+	}
+}
+
+// networkChanged opens new sessions for later streams, leaving the ones on
+// the previous network to finish.
+func (m *muxOutbound) networkChanged() {
+	m.retireSessions()
+	if n, ok := m.inner.(networkObserver); ok {
+		n.networkChanged()
+	}
+}
+
+func (m *muxOutbound) retireSessions() {
+	m.mu.Lock()
+	sessions := m.sessions
+	m.sessions = nil
+	m.mu.Unlock()
+
+	for _, s := range sessions {
+		go func() {
+			for s.NumStreams() > 0 && !s.IsClosed() {
+				time.Sleep(time.Second)
+			}
+			s.Close()
+		}()
+	}
+}
+
+type muxConn struct {
+	*yamux.Stream
+	owner     *muxOutbound
+	responded bool
+}
+
+func (c *muxConn) Read(p []byte) (int, error) {
+	if !c.responded {
+		var status [1]byte
+		if _, err := io.ReadFull(c.Stream, status[:]); err != nil {
+			return 0, err
+		}
+		if status[0] != muxStatusSuccess {
+			message, _ := readMuxMessage(c.Stream)
+			return 0, fmt.Errorf("%w: %s", errConnectRejected, message)
+		}
+		c.responded = true
+	}
+	return c.Stream.Read(p)
+}
+
+func readMuxMessage(r io.Reader) (string, error) {
+	br := bufio.NewReader(io.LimitReader(r, binary.MaxVarintLen64+1024))
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	if n > 1024 {
+		return "", errors.New("mux error message too long")
+	}
+	message := make([]byte, n)
+	_, err = io.ReadFull(br, message)
+	return string(message), err
+}
+
+// CloseWrite sends FIN; yamux keeps the stream readable until the server
+// closes its side.
+func (c *muxConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+func (c *muxConn) CloseRead() error {
+	return nil
+}
+
+func (c *muxConn) Close() error {
+	c.Stream.SetReadDeadline(time.Now())
+	err := c.Stream.Close()
+	c.owner.release(c.Stream.Session())
+	return err
+}
@@ -0,0 +1,74 @@
+package tun2socks
+
+import (
+	"fmt"
+	"strings"
+)
+
+// networkObserver is implemented by what holds connections or state tied to
+// the network the device is on.
+type networkObserver interface {
+	networkChanged()
+}
+
+var networkTypes = map[string]bool{"": true, "wifi": true, "cellular": true, "wired": true, "other": true, "none": true}
+
+type networkEvent struct {
+	Event      string `json:"event"`
+	Network    string `json:"network,omitempty"`
+	ResetFlows int    `json:"resetFlows"`
+}
+
+// NotifyNetworkChange tells the tunnel that the device moved to another
+// network. networkType is "wifi", "cellular", "wired", "other" or "none"
+// when the device went offline. Pooled proxy connections and UDP flows,
+// whose NAT mappings belong to the previous network, are closed right away.
+// Unless offline, NAT64 is discovered again, the pool is refilled, HTTP/2,
+// mux and KCP sessions are replaced for new flows, a WireGuard tunnel moves
+// to a new socket and health checks and the keepalive probe run without
+// waiting for their interval. Established TCP flows are left alone.
+func NotifyNetworkChange(networkType string) error {
+	networkType = strings.ToLower(networkType)
+	if !networkTypes[networkType] {
+		return fmt.Errorf("%w: unknown network type %q", ErrInvalidConfig, networkType)
+	}
+
+	stateMu.Lock()
+	if !running {
+		stateMu.Unlock()
+		return ErrNotRunning
+	}
+	var observers []networkObserver
+	for _, r := range resources {
+		if n, ok := r.(networkObserver); ok {
+			observers = append(observers, n)
+		}
+	}
+	if n, ok := lwipStack.(networkObserver); ok {
+		observers = append(observers, n)
+	}
+	if keepaliveProbe != nil {
+		observers = append(observers, keepaliveProbe)
+	}
+	stateMu.Unlock()
+
+	addrs := httpProxyPool.closeAll()
+	kcpSessions.retire()
+	reset := abortFlows("udp", 0)
+	FlushDNSCache()
+	logger.Info("network changed", "network", networkType, "resetFlows", reset)
+	emitEvent(networkEvent{Event: "network", Network: networkType, ResetFlows: reset})
+
+	if networkType == "none" {
+		return nil
+	}
+	go func() {
+		refreshNAT64()
+		refreshServerAddrs()
+		httpProxyPool.warm(addrs)
+		for _, n := range observers {
+			n.networkChanged()
+		}
+	}()
+	return nil
+}
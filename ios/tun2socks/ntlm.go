@@ -0,0 +1,161 @@
+package tun2socks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLM messages as described in MS-NLMP. Only NTLMv2 responses are sent;
+// the session key, signing and the MIC are left out since the proxy only
+// authenticates the connection.
+const (
+	ntlmNegotiateUnicode       = 0x00000001
+	ntlmNegotiateOEM           = 0x00000002
+	ntlmRequestTarget          = 0x00000004
+	ntlmNegotiateNTLM          = 0x00000200
+	ntlmNegotiateAlwaysSign    = 0x00008000
+	ntlmNegotiateExtendedSec   = 0x00080000
+	ntlmNegotiateTargetInfo    = 0x00800000
+	ntlmNegotiate128           = 0x20000000
+	ntlmNegotiate56            = 0x80000000
+	ntlmAvEOL                  = 0
+	ntlmAvTimestamp            = 7
+	ntlmChallengeHeaderSize    = 48
+	ntlmAuthenticateHeaderSize = 64
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+const ntlmNegotiateFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget | ntlmNegotiateNTLM |
+	ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSec | ntlmNegotiate128 | ntlmNegotiate56
+
+func ntlmNegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateFlags)
+	return msg
+}
+
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  [8]byte
+	targetInfo []byte
+}
+
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < ntlmChallengeHeaderSize || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errors.New("invalid ntlm challenge")
+	}
+	c := &ntlmChallenge{flags: binary.LittleEndian.Uint32(msg[20:])}
+	copy(c.challenge[:], msg[24:32])
+	if c.flags&ntlmNegotiateTargetInfo != 0 {
+		length := int(binary.LittleEndian.Uint16(msg[40:]))
+		offset := int(binary.LittleEndian.Uint32(msg[44:]))
+		if offset+length > len(msg) {
+			return nil, errors.New("invalid ntlm target info")
+		}
+		c.targetInfo = msg[offset : offset+length]
+	}
+	return c, nil
+}
+
+// timestamp returns the server time from the target info, if any.
+func (c *ntlmChallenge) timestamp() ([]byte, bool) {
+	info := c.targetInfo
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == ntlmAvEOL || len(info) < 4+length {
+			break
+		}
+		if id == ntlmAvTimestamp && length == 8 {
+			return info[4:12], true
+		}
+		info = info[4+length:]
+	}
+	return nil, false
+}
+
+// ntlmAuthenticateMessage answers a challenge with NTLMv2. username may be
+// given as DOMAIN\user.
+func ntlmAuthenticateMessage(c *ntlmChallenge, username string, password string) ([]byte, error) {
+	domain, user, found := strings.Cut(username, `\`)
+	if !found {
+		domain, user = "", username
+	}
+
+	h := md4.New()
+	h.Write(utf16LE(password))
+	ntowf := hmacMD5(h.Sum(nil), utf16LE(strings.ToUpper(user)+domain))
+
+	var clientChallenge [8]byte
+	if _, err := rand.Read(clientChallenge[:]); err != nil {
+		return nil, err
+	}
+	stamp, serverTime := c.timestamp()
+	if !serverTime {
+		stamp = binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()/100+116444736000000000))
+	}
+
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, stamp...)
+	temp = append(temp, clientChallenge[:]...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, c.targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+	ntResponse := append(hmacMD5(ntowf, c.challenge[:], temp), temp...)
+
+	// With a server timestamp the LMv2 response must be zeroed.
+	lmResponse := make([]byte, 24)
+	if !serverTime {
+		lmResponse = append(hmacMD5(ntowf, c.challenge[:], clientChallenge[:]), clientChallenge[:]...)
+	}
+
+	flags := c.flags & ntlmNegotiateFlags
+	flags |= ntlmNegotiateNTLM
+	encode := utf16LE
+	if flags&ntlmNegotiateUnicode == 0 {
+		encode = func(s string) []byte { return []byte(s) }
+	}
+	fields := [][]byte{lmResponse, ntResponse, encode(domain), encode(user), nil, nil}
+
+	msg := make([]byte, ntlmAuthenticateHeaderSize)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, field := range fields {
+		at := 12 + i*8
+		binary.LittleEndian.PutUint16(msg[at:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(msg[at+2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(msg[at+4:], uint32(len(msg)))
+		msg = append(msg, field...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+	return msg, nil
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func utf16LE(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
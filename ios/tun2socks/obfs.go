@@ -0,0 +1,83 @@
+package tun2socks
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const obfsUserAgent = "curl/7.88.1"
+
+// obfsHTTPConn speaks the client side of simple-obfs HTTP mode. The first
+// write goes out as the body of a WebSocket upgrade request and the
+// server's 101 response is skipped before the first read; after that the
+// stream is passed through untouched. Both proxy protocols it wraps have
+// the client write first.
+type obfsHTTPConn struct {
+	net.Conn
+	request  string
+	reader   *bufio.Reader
+	sent     bool
+	received bool
+}
+
+func newObfsHTTPConn(conn net.Conn, cfg *transportConfig, addr string) net.Conn {
+	host, port, _ := net.SplitHostPort(addr)
+	if cfg.Host != "" {
+		host = cfg.Host
+	}
+	if port != "80" {
+		host = net.JoinHostPort(host, port)
+	}
+	path := cfg.Path
+	if path == "" {
+		path = "/"
+	}
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	headers := map[string]string{"User-Agent": obfsUserAgent}
+	for k, v := range cfg.Headers {
+		headers[http.CanonicalHeaderKey(k)] = v
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "GET %s HTTP/1.1\r\nHost: %s\r\n", path, host)
+	for _, k := range slices.Sorted(maps.Keys(headers)) {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, headers[k])
+	}
+	fmt.Fprintf(&b, "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\n", base64.StdEncoding.EncodeToString(key))
+	return &obfsHTTPConn{Conn: conn, request: b.String(), reader: bufio.NewReader(conn)}
+}
+
+func (c *obfsHTTPConn) Write(p []byte) (int, error) {
+	if c.sent {
+		return c.Conn.Write(p)
+	}
+	c.sent = true
+	head := fmt.Sprintf("%sContent-Length: %d\r\n\r\n", c.request, len(p))
+	if _, err := c.Conn.Write(append([]byte(head), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *obfsHTTPConn) Read(p []byte) (int, error) {
+	if !c.received {
+		resp, err := http.ReadResponse(c.reader, nil)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			return 0, fmt.Errorf("obfs server answered %s", resp.Status)
+		}
+		c.received = true
+	}
+	return c.reader.Read(p)
+}
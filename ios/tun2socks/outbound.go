@@ -0,0 +1,254 @@
+package tun2socks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/proxy/dnsfallback"
+	"golang.org/x/net/proxy"
+)
+
+const maxRetryBackoff = 2 * time.Second
+
+type outbound interface {
+	core.TCPConnHandler
+	proxy.Dialer
+}
+
+type retryConfig struct {
+	Attempts  int `json:"attempts"`
+	BackoffMs int `json:"backoffMs,omitempty"`
+}
+
+var (
+	retryAttempts atomic.Int32
+	retryBackoff  atomic.Int64
+)
+
+func configureRetry(cfg *retryConfig) {
+	if cfg == nil {
+		retryAttempts.Store(0)
+		return
+	}
+	backoff := 200 * time.Millisecond
+	if cfg.BackoffMs > 0 {
+		backoff = time.Duration(cfg.BackoffMs) * time.Millisecond
+	}
+	retryAttempts.Store(int32(cfg.Attempts))
+	retryBackoff.Store(int64(backoff))
+}
+
+// retryable reports whether a failed dial may succeed when repeated, such
+// as after a timeout or a reset during a network handover. Answers from the
+// proxy itself and refused connections are final.
+func retryable(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, errBlocked) {
+		return false
+	}
+	switch classifyError(err) {
+	case errCodeAuthFailed, errCodeRejected, errCodeTLSFailure, errCodePinMismatch:
+		return false
+	case errCodeDNSFailure:
+		var dnsErr *net.DNSError
+		return errors.As(err, &dnsErr) && !dnsErr.IsNotFound
+	default:
+		return true
+	}
+}
+
+// dialWithRetry dials through dialer, repeating retryable failures with
+// doubling backoff up to the configured number of extra attempts.
+func dialWithRetry(dialer proxy.Dialer, network string, addr string) (net.Conn, error) {
+	attempts := int(retryAttempts.Load())
+	backoff := time.Duration(retryBackoff.Load())
+	start := time.Now()
+	for i := 0; ; i++ {
+		c, err := dialer.Dial(network, addr)
+		if err == nil {
+			dialLatency.observe(time.Since(start))
+		}
+		if err == nil || i >= attempts || !retryable(err) || draining.Load() {
+			return c, err
+		}
+		logger.Debug("dial failed, retrying", "target", addr, "attempt", i+1, "error", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// dialServer reaches a proxy server, through via when the outbound is
+// chained behind another one.
+func dialServer(via proxy.Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	if via != nil {
+		return via.Dial("tcp", addr)
+	}
+	return dialTCP(addr, timeout)
+}
+
+func relayThrough(dialer proxy.Dialer, conn net.Conn, target *net.TCPAddr) error {
+	if target == nil {
+		return errors.New("missing target address")
+	}
+	if ipv6Disabled() && target.IP.To4() == nil {
+		return errIPv6Disabled
+	}
+
+	if flowRedirector.Load() != nil {
+		go redirectThrough(dialer, conn, target)
+		return nil
+	}
+
+	c, err := dialTarget(dialer, target.String())
+	if err != nil {
+		return err
+	}
+	go relayTCP(conn, c)
+	return nil
+}
+
+func dialTarget(dialer proxy.Dialer, addr string) (net.Conn, error) {
+	c, err := dialWithRetry(dialer, "tcp", addr)
+	if errors.Is(err, errBlocked) {
+		return nil, err
+	}
+	if err != nil {
+		logger.Warn("dial failed", "target", addr, "error", err)
+		reportError("tcp", addr, err)
+		return nil, err
+	}
+	return c, nil
+}
+
+// newOutbound builds the outbound for cfg. A non-nil via is the outbound
+// its proxy server is reached through, for chained proxies.
+func newOutbound(cfg proxyConfig, via proxy.Dialer, dialTimeout time.Duration, udpTimeout time.Duration) (outbound, core.UDPConnHandler, error) {
+	ob, udp, err := newProxyOutbound(cfg, via, dialTimeout, udpTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Mux != nil {
+		ob = newMuxOutbound(ob, cfg.Mux)
+	}
+	if cfg.UDPOverTCP {
+		udp = newUoTUDPHandler(ob, udpTimeout)
+	}
+	if cfg.HalfClose != nil && !*cfg.HalfClose {
+		ob = &fullCloseOutbound{outbound: ob}
+	}
+	return ob, udp, nil
+}
+
+// fullCloseOutbound never half-closes the upstream side of its flows: when
+// the app finishes sending, the proxy connection stays open until the
+// response is done. Some proxies take a FIN for a full close and cut the
+// response short.
+type fullCloseOutbound struct {
+	outbound
+}
+
+func (o *fullCloseOutbound) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(o, conn, target)
+}
+
+func (o *fullCloseOutbound) Dial(network string, addr string) (net.Conn, error) {
+	c, err := o.outbound.Dial(network, addr)
+	if err != nil || network != "tcp" {
+		return c, err
+	}
+	return &fullCloseConn{halfCloser: halfCloser{c}}, nil
+}
+
+func (o *fullCloseOutbound) Bind(target string) (*binding, error) {
+	return bindThrough(o.outbound, target)
+}
+
+func (o *fullCloseOutbound) CanBind(target string) bool {
+	return canBindThrough(o.outbound, target)
+}
+
+func (o *fullCloseOutbound) Close() error {
+	if c, ok := o.outbound.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// fullCloseConn ignores CloseWrite; the relay closes it once both
+// directions are done.
+type fullCloseConn struct {
+	halfCloser
+}
+
+func (c *fullCloseConn) CloseWrite() error {
+	return nil
+}
+
+func newProxyOutbound(cfg proxyConfig, via proxy.Dialer, dialTimeout time.Duration, udpTimeout time.Duration) (outbound, core.UDPConnHandler, error) {
+	host := cfg.Host
+	port := uint16(cfg.Port)
+
+	// Only TCP crosses a chain, so UDP falls back as with transports.
+	switch cfg.Type {
+	case "socks5", "socks":
+		tcp := newSocksTCPHandler(host, port, cfg.Username, cfg.Password, nil, cfg.Transport, via, dialTimeout)
+		if cfg.Transport != nil || via != nil || isUnixSocket(host) {
+			return tcp, dnsfallback.NewUDPHandler(), nil
+		}
+		return tcp, newSocksUDPHandler(host, port, cfg.Username, cfg.Password, dialTimeout, udpTimeout), nil
+	case "socks4", "socks4a":
+		return newSocks4TCPHandler(host, port, cfg.Username, cfg.Type == "socks4a", via, dialTimeout),
+			dnsfallback.NewUDPHandler(), nil
+	case "socks5-tls", "socks5s":
+		tlsCfg, err := cfg.TLS.clientConfig(host)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newSocksTCPHandler(host, port, cfg.Username, cfg.Password, tlsCfg, nil, via, dialTimeout),
+			dnsfallback.NewUDPHandler(), nil
+	case "http":
+		return newHTTPConnectHandler(host, port, cfg.Username, cfg.Password, cfg.HTTPAuth, cfg.connectHeader(), nil, via, dialTimeout),
+			dnsfallback.NewUDPHandler(), nil
+	case "https":
+		tlsCfg, err := cfg.TLS.clientConfig(host)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cfg.HTTP2 {
+			return newH2ConnectHandler(host, port, cfg.Username, cfg.Password, cfg.connectHeader(), tlsCfg, via, dialTimeout),
+				dnsfallback.NewUDPHandler(), nil
+		}
+		return newHTTPConnectHandler(host, port, cfg.Username, cfg.Password, cfg.HTTPAuth, cfg.connectHeader(), tlsCfg, via, dialTimeout),
+			dnsfallback.NewUDPHandler(), nil
+	case "shadowsocks", "ss":
+		ssCipher, err := newSSCipher(cfg.Username, cfg.Password)
+		if err != nil {
+			return nil, nil, err
+		}
+		tcp := newShadowsocksTCPHandler(host, port, ssCipher, cfg.Transport, via, dialTimeout)
+		if cfg.Transport != nil || via != nil {
+			return tcp, dnsfallback.NewUDPHandler(), nil
+		}
+		return tcp, newShadowsocksUDPHandler(host, port, ssCipher, udpTimeout), nil
+	case "vmess":
+		ob, err := newVMessTCPHandler(host, port, cfg.uuid(), cfg.Security, cfg.Transport, via, dialTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ob, dnsfallback.NewUDPHandler(), nil
+	case "vless":
+		ob, err := newVLESSTCPHandler(host, port, cfg.uuid(), cfg.Transport, via, dialTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ob, dnsfallback.NewUDPHandler(), nil
+	case "wireguard":
+		return nil, nil, errors.New("wireguard can only be used as the main proxy")
+	default:
+		return nil, nil, errors.New("unsupported proxy type")
+	}
+}
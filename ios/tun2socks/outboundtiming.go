@@ -0,0 +1,246 @@
+package tun2socks
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxConnectTraces bounds the connect times waiting to be claimed by the
+// outbound that dialed them.
+const maxConnectTraces = 256
+
+// outboundTiming holds the latency histograms of one outbound: the
+// connection to its server, the proxy handshake after it, and the first
+// byte of the answer after the app has sent its request.
+type outboundTiming struct {
+	name       string
+	connect    *histogram
+	handshake  *histogram
+	firstByte  *histogram
+	noResponse atomic.Uint64
+}
+
+type latencySnapshot struct {
+	Count uint64  `json:"count"`
+	P50Ms float64 `json:"p50Ms"`
+	P90Ms float64 `json:"p90Ms"`
+	P99Ms float64 `json:"p99Ms"`
+}
+
+type outboundTimingSnapshot struct {
+	Connect    latencySnapshot `json:"connect"`
+	Handshake  latencySnapshot `json:"handshake"`
+	FirstByte  latencySnapshot `json:"firstByte"`
+	NoResponse uint64          `json:"noResponse"`
+}
+
+// connectTrace is a connection to a proxy server, opened from start to
+// end.
+type connectTrace struct {
+	start time.Time
+	end   time.Time
+}
+
+var (
+	timingMu        sync.Mutex
+	outboundTimings = make(map[string]*outboundTiming)
+
+	connectMu     sync.Mutex
+	connectTraces = make(map[string]connectTrace)
+)
+
+// timingFor returns the histograms of the outbound called name. They are
+// looked up on every dial, so a restart, which clears them, is seen by
+// outbounds that outlive it.
+func timingFor(name string) *outboundTiming {
+	timingMu.Lock()
+	defer timingMu.Unlock()
+	t, ok := outboundTimings[name]
+	if !ok {
+		t = &outboundTiming{
+			name:      name,
+			connect:   newHistogram(dialBuckets),
+			handshake: newHistogram(dialBuckets),
+			firstByte: newHistogram(dialBuckets),
+		}
+		outboundTimings[name] = t
+	}
+	return t
+}
+
+func outboundTimingSnapshots() map[string]outboundTimingSnapshot {
+	timingMu.Lock()
+	defer timingMu.Unlock()
+	if len(outboundTimings) == 0 {
+		return nil
+	}
+	out := make(map[string]outboundTimingSnapshot, len(outboundTimings))
+	for name, t := range outboundTimings {
+		out[name] = outboundTimingSnapshot{
+			Connect:    t.connect.latency(),
+			Handshake:  t.handshake.latency(),
+			FirstByte:  t.firstByte.latency(),
+			NoResponse: t.noResponse.Load(),
+		}
+	}
+	return out
+}
+
+// outboundTimingList returns the histograms of all outbounds by name.
+func outboundTimingList() []*outboundTiming {
+	timingMu.Lock()
+	defer timingMu.Unlock()
+	list := make([]*outboundTiming, 0, len(outboundTimings))
+	for _, t := range outboundTimings {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+func resetOutboundTimings() {
+	timingMu.Lock()
+	clear(outboundTimings)
+	timingMu.Unlock()
+
+	connectMu.Lock()
+	clear(connectTraces)
+	connectMu.Unlock()
+}
+
+// traceConnect records that the connection c to a proxy server was opened
+// from start until now, for the outbound dialing through it to claim by
+// its local address.
+func traceConnect(c net.Conn, start time.Time) {
+	key := connKey(c)
+	if key == "" {
+		return
+	}
+	connectMu.Lock()
+	defer connectMu.Unlock()
+	if len(connectTraces) >= maxConnectTraces {
+		clear(connectTraces)
+	}
+	connectTraces[key] = connectTrace{start: start, end: time.Now()}
+}
+
+// claimConnect returns how long it took to open the server connection
+// under c, if that happened after since. Connections taken from a pool or
+// shared by multiplexing were opened before.
+func claimConnect(c net.Conn, since time.Time) (time.Duration, bool) {
+	key := connKey(c)
+	if key == "" {
+		return 0, false
+	}
+	connectMu.Lock()
+	defer connectMu.Unlock()
+	t, ok := connectTraces[key]
+	if !ok {
+		return 0, false
+	}
+	delete(connectTraces, key)
+	if t.start.Before(since) {
+		return 0, false
+	}
+	return t.end.Sub(t.start), true
+}
+
+// connKey identifies c among open connections. Unix sockets have no local
+// address, so they are not traced.
+func connKey(c net.Conn) string {
+	addr := c.LocalAddr()
+	if addr == nil {
+		return ""
+	}
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return ""
+	}
+	return addr.String()
+}
+
+// timedOutbound records the latencies of the flows through a proxy
+// outbound under its name. The outbound itself is tracked as the resource,
+// so closing, draining and network changes reach it unwrapped.
+type timedOutbound struct {
+	outbound
+	name string
+}
+
+func newTimedOutbound(name string, ob outbound) outbound {
+	return &timedOutbound{outbound: ob, name: name}
+}
+
+func (o *timedOutbound) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(o, conn, target)
+}
+
+// Dial splits the time to a usable connection into the connect, when the
+// dial opened one to the server, and the handshake after it. Pooled and
+// multiplexed connections only have a handshake, and so do the later
+// outbounds of a chain. Protocols that do not wait for the server to reach
+// the target count that in the first byte.
+func (o *timedOutbound) Dial(network string, addr string) (net.Conn, error) {
+	start := time.Now()
+	c, err := o.outbound.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ready := time.Now()
+	t := timingFor(o.name)
+	total := ready.Sub(start)
+	if connect, ok := claimConnect(c, start); ok && connect <= total {
+		t.connect.observe(connect)
+		total -= connect
+	}
+	t.handshake.observe(total)
+	return &timedConn{halfCloser: halfCloser{c}, timing: t, ready: ready}, nil
+}
+
+func (o *timedOutbound) Bind(target string) (*binding, error) {
+	return bindThrough(o.outbound, target)
+}
+
+func (o *timedOutbound) CanBind(target string) bool {
+	return canBindThrough(o.outbound, target)
+}
+
+// timedConn times the first byte from the proxy, from the app's first
+// write or, for protocols where the server speaks first, from the dial.
+// A connection closed after a write without any answer is counted as not
+// responding, the sign of a proxy that accepts connections but stalls.
+type timedConn struct {
+	halfCloser
+	timing   *outboundTiming
+	ready    time.Time
+	wroteAt  atomic.Int64
+	answered atomic.Bool
+}
+
+func (c *timedConn) Write(b []byte) (int, error) {
+	if c.wroteAt.Load() == 0 {
+		c.wroteAt.CompareAndSwap(0, time.Now().UnixNano())
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *timedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.answered.Load() && c.answered.CompareAndSwap(false, true) {
+		start := c.ready
+		if at := c.wroteAt.Load(); at != 0 {
+			start = time.Unix(0, at)
+		}
+		c.timing.firstByte.observe(time.Since(start))
+	}
+	return n, err
+}
+
+func (c *timedConn) Close() error {
+	if !c.answered.Swap(true) && c.wroteAt.Load() != 0 {
+		c.timing.noResponse.Add(1)
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,162 @@
+package tun2socks
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type pooledConn struct {
+	conn    net.Conn
+	idledAt time.Time
+}
+
+type connPool struct {
+	mu          sync.Mutex
+	idle        map[string][]pooledConn
+	filling     map[string]int
+	maxPerHost  int
+	idleTimeout time.Duration
+	dialTimeout time.Duration
+}
+
+var httpProxyPool = newConnPool(0, 60*time.Second)
+
+func newConnPool(maxPerHost int, idleTimeout time.Duration) *connPool {
+	return &connPool{
+		idle:        make(map[string][]pooledConn),
+		filling:     make(map[string]int),
+		maxPerHost:  maxPerHost,
+		idleTimeout: idleTimeout,
+		dialTimeout: 10 * time.Second,
+	}
+}
+
+// SetHTTPPoolConfig limits the idle connections kept per HTTP proxy and how
+// long they stay idle. A zero timeout keeps the current one.
+func SetHTTPPoolConfig(maxPerHost int, idleTimeout time.Duration) error {
+	if maxPerHost < 0 || idleTimeout < 0 {
+		return ErrInvalidConfig
+	}
+	httpProxyPool.configure(maxPerHost, idleTimeout)
+	return nil
+}
+
+func (p *connPool) configure(maxPerHost int, idleTimeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.maxPerHost = maxPerHost
+	if idleTimeout > 0 {
+		p.idleTimeout = idleTimeout
+	}
+	for addr, conns := range p.idle {
+		for len(conns) > maxPerHost {
+			conns[0].conn.Close()
+			conns = conns[1:]
+		}
+		p.idle[addr] = conns
+	}
+}
+
+// get returns a warm connection to addr when one is available and still
+// alive, otherwise it dials a new one. The pool is refilled in the
+// background so the next flow can skip the TCP handshake.
+func (p *connPool) get(addr string) (net.Conn, bool, error) {
+	p.mu.Lock()
+	enabled := p.maxPerHost > 0
+	var conn net.Conn
+	for len(p.idle[addr]) > 0 {
+		conns := p.idle[addr]
+		last := conns[len(conns)-1]
+		p.idle[addr] = conns[:len(conns)-1]
+		if time.Since(last.idledAt) > p.idleTimeout || !connAlive(last.conn) {
+			last.conn.Close()
+			continue
+		}
+		conn = last.conn
+		break
+	}
+	p.mu.Unlock()
+
+	if enabled {
+		go p.fill(addr)
+	}
+	if conn != nil {
+		return conn, true, nil
+	}
+
+	conn, err := dialTCP(addr, p.dialTimeout)
+	return conn, false, err
+}
+
+func (p *connPool) fill(addr string) {
+	p.mu.Lock()
+	missing := p.maxPerHost - len(p.idle[addr]) - p.filling[addr]
+	if missing <= 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.filling[addr] += missing
+	p.mu.Unlock()
+
+	for i := 0; i < missing; i++ {
+		conn, err := dialTCP(addr, p.dialTimeout)
+
+		p.mu.Lock()
+		p.filling[addr]--
+		if err == nil {
+			if len(p.idle[addr]) < p.maxPerHost {
+				p.idle[addr] = append(p.idle[addr], pooledConn{conn: conn, idledAt: time.Now()})
+				conn = nil
+			}
+		}
+		p.mu.Unlock()
+
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// closeAll closes every idle connection and returns the addresses they led
+// to.
+func (p *connPool) closeAll() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var addrs []string
+	for addr, conns := range p.idle {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+		delete(p.idle, addr)
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// warm opens fresh idle connections to addrs.
+func (p *connPool) warm(addrs []string) {
+	p.mu.Lock()
+	enabled := p.maxPerHost > 0
+	p.mu.Unlock()
+	if !enabled {
+		return
+	}
+	for _, addr := range addrs {
+		go p.fill(addr)
+	}
+}
+
+func connAlive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	var buf [1]byte
+	_, err := conn.Read(buf[:])
+	conn.SetReadDeadline(time.Time{})
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
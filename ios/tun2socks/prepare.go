@@ -0,0 +1,52 @@
+package tun2socks
+
+// prepared is the configuration PrepareReload built, kept until a reload
+// switches to it or to another one. Only its outbounds, resolvers and
+// rules are ready: the lwIP stack is shared, and proxy connections are
+// dialed once flows arrive. Guarded by stateMu.
+var prepared *preparedConfig
+
+// PrepareReload builds the outbounds, resolvers and rules of jsonConfig
+// next to the running configuration and starts looking up its proxy
+// servers, so a later Reload of the same document only switches over. A
+// document prepared before is discarded.
+func PrepareReload(jsonConfig string) error {
+	document := jsonConfig
+	jsonConfig, remote := withRemote(jsonConfig)
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	p, err := prepareLocked(jsonConfig)
+	if err != nil {
+		return err
+	}
+	dropPreparedLocked()
+	p.document, p.remote = document, remote
+	prepared = p
+	logger.Info("reload prepared", "proxy", p.cfg.Proxy.Type)
+	return nil
+}
+
+// takePreparedLocked returns the prepared configuration if it was built
+// from jsonConfig. Any other one is discarded, since the reload replaces
+// what it was prepared against.
+func takePreparedLocked(jsonConfig string) *preparedConfig {
+	p := prepared
+	if p == nil {
+		return nil
+	}
+	prepared = nil
+	if p.document != jsonConfig {
+		closeAll(p.resources)
+		return nil
+	}
+	return p
+}
+
+func dropPreparedLocked() {
+	if prepared != nil {
+		closeAll(prepared.resources)
+		prepared = nil
+	}
+}
@@ -0,0 +1,174 @@
+package tun2socks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Priority classes of TCP flows, from the most to the least urgent.
+const (
+	priorityInteractive = iota
+	priorityStreaming
+	priorityBulk
+	numPriorities
+)
+
+var priorityNames = map[string]int{
+	"interactive": priorityInteractive,
+	"streaming":   priorityStreaming,
+	"bulk":        priorityBulk,
+}
+
+var priorityLabels = [numPriorities]string{"interactive", "streaming", "bulk"}
+
+// defaultPriorityWeights are the shares of a saturated link each class
+// gets while all of them have data waiting.
+var defaultPriorityWeights = [numPriorities]float64{8, 4, 1}
+
+// qosConfig assigns flows to priority classes. The first matching rule
+// decides; other flows get Default, or streaming.
+type qosConfig struct {
+	Rules   []qosRuleConfig `json:"rules,omitempty"`
+	Default string          `json:"default,omitempty"`
+	Weights map[string]int  `json:"weights,omitempty"`
+}
+
+type qosRuleConfig struct {
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Priority string `json:"priority"`
+}
+
+func (c *qosConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	_, err := newQoSPolicy(c)
+	return err
+}
+
+// qosPolicy classifies flows with the rules of the routing table, routing
+// to priority names instead of outbounds.
+type qosPolicy struct {
+	router  *router
+	weights [numPriorities]float64
+}
+
+var activeQoS atomic.Pointer[qosPolicy]
+
+func newQoSPolicy(cfg *qosConfig) (*qosPolicy, error) {
+	p := &qosPolicy{router: &router{final: "streaming"}, weights: defaultPriorityWeights}
+	if cfg.Default != "" {
+		if _, ok := priorityNames[cfg.Default]; !ok {
+			return nil, fmt.Errorf("unknown qos priority %q", cfg.Default)
+		}
+		p.router.final = cfg.Default
+	}
+	for _, rc := range cfg.Rules {
+		if _, ok := priorityNames[rc.Priority]; !ok {
+			return nil, fmt.Errorf("unknown qos priority %q", rc.Priority)
+		}
+		rule, err := parseRule(rc.Type, rc.Value, rc.Priority)
+		if err != nil {
+			return nil, fmt.Errorf("qos rule: %w", err)
+		}
+		if rule.kind == "geoip" || rule.kind == "rule-set" {
+			return nil, fmt.Errorf("qos rules cannot be of type %q", rc.Type)
+		}
+		p.router.rules = append(p.router.rules, rule)
+	}
+	for name, w := range cfg.Weights {
+		prio, ok := priorityNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown qos priority %q", name)
+		}
+		if w <= 0 {
+			return nil, errors.New("qos weights must be positive")
+		}
+		p.weights[prio] = float64(w)
+	}
+	return p, nil
+}
+
+func configureQoS(cfg *qosConfig) {
+	if cfg == nil {
+		activeQoS.Store(nil)
+		return
+	}
+	p, err := newQoSPolicy(cfg)
+	if err != nil {
+		// validate has rejected it already.
+		activeQoS.Store(nil)
+		return
+	}
+	activeQoS.Store(p)
+}
+
+// flowPriority returns the class of a flow to target, matching domain
+// rules against host when it is known.
+func flowPriority(target string, host string) int {
+	p := activeQoS.Load()
+	if p == nil {
+		return priorityStreaming
+	}
+	addr := target
+	if host != "" {
+		if _, port, err := net.SplitHostPort(target); err == nil {
+			addr = net.JoinHostPort(host, port)
+		}
+	}
+	return priorityNames[p.router.route(addr)]
+}
+
+// priorityQueue paces the TCP writes of one direction while the
+// tunnel-wide cap holds: each class sends at its weight's share of the
+// rate among the classes that are sending, so a class alone gets all of
+// it. Relays have one write in flight, so ordering a queue would only
+// alternate between classes. Validation requires a cap with QoS; one
+// removed at run time pauses the scheduling. UDP datagrams are not
+// classified and only meet the cap itself.
+type priorityQueue struct {
+	bucket *tokenBucket
+
+	mu sync.Mutex
+	// next is when the bytes each class has sent so far are paid for.
+	next [numPriorities]time.Time
+}
+
+var (
+	uplinkQueue   = &priorityQueue{bucket: uplinkLimit}
+	downlinkQueue = &priorityQueue{bucket: downlinkLimit}
+)
+
+// wait blocks until n bytes of class prio may be written. They are taken
+// from the tunnel-wide bucket as well, so datagrams see the link in use.
+func (q *priorityQueue) wait(n int, prio int, weights [numPriorities]float64) {
+	rate := q.bucket.bytesPerSec()
+	if rate <= 0 {
+		return
+	}
+	now := time.Now()
+	q.mu.Lock()
+	total := 0.0
+	for c := range q.next {
+		if c == prio || q.next[c].After(now) {
+			total += weights[c]
+		}
+	}
+	start := q.next[prio]
+	if start.Before(now) {
+		start = now
+	}
+	share := rate * weights[prio] / total
+	q.next[prio] = start.Add(time.Duration(float64(n) / share * float64(time.Second)))
+	q.mu.Unlock()
+
+	q.bucket.reserve(n)
+	if d := start.Sub(now); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,183 @@
+package tun2socks
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policies applied by the output queue when it is full.
+const (
+	QueueDropNewest = iota
+	QueueDropOldest
+	QueueBlock
+)
+
+const (
+	defaultQueueSize     = 2048
+	defaultQueueDeadline = 50 * time.Millisecond
+)
+
+var (
+	// The settings of SetQueueConfig, or the defaults, which every start
+	// begins from before applying the document's queue block.
+	baseQueueSize     = defaultQueueSize
+	baseQueuePolicy   = QueueDropNewest
+	baseQueueDeadline = defaultQueueDeadline
+
+	// The settings in effect.
+	queueSize     = defaultQueueSize
+	queuePolicy   = QueueDropNewest
+	queueDeadline = defaultQueueDeadline
+
+	droppedPackets atomic.Uint64
+
+	heldMu     sync.Mutex
+	heldPacket []byte
+)
+
+// SetQueueConfig sizes the output queue, applied on the next start, and
+// chooses what happens when it is full. A zero deadline keeps the current
+// one.
+func SetQueueConfig(size int, policy int, deadline time.Duration) error {
+	if size <= 0 || policy < QueueDropNewest || policy > QueueBlock || deadline < 0 {
+		return ErrInvalidConfig
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	baseQueueSize, queueSize = size, size
+	baseQueuePolicy, queuePolicy = policy, policy
+	if deadline > 0 {
+		baseQueueDeadline, queueDeadline = deadline, deadline
+	}
+	return nil
+}
+
+// configureQueue sets the output queue for a start: the settings of
+// SetQueueConfig or the defaults, with those of cfg over them, so a queue
+// block of an earlier start does not carry over. Called with stateMu held.
+func configureQueue(cfg *queueConfig) {
+	queueSize, queuePolicy, queueDeadline = baseQueueSize, baseQueuePolicy, baseQueueDeadline
+	if cfg == nil {
+		return
+	}
+	if cfg.Size > 0 {
+		queueSize = cfg.Size
+	}
+	if cfg.Policy != "" {
+		queuePolicy = queuePolicies[cfg.Policy]
+	}
+	if cfg.DeadlineMs > 0 {
+		queueDeadline = time.Duration(cfg.DeadlineMs) * time.Millisecond
+	}
+}
+
+// DroppedPackets returns the number of output packets dropped since start.
+func DroppedPackets() uint64 {
+	return droppedPackets.Load()
+}
+
+// PeekPacketSize returns the length of the next queued packet without
+// consuming it, or 0 when the queue is empty.
+func PeekPacketSize() int {
+	stateMu.Lock()
+	queue := outputQueue
+	isRunning := running
+	stateMu.Unlock()
+
+	if !isRunning || queue == nil {
+		return 0
+	}
+
+	heldMu.Lock()
+	defer heldMu.Unlock()
+	if heldPacket == nil {
+		select {
+		case heldPacket = <-queue:
+		default:
+			return 0
+		}
+	}
+	return len(heldPacket)
+}
+
+// heldOrNextPacket returns a packet held back by a peek or a short buffer,
+// or else the next queued packet without blocking.
+func heldOrNextPacket(queue chan []byte) ([]byte, bool) {
+	heldMu.Lock()
+	defer heldMu.Unlock()
+	if packet := heldPacket; packet != nil {
+		heldPacket = nil
+		return packet, true
+	}
+	select {
+	case packet := <-queue:
+		return packet, true
+	default:
+		return nil, false
+	}
+}
+
+// deliverPacket copies packet into out. A packet that does not fit is held
+// for the next read and its length is returned negated.
+func deliverPacket(packet []byte, out []byte) int {
+	if len(packet) > len(out) {
+		heldMu.Lock()
+		if heldPacket == nil {
+			heldPacket = packet
+		} else {
+			putPacket(packet)
+			droppedPackets.Add(1)
+		}
+		heldMu.Unlock()
+		return -len(packet)
+	}
+	n := copy(out, packet)
+	putPacket(packet)
+	return n
+}
+
+func dropHeldPacket() {
+	heldMu.Lock()
+	defer heldMu.Unlock()
+	heldPacket = nil
+}
+
+func enqueuePacket(queue chan []byte, packet []byte, policy int, deadline time.Duration) {
+	select {
+	case queue <- packet:
+		return
+	default:
+	}
+
+	switch policy {
+	case QueueDropOldest:
+		for {
+			select {
+			case old := <-queue:
+				putPacket(old)
+				droppedPackets.Add(1)
+			default:
+			}
+			select {
+			case queue <- packet:
+				return
+			default:
+			}
+		}
+	case QueueBlock:
+		timer := time.NewTimer(deadline)
+		defer timer.Stop()
+		select {
+		case queue <- packet:
+		case <-timer.C:
+			putPacket(packet)
+			droppedPackets.Add(1)
+		}
+	default:
+		putPacket(packet)
+		droppedPackets.Add(1)
+	}
+}
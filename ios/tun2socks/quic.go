@@ -0,0 +1,142 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+const (
+	quicAuto  = ""
+	quicBlock = "block"
+	quicRelay = "relay"
+
+	quicPort       = 443
+	ipProtoICMP    = 1
+	ipProtoICMPv6  = 58
+	icmpQuoteLimit = 548
+
+	// Destination unreachable codes.
+	icmpv4PortUnreachable = 3
+	icmpv4Prohibited      = 13
+	icmpv6PortUnreachable = 4
+	icmpv6Prohibited      = 1
+)
+
+var quicModes = map[string]bool{
+	quicAuto:  true,
+	quicBlock: true,
+	quicRelay: true,
+}
+
+var blockQUIC atomic.Bool
+
+// configureQUIC decides whether UDP/443 is dropped before it reaches the
+// stack. In auto mode QUIC is blocked only when the proxy cannot relay UDP,
+// so apps fall back to TCP at once instead of waiting for a handshake to
+// time out.
+func configureQUIC(mode string, relaysUDP bool) {
+	switch mode {
+	case quicBlock:
+		blockQUIC.Store(true)
+	case quicRelay:
+		blockQUIC.Store(false)
+	default:
+		blockQUIC.Store(!relaysUDP)
+	}
+}
+
+// filterQUIC reports whether packet is a QUIC datagram that must not enter
+// the stack. A port unreachable error is written back so the sender gives
+// up on QUIC immediately.
+func filterQUIC(packet []byte) bool {
+	if !blockQUIC.Load() || len(packet) < 1 {
+		return false
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < 20 || len(packet) < ihl+8 || packet[9] != ipProtoUDP || binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return false
+		}
+		if binary.BigEndian.Uint16(packet[ihl+2:]) != quicPort {
+			return false
+		}
+		writeOutput(icmpv4Unreachable(packet, icmpv4PortUnreachable))
+	case 6:
+		if len(packet) < 48 || packet[6] != ipProtoUDP {
+			return false
+		}
+		if binary.BigEndian.Uint16(packet[42:]) != quicPort {
+			return false
+		}
+		writeOutput(icmpv6Unreachable(packet, icmpv6PortUnreachable))
+	default:
+		return false
+	}
+	return true
+}
+
+func icmpv4Unreachable(packet []byte, code byte) []byte {
+	quote := packet[:min(len(packet), icmpQuoteLimit)]
+	out := make([]byte, 20+8+len(quote))
+
+	out[0] = 0x45
+	binary.BigEndian.PutUint16(out[2:], uint16(len(out)))
+	out[8] = 64
+	out[9] = ipProtoICMP
+	copy(out[12:16], packet[16:20])
+	copy(out[16:20], packet[12:16])
+	binary.BigEndian.PutUint16(out[10:], checksum(out[:20], 0))
+
+	icmp := out[20:]
+	icmp[0] = 3 // destination unreachable
+	icmp[1] = code
+	copy(icmp[8:], quote)
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, 0))
+	return out
+}
+
+func icmpv6Unreachable(packet []byte, code byte) []byte {
+	quote := packet[:min(len(packet), 1280-40-8)]
+	out := make([]byte, 40+8+len(quote))
+
+	out[0] = 0x60
+	binary.BigEndian.PutUint16(out[4:], uint16(8+len(quote)))
+	out[6] = ipProtoICMPv6
+	out[7] = 64
+	copy(out[8:24], packet[24:40])
+	copy(out[24:40], packet[8:24])
+
+	icmp := out[40:]
+	icmp[0] = 1 // destination unreachable
+	icmp[1] = code
+	copy(icmp[8:], quote)
+
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, ipv6PseudoSum(out, len(icmp))))
+	return out
+}
+
+// ipv6PseudoSum sums the pseudo-header of an ICMPv6 message of length bytes
+// carried in the IPv6 packet starting at header.
+func ipv6PseudoSum(header []byte, length int) uint32 {
+	var sum uint32
+	for i := 8; i < 40; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	return sum + uint32(length) + ipProtoICMPv6
+}
+
+func checksum(b []byte, sum uint32) uint16 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
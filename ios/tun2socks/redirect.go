@@ -0,0 +1,177 @@
+package tun2socks
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// redirectSniffWait is how long a flow waits for the app's first bytes
+// before the redirector is asked without a sniffed host. Protocols where
+// the server speaks first are delayed by that much when a redirector is
+// registered.
+const redirectSniffWait = 200 * time.Millisecond
+
+// FlowRedirector returns the address a TCP connection is sent to instead
+// of its target, as "host:port", or "" to keep it. srcPort is the local
+// port of the flow, dst its target address, host the server name sniffed
+// from TLS or HTTP, or the name dst was resolved from, and proto "tcp".
+type FlowRedirector func(srcPort int, dst string, host string, proto string) string
+
+var flowRedirector atomic.Pointer[FlowRedirector]
+
+// RegisterFlowRedirector makes fn decide the destination of every TCP
+// connection right before it is dialed, after its first bytes are sniffed.
+// The rules and outbounds then see the new address. A nil fn stops
+// redirecting.
+func RegisterFlowRedirector(fn FlowRedirector) {
+	if fn == nil {
+		flowRedirector.Store(nil)
+		return
+	}
+	flowRedirector.Store(&fn)
+}
+
+// redirectThrough relays a flow to where the redirector sends it. The
+// stack holds back what the app sends until Handle returns, so the flow is
+// accepted first and dialed once its first bytes are sniffed; a failed
+// dial then ends it as the stack would have.
+func redirectThrough(dialer proxy.Dialer, conn net.Conn, target *net.TCPAddr) {
+	conn, addr := redirectFlow(conn, target)
+	c, err := dialTarget(dialer, addr)
+	if err != nil {
+		if refusedFlow(err) {
+			err = refuseTCP(conn, target, err)
+		}
+		if err != nil {
+			abortConn(conn)
+		}
+		return
+	}
+	relayTCP(conn, c)
+}
+
+// redirectFlow asks the redirector where the flow on conn to target goes.
+// It returns the connection to relay, which replays any bytes read for
+// sniffing, and the address to dial.
+func redirectFlow(conn net.Conn, target *net.TCPAddr) (net.Conn, string) {
+	addr := target.String()
+	fn := flowRedirector.Load()
+	if fn == nil {
+		return conn, addr
+	}
+	peeked := peekConn(conn, redirectSniffWait)
+	host := sniffHost(peeked.head)
+	if host == "" {
+		host = resolvedName(target.IP)
+	}
+	srcPort := 0
+	if app, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		srcPort = app.Port
+	}
+	to := (*fn)(srcPort, addr, host, "tcp")
+	if to == "" || to == addr {
+		return peeked, addr
+	}
+	if _, port, err := net.SplitHostPort(to); err != nil {
+		logger.Warn("invalid flow redirect", "target", addr, "to", to, "error", err)
+		return peeked, addr
+	} else if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		logger.Warn("invalid flow redirect", "target", addr, "to", to)
+		return peeked, addr
+	}
+	logger.Debug("flow redirected", "target", addr, "host", host, "to", to)
+	return peeked, to
+}
+
+// resolvedName returns the name ip was handed out or resolved for, if the
+// DNS interception knows it.
+func resolvedName(ip net.IP) string {
+	stateMu.Lock()
+	pool, names := activeFakeIPPool, activeReverseMap
+	stateMu.Unlock()
+	if pool != nil {
+		if name, ok := pool.lookup(ip); ok {
+			return name
+		}
+	}
+	if names != nil {
+		if name, ok := names.lookup(ip); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// resolvedTargetName is resolvedName for a "host:port" target.
+func resolvedTargetName(target string) string {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return resolvedName(ip)
+}
+
+type peekResult struct {
+	data []byte
+	err  error
+}
+
+// peekedConn hands out the bytes read ahead of the relay before reading
+// from the connection again. A read still pending when the wait ended is
+// picked up by the first Read.
+type peekedConn struct {
+	halfCloser
+	pending chan peekResult
+	head    []byte
+	err     error
+}
+
+// peekConn reads the first bytes the app sends on conn, waiting at most
+// wait for them; tcpConn ignores deadlines, so the read runs on its own.
+func peekConn(conn net.Conn, wait time.Duration) *peekedConn {
+	pending := make(chan peekResult, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		pending <- peekResult{data: buf[:n], err: err}
+	}()
+	c := &peekedConn{halfCloser: halfCloser{conn}, pending: pending}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case r := <-pending:
+		c.pending, c.head, c.err = nil, r.data, r.err
+	case <-timer.C:
+	}
+	return c
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if c.pending != nil {
+		r := <-c.pending
+		c.pending, c.head, c.err = nil, r.data, r.err
+	}
+	if len(c.head) > 0 {
+		n := copy(b, c.head)
+		c.head = c.head[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		err := c.err
+		c.err = nil
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *peekedConn) Abort() {
+	abortConn(c.Conn)
+}
@@ -0,0 +1,129 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// How the app is told that a rule or the proxy refused its flow.
+const (
+	rejectReset = iota
+	rejectICMP
+	rejectDrop
+)
+
+var rejectModes = map[string]int32{
+	"":      rejectReset,
+	"reset": rejectReset,
+	"icmp":  rejectICMP,
+	"drop":  rejectDrop,
+}
+
+var rejectMode atomic.Int32
+
+func configureReject(mode string) {
+	rejectMode.Store(rejectModes[mode])
+}
+
+// refusedFlow reports whether err refused the flow by policy, as a
+// blocking rule or a proxy rejecting the target does, rather than failing
+// it.
+func refusedFlow(err error) bool {
+	return errors.Is(err, errBlocked) || errors.Is(err, errConnectRejected)
+}
+
+// refuseTCP answers a refused TCP connection. The stack has completed the
+// handshake by the time a flow is routed, so it is reset, held open
+// without an answer until the idle timeout, or reset after an ICMP
+// administratively prohibited message.
+func refuseTCP(conn net.Conn, target *net.TCPAddr, err error) error {
+	switch rejectMode.Load() {
+	case rejectICMP:
+		if app, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			sendProhibited(ipProtoTCP, app.AddrPort(), target.AddrPort())
+		}
+	case rejectDrop:
+		go holdRefused(conn)
+		return nil
+	}
+	return err
+}
+
+// refuseUDP answers a datagram that opened a refused UDP session. It is
+// dropped unless ICMP is asked for; UDP has nothing to reset.
+func refuseUDP(conn core.UDPConn, target *net.UDPAddr, err error) error {
+	if rejectMode.Load() == rejectICMP {
+		sendProhibited(ipProtoUDP, conn.LocalAddr().AddrPort(), target.AddrPort())
+	}
+	return err
+}
+
+// holdRefused discards what the app sends on conn and closes it once it
+// has been quiet for the TCP idle timeout.
+func holdRefused(conn net.Conn) {
+	defer conn.Close()
+	idle := time.Duration(tcpIdleTimeout.Load())
+	var timer *time.Timer
+	if idle > 0 {
+		timer = time.AfterFunc(idle, func() { conn.Close() })
+		defer timer.Stop()
+	}
+	buf := make([]byte, 4096)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		if timer != nil {
+			timer.Reset(idle)
+		}
+	}
+}
+
+// sendProhibited writes an ICMP administratively prohibited message for
+// the flow from app to target. The quoted header is rebuilt from the
+// addresses; it carries no TCP sequence number.
+func sendProhibited(proto byte, app netip.AddrPort, target netip.AddrPort) {
+	src, dst := app.Addr().Unmap(), target.Addr().Unmap()
+	if src.Is4() != dst.Is4() {
+		return
+	}
+	var quote []byte
+	if src.Is4() {
+		quote = make([]byte, 20+8)
+		quote[0] = 0x45
+		binary.BigEndian.PutUint16(quote[2:], uint16(len(quote)))
+		quote[8] = 64
+		quote[9] = proto
+		s, d := src.As4(), dst.As4()
+		copy(quote[12:16], s[:])
+		copy(quote[16:20], d[:])
+		binary.BigEndian.PutUint16(quote[10:], checksum(quote[:20], 0))
+	} else {
+		quote = make([]byte, 40+8)
+		quote[0] = 0x60
+		binary.BigEndian.PutUint16(quote[4:], 8)
+		quote[6] = proto
+		quote[7] = 64
+		s, d := src.As16(), dst.As16()
+		copy(quote[8:24], s[:])
+		copy(quote[24:40], d[:])
+	}
+	l4 := quote[len(quote)-8:]
+	binary.BigEndian.PutUint16(l4[0:], app.Port())
+	binary.BigEndian.PutUint16(l4[2:], target.Port())
+	if proto == ipProtoUDP {
+		binary.BigEndian.PutUint16(l4[4:], 8)
+	}
+
+	if src.Is4() {
+		writeOutput(icmpv4Unreachable(quote, icmpv4Prohibited))
+	} else {
+		writeOutput(icmpv6Unreachable(quote, icmpv6Prohibited))
+	}
+}
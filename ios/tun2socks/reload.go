@@ -0,0 +1,234 @@
+package tun2socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+type switchTCPHandler struct {
+	mu      sync.RWMutex
+	handler outbound
+}
+
+func (h *switchTCPHandler) set(handler outbound) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handler = handler
+}
+
+func (h *switchTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	if draining.Load() {
+		return errDraining
+	}
+	if target != nil {
+		if err := rejectLoop("tcp", target.AddrPort()); err != nil {
+			return err
+		}
+	}
+	if err := admitTCP(); err != nil {
+		return err
+	}
+	h.mu.RLock()
+	handler := h.handler
+	h.mu.RUnlock()
+	return handler.Handle(conn, target)
+}
+
+// Dial opens a connection through the current outbounds, for flows that
+// do not come from the TUN side.
+func (h *switchTCPHandler) Dial(network string, addr string) (net.Conn, error) {
+	h.mu.RLock()
+	handler := h.handler
+	h.mu.RUnlock()
+	return handler.Dial(network, addr)
+}
+
+func (h *switchTCPHandler) Bind(target string) (*binding, error) {
+	h.mu.RLock()
+	handler := h.handler
+	h.mu.RUnlock()
+	return bindThrough(handler, target)
+}
+
+func (h *switchTCPHandler) CanBind(target string) bool {
+	h.mu.RLock()
+	handler := h.handler
+	h.mu.RUnlock()
+	return canBindThrough(handler, target)
+}
+
+// Reload applies a new configuration to the running tunnel without
+// restarting the stack. Established flows keep their outbound. A document
+// handed to PrepareReload before is switched to at once.
+func Reload(jsonConfig string) error {
+	stateMu.Lock()
+	if p := takePreparedLocked(jsonConfig); p != nil {
+		defer stateMu.Unlock()
+		err := applyLocked(p)
+		if err != nil && running {
+			recordFailure("reload", err)
+		}
+		if err == nil {
+			setRemote(p.remote)
+		}
+		return err
+	}
+	stateMu.Unlock()
+
+	jsonConfig, remote := withRemote(jsonConfig)
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	err := reloadLocked(jsonConfig)
+	if err != nil && running {
+		recordFailure("reload", err)
+	}
+	if err == nil {
+		setRemote(remote)
+	}
+	return err
+}
+
+func reloadLocked(jsonConfig string) error {
+	p, err := prepareLocked(jsonConfig)
+	if err != nil {
+		return err
+	}
+	return applyLocked(p)
+}
+
+// preparedConfig is a configuration with its outbounds built and its proxy
+// servers being looked up, ready to take over from the running one.
+type preparedConfig struct {
+	cfg       *tunnelConfig
+	tcp       outbound
+	udp       core.UDPConnHandler
+	outbounds map[string]outbound
+	resources []io.Closer
+	servers   *serverResolver
+
+	document string
+	remote   *remoteSource
+}
+
+// prepareLocked builds the handlers of jsonConfig next to the running
+// ones, which keep their resources.
+func prepareLocked(jsonConfig string) (*preparedConfig, error) {
+	cfg, err := parseConfig(jsonConfig)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	if !running {
+		return nil, ErrNotRunning
+	}
+	if tcpSwitch == nil || udpSwitch == nil || cfg.Proxy.Type == "wireguard" {
+		return nil, ErrUnsupported
+	}
+
+	current := resources
+	resources = nil
+	tcpHandler, udpHandler, outbounds, err := buildHandlers(cfg)
+	built := resources
+	resources = current
+	if err != nil {
+		logger.Error("reload failed", "proxy", cfg.Proxy.Type, "error", err)
+		closeAll(built)
+		return nil, err
+	}
+	return &preparedConfig{
+		cfg:       cfg,
+		tcp:       tcpHandler,
+		udp:       udpHandler,
+		outbounds: outbounds,
+		resources: built,
+		servers:   newServerResolver(cfg),
+	}, nil
+}
+
+// applyLocked switches the tunnel to p. On failure p is closed and the
+// running configuration stays.
+func applyLocked(p *preparedConfig) error {
+	cfg := p.cfg
+	previous := resources
+	resources = p.resources
+	if err := configureIPv6(cfg.IPv6, cfg.NAT64); err != nil {
+		closeResources()
+		resources = previous
+		return err
+	}
+	if err := configureCapture(cfg.Capture); err != nil {
+		closeResources()
+		resources = previous
+		return err
+	}
+	if err := configureUsage(cfg.Usage); err != nil {
+		closeResources()
+		resources = previous
+		return err
+	}
+	configureMTU(cfg.MTU)
+	configureQUIC(cfg.QUIC, cfg.relaysUDP(&cfg.Proxy))
+	configureMulticast(cfg.Multicast, cfg.Proxy)
+	configureICMP(cfg.ICMP, cfg.Proxy, cfg.Timeouts.connect())
+	configureBandwidth(cfg.Bandwidth)
+	configureQoS(cfg.QoS)
+	configureIdle(cfg.Timeouts)
+	configureDrain(cfg.Timeouts)
+	configureRetry(cfg.Retry)
+	configureSocket(cfg.Socket)
+	configureLimits(cfg.Stack)
+	configureDNSCache(cfg.DNS.Cache)
+	configureUDP(cfg.UDP)
+	activeServerResolver.Store(p.servers)
+	configureMemory(cfg.Memory)
+	configureWatchdog(cfg.Watchdog, cfg.Proxy.Type)
+	configureTTL(cfg.TTL)
+	configureReject(cfg.Reject)
+	if cfg.HTTPPool != nil {
+		httpProxyPool.configure(cfg.HTTPPool.MaxPerHost, time.Duration(cfg.HTTPPool.IdleTimeoutMs)*time.Millisecond)
+	}
+	httpProxyPool.closeAll()
+	kcpSessions.retire()
+
+	tcpSwitch.set(p.tcp)
+	udpSwitch.setInner(p.udp)
+	namedOutbounds = p.outbounds
+	startResources(p.resources)
+	if err := configureInbound(cfg.Inbound); err != nil {
+		logger.Warn("inbound not started", "error", err)
+	}
+	if err := configureForwards(cfg.Forwards); err != nil {
+		logger.Warn("forwards not started", "error", err)
+	}
+	if err := configureKeepalive(cfg.Keepalive); err != nil {
+		logger.Warn("keepalive not started", "error", err)
+	}
+	retireResources(previous)
+	setActiveConfig(cfg.Proxy.Type)
+	undrain()
+
+	logger.Info("config reloaded", "proxy", cfg.Proxy.Type)
+	return nil
+}
+
+// retireResources releases what the previous configuration held. Resources
+// that can drain gracefully keep serving established flows and are closed
+// for good on stop.
+func retireResources(previous []io.Closer) {
+	for _, r := range previous {
+		if g, ok := r.(interface{ shutdown() }); ok {
+			g.shutdown()
+			resources = append(resources, r)
+			continue
+		}
+		if err := r.Close(); err != nil {
+			logger.Debug("close failed", "error", err)
+		}
+	}
+}
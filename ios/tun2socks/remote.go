@@ -0,0 +1,385 @@
+package tun2socks
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxRemoteConfig    = 4 << 20
+	remoteFetchTimeout = 30 * time.Second
+	// remoteIdleCheck is how often the refresh loop looks for a remote
+	// block while the configuration has none or no interval.
+	remoteIdleCheck = time.Minute
+)
+
+const (
+	remoteApplied  = "applied"
+	remoteFallback = "fallback"
+	remoteFailed   = "failed"
+)
+
+var (
+	errBadSignature = errors.New("remote config signature does not verify")
+	errNoVersion    = errors.New("remote config has no positive version")
+)
+
+// remoteRootCAs verifies the remote servers; nil uses the system roots.
+var remoteRootCAs *x509.CertPool
+
+// remoteConfig points at a document served over HTTPS and signed with
+// Ed25519, whose top-level keys replace those of the local document.
+type remoteConfig struct {
+	URL          string `json:"url"`
+	SignatureURL string `json:"signatureUrl,omitempty"`
+	PublicKey    string `json:"publicKey"`
+	IntervalMs   int    `json:"intervalMs,omitempty"`
+}
+
+type remoteEvent struct {
+	Event   string `json:"event"`
+	Result  string `json:"result"`
+	URL     string `json:"url"`
+	Version int64  `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// remoteStatus is the remote part of the tunnel state: applied while a
+// remote document is in effect, fallback while the local document runs
+// because none could be used.
+type remoteStatus struct {
+	State   string `json:"state"`
+	URL     string `json:"url"`
+	Version int64  `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// remoteSource is the remote block in effect, with the local document it
+// is merged into and the digest and version of the remote document last
+// applied. fallback is why none is applied.
+type remoteSource struct {
+	config   remoteConfig
+	base     string
+	applied  [sha256.Size]byte
+	version  int64
+	fallback error
+}
+
+var activeRemote atomic.Pointer[remoteSource]
+
+// appliedRemote is the newest remote document applied with a public key.
+type appliedRemote struct {
+	version int64
+	digest  [sha256.Size]byte
+}
+
+// remoteVersions holds the newest document applied with each public key
+// since the process started, so an older one cannot be replayed.
+var (
+	remoteVersionsMu sync.Mutex
+	remoteVersions   = map[string]appliedRemote{}
+)
+
+func (c *remoteConfig) validate() error {
+	if err := checkHTTPSURL(c.URL); err != nil {
+		return fmt.Errorf("remote url: %w", err)
+	}
+	if c.SignatureURL != "" {
+		if err := checkHTTPSURL(c.SignatureURL); err != nil {
+			return fmt.Errorf("remote signatureUrl: %w", err)
+		}
+	}
+	if _, err := parsePublicKey(c.PublicKey); err != nil {
+		return err
+	}
+	if c.IntervalMs < 0 {
+		return errors.New("remote intervalMs must not be negative")
+	}
+	return nil
+}
+
+func checkHTTPSURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return errors.New("must be an https URL")
+	}
+	return nil
+}
+
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("remote publicKey must be a base64 Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// withRemote returns jsonConfig with the remote document it names merged
+// in, and the remote block to keep refreshing, if any. When no remote
+// document can be used the local document is returned as it is, with the
+// reason kept as the source's fallback.
+func withRemote(jsonConfig string) (string, *remoteSource) {
+	var doc struct {
+		Remote *remoteConfig `json:"remote"`
+	}
+	if err := json.Unmarshal([]byte(jsonConfig), &doc); err != nil || doc.Remote == nil {
+		return jsonConfig, nil
+	}
+	// An invalid block fails the validation of the document.
+	if err := doc.Remote.validate(); err != nil {
+		return jsonConfig, nil
+	}
+	src := &remoteSource{config: *doc.Remote, base: jsonConfig}
+
+	body, version, err := loadRemote(doc.Remote)
+	if err != nil {
+		src.fallback = err
+		return jsonConfig, src
+	}
+	merged, err := mergeRemote(jsonConfig, body)
+	if err != nil {
+		src.fallback = err
+		return jsonConfig, src
+	}
+	src.applied, src.version = sha256.Sum256(body), version
+	return merged, src
+}
+
+// setRemote records the remote block of the configuration now in effect.
+// A nil src turns refreshing off.
+func setRemote(src *remoteSource) {
+	activeRemote.Store(src)
+	if src == nil {
+		statusMu.Lock()
+		remoteState = nil
+		statusMu.Unlock()
+		return
+	}
+	if src.fallback != nil {
+		reportRemote(src, remoteFallback, src.fallback)
+		return
+	}
+	recordRemoteVersion(src)
+	reportRemote(src, remoteApplied, nil)
+}
+
+// runRemote fetches the remote document every interval and reloads the
+// tunnel when it changed, until stop is closed.
+func runRemote(stop <-chan struct{}) {
+	for {
+		wait := remoteIdleCheck
+		if src := activeRemote.Load(); src != nil && src.config.IntervalMs > 0 {
+			wait = time.Duration(src.config.IntervalMs) * time.Millisecond
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if src := activeRemote.Load(); src != nil && src.config.IntervalMs > 0 {
+			refreshRemote(src)
+		}
+	}
+}
+
+func refreshRemote(src *remoteSource) {
+	body, version, err := loadRemote(&src.config)
+	if err != nil {
+		reportRemote(src, remoteFailed, err)
+		return
+	}
+	digest := sha256.Sum256(body)
+	if digest == src.applied {
+		return
+	}
+	merged, err := mergeRemote(src.base, body)
+	if err != nil {
+		reportRemote(src, remoteFailed, err)
+		return
+	}
+
+	stateMu.Lock()
+	if activeRemote.Load() != src {
+		// Replaced by a reload meanwhile.
+		stateMu.Unlock()
+		return
+	}
+	err = reloadLocked(merged)
+	if err != nil && running {
+		recordFailure("remote config", err)
+	}
+	if err == nil {
+		src = &remoteSource{config: src.config, base: src.base, applied: digest, version: version}
+		activeRemote.Store(src)
+		recordRemoteVersion(src)
+	}
+	stateMu.Unlock()
+	if err != nil {
+		reportRemote(src, remoteFailed, err)
+		return
+	}
+	reportRemote(src, remoteApplied, nil)
+}
+
+// reportRemote emits the outcome of applying or refreshing src and keeps
+// it in the tunnel state. A failed refresh leaves the state as it was,
+// applied or fallback, with the error.
+func reportRemote(src *remoteSource, result string, err error) {
+	status := &remoteStatus{State: remoteApplied, URL: src.config.URL, Version: src.version}
+	if src.fallback != nil {
+		status.State = remoteFallback
+	}
+	event := remoteEvent{Event: "remoteConfig", Result: result, URL: src.config.URL, Version: src.version}
+	if err != nil {
+		status.Error, event.Error = err.Error(), err.Error()
+		logger.Warn("remote config not applied", "url", src.config.URL, "result", result, "error", err)
+	} else {
+		logger.Info("remote config applied", "url", src.config.URL, "version", src.version)
+	}
+	statusMu.Lock()
+	remoteState = status
+	statusMu.Unlock()
+	emitEvent(event)
+}
+
+// loadRemote fetches and verifies the remote document and checks that its
+// version is newer than the last one applied with the same key. The one
+// applied may be fetched again.
+func loadRemote(cfg *remoteConfig) ([]byte, int64, error) {
+	body, err := fetchRemote(cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	var doc struct {
+		Version int64 `json:"version"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, 0, fmt.Errorf("remote config: %w", err)
+	}
+	if doc.Version <= 0 {
+		return nil, 0, errNoVersion
+	}
+	remoteVersionsMu.Lock()
+	last, ok := remoteVersions[cfg.PublicKey]
+	remoteVersionsMu.Unlock()
+	if ok && (doc.Version < last.version || doc.Version == last.version && sha256.Sum256(body) != last.digest) {
+		return nil, 0, fmt.Errorf("remote config version %d is not newer than the applied %d", doc.Version, last.version)
+	}
+	return body, doc.Version, nil
+}
+
+func recordRemoteVersion(src *remoteSource) {
+	remoteVersionsMu.Lock()
+	defer remoteVersionsMu.Unlock()
+	if last, ok := remoteVersions[src.config.PublicKey]; !ok || src.version > last.version {
+		remoteVersions[src.config.PublicKey] = appliedRemote{version: src.version, digest: src.applied}
+	}
+}
+
+// fetchRemote downloads the document and its detached signature, by
+// default at the document's URL plus ".sig", and verifies it. The
+// connection does not go through the tunnel.
+func fetchRemote(cfg *remoteConfig) ([]byte, error) {
+	key, err := parsePublicKey(cfg.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Timeout: remoteFetchTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return socketDialer().DialContext(ctx, network, addr)
+			},
+			TLSClientConfig:   &tls.Config{RootCAs: remoteRootCAs},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	body, err := fetchBody(client, cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	sigURL := cfg.SignatureURL
+	if sigURL == "" {
+		sigURL = cfg.URL + ".sig"
+	}
+	sig, err := fetchBody(client, sigURL)
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	if len(sig) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+		if err != nil {
+			return nil, errBadSignature
+		}
+		sig = decoded
+	}
+	if len(sig) != ed25519.SignatureSize || !ed25519.Verify(key, body, sig) {
+		return nil, errBadSignature
+	}
+	return body, nil
+}
+
+func fetchBody(client *http.Client, rawURL string) ([]byte, error) {
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteConfig+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxRemoteConfig {
+		return nil, fmt.Errorf("%s: larger than %d bytes", rawURL, maxRemoteConfig)
+	}
+	return body, nil
+}
+
+// mergeRemote replaces the top-level keys of base with those of the remote
+// document, except the remote block and the version, so a document may
+// carry a whole configuration or only its routing rules.
+func mergeRemote(base string, remote []byte) (string, error) {
+	var doc, overlay map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(base), &doc); err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(remote, &overlay); err != nil {
+		return "", fmt.Errorf("remote config: %w", err)
+	}
+	for k, v := range overlay {
+		if !strings.EqualFold(k, "remote") && !strings.EqualFold(k, "version") {
+			doc[k] = v
+		}
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,167 @@
+package tun2socks
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	maxReverseEntries = 8192
+	// minReverseTTL keeps short-lived answers around, since apps commonly
+	// connect well after the record they resolved has expired.
+	minReverseTTL = 10 * time.Minute
+)
+
+type reverseEntry struct {
+	name    string
+	expires time.Time
+}
+
+// reverseMap remembers which name the intercepted DNS answers gave each
+// address for, so connections to real addresses can go to the proxy by
+// hostname when fake-IP is off.
+type reverseMap struct {
+	mu      sync.Mutex
+	entries map[netip.Addr]reverseEntry
+}
+
+var activeReverseMap *reverseMap
+
+// sharedReverseMap keeps the same map across reloads so addresses apps
+// already resolved keep their names.
+func sharedReverseMap() *reverseMap {
+	if activeReverseMap == nil {
+		activeReverseMap = &reverseMap{entries: make(map[netip.Addr]reverseEntry)}
+	}
+	return activeReverseMap
+}
+
+// record adds the A and AAAA records of a DNS answer under the name that
+// was asked for, which is the one the app knows rather than the end of a
+// CNAME chain.
+func (m *reverseMap) record(answer []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil || msg.RCode != dnsmessage.RCodeSuccess || len(msg.Questions) != 1 {
+		return
+	}
+	name := normalizeDomain(msg.Questions[0].Name.String())
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rr := range msg.Answers {
+		var addr netip.Addr
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addr = netip.AddrFrom4(body.A)
+		case *dnsmessage.AAAAResource:
+			addr = netip.AddrFrom16(body.AAAA)
+		default:
+			continue
+		}
+		if addr.IsUnspecified() {
+			// Filtering resolvers answer blocked names with it.
+			continue
+		}
+		ttl := time.Duration(rr.Header.TTL) * time.Second
+		if ttl < minReverseTTL {
+			ttl = minReverseTTL
+		}
+		if _, ok := m.entries[addr]; !ok && len(m.entries) >= maxReverseEntries {
+			m.evictLocked(now)
+		}
+		m.entries[addr] = reverseEntry{name: name, expires: now.Add(ttl)}
+	}
+}
+
+// evictLocked drops the expired entries, or an arbitrary one when none has
+// expired.
+func (m *reverseMap) evictLocked(now time.Time) {
+	for addr, e := range m.entries {
+		if now.After(e.expires) {
+			delete(m.entries, addr)
+		}
+	}
+	if len(m.entries) < maxReverseEntries {
+		return
+	}
+	for addr := range m.entries {
+		delete(m.entries, addr)
+		return
+	}
+}
+
+func (m *reverseMap) lookup(ip net.IP) (string, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return "", false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[addr.Unmap()]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.name, true
+}
+
+// restore replaces the host of addr with the name it was resolved from.
+func (m *reverseMap) restore(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if name, ok := m.lookup(net.ParseIP(host)); ok {
+		return net.JoinHostPort(name, port)
+	}
+	return addr
+}
+
+type reverseMapResolver struct {
+	names *reverseMap
+	inner dnsUpstream
+}
+
+func newReverseMapResolver(names *reverseMap, inner dnsUpstream) dnsUpstream {
+	return &reverseMapResolver{names: names, inner: inner}
+}
+
+func (r *reverseMapResolver) Exchange(query []byte) ([]byte, error) {
+	answer, err := r.inner.Exchange(query)
+	if err == nil {
+		r.names.record(answer)
+	}
+	return answer, err
+}
+
+// reverseMapOutbound dials by hostname when the target address came from
+// an intercepted answer. It wraps the proxy outbounds after routing, so
+// address rules still see the address and direct connections keep it.
+type reverseMapOutbound struct {
+	outbound
+	names *reverseMap
+}
+
+func newReverseMapOutbound(inner outbound, names *reverseMap) outbound {
+	return &reverseMapOutbound{outbound: inner, names: names}
+}
+
+func (o *reverseMapOutbound) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(o, conn, target)
+}
+
+func (o *reverseMapOutbound) Dial(network string, addr string) (net.Conn, error) {
+	return o.outbound.Dial(network, o.names.restore(addr))
+}
+
+func (o *reverseMapOutbound) Bind(target string) (*binding, error) {
+	return bindThrough(o.outbound, o.names.restore(target))
+}
+
+func (o *reverseMapOutbound) CanBind(target string) bool {
+	return canBindThrough(o.outbound, o.names.restore(target))
+}
@@ -0,0 +1,433 @@
+package tun2socks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	outboundProxy  = "proxy"
+	outboundDirect = "direct"
+	outboundBlock  = "block"
+)
+
+type routeRule struct {
+	kind     string
+	prefix   netip.Prefix
+	country  string
+	domain   string
+	ports    [2]uint16
+	provider string
+	set      *ruleProvider
+	outbound string
+}
+
+type router struct {
+	bypass    []routeRule
+	blocked   map[string]struct{}
+	rules     []routeRule
+	providers map[string]*ruleProvider
+	geoip     *maxminddb.Reader
+	final     string
+}
+
+func newRouter(cfg routingConfig) (*router, error) {
+	r := &router{final: cfg.Final}
+	if r.final == "" {
+		r.final = outboundProxy
+	}
+
+	// Bypass entries come first so no rule can send them to a proxy, then
+	// the blocklist, then the rules.
+	if cfg.BypassLAN {
+		outbound := cfg.LANOutbound
+		if outbound == "" {
+			outbound = outboundDirect
+		}
+		for _, prefix := range lanPrefixes {
+			r.bypass = append(r.bypass, routeRule{kind: "ip-cidr", prefix: prefix, outbound: outbound})
+		}
+	}
+	for _, entry := range cfg.Bypass {
+		rule, err := parseBypass(entry)
+		if err != nil {
+			return nil, err
+		}
+		r.bypass = append(r.bypass, rule)
+	}
+	if len(cfg.Blocklist) > 0 {
+		r.blocked = make(map[string]struct{})
+		for _, path := range cfg.Blocklist {
+			if err := loadBlocklist(path, r.blocked); err != nil {
+				return nil, err
+			}
+		}
+	}
+	r.providers = make(map[string]*ruleProvider, len(cfg.Providers))
+	for name, pc := range cfg.Providers {
+		p, err := newRuleProvider(name, pc)
+		if err != nil {
+			return nil, err
+		}
+		r.providers[name] = p
+	}
+	for _, rc := range cfg.Rules {
+		rule, err := parseRule(rc.Type, rc.Value, rc.Outbound)
+		if err != nil {
+			return nil, err
+		}
+		if rule.kind == "geoip" && cfg.GeoIPPath == "" {
+			return nil, fmt.Errorf("geoip rule %q requires geoipPath", rc.Value)
+		}
+		if rule.kind == "rule-set" {
+			if rule.set = r.providers[rule.provider]; rule.set == nil {
+				return nil, fmt.Errorf("unknown rule set %q", rc.Value)
+			}
+		}
+		r.rules = append(r.rules, rule)
+	}
+
+	if cfg.GeoIPPath != "" {
+		reader, err := maxminddb.Open(cfg.GeoIPPath)
+		if err != nil {
+			return nil, err
+		}
+		r.geoip = reader
+	}
+	return r, nil
+}
+
+// lanPrefixes are the ranges bypassLAN keeps off the proxies: private,
+// link-local, loopback, multicast and broadcast addresses, which AirPlay
+// and local discovery use.
+var lanPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("255.255.255.255/32"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+func parseRule(kind string, value string, outbound string) (routeRule, error) {
+	rule := routeRule{kind: strings.ToLower(kind), outbound: outbound}
+	switch rule.kind {
+	case "ip-cidr", "ip-cidr6":
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return rule, err
+		}
+		rule.prefix = prefix.Masked()
+	case "geoip":
+		rule.country = strings.ToUpper(value)
+	case "domain", "domain-suffix", "domain-keyword", "domain-wildcard":
+		rule.domain = normalizeDomain(value)
+	case "rule-set":
+		rule.provider = value
+	case "dst-port":
+		low, high, found := strings.Cut(value, "-")
+		if !found {
+			high = low
+		}
+		from, err := strconv.ParseUint(low, 10, 16)
+		if err != nil {
+			return rule, fmt.Errorf("invalid port %q", value)
+		}
+		to, err := strconv.ParseUint(high, 10, 16)
+		if err != nil || to < from {
+			return rule, fmt.Errorf("invalid port range %q", value)
+		}
+		rule.ports = [2]uint16{uint16(from), uint16(to)}
+	default:
+		return rule, fmt.Errorf("unsupported rule type %q", kind)
+	}
+	return rule, nil
+}
+
+// parseBypass turns a bypass entry into a rule to the direct outbound:
+// ":443" or ":8000-8100" is a port, "10.0.0.0/8" or "1.1.1.1" an address,
+// "*.example.com" a wildcard and any other name a domain with its
+// subdomains.
+func parseBypass(entry string) (routeRule, error) {
+	switch {
+	case strings.HasPrefix(entry, ":"):
+		return parseRule("dst-port", entry[1:], outboundDirect)
+	case strings.Contains(entry, "/"):
+		return parseRule("ip-cidr", entry, outboundDirect)
+	case strings.Contains(entry, "*"):
+		return parseRule("domain-wildcard", entry, outboundDirect)
+	}
+	if ip, err := netip.ParseAddr(entry); err == nil {
+		return routeRule{kind: "ip-cidr", prefix: netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()), outbound: outboundDirect}, nil
+	}
+	if entry == "" {
+		return routeRule{}, errors.New("empty bypass entry")
+	}
+	return parseRule("domain-suffix", entry, outboundDirect)
+}
+
+func (r *router) route(addr string) string {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	port, _ := strconv.ParseUint(portText, 10, 16)
+	t := routeTarget{domain: normalizeDomain(host), port: uint16(port)}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		t.ip, t.isIP = ip.Unmap(), true
+	}
+
+	if name, ok := r.match(r.bypass, &t); ok {
+		return name
+	}
+	if !t.isIP && r.blockedDomain(t.domain) {
+		return outboundBlock
+	}
+	if name, ok := r.match(r.rules, &t); ok {
+		return name
+	}
+	return r.final
+}
+
+type routeTarget struct {
+	ip      netip.Addr
+	isIP    bool
+	domain  string
+	port    uint16
+	country string
+}
+
+func (r *router) match(rules []routeRule, t *routeTarget) (string, bool) {
+	for _, rule := range rules {
+		switch rule.kind {
+		case "dst-port":
+			if t.port != 0 && t.port >= rule.ports[0] && t.port <= rule.ports[1] {
+				return rule.outbound, true
+			}
+		case "ip-cidr", "ip-cidr6":
+			if t.isIP && rule.prefix.Contains(t.ip) {
+				return rule.outbound, true
+			}
+		case "geoip":
+			if !t.isIP {
+				continue
+			}
+			if t.country == "" {
+				t.country = r.country(t.ip)
+			}
+			if t.country != "" && t.country == rule.country {
+				return rule.outbound, true
+			}
+		case "rule-set":
+			if rule.set.set.Load().matches(r, t) {
+				return rule.outbound, true
+			}
+		default:
+			if !t.isIP && matchDomain(rule, t.domain) {
+				return rule.outbound, true
+			}
+		}
+	}
+	return "", false
+}
+
+// blockedDomain reports whether domain or one of its parents is on the
+// blocklist.
+func (r *router) blockedDomain(domain string) bool {
+	for len(r.blocked) > 0 && domain != "" {
+		if _, ok := r.blocked[domain]; ok {
+			return true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return false
+}
+
+// blocks reports whether any name can be routed to the block outbound.
+func (r *router) blocks() bool {
+	if len(r.blocked) > 0 || r.final == outboundBlock {
+		return true
+	}
+	for _, rule := range r.rules {
+		if rule.outbound == outboundBlock {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(rule routeRule, domain string) bool {
+	switch rule.kind {
+	case "domain":
+		return domain == rule.domain
+	case "domain-suffix":
+		return domain == rule.domain || strings.HasSuffix(domain, "."+rule.domain)
+	case "domain-keyword":
+		return strings.Contains(domain, rule.domain)
+	case "domain-wildcard":
+		return matchWildcard(rule.domain, domain)
+	}
+	return false
+}
+
+// matchWildcard reports whether name matches pattern, where each * stands
+// for any run of characters, dots included.
+func matchWildcard(pattern string, name string) bool {
+	head, rest, found := strings.Cut(pattern, "*")
+	if !found {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, head) {
+		return false
+	}
+	name = name[len(head):]
+	for i := 0; i <= len(name); i++ {
+		if matchWildcard(rest, name[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *router) country(ip netip.Addr) string {
+	if r.geoip == nil {
+		return ""
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := r.geoip.Lookup(net.IP(ip.AsSlice()), &record); err != nil {
+		return ""
+	}
+	return strings.ToUpper(record.Country.ISOCode)
+}
+
+func (r *router) Close() error {
+	if r.geoip != nil {
+		return r.geoip.Close()
+	}
+	return nil
+}
+
+type routedOutbound struct {
+	router    *router
+	outbounds map[string]outbound
+}
+
+func newRoutedOutbound(r *router, outbounds map[string]outbound) outbound {
+	return &routedOutbound{router: r, outbounds: outbounds}
+}
+
+func (o *routedOutbound) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(o, conn, target)
+}
+
+func (o *routedOutbound) Dial(network string, addr string) (net.Conn, error) {
+	name := o.router.route(addr)
+	ob, ok := o.outbounds[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown outbound %q", name)
+	}
+	return ob.Dial(network, addr)
+}
+
+func (o *routedOutbound) Bind(target string) (*binding, error) {
+	name := o.router.route(target)
+	ob, ok := o.outbounds[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown outbound %q", name)
+	}
+	return bindThrough(ob, target)
+}
+
+func (o *routedOutbound) CanBind(target string) bool {
+	ob, ok := o.outbounds[o.router.route(target)]
+	return ok && canBindThrough(ob, target)
+}
+
+type routedUDPHandler struct {
+	sync.Mutex
+
+	router   *router
+	handlers map[string]core.UDPConnHandler
+	conns    map[core.UDPConn]*routedUDPConn
+}
+
+type routedUDPConn struct {
+	core.UDPConn
+	owner   *routedUDPHandler
+	handler core.UDPConnHandler
+}
+
+func newRoutedUDPHandler(r *router, handlers map[string]core.UDPConnHandler) core.UDPConnHandler {
+	return &routedUDPHandler{
+		router:   r,
+		handlers: handlers,
+		conns:    make(map[core.UDPConn]*routedUDPConn, 8),
+	}
+}
+
+func (h *routedUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	name := h.router.final
+	if target != nil {
+		name = h.router.route(target.String())
+	}
+	handler, ok := h.handlers[name]
+	if !ok {
+		return fmt.Errorf("unknown outbound %q", name)
+	}
+
+	routed := &routedUDPConn{UDPConn: conn, owner: h, handler: handler}
+	h.Lock()
+	h.conns[conn] = routed
+	h.Unlock()
+	onSessionClose(conn, func() { h.forget(conn) })
+
+	if err := handler.Connect(routed, target); err != nil {
+		h.forget(conn)
+		return err
+	}
+	return nil
+}
+
+func (h *routedUDPHandler) forget(conn core.UDPConn) {
+	h.Lock()
+	delete(h.conns, conn)
+	h.Unlock()
+}
+
+func (h *routedUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	routed, ok := h.conns[conn]
+	h.Unlock()
+
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("routed connection %v->%v does not exist", conn.LocalAddr(), addr)
+	}
+	return routed.handler.ReceiveTo(routed, data, addr)
+}
+
+func (c *routedUDPConn) Close() error {
+	c.owner.forget(c.UDPConn)
+	return c.UDPConn.Close()
+}
+
+func (c *routedUDPConn) unwrapUDP() core.UDPConn {
+	return c.UDPConn
+}
@@ -0,0 +1,403 @@
+package tun2socks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+var ruleSetFormats = map[string]bool{"": true, "domain": true, "ipcidr": true, "classical": true, "geosite": true}
+
+// ruleProviderConfig names a file of rules that routing rules of type
+// rule-set refer to.
+type ruleProviderConfig struct {
+	Path     string `json:"path"`
+	Format   string `json:"format,omitempty"`
+	Category string `json:"category,omitempty"`
+}
+
+// ruleSet is the content of a provider file, indexed for lookups.
+type ruleSet struct {
+	full      map[string]struct{}
+	suffix    map[string]struct{}
+	children  map[string]struct{}
+	oneLabel  map[string]struct{}
+	keywords  []string
+	wildcards []string
+	regexps   []*regexp.Regexp
+	rules     []routeRule
+	size      int
+	// skipped holds the entries left out because they cannot be matched,
+	// such as geosite regexps RE2 does not support.
+	skipped []error
+}
+
+// ruleProvider holds the loaded set of one provider, replaced as a whole
+// on reload.
+type ruleProvider struct {
+	name   string
+	config ruleProviderConfig
+	set    atomic.Pointer[ruleSet]
+}
+
+func newRuleProvider(name string, cfg ruleProviderConfig) (*ruleProvider, error) {
+	p := &ruleProvider{name: name, config: cfg}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ReloadRuleSets reads the files of the running configuration's rule
+// providers again, for lists updated in place. A provider whose file fails
+// to load keeps its rules.
+func ReloadRuleSets() error {
+	stateMu.Lock()
+	isRunning := running
+	var providers []*ruleProvider
+	for _, res := range resources {
+		if r, ok := res.(*router); ok {
+			for _, p := range r.providers {
+				providers = append(providers, p)
+			}
+		}
+	}
+	stateMu.Unlock()
+	if !isRunning {
+		return ErrNotRunning
+	}
+
+	var errs []error
+	for _, p := range providers {
+		if err := p.load(); err != nil {
+			logger.Warn("rule set reload failed", "name", p.name, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *ruleProvider) load() error {
+	data, err := os.ReadFile(p.config.Path)
+	if err != nil {
+		return err
+	}
+	set := &ruleSet{
+		full:     make(map[string]struct{}),
+		suffix:   make(map[string]struct{}),
+		children: make(map[string]struct{}),
+		oneLabel: make(map[string]struct{}),
+	}
+	switch strings.ToLower(p.config.Format) {
+	case "", "domain":
+		err = eachRuleLine(data, set.addClashDomain)
+	case "ipcidr":
+		err = eachRuleLine(data, func(line string) error {
+			return set.addRule("ip-cidr", line)
+		})
+	case "classical":
+		err = eachRuleLine(data, set.addClassical)
+	case "geosite":
+		err = set.addGeosite(data, p.config.Category)
+	default:
+		err = fmt.Errorf("unsupported rule set format %q", p.config.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("rule set %s: %w", p.name, err)
+	}
+	for _, err := range set.skipped {
+		logger.Warn("rule set entry skipped", "name", p.name, "error", err)
+	}
+	p.set.Store(set)
+	logger.Info("rule set loaded", "name", p.name, "rules", set.size, "skipped", len(set.skipped))
+	return nil
+}
+
+// eachRuleLine calls fn for every entry of a text list, one per line with
+// # comments, or of the payload list of a Clash YAML provider.
+func eachRuleLine(data []byte, fn func(line string) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "payload:" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "- "); ok {
+			line = strings.Trim(strings.TrimSpace(rest), `'"`)
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%q: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// addClashDomain adds an entry in the Clash domain format: "+.example.com"
+// matches the domain and its subdomains, ".example.com" only subdomains,
+// "*.example.com" subdomains one label deep and a bare name itself.
+func (s *ruleSet) addClashDomain(entry string) error {
+	switch {
+	case strings.HasPrefix(entry, "+."):
+		s.suffix[normalizeDomain(entry[2:])] = struct{}{}
+	case strings.HasPrefix(entry, "*.") && !strings.Contains(entry[2:], "*"):
+		s.oneLabel[normalizeDomain(entry[2:])] = struct{}{}
+	case strings.Contains(entry, "*"):
+		s.wildcards = append(s.wildcards, normalizeDomain(entry))
+	case strings.HasPrefix(entry, "."):
+		s.children[normalizeDomain(entry[1:])] = struct{}{}
+	default:
+		s.full[normalizeDomain(entry)] = struct{}{}
+	}
+	s.size++
+	return nil
+}
+
+// addClassical adds a Clash classical line such as
+// "DOMAIN-SUFFIX,example.com" or "IP-CIDR,10.0.0.0/8,no-resolve". Rule
+// types routing does not know are skipped.
+func (s *ruleSet) addClassical(line string) error {
+	fields := strings.Split(line, ",")
+	if len(fields) < 2 {
+		return errors.New("expected TYPE,VALUE")
+	}
+	kind, value := strings.ToLower(strings.TrimSpace(fields[0])), strings.TrimSpace(fields[1])
+	switch kind {
+	case "domain":
+		s.full[normalizeDomain(value)] = struct{}{}
+	case "domain-suffix":
+		s.suffix[normalizeDomain(value)] = struct{}{}
+	case "domain-keyword":
+		s.keywords = append(s.keywords, normalizeDomain(value))
+	case "domain-wildcard":
+		s.wildcards = append(s.wildcards, normalizeDomain(value))
+	case "domain-regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return err
+		}
+		s.regexps = append(s.regexps, re)
+	case "ip-cidr", "ip-cidr6", "geoip", "dst-port":
+		return s.addRule(kind, value)
+	default:
+		logger.Debug("rule set entry skipped", "type", fields[0])
+		return nil
+	}
+	s.size++
+	return nil
+}
+
+func (s *ruleSet) addRule(kind string, value string) error {
+	rule, err := parseRule(kind, value, "")
+	if err != nil {
+		return err
+	}
+	s.rules = append(s.rules, rule)
+	s.size++
+	return nil
+}
+
+// Domain types of the geosite format.
+const (
+	geositePlain = iota
+	geositeRegex
+	geositeDomain
+	geositeFull
+)
+
+// addGeosite adds the domains of category from a V2Ray geosite file
+// (dlc.dat), a protobuf GeoSiteList of GeoSite{country_code, domain}
+// entries with Domain{type, value, attribute}. As in V2Ray, a category
+// written "name@attr" takes only the domains that carry every attribute
+// listed after the name.
+func (s *ruleSet) addGeosite(data []byte, category string) error {
+	category, list, _ := strings.Cut(category, "@")
+	var attrs []string
+	for _, attr := range strings.Split(list, "@") {
+		if attr = strings.ToLower(strings.TrimSpace(attr)); attr != "" {
+			attrs = append(attrs, attr)
+		}
+	}
+	found := false
+	err := eachProtoField(data, func(num int, site []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var code string
+		var domains [][]byte
+		err := eachProtoField(site, func(num int, value []byte) error {
+			switch num {
+			case 1:
+				code = string(value)
+			case 2:
+				domains = append(domains, value)
+			}
+			return nil
+		})
+		if err != nil || !strings.EqualFold(code, category) {
+			return err
+		}
+		found = true
+		for _, d := range domains {
+			if err := s.addGeositeDomain(d, attrs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no geosite category %q", category)
+	}
+	return nil
+}
+
+// addGeositeDomain adds a Domain entry if it carries all of attrs. A
+// regexp RE2 cannot compile, such as one with lookarounds, is skipped.
+func (s *ruleSet) addGeositeDomain(data []byte, attrs []string) error {
+	kind := geositePlain
+	var value string
+	var has []string
+	err := eachProtoField(data, func(num int, field []byte) error {
+		switch num {
+		case 1:
+			v, _ := binary.Uvarint(field)
+			kind = int(v)
+		case 2:
+			value = string(field)
+		case 3:
+			return eachProtoField(field, func(num int, key []byte) error {
+				if num == 1 {
+					has = append(has, strings.ToLower(string(key)))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		if !slices.Contains(has, attr) {
+			return nil
+		}
+	}
+	switch kind {
+	case geositePlain:
+		s.keywords = append(s.keywords, normalizeDomain(value))
+	case geositeRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			s.skipped = append(s.skipped, fmt.Errorf("geosite regexp %q: %w", value, err))
+			return nil
+		}
+		s.regexps = append(s.regexps, re)
+	case geositeDomain:
+		s.suffix[normalizeDomain(value)] = struct{}{}
+	case geositeFull:
+		s.full[normalizeDomain(value)] = struct{}{}
+	}
+	s.size++
+	return nil
+}
+
+// eachProtoField walks the top-level fields of a protobuf message. Varint
+// fields are passed as their encoded bytes, length-delimited ones as their
+// content; fixed-width fields are skipped.
+func eachProtoField(data []byte, fn func(num int, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return io.ErrUnexpectedEOF
+		}
+		data = data[n:]
+		var value []byte
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(data)
+			if n <= 0 {
+				return io.ErrUnexpectedEOF
+			}
+			value, data = data[:n], data[n:]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return io.ErrUnexpectedEOF
+			}
+			data = data[size:]
+			continue
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return io.ErrUnexpectedEOF
+			}
+			value, data = data[n:n+int(length)], data[n+int(length):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if err := fn(int(key>>3), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether the target falls under the set.
+func (s *ruleSet) matches(r *router, t *routeTarget) bool {
+	if len(s.rules) > 0 {
+		if _, ok := r.match(s.rules, t); ok {
+			return true
+		}
+	}
+	if t.isIP || t.domain == "" {
+		return false
+	}
+	if _, ok := s.full[t.domain]; ok {
+		return true
+	}
+	for d, first := t.domain, true; d != ""; first = false {
+		if _, ok := s.suffix[d]; ok {
+			return true
+		}
+		if _, ok := s.children[d]; ok && !first {
+			return true
+		}
+		var found bool
+		_, d, found = strings.Cut(d, ".")
+		if first && found {
+			if _, ok := s.oneLabel[d]; ok {
+				return true
+			}
+		}
+	}
+	for _, keyword := range s.keywords {
+		if strings.Contains(t.domain, keyword) {
+			return true
+		}
+	}
+	for _, pattern := range s.wildcards {
+		if matchWildcard(pattern, t.domain) {
+			return true
+		}
+	}
+	for _, re := range s.regexps {
+		if re.MatchString(t.domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,379 @@
+package tun2socks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	ssMaxPayload    = 0x3FFF
+	ssMaxUDPPayload = 64 * 1024
+)
+
+type ssCipher struct {
+	key      []byte
+	saltSize int
+	newAEAD  func(key []byte) (cipher.AEAD, error)
+}
+
+func newSSCipher(method string, password string) (*ssCipher, error) {
+	switch strings.ToLower(method) {
+	case "aes-256-gcm", "aead_aes_256_gcm":
+		return &ssCipher{
+			key:      evpBytesToKey(password, 32),
+			saltSize: 32,
+			newAEAD: func(key []byte) (cipher.AEAD, error) {
+				block, err := aes.NewCipher(key)
+				if err != nil {
+					return nil, err
+				}
+				return cipher.NewGCM(block)
+			},
+		}, nil
+	case "chacha20-ietf-poly1305", "chacha20-poly1305", "aead_chacha20_poly1305":
+		return &ssCipher{
+			key:      evpBytesToKey(password, chacha20poly1305.KeySize),
+			saltSize: 32,
+			newAEAD:  chacha20poly1305.New,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported shadowsocks cipher %q", method)
+	}
+}
+
+func (c *ssCipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey, err := hkdf.Key(sha1.New, c.key, salt, "ss-subkey", len(c.key))
+	if err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+func evpBytesToKey(password string, keyLen int) []byte {
+	var key, prev []byte
+	for len(key) < keyLen {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keyLen]
+}
+
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+type ssConn struct {
+	halfCloser
+	cipher *ssCipher
+
+	writeMu    sync.Mutex
+	writer     cipher.AEAD
+	writeNonce []byte
+	writeBuf   []byte
+
+	reader    cipher.AEAD
+	readNonce []byte
+	readBuf   []byte
+	pending   []byte
+}
+
+func newSSConn(conn net.Conn, c *ssCipher) *ssConn {
+	return &ssConn{halfCloser: halfCloser{conn}, cipher: c}
+}
+
+func (c *ssConn) initWriter() error {
+	salt := make([]byte, c.cipher.saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := c.cipher.aead(salt)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Conn.Write(salt); err != nil {
+		return err
+	}
+	c.writer = aead
+	c.writeNonce = make([]byte, aead.NonceSize())
+	c.writeBuf = make([]byte, 2+aead.Overhead()+ssMaxPayload+aead.Overhead())
+	return nil
+}
+
+func (c *ssConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.writer == nil {
+		if err := c.initWriter(); err != nil {
+			return 0, err
+		}
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > ssMaxPayload {
+			n = ssMaxPayload
+		}
+		overhead := c.writer.Overhead()
+		buf := c.writeBuf[:2+overhead+n+overhead]
+		binary.BigEndian.PutUint16(buf[:2], uint16(n))
+		c.writer.Seal(buf[:0], c.writeNonce, buf[:2], nil)
+		incrementNonce(c.writeNonce)
+		c.writer.Seal(buf[2+overhead:2+overhead], c.writeNonce, p[:n], nil)
+		incrementNonce(c.writeNonce)
+		if _, err := c.Conn.Write(buf); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *ssConn) initReader() error {
+	salt := make([]byte, c.cipher.saltSize)
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	aead, err := c.cipher.aead(salt)
+	if err != nil {
+		return err
+	}
+	c.reader = aead
+	c.readNonce = make([]byte, aead.NonceSize())
+	c.readBuf = make([]byte, ssMaxPayload+aead.Overhead())
+	return nil
+}
+
+func (c *ssConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	if c.reader == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+
+	overhead := c.reader.Overhead()
+	buf := c.readBuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	if _, err := c.reader.Open(buf[:0], c.readNonce, buf, nil); err != nil {
+		return 0, err
+	}
+	incrementNonce(c.readNonce)
+
+	size := int(binary.BigEndian.Uint16(buf[:2])) & ssMaxPayload
+	buf = c.readBuf[:size+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	payload, err := c.reader.Open(buf[:0], c.readNonce, buf, nil)
+	if err != nil {
+		return 0, err
+	}
+	incrementNonce(c.readNonce)
+
+	n := copy(p, payload)
+	c.pending = payload[n:]
+	return n, nil
+}
+
+type shadowsocksTCPHandler struct {
+	serverAddr  string
+	cipher      *ssCipher
+	transport   *transportConfig
+	via         proxy.Dialer
+	dialTimeout time.Duration
+}
+
+func newShadowsocksTCPHandler(host string, port uint16, c *ssCipher, transport *transportConfig, via proxy.Dialer, dialTimeout time.Duration) outbound {
+	return &shadowsocksTCPHandler{
+		serverAddr:  net.JoinHostPort(host, strconv.Itoa(int(port))),
+		cipher:      c,
+		transport:   transport,
+		via:         via,
+		dialTimeout: dialTimeout,
+	}
+}
+
+func (h *shadowsocksTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(h, conn, target)
+}
+
+func (h *shadowsocksTCPHandler) Dial(network string, addr string) (net.Conn, error) {
+	target := socks.ParseAddr(addr)
+	if target == nil {
+		return nil, fmt.Errorf("invalid target address %q", addr)
+	}
+	rc, err := dialTransport(h.transport, h.via, h.serverAddr, h.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := newSSConn(rc, h.cipher)
+	if _, err := sc.Write(target); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+type shadowsocksUDPHandler struct {
+	sync.Mutex
+
+	serverAddr string
+	cipher     *ssCipher
+	timeout    time.Duration
+	conns      map[core.UDPConn]net.PacketConn
+	remotes    map[core.UDPConn]*net.UDPAddr
+}
+
+func newShadowsocksUDPHandler(host string, port uint16, c *ssCipher, timeout time.Duration) core.UDPConnHandler {
+	return &shadowsocksUDPHandler{
+		serverAddr: net.JoinHostPort(host, strconv.Itoa(int(port))),
+		cipher:     c,
+		timeout:    timeout,
+		conns:      make(map[core.UDPConn]net.PacketConn, 8),
+		remotes:    make(map[core.UDPConn]*net.UDPAddr, 8),
+	}
+}
+
+func (h *shadowsocksUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	remote, err := resolveUDPAddr(h.serverAddr)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return err
+	}
+
+	h.Lock()
+	h.conns[conn] = pc
+	h.remotes[conn] = remote
+	h.Unlock()
+
+	go h.fetchInput(conn, pc)
+	return nil
+}
+
+func (h *shadowsocksUDPHandler) fetchInput(conn core.UDPConn, pc net.PacketConn) {
+	buf := make([]byte, ssMaxUDPPayload)
+	defer h.Close(conn)
+
+	for {
+		pc.SetReadDeadline(time.Now().Add(h.timeout))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		payload, err := h.unpack(buf[:n])
+		if err != nil {
+			continue
+		}
+		addr := socks.SplitAddr(payload)
+		if addr == nil {
+			continue
+		}
+		src, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			continue
+		}
+		if _, err := conn.WriteFrom(payload[len(addr):], src); err != nil {
+			return
+		}
+	}
+}
+
+func (h *shadowsocksUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	pc, ok1 := h.conns[conn]
+	remote, ok2 := h.remotes[conn]
+	h.Unlock()
+
+	if !ok1 || !ok2 {
+		h.Close(conn)
+		return fmt.Errorf("proxy connection %v->%v does not exist", conn.LocalAddr(), addr)
+	}
+
+	packet, err := h.pack(append(socks.ParseAddr(addr.String()), data...))
+	if err != nil {
+		return err
+	}
+	if _, err := pc.WriteTo(packet, remote); err != nil {
+		h.Close(conn)
+		return fmt.Errorf("write remote failed: %v", err)
+	}
+	return nil
+}
+
+func (h *shadowsocksUDPHandler) pack(plaintext []byte) ([]byte, error) {
+	salt := make([]byte, h.cipher.saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := h.cipher.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(salt, nonce, plaintext, nil), nil
+}
+
+func (h *shadowsocksUDPHandler) unpack(packet []byte) ([]byte, error) {
+	if len(packet) < h.cipher.saltSize {
+		return nil, errors.New("short shadowsocks packet")
+	}
+	aead, err := h.cipher.aead(packet[:h.cipher.saltSize])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Open(nil, nonce, packet[h.cipher.saltSize:], nil)
+}
+
+func (h *shadowsocksUDPHandler) Close(conn core.UDPConn) {
+	conn.Close()
+
+	h.Lock()
+	defer h.Unlock()
+
+	if pc, ok := h.conns[conn]; ok {
+		pc.Close()
+		delete(h.conns, conn)
+	}
+	delete(h.remotes, conn)
+}
@@ -0,0 +1,129 @@
+package tun2socks
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	drainPoll    = 50 * time.Millisecond
+	flowExitWait = 2 * time.Second
+)
+
+var (
+	drainTimeout atomic.Int64
+	draining     atomic.Bool
+
+	errDraining = errors.New("tunnel is shutting down")
+)
+
+type shutdownEvent struct {
+	Event          string `json:"event"`
+	DrainedFlows   int    `json:"drainedFlows"`
+	AbortedFlows   int    `json:"abortedFlows"`
+	RemainingFlows int    `json:"remainingFlows"`
+	DurationMs     int64  `json:"durationMs"`
+}
+
+func configureDrain(cfg timeoutConfig) {
+	drainTimeout.Store(int64(time.Duration(cfg.DrainMs) * time.Millisecond))
+}
+
+func openFlows() int {
+	connMu.Lock()
+	defer connMu.Unlock()
+	return len(connections)
+}
+
+// drainFlows stops new flows from being accepted and waits up to the drain
+// timeout for open ones to finish on their own. It returns how many did.
+func drainFlows() int {
+	draining.Store(true)
+	open := openFlows()
+	deadline := time.Now().Add(time.Duration(drainTimeout.Load()))
+	for remaining := open; remaining > 0 && time.Now().Before(deadline); remaining = openFlows() {
+		time.Sleep(drainPoll)
+	}
+	return max(open-openFlows(), 0)
+}
+
+// Drain refuses new TCP connections and UDP sessions and waits up to
+// timeout for the open flows to finish, calling fn with the number still
+// open at first and whenever it changes. It returns that number. The
+// tunnel keeps relaying the open flows, and refusing new ones, until Stop
+// aborts what is left or a Reload switches servers, so the switch does
+// not cut a transfer that can finish first.
+func Drain(timeout time.Duration, fn func(remaining int)) (int, error) {
+	lifecycleMu.Lock()
+	stateMu.Lock()
+	t := &Tunnel{gen: tunnelGen}
+	isRunning := running
+	stateMu.Unlock()
+	if isRunning {
+		draining.Store(true)
+		setPhase(stateStopping, "")
+		statusMu.Lock()
+		drainHeld = true
+		statusMu.Unlock()
+	}
+	lifecycleMu.Unlock()
+	if !isRunning {
+		return 0, ErrNotRunning
+	}
+
+	logger.Info("draining flows", "flows", openFlows(), "timeout", timeout)
+	deadline := time.Now().Add(timeout)
+	reported := -1
+	for {
+		remaining := openFlows()
+		if remaining != reported {
+			reported = remaining
+			if fn != nil {
+				fn(remaining)
+			}
+		}
+		// A stop in the meantime has aborted the rest.
+		if remaining == 0 || !time.Now().Before(deadline) || !t.Running() {
+			return remaining, nil
+		}
+		time.Sleep(drainPoll)
+	}
+}
+
+// undrain lets new flows in again once a reload has switched the tunnel
+// away from the configuration a Drain emptied. A stop keeps them out.
+func undrain() {
+	statusMu.Lock()
+	resumed := drainHeld && phase == stateStopping
+	if resumed {
+		drainHeld = false
+		phase = stateRunning
+		draining.Store(false)
+	}
+	statusMu.Unlock()
+	if resumed {
+		logger.Info("drain ended by reload")
+		updateState()
+	}
+}
+
+// reportShutdown waits briefly for aborted relays to unwind and then emits
+// a stopped event, so the host knows no proxy connection is left behind.
+func reportShutdown(started time.Time, drained int, aborted int) {
+	deadline := time.Now().Add(flowExitWait)
+	for openFlows() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPoll)
+	}
+	remaining := openFlows()
+	if remaining > 0 {
+		logger.Warn("flows still open after stop", "flows", remaining)
+	}
+	emitEvent(shutdownEvent{
+		Event:          "stopped",
+		DrainedFlows:   drained,
+		AbortedFlows:   aborted,
+		RemainingFlows: remaining,
+		DurationMs:     time.Since(started).Milliseconds(),
+	})
+}
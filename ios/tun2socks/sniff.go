@@ -0,0 +1,115 @@
+package tun2socks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func sniffHost(data []byte) string {
+	if host := sniffTLSServerName(data); host != "" {
+		return host
+	}
+	return sniffHTTPHost(data)
+}
+
+func sniffTLSServerName(data []byte) string {
+	if len(data) < 5 || data[0] != 0x16 || data[1] != 0x03 {
+		return ""
+	}
+	data = data[5:]
+	if len(data) < 4 || data[0] != 0x01 {
+		return ""
+	}
+	data = data[4:]
+
+	// client_version + random
+	if len(data) < 34 {
+		return ""
+	}
+	data = data[34:]
+
+	skip := func(lenBytes int) bool {
+		if len(data) < lenBytes {
+			return false
+		}
+		n := 0
+		for i := 0; i < lenBytes; i++ {
+			n = n<<8 | int(data[i])
+		}
+		if len(data) < lenBytes+n {
+			return false
+		}
+		data = data[lenBytes+n:]
+		return true
+	}
+	// session_id, cipher_suites, compression_methods
+	if !skip(1) || !skip(2) || !skip(1) {
+		return ""
+	}
+
+	if len(data) < 2 {
+		return ""
+	}
+	extLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) > extLen {
+		data = data[:extLen]
+	}
+
+	for len(data) >= 4 {
+		extType := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+		if len(data) < length {
+			return ""
+		}
+		if extType == 0 {
+			ext := data[:length]
+			if len(ext) < 2 {
+				return ""
+			}
+			ext = ext[2:]
+			for len(ext) >= 3 {
+				nameType := ext[0]
+				nameLen := int(binary.BigEndian.Uint16(ext[1:]))
+				ext = ext[3:]
+				if len(ext) < nameLen {
+					return ""
+				}
+				if nameType == 0 {
+					return string(ext[:nameLen])
+				}
+				ext = ext[nameLen:]
+			}
+			return ""
+		}
+		data = data[length:]
+	}
+	return ""
+}
+
+func sniffHTTPHost(data []byte) string {
+	end := bytes.IndexByte(data, ' ')
+	if end <= 0 || end > 8 {
+		return ""
+	}
+	switch string(data[:end]) {
+	case "GET", "POST", "PUT", "HEAD", "DELETE", "OPTIONS", "PATCH", "CONNECT":
+	default:
+		return ""
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil || req.Host == "" {
+		return ""
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
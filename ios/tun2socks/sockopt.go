@@ -0,0 +1,63 @@
+package tun2socks
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// socketConfig tunes the TCP sockets dialed to proxies and direct targets.
+// Zero values keep the Go defaults: no delay on, keepalive every 15s and
+// the system buffer sizes.
+type socketConfig struct {
+	NoDelay       *bool `json:"noDelay,omitempty"`
+	KeepAliveMs   int   `json:"keepAliveMs,omitempty"`
+	SendBuffer    int   `json:"sendBuffer,omitempty"`
+	ReceiveBuffer int   `json:"receiveBuffer,omitempty"`
+	FastOpen      bool  `json:"fastOpen,omitempty"`
+
+	FlowKeepalive *flowKeepaliveConfig `json:"flowKeepalive,omitempty"`
+}
+
+var socketOptions atomic.Pointer[socketConfig]
+
+func configureSocket(cfg *socketConfig) {
+	socketOptions.Store(cfg)
+}
+
+// socketDialer returns a dialer applying the socket options. Buffer sizes
+// and TCP Fast Open are set before connecting so they take part in the
+// handshake.
+func socketDialer() *net.Dialer {
+	d := &net.Dialer{}
+	opts := socketOptions.Load()
+	if opts == nil {
+		return d
+	}
+	switch {
+	case opts.KeepAliveMs > 0:
+		interval := time.Duration(opts.KeepAliveMs) * time.Millisecond
+		d.KeepAliveConfig = net.KeepAliveConfig{Enable: true, Idle: interval, Interval: interval}
+	case opts.KeepAliveMs < 0:
+		d.KeepAlive = -1
+	}
+	if opts.SendBuffer > 0 || opts.ReceiveBuffer > 0 || opts.FastOpen {
+		d.Control = func(network string, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				controlSocket(fd, opts)
+			})
+		}
+	}
+	return d
+}
+
+func tuneConn(conn net.Conn) {
+	opts := socketOptions.Load()
+	if opts == nil || opts.NoDelay == nil {
+		return
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetNoDelay(*opts.NoDelay)
+	}
+}
@@ -0,0 +1,18 @@
+package tun2socks
+
+import "golang.org/x/sys/unix"
+
+// Darwin only offers TCP Fast Open to clients through connectx(2), which
+// the Go runtime does not use, so fastOpen is ignored here.
+func controlSocket(fd uintptr, opts *socketConfig) {
+	if opts.SendBuffer > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, opts.SendBuffer); err != nil {
+			logger.Debug("send buffer not set", "error", err)
+		}
+	}
+	if opts.ReceiveBuffer > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, opts.ReceiveBuffer); err != nil {
+			logger.Debug("receive buffer not set", "error", err)
+		}
+	}
+}
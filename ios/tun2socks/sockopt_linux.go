@@ -0,0 +1,21 @@
+package tun2socks
+
+import "golang.org/x/sys/unix"
+
+func controlSocket(fd uintptr, opts *socketConfig) {
+	if opts.SendBuffer > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, opts.SendBuffer); err != nil {
+			logger.Debug("send buffer not set", "error", err)
+		}
+	}
+	if opts.ReceiveBuffer > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, opts.ReceiveBuffer); err != nil {
+			logger.Debug("receive buffer not set", "error", err)
+		}
+	}
+	if opts.FastOpen {
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1); err != nil {
+			logger.Debug("tcp fast open not available", "error", err)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+//go:build !darwin && !linux
+
+package tun2socks
+
+func controlSocket(fd uintptr, opts *socketConfig) {}
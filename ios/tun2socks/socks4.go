@@ -0,0 +1,117 @@
+package tun2socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	socks4Version    = 4
+	socks4CmdConnect = 1
+	socks4Granted    = 0x5a
+	socks4Rejected   = 0x5b
+	maxSocks4Field   = 255
+)
+
+// socks4TCPHandler connects through a SOCKS4 proxy. SOCKS4 only carries
+// IPv4 addresses, so names are resolved locally. With SOCKS4a they are
+// sent to the proxy instead, which keeps fake-IP and domain routing
+// working as with SOCKS5.
+type socks4TCPHandler struct {
+	proxyHost   string
+	proxyPort   uint16
+	userID      string
+	hostnames   bool
+	via         proxy.Dialer
+	dialTimeout time.Duration
+}
+
+func newSocks4TCPHandler(host string, port uint16, userID string, hostnames bool, via proxy.Dialer, dialTimeout time.Duration) outbound {
+	return &socks4TCPHandler{
+		proxyHost:   host,
+		proxyPort:   port,
+		userID:      userID,
+		hostnames:   hostnames,
+		via:         via,
+		dialTimeout: dialTimeout,
+	}
+}
+
+func (h *socks4TCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(h, conn, target)
+}
+
+func (h *socks4TCPHandler) Dial(network string, addr string) (net.Conn, error) {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portText)
+	}
+	if len(h.userID) > maxSocks4Field || len(host) > maxSocks4Field {
+		return nil, errors.New("socks4 user id or host too long")
+	}
+
+	req := []byte{socks4Version, socks4CmdConnect, byte(port >> 8), byte(port)}
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() == nil:
+		return nil, errors.New("socks4 cannot connect to ipv6 addresses")
+	case ip != nil:
+		req = append(req, ip.To4()...)
+		req = append(req, h.userID...)
+		req = append(req, 0)
+	case h.hostnames:
+		// SOCKS4a: an address of 0.0.0.x with x non-zero announces the
+		// host name after the user id.
+		req = append(req, 0, 0, 0, 1)
+		req = append(req, h.userID...)
+		req = append(req, 0)
+		req = append(req, host...)
+		req = append(req, 0)
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), h.dialTimeout)
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", host)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		v4 := addrs[0].Unmap().As4()
+		req = append(req, v4[:]...)
+		req = append(req, h.userID...)
+		req = append(req, 0)
+	}
+
+	conn, err := dialServer(h.via, net.JoinHostPort(h.proxyHost, strconv.Itoa(int(h.proxyPort))), h.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(handshakeDeadline())
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply[1] != socks4Granted {
+		conn.Close()
+		if reply[1] == socks4Rejected {
+			return nil, fmt.Errorf("%w: socks4 request rejected", errConnectRejected)
+		}
+		return nil, fmt.Errorf("%w: socks4 identd check failed with reply %#x", errProxyAuth, reply[1])
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
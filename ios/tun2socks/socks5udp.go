@@ -0,0 +1,275 @@
+package tun2socks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	socks5Version       = 5
+	socks5AuthNone      = 0
+	socks5AuthPassword  = 2
+	socks5CmdBind       = 2
+	socks5CmdUDPAssoc   = 3
+	socks5MaxUDPPayload = 65535 - 20 - 8 - 7
+)
+
+func socks5Handshake(conn net.Conn, auth *proxy.Auth) error {
+	methods := []byte{socks5Version, 1, socks5AuthNone}
+	if auth != nil {
+		methods = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return errors.New("unexpected socks version")
+	}
+
+	switch buf[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if auth == nil {
+			return fmt.Errorf("%w: socks5 server requires credentials", errProxyAuth)
+		}
+		if len(auth.User) > 255 || len(auth.Password) > 255 {
+			return errors.New("socks5 credentials too long")
+		}
+		req := []byte{1, byte(len(auth.User))}
+		req = append(req, auth.User...)
+		req = append(req, byte(len(auth.Password)))
+		req = append(req, auth.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errProxyAuth
+		}
+		return nil
+	default:
+		return errors.New("no acceptable socks5 authentication method")
+	}
+}
+
+func socks5Request(conn net.Conn, cmd byte, addr socks.Addr) (socks.Addr, error) {
+	req := append([]byte{socks5Version, cmd, 0}, addr...)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	return readSocks5Reply(conn)
+}
+
+// readSocks5Reply reads a reply to a request and returns its address.
+func readSocks5Reply(conn net.Conn) (socks.Addr, error) {
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if buf[1] != 0 {
+		return nil, fmt.Errorf("socks5 request failed with reply %d", buf[1])
+	}
+	return readSocksAddr(conn)
+}
+
+func readSocksAddr(r io.Reader) (socks.Addr, error) {
+	buf := make([]byte, socks.MaxAddrLen)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return nil, err
+	}
+
+	var n int
+	switch buf[0] {
+	case 1:
+		n = 1 + net.IPv4len + 2
+	case 4:
+		n = 1 + net.IPv6len + 2
+	case 3:
+		if _, err := io.ReadFull(r, buf[1:2]); err != nil {
+			return nil, err
+		}
+		n = 1 + 1 + int(buf[1]) + 2
+	default:
+		return nil, errors.New("unsupported socks address type")
+	}
+
+	start := 1
+	if buf[0] == 3 {
+		start = 2
+	}
+	if _, err := io.ReadFull(r, buf[start:n]); err != nil {
+		return nil, err
+	}
+	return socks.Addr(buf[:n]), nil
+}
+
+type socksUDPHandler struct {
+	sync.Mutex
+
+	proxyHost   string
+	proxyPort   uint16
+	auth        *proxy.Auth
+	dialTimeout time.Duration
+	timeout     time.Duration
+	tcpConns    map[core.UDPConn]net.Conn
+	udpConns    map[core.UDPConn]net.PacketConn
+	relays      map[core.UDPConn]*net.UDPAddr
+}
+
+func newSocksUDPHandler(host string, port uint16, username string, password string, dialTimeout time.Duration, timeout time.Duration) core.UDPConnHandler {
+	var auth *proxy.Auth
+	if username != "" || password != "" {
+		auth = &proxy.Auth{User: username, Password: password}
+	}
+
+	return &socksUDPHandler{
+		proxyHost:   host,
+		proxyPort:   port,
+		auth:        auth,
+		dialTimeout: dialTimeout,
+		timeout:     timeout,
+		tcpConns:    make(map[core.UDPConn]net.Conn, 8),
+		udpConns:    make(map[core.UDPConn]net.PacketConn, 8),
+		relays:      make(map[core.UDPConn]*net.UDPAddr, 8),
+	}
+}
+
+func (h *socksUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	proxyAddr := net.JoinHostPort(h.proxyHost, strconv.Itoa(int(h.proxyPort)))
+	c, err := dialTCP(proxyAddr, h.dialTimeout)
+	if err != nil {
+		return err
+	}
+
+	c.SetDeadline(handshakeDeadline())
+	if err := socks5Handshake(c, h.auth); err != nil {
+		c.Close()
+		return err
+	}
+	bound, err := socks5Request(c, socks5CmdUDPAssoc, socks.Addr{1, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		c.Close()
+		return err
+	}
+	c.SetDeadline(time.Time{})
+
+	relay, err := resolveUDPAddr(bound.String())
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		relay, err = resolveUDPAddr(net.JoinHostPort(h.proxyHost, strconv.Itoa(relay.Port)))
+		if err != nil {
+			c.Close()
+			return err
+		}
+	}
+
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	h.Lock()
+	h.tcpConns[conn] = c
+	h.udpConns[conn] = pc
+	h.relays[conn] = relay
+	h.Unlock()
+
+	go h.watchControl(conn, c)
+	go h.fetchInput(conn, pc)
+	return nil
+}
+
+func (h *socksUDPHandler) watchControl(conn core.UDPConn, c net.Conn) {
+	defer h.Close(conn)
+	buf := make([]byte, 1)
+	for {
+		if _, err := c.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+func (h *socksUDPHandler) fetchInput(conn core.UDPConn, pc net.PacketConn) {
+	buf := make([]byte, socks5MaxUDPPayload)
+	defer h.Close(conn)
+
+	for {
+		pc.SetReadDeadline(time.Now().Add(h.timeout))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+		addr := socks.SplitAddr(buf[3:n])
+		if addr == nil {
+			continue
+		}
+		src, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			continue
+		}
+		if _, err := conn.WriteFrom(buf[3+len(addr):n], src); err != nil {
+			return
+		}
+	}
+}
+
+func (h *socksUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	pc, ok1 := h.udpConns[conn]
+	relay, ok2 := h.relays[conn]
+	h.Unlock()
+
+	if !ok1 || !ok2 {
+		h.Close(conn)
+		return fmt.Errorf("proxy connection %v->%v does not exist", conn.LocalAddr(), addr)
+	}
+
+	packet := append([]byte{0, 0, 0}, socks.ParseAddr(addr.String())...)
+	packet = append(packet, data...)
+	if _, err := pc.WriteTo(packet, relay); err != nil {
+		h.Close(conn)
+		return fmt.Errorf("write remote failed: %v", err)
+	}
+	return nil
+}
+
+func (h *socksUDPHandler) Close(conn core.UDPConn) {
+	conn.Close()
+
+	h.Lock()
+	defer h.Unlock()
+
+	if c, ok := h.tcpConns[conn]; ok {
+		c.Close()
+		delete(h.tcpConns, conn)
+	}
+	if pc, ok := h.udpConns[conn]; ok {
+		pc.Close()
+		delete(h.udpConns, conn)
+	}
+	delete(h.relays, conn)
+}
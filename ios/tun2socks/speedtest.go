@@ -0,0 +1,313 @@
+package tun2socks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSpeedTestDuration = 10 * time.Second
+	defaultSpeedTestPings    = 10
+	defaultUploadBytes       = 25 << 20
+
+	speedTestInterval = 250 * time.Millisecond
+)
+
+var errSpeedTestRunning = errors.New("a speed test is already running")
+
+type speedTestConfig struct {
+	URL         string `json:"url"`
+	UploadURL   string `json:"uploadURL,omitempty"`
+	UploadBytes int64  `json:"uploadBytes,omitempty"`
+	DurationMs  int    `json:"durationMs,omitempty"`
+	Pings       int    `json:"pings,omitempty"`
+}
+
+// speedTestReport is sent after every step. Each one carries the results
+// so far, so the last one, with phase "done", is the final result.
+type speedTestReport struct {
+	Phase         string  `json:"phase"`
+	LatencyMs     float64 `json:"latencyMs"`
+	JitterMs      float64 `json:"jitterMs"`
+	DownloadBytes int64   `json:"downloadBytes"`
+	DownloadKbps  int64   `json:"downloadKbps"`
+	UploadBytes   int64   `json:"uploadBytes"`
+	UploadKbps    int64   `json:"uploadKbps"`
+}
+
+var speedTestMu sync.Mutex
+
+// RunSpeedTest measures latency, jitter and throughput through the main
+// outbound of the running tunnel. jsonConfig is {"url", "uploadURL",
+// "uploadBytes", "durationMs", "pings"}. fn receives a JSON report after
+// each latency sample, a few times a second while transferring and once
+// more with phase "done". It returns when the test is over.
+func RunSpeedTest(jsonConfig string, fn func(json string)) error {
+	var cfg speedTestConfig
+	if err := json.Unmarshal([]byte(jsonConfig), &cfg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	if cfg.UploadBytes < 0 || cfg.DurationMs < 0 || cfg.Pings < 0 {
+		return ErrInvalidConfig
+	}
+	if cfg.URL == "" {
+		return fmt.Errorf("%w: speed test needs a url", ErrInvalidConfig)
+	}
+	u, err := parseProbeURL(cfg.URL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	if cfg.UploadURL != "" {
+		if _, err := parseProbeURL(cfg.UploadURL); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+	}
+
+	stateMu.Lock()
+	ob := tcpSwitch
+	stateMu.Unlock()
+	if ob == nil {
+		return ErrNotRunning
+	}
+	if !speedTestMu.TryLock() {
+		return errSpeedTestRunning
+	}
+	defer speedTestMu.Unlock()
+
+	t := &speedTest{
+		config:   cfg,
+		fn:       fn,
+		duration: defaultSpeedTestDuration,
+		pings:    defaultSpeedTestPings,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return ob.Dial(network, addr)
+				},
+				DisableCompression: true,
+			},
+		},
+	}
+	defer t.client.CloseIdleConnections()
+	if cfg.DurationMs > 0 {
+		t.duration = time.Duration(cfg.DurationMs) * time.Millisecond
+	}
+	if cfg.Pings > 0 {
+		t.pings = cfg.Pings
+	}
+	if t.config.UploadBytes == 0 {
+		t.config.UploadBytes = defaultUploadBytes
+	}
+
+	if err := t.latency(u.String()); err != nil {
+		return err
+	}
+	if err := t.download(); err != nil {
+		return err
+	}
+	if cfg.UploadURL != "" {
+		if err := t.upload(); err != nil {
+			return err
+		}
+	}
+	t.report("done")
+	logger.Info("speed test finished", "latencyMs", t.result.LatencyMs, "downloadKbps", t.result.DownloadKbps, "uploadKbps", t.result.UploadKbps)
+	return nil
+}
+
+type speedTest struct {
+	config   speedTestConfig
+	fn       func(json string)
+	client   *http.Client
+	duration time.Duration
+	pings    int
+
+	result speedTestReport
+}
+
+func (t *speedTest) report(phase string) {
+	if t.fn == nil {
+		return
+	}
+	t.result.Phase = phase
+	data, err := json.Marshal(t.result)
+	if err != nil {
+		return
+	}
+	t.fn(string(data))
+}
+
+// latency times HEAD requests on one kept-alive connection. The first
+// request opens the connection through the outbound and is not counted.
+// Jitter is the mean difference between consecutive samples.
+func (t *speedTest) latency(target string) error {
+	var samples []time.Duration
+	for i := 0; i <= t.pings; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), t.duration)
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+		if err != nil {
+			cancel()
+			return err
+		}
+		start := time.Now()
+		resp, err := t.client.Do(req)
+		if err != nil {
+			cancel()
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		cancel()
+		if i == 0 {
+			continue
+		}
+
+		samples = append(samples, time.Since(start))
+		var sum, diffs time.Duration
+		for j, s := range samples {
+			sum += s
+			if j > 0 {
+				diffs += (s - samples[j-1]).Abs()
+			}
+		}
+		t.result.LatencyMs = milliseconds(sum / time.Duration(len(samples)))
+		if len(samples) > 1 {
+			t.result.JitterMs = milliseconds(diffs / time.Duration(len(samples)-1))
+		}
+		t.report("latency")
+	}
+	return nil
+}
+
+func (t *speedTest) download() error {
+	var count atomic.Int64
+	elapsed, err := t.transfer("download", &count, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.config.URL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := t.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("download returned status %d", resp.StatusCode)
+		}
+		_, err = io.Copy(byteCounter{&count}, resp.Body)
+		return err
+	}, func(n int64, kbps int64) {
+		t.result.DownloadBytes, t.result.DownloadKbps = n, kbps
+	})
+	logger.Debug("speed test download", "bytes", count.Load(), "elapsed", elapsed)
+	return err
+}
+
+// upload posts uploadBytes of zeros. The body is sent chunked so it can end
+// early once the test duration is up.
+func (t *speedTest) upload() error {
+	var count atomic.Int64
+	elapsed, err := t.transfer("upload", &count, func(ctx context.Context) error {
+		body := &zeroReader{remaining: t.config.UploadBytes, count: &count}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.config.UploadURL, body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := t.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("upload returned status %d", resp.StatusCode)
+		}
+		return nil
+	}, func(n int64, kbps int64) {
+		t.result.UploadBytes, t.result.UploadKbps = n, kbps
+	})
+	logger.Debug("speed test upload", "bytes", count.Load(), "elapsed", elapsed)
+	return err
+}
+
+// transfer runs fn for at most the test duration and reports the bytes
+// counted so far every speedTestInterval. Running out of time ends the
+// transfer normally.
+func (t *speedTest) transfer(phase string, count *atomic.Int64, fn func(ctx context.Context) error, update func(n int64, kbps int64)) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.duration)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	ticker := time.NewTicker(speedTestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n := count.Load()
+			update(n, kbps(n, time.Since(start)))
+			t.report(phase)
+		case err := <-done:
+			elapsed := time.Since(start)
+			n := count.Load()
+			if err != nil && ctx.Err() == nil {
+				return elapsed, err
+			}
+			if n == 0 {
+				return elapsed, fmt.Errorf("no data transferred during %s", phase)
+			}
+			update(n, kbps(n, elapsed))
+			t.report(phase)
+			return elapsed, nil
+		}
+	}
+}
+
+type byteCounter struct {
+	count *atomic.Int64
+}
+
+func (w byteCounter) Write(p []byte) (int, error) {
+	w.count.Add(int64(len(p)))
+	return len(p), nil
+}
+
+type zeroReader struct {
+	remaining int64
+	count     *atomic.Int64
+}
+
+func (r *zeroReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), r.remaining))
+	clear(p[:n])
+	r.remaining -= int64(n)
+	r.count.Add(int64(n))
+	return n, nil
+}
+
+func kbps(n int64, elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(n) * 8 / 1000 / elapsed.Seconds())
+}
+
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
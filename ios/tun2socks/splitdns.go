@@ -0,0 +1,93 @@
+package tun2socks
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsRuleConfig sends queries for some domains to their own resolver,
+// reached through the named outbound, direct by default.
+type dnsRuleConfig struct {
+	Domains    []string `json:"domains"`
+	Mode       string   `json:"mode,omitempty"`
+	Server     string   `json:"server"`
+	ServerName string   `json:"serverName,omitempty"`
+	Outbound   string   `json:"outbound,omitempty"`
+}
+
+type splitDNSRoute struct {
+	domains  []routeRule
+	upstream dnsUpstream
+}
+
+// splitResolver picks the resolver for a query by its name. The first rule
+// with a matching domain wins; other queries go to the default resolver.
+type splitResolver struct {
+	routes   []splitDNSRoute
+	fallback dnsUpstream
+}
+
+func newSplitResolver(rules []dnsRuleConfig, fallback dnsUpstream, outbounds map[string]outbound, timeout time.Duration) (dnsUpstream, error) {
+	r := &splitResolver{fallback: fallback}
+	for _, rc := range rules {
+		ob, ok := outbounds[rc.outbound()]
+		if !ok {
+			return nil, fmt.Errorf("dns rule: unknown outbound %q", rc.Outbound)
+		}
+		upstream, err := newDNSUpstream(dnsConfig{Mode: rc.Mode, Server: rc.Server, ServerName: rc.ServerName}, ob, timeout)
+		if err != nil {
+			return nil, err
+		}
+		route := splitDNSRoute{upstream: upstream}
+		for _, entry := range rc.Domains {
+			rule, err := parseDNSDomain(entry)
+			if err != nil {
+				return nil, err
+			}
+			route.domains = append(route.domains, rule)
+		}
+		r.routes = append(r.routes, route)
+	}
+	return r, nil
+}
+
+// parseDNSDomain accepts "corp", ".corp" and "*.corp" for corp and its
+// subdomains, and other patterns with * as wildcards.
+func parseDNSDomain(entry string) (routeRule, error) {
+	name := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+	switch {
+	case name == "":
+		return routeRule{}, errors.New("empty dns rule domain")
+	case strings.Contains(name, "*"):
+		return parseRule("domain-wildcard", entry, "")
+	default:
+		return parseRule("domain-suffix", name, "")
+	}
+}
+
+func (c *dnsRuleConfig) outbound() string {
+	if c.Outbound == "" {
+		return outboundDirect
+	}
+	return c.Outbound
+}
+
+func (r *splitResolver) Exchange(query []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return r.fallback.Exchange(query)
+	}
+	name := normalizeDomain(msg.Questions[0].Name.String())
+	for _, route := range r.routes {
+		for _, rule := range route.domains {
+			if matchDomain(rule, name) {
+				return route.upstream.Exchange(query)
+			}
+		}
+	}
+	return r.fallback.Exchange(query)
+}
@@ -0,0 +1,84 @@
+package tun2socks
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// lifecycleMu serializes starts and stops, so a new run never sets up its
+// stack while the previous one is still being torn down. It is taken
+// before stateMu.
+var lifecycleMu sync.Mutex
+
+// The lwIP callbacks are process-wide. They are registered once and hand
+// flows to the handlers of the run in progress, so a flow arriving around
+// a restart never reaches the outbounds of a stopped tunnel.
+var (
+	registerOnce sync.Once
+	activeTCP    atomic.Pointer[switchTCPHandler]
+	activeUDP    atomic.Pointer[trackedUDPHandler]
+)
+
+func registerStack() {
+	registerOnce.Do(func() {
+		core.RegisterOutputFn(writeOutput)
+		core.RegisterTCPConnHandler(stackTCPHandler{})
+		core.RegisterUDPConnHandler(stackUDPHandler{})
+	})
+}
+
+// activateHandlers makes the handlers of the run in progress receive flows
+// from the stack. Called with stateMu held.
+func activateHandlers() {
+	activeTCP.Store(tcpSwitch)
+	activeUDP.Store(udpSwitch)
+}
+
+// deactivateHandlers refuses new flows from the stack. Called with stateMu
+// held.
+func deactivateHandlers() {
+	activeTCP.Store(nil)
+	activeUDP.Store(nil)
+	tcpSwitch = nil
+	udpSwitch = nil
+}
+
+type stackTCPHandler struct{}
+
+func (stackTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	stackAccepts.Add(1)
+	h := activeTCP.Load()
+	if h == nil {
+		return ErrNotRunning
+	}
+	err := h.Handle(conn, target)
+	if err != nil && refusedFlow(err) {
+		return refuseTCP(conn, target, err)
+	}
+	return err
+}
+
+type stackUDPHandler struct{}
+
+func (stackUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	h := activeUDP.Load()
+	if h == nil {
+		return ErrNotRunning
+	}
+	err := h.Connect(conn, target)
+	if err != nil && refusedFlow(err) {
+		return refuseUDP(conn, target, err)
+	}
+	return err
+}
+
+func (stackUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h := activeUDP.Load()
+	if h == nil {
+		return ErrNotRunning
+	}
+	return h.ReceiveTo(conn, data, addr)
+}
@@ -0,0 +1,83 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// startSteps receives the steps of the start in progress for StartAsync.
+// It is guarded by lifecycleMu.
+var startSteps chan<- string
+
+type startProgressEvent struct {
+	Event string `json:"event"`
+	Step  string `json:"step"`
+}
+
+type startDoneEvent struct {
+	Event string `json:"event"`
+	startResult
+}
+
+// reportStep tells the caller of StartAsync which step the start reached:
+// config, device, outbounds or stack. Called with lifecycleMu held.
+func reportStep(step string) {
+	if startSteps == nil {
+		return
+	}
+	select {
+	case startSteps <- step:
+	default:
+	}
+}
+
+// StartAsync starts the tunnel in the background, like StartWithFD or,
+// when fd is negative, like StartWithConfig, and returns at once. progress
+// receives {"event": "startProgress", "step": ...} as the start advances
+// and finally {"event": "startDone", ...} with the fields of StartResult.
+// The calls come from another goroutine, in order, after the step has been
+// reached, and never while the start holds its locks.
+func StartAsync(fd int, jsonConfig string, progress func(json string)) {
+	steps := make(chan string, 8)
+	done := make(chan error, 1)
+	go func() {
+		lifecycleMu.Lock()
+		startSteps = steps
+		err := startAsync(fd, jsonConfig)
+		startSteps = nil
+		lifecycleMu.Unlock()
+		done <- err
+		close(steps)
+	}()
+
+	go func() {
+		for step := range steps {
+			emitProgress(progress, startProgressEvent{Event: "startProgress", Step: step})
+		}
+		emitProgress(progress, startDoneEvent{Event: "startDone", startResult: newStartResult(<-done)})
+	}()
+}
+
+func startAsync(fd int, jsonConfig string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ReportPanic(r)
+			err = fmt.Errorf("%w: %v", ErrPanic, r)
+		}
+	}()
+	if fd < 0 {
+		return startWithConfig(jsonConfig)
+	}
+	return startWithFD(fd, jsonConfig)
+}
+
+func emitProgress(progress func(json string), event any) {
+	if progress == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	progress(string(data))
+}
@@ -0,0 +1,77 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Codes of a start result.
+const (
+	startOK            = "ok"
+	startInvalidConfig = "invalid-config"
+	startUnsupported   = "unsupported"
+	startFailed        = "start-failed"
+	startPanic         = "panic"
+)
+
+// StartError is a failed start with the subsystem that failed, such as
+// "outbounds" or "stack".
+type StartError struct {
+	Subsystem string
+	Err       error
+}
+
+func (e *StartError) Error() string {
+	return e.Subsystem + ": " + e.Err.Error()
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+func startFailure(subsystem string, err error) error {
+	return &StartError{Subsystem: subsystem, Err: err}
+}
+
+type startResult struct {
+	OK        bool   `json:"ok"`
+	Code      string `json:"code"`
+	Subsystem string `json:"subsystem,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// StartResult describes the outcome of a start as JSON: ok, a code
+// (ok, invalid-config, unsupported, start-failed or panic), the subsystem
+// that failed and a readable message.
+func StartResult(err error) string {
+	data, err := json.Marshal(newStartResult(err))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func newStartResult(err error) startResult {
+	result := startResult{OK: err == nil, Code: startOK}
+	if err != nil {
+		result.Message = err.Error()
+		var se *StartError
+		if errors.As(err, &se) {
+			result.Subsystem = se.Subsystem
+		}
+		switch {
+		case errors.Is(err, ErrPanic):
+			result.Code = startPanic
+		case errors.Is(err, ErrInvalidConfig):
+			result.Code = startInvalidConfig
+			if result.Subsystem == "" {
+				result.Subsystem = "config"
+			}
+		case errors.Is(err, ErrUnsupported):
+			result.Code = startUnsupported
+		default:
+			result.Code = startFailed
+		}
+	}
+	return result
+}
@@ -0,0 +1,172 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	stateStopped  = "stopped"
+	stateStarting = "starting"
+	stateRunning  = "running"
+	stateDegraded = "degraded"
+	stateStopping = "stopping"
+)
+
+type stateEvent struct {
+	Event  string `json:"event"`
+	State  string `json:"state"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type tunnelStatus struct {
+	State         string        `json:"state"`
+	Reason        string        `json:"reason,omitempty"`
+	Proxy         string        `json:"proxy,omitempty"`
+	Outbound      string        `json:"outbound,omitempty"`
+	UptimeMs      int64         `json:"uptimeMs"`
+	LastError     string        `json:"lastError,omitempty"`
+	LastErrorTime int64         `json:"lastErrorTime,omitempty"`
+	Remote        *remoteStatus `json:"remote,omitempty"`
+}
+
+// The status has its own lock, so it can be read while a start or stop
+// holds stateMu.
+var (
+	statusMu       sync.Mutex
+	phase          = stateStopped
+	startedAt      time.Time
+	statusProxy    string
+	mainGroup      *outboundGroup
+	drainHeld      bool
+	upstreamErr    string
+	lastError      string
+	lastErrorAt    time.Time
+	reportedState  = stateStopped
+	reportedReason string
+	remoteState    *remoteStatus
+)
+
+// setPhase moves the tunnel to stopped, starting, running or stopping.
+func setPhase(p string, proxyType string) {
+	statusMu.Lock()
+	phase = p
+	drainHeld = false
+	switch p {
+	case stateStarting:
+		statusProxy = proxyType
+		startedAt = time.Time{}
+		mainGroup = nil
+		upstreamErr = ""
+		lastError = ""
+		remoteState = nil
+	case stateRunning:
+		startedAt = time.Now()
+	case stateStopped:
+		startedAt = time.Time{}
+		mainGroup = nil
+		upstreamErr = ""
+	}
+	statusMu.Unlock()
+	updateState()
+}
+
+// setActiveConfig records the main proxy type and the group behind it, if
+// it is one, from the resources of the configuration in effect. Called
+// with stateMu held.
+func setActiveConfig(proxyType string) {
+	var group *outboundGroup
+	for _, r := range resources {
+		if g, ok := r.(*outboundGroup); ok && g.name == outboundProxy {
+			group = g
+			break
+		}
+	}
+	statusMu.Lock()
+	statusProxy, mainGroup = proxyType, group
+	statusMu.Unlock()
+	updateState()
+}
+
+// setUpstreamError records what the keepalive probe found: nil while the
+// upstream is reachable.
+func setUpstreamError(err error) {
+	statusMu.Lock()
+	upstreamErr = ""
+	if err != nil {
+		upstreamErr = err.Error()
+		lastError, lastErrorAt = "keepalive: "+upstreamErr, time.Now()
+	}
+	statusMu.Unlock()
+	updateState()
+}
+
+// recordFailure keeps err as the last error of the tunnel.
+func recordFailure(op string, err error) {
+	statusMu.Lock()
+	lastError, lastErrorAt = op+": "+err.Error(), time.Now()
+	statusMu.Unlock()
+}
+
+// currentStateLocked derives the reported state: a running tunnel is
+// degraded while the keepalive probe fails or no member of the main group
+// is healthy.
+func currentStateLocked() (string, string) {
+	if phase != stateRunning {
+		return phase, ""
+	}
+	if upstreamErr != "" {
+		return stateDegraded, "upstream unreachable: " + upstreamErr
+	}
+	if mainGroup != nil && !mainGroup.healthy() {
+		return stateDegraded, "no healthy outbound in the group"
+	}
+	return stateRunning, ""
+}
+
+// updateState emits a state event when the reported state changed.
+func updateState() {
+	statusMu.Lock()
+	state, reason := currentStateLocked()
+	changed := state != reportedState || reason != reportedReason
+	reportedState, reportedReason = state, reason
+	statusMu.Unlock()
+
+	if changed {
+		logger.Info("tunnel state", "state", state, "reason", reason)
+		emitEvent(stateEvent{Event: "state", State: state, Reason: reason})
+	}
+}
+
+// State returns the tunnel's state as JSON: stopped, starting, running,
+// degraded or stopping, with the reason for degraded, the proxy type, the
+// outbound new flows use, the uptime, the last error and whether a remote
+// configuration is applied.
+func State() string {
+	statusMu.Lock()
+	state, reason := currentStateLocked()
+	status := tunnelStatus{State: state, Reason: reason}
+	if phase != stateStopped {
+		status.Proxy = statusProxy
+		status.Remote = remoteState
+	}
+	if !startedAt.IsZero() {
+		status.UptimeMs = time.Since(startedAt).Milliseconds()
+		status.Outbound = outboundProxy
+		if mainGroup != nil {
+			status.Outbound = mainGroup.active()
+		}
+	}
+	if lastError != "" {
+		status.LastError = lastError
+		status.LastErrorTime = lastErrorAt.UnixMilli()
+	}
+	statusMu.Unlock()
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,212 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+const (
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+type protoCounters struct {
+	uplinkBytes     atomic.Uint64
+	downlinkBytes   atomic.Uint64
+	uplinkPackets   atomic.Uint64
+	downlinkPackets atomic.Uint64
+}
+
+type trafficStats struct {
+	tcp   protoCounters
+	udp   protoCounters
+	other protoCounters
+
+	tcpConns atomic.Int64
+	udpConns atomic.Int64
+
+	// Payload bytes copied by TCP relays, without IP and TCP headers.
+	relayUplink   atomic.Uint64
+	relayDownlink atomic.Uint64
+
+	blockedFlows   atomic.Uint64
+	blockedQueries atomic.Uint64
+	rejectedFlows  atomic.Uint64
+	loopedFlows    atomic.Uint64
+
+	dnsCacheHits   atomic.Uint64
+	dnsCacheMisses atomic.Uint64
+	dnsCoalesced   atomic.Uint64
+
+	udpEvicted  atomic.Uint64
+	udpFiltered atomic.Uint64
+
+	stackRecoveries  atomic.Uint64
+	ttlDropped       atomic.Uint64
+	multicastDropped atomic.Uint64
+}
+
+var stats trafficStats
+
+type protoSnapshot struct {
+	UplinkBytes     uint64 `json:"uplinkBytes"`
+	DownlinkBytes   uint64 `json:"downlinkBytes"`
+	UplinkPackets   uint64 `json:"uplinkPackets"`
+	DownlinkPackets uint64 `json:"downlinkPackets"`
+}
+
+type statsSnapshot struct {
+	protoSnapshot
+	TCPConnections int64                             `json:"tcpConnections"`
+	UDPSessions    int64                             `json:"udpSessions"`
+	DroppedPackets uint64                            `json:"droppedPackets"`
+	RelayUplink    uint64                            `json:"tcpPayloadUplinkBytes"`
+	RelayDownlink  uint64                            `json:"tcpPayloadDownlinkBytes"`
+	BlockedFlows   uint64                            `json:"blockedFlows"`
+	BlockedQueries uint64                            `json:"blockedQueries"`
+	RejectedFlows  uint64                            `json:"rejectedFlows"`
+	LoopedFlows    uint64                            `json:"loopedFlows"`
+	DNSCacheHits   uint64                            `json:"dnsCacheHits"`
+	DNSCacheMisses uint64                            `json:"dnsCacheMisses"`
+	DNSCoalesced   uint64                            `json:"dnsCoalescedQueries"`
+	UDPEvicted     uint64                            `json:"udpEvictedSessions"`
+	UDPFiltered    uint64                            `json:"udpFilteredPackets"`
+	StackRecovered uint64                            `json:"stackRecoveries"`
+	TTLDropped     uint64                            `json:"ttlDroppedPackets"`
+	MulticastDrops uint64                            `json:"multicastDroppedPackets"`
+	Protocols      map[string]protoSnapshot          `json:"protocols"`
+	Tags           map[string]tagSnapshot            `json:"tags,omitempty"`
+	Outbounds      map[string]outboundTimingSnapshot `json:"outbounds,omitempty"`
+}
+
+// Stats returns cumulative traffic counters since start as JSON.
+func Stats() string {
+	data, err := json.Marshal(stats.snapshot())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func (s *trafficStats) reset() {
+	for _, c := range []*protoCounters{&s.tcp, &s.udp, &s.other} {
+		c.uplinkBytes.Store(0)
+		c.downlinkBytes.Store(0)
+		c.uplinkPackets.Store(0)
+		c.downlinkPackets.Store(0)
+	}
+	s.relayUplink.Store(0)
+	s.relayDownlink.Store(0)
+	s.blockedFlows.Store(0)
+	s.blockedQueries.Store(0)
+	s.loopedFlows.Store(0)
+	s.dnsCacheHits.Store(0)
+	s.dnsCacheMisses.Store(0)
+	s.dnsCoalesced.Store(0)
+	s.udpEvicted.Store(0)
+	s.udpFiltered.Store(0)
+	s.stackRecoveries.Store(0)
+	s.ttlDropped.Store(0)
+	s.multicastDropped.Store(0)
+	resetTags()
+	resetOutboundTimings()
+}
+
+// totals returns the bytes of all protocols in each direction.
+func (s *trafficStats) totals() (uint64, uint64) {
+	var up, down uint64
+	for _, c := range []*protoCounters{&s.tcp, &s.udp, &s.other} {
+		up += c.uplinkBytes.Load()
+		down += c.downlinkBytes.Load()
+	}
+	return up, down
+}
+
+func (s *trafficStats) counters(packet []byte) *protoCounters {
+	switch ipProtocol(packet) {
+	case ipProtoTCP:
+		return &s.tcp
+	case ipProtoUDP:
+		return &s.udp
+	default:
+		return &s.other
+	}
+}
+
+func (s *trafficStats) recordUplink(packet []byte) {
+	c := s.counters(packet)
+	c.uplinkBytes.Add(uint64(len(packet)))
+	c.uplinkPackets.Add(1)
+}
+
+func (s *trafficStats) recordDownlink(packet []byte) {
+	c := s.counters(packet)
+	c.downlinkBytes.Add(uint64(len(packet)))
+	c.downlinkPackets.Add(1)
+}
+
+func (c *protoCounters) snapshot() protoSnapshot {
+	return protoSnapshot{
+		UplinkBytes:     c.uplinkBytes.Load(),
+		DownlinkBytes:   c.downlinkBytes.Load(),
+		UplinkPackets:   c.uplinkPackets.Load(),
+		DownlinkPackets: c.downlinkPackets.Load(),
+	}
+}
+
+func (s *trafficStats) snapshot() statsSnapshot {
+	protocols := map[string]protoSnapshot{
+		"tcp":   s.tcp.snapshot(),
+		"udp":   s.udp.snapshot(),
+		"other": s.other.snapshot(),
+	}
+
+	var total protoSnapshot
+	for _, p := range protocols {
+		total.UplinkBytes += p.UplinkBytes
+		total.DownlinkBytes += p.DownlinkBytes
+		total.UplinkPackets += p.UplinkPackets
+		total.DownlinkPackets += p.DownlinkPackets
+	}
+
+	return statsSnapshot{
+		protoSnapshot:  total,
+		TCPConnections: s.tcpConns.Load(),
+		UDPSessions:    s.udpConns.Load(),
+		DroppedPackets: droppedPackets.Load(),
+		RelayUplink:    s.relayUplink.Load(),
+		RelayDownlink:  s.relayDownlink.Load(),
+		BlockedFlows:   s.blockedFlows.Load(),
+		BlockedQueries: s.blockedQueries.Load(),
+		RejectedFlows:  s.rejectedFlows.Load(),
+		LoopedFlows:    s.loopedFlows.Load(),
+		DNSCacheHits:   s.dnsCacheHits.Load(),
+		DNSCacheMisses: s.dnsCacheMisses.Load(),
+		DNSCoalesced:   s.dnsCoalesced.Load(),
+		UDPEvicted:     s.udpEvicted.Load(),
+		UDPFiltered:    s.udpFiltered.Load(),
+		StackRecovered: s.stackRecoveries.Load(),
+		TTLDropped:     s.ttlDropped.Load(),
+		MulticastDrops: s.multicastDropped.Load(),
+		Protocols:      protocols,
+		Tags:           tagSnapshots(),
+		Outbounds:      outboundTimingSnapshots(),
+	}
+}
+
+func ipProtocol(packet []byte) byte {
+	if len(packet) == 0 {
+		return 0
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) > 9 {
+			return packet[9]
+		}
+	case 6:
+		if len(packet) > 6 {
+			return packet[6]
+		}
+	}
+	return 0
+}
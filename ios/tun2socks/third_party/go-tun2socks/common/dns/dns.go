@@ -0,0 +1,3 @@
+package dns
+
+const COMMON_DNS_PORT = 53
@@ -0,0 +1 @@
+#pragma pack(push,1)
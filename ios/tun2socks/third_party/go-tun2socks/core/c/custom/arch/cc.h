@@ -0,0 +1,6 @@
+#ifdef _WIN32
+  // both win32 and win64 are defined here
+  #include "cc_windows.h"
+#else
+  #include "cc_others.h"
+#endif
@@ -0,0 +1 @@
+#pragma pack(pop)
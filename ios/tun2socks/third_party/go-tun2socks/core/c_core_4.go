@@ -0,0 +1,13 @@
+package core
+
+/*
+#include "c/core/ipv4/autoip.c"
+#include "c/core/ipv4/dhcp.c"
+#include "c/core/ipv4/etharp.c"
+#include "c/core/ipv4/icmp.c"
+#include "c/core/ipv4/igmp.c"
+#include "c/core/ipv4/ip4_frag.c"
+#include "c/core/ipv4/ip4.c"
+#include "c/core/ipv4/ip4_addr.c"
+*/
+import "C"
@@ -0,0 +1,7 @@
+package core
+
+/*
+#cgo CFLAGS: -I./c/custom
+#include "c/custom/sys_arch.c"
+*/
+import "C"
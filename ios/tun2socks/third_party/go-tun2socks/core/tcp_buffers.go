@@ -0,0 +1,32 @@
+package core
+
+/*
+unsigned short tun2socks_tcp_wnd = 32 * 1024;
+unsigned short tun2socks_tcp_snd_buf = 32 * 1024;
+*/
+import "C"
+
+import "fmt"
+
+// TCPMSS is the maximum segment size of the stack.
+const TCPMSS = 1460
+
+// SetTCPBuffers sets the TCP receive window and send buffer, in bytes, of
+// connections accepted from now on. Connections already open keep the
+// values they were accepted with, but lwIP compares their window against
+// the current one when they close, so the buffers should only change while
+// no connection is open. The window must be between TCPMSS and 65535 and
+// the send buffer between 2*TCPMSS and 65535.
+func SetTCPBuffers(window, sendBuffer int) error {
+	if window < TCPMSS || window > 0xFFFF {
+		return fmt.Errorf("tcp window %d out of range [%d, %d]", window, TCPMSS, 0xFFFF)
+	}
+	if sendBuffer < 2*TCPMSS || sendBuffer > 0xFFFF {
+		return fmt.Errorf("tcp send buffer %d out of range [%d, %d]", sendBuffer, 2*TCPMSS, 0xFFFF)
+	}
+	lwipMutex.Lock()
+	C.tun2socks_tcp_wnd = C.ushort(window)
+	C.tun2socks_tcp_snd_buf = C.ushort(sendBuffer)
+	lwipMutex.Unlock()
+	return nil
+}
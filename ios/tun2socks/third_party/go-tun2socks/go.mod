@@ -0,0 +1,9 @@
+module github.com/eycorsican/go-tun2socks
+
+go 1.13
+
+require (
+	github.com/songgao/water v0.0.0-20190725173103-fd331bda3f4b
+	golang.org/x/net v0.0.0-20191021144547-ec77196f6094
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037
+)
@@ -0,0 +1,104 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+type tcpHandler struct {
+	sync.Mutex
+
+	proxyHost string
+	proxyPort uint16
+}
+
+func NewTCPHandler(proxyHost string, proxyPort uint16) core.TCPConnHandler {
+	return &tcpHandler{
+		proxyHost: proxyHost,
+		proxyPort: proxyPort,
+	}
+}
+
+type direction byte
+
+const (
+	dirUplink direction = iota
+	dirDownlink
+)
+
+type duplexConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+func (h *tcpHandler) relay(lhs, rhs net.Conn) {
+	upCh := make(chan struct{})
+
+	cls := func(dir direction, interrupt bool) {
+		lhsDConn, lhsOk := lhs.(duplexConn)
+		rhsDConn, rhsOk := rhs.(duplexConn)
+		if !interrupt && lhsOk && rhsOk {
+			switch dir {
+			case dirUplink:
+				lhsDConn.CloseRead()
+				rhsDConn.CloseWrite()
+			case dirDownlink:
+				lhsDConn.CloseWrite()
+				rhsDConn.CloseRead()
+			default:
+				panic("unexpected direction")
+			}
+		} else {
+			lhs.Close()
+			rhs.Close()
+		}
+	}
+
+	// Uplink
+	go func() {
+		var err error
+		_, err = io.Copy(rhs, lhs)
+		if err != nil {
+			cls(dirUplink, true) // interrupt the conn if the error is not nil (not EOF)
+		} else {
+			cls(dirUplink, false) // half close uplink direction of the TCP conn if possible
+		}
+		upCh <- struct{}{}
+	}()
+
+	// Downlink
+	var err error
+	_, err = io.Copy(lhs, rhs)
+	if err != nil {
+		cls(dirDownlink, true)
+	} else {
+		cls(dirDownlink, false)
+	}
+
+	<-upCh // Wait for uplink done.
+}
+
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	dialer, err := proxy.SOCKS5("tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String(), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	c, err := dialer.Dial(target.Network(), target.String())
+	if err != nil {
+		return err
+	}
+
+	go h.relay(conn, c)
+
+	log.Infof("new proxy connection to %v", target)
+
+	return nil
+}
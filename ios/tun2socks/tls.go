@@ -0,0 +1,101 @@
+package tun2socks
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+type tlsConfig struct {
+	ServerName string   `json:"serverName,omitempty"`
+	CA         string   `json:"ca,omitempty"`
+	Insecure   bool     `json:"insecure,omitempty"`
+	Pins       []string `json:"pins,omitempty"`
+}
+
+func (c *tlsConfig) clientConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+	if c == nil {
+		return config, nil
+	}
+	if c.ServerName != "" {
+		config.ServerName = c.ServerName
+	}
+	config.InsecureSkipVerify = c.Insecure
+	if c.CA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(c.CA)) {
+			return nil, errors.New("no certificates found in tls ca")
+		}
+		config.RootCAs = pool
+	}
+	config.VerifyConnection = verifyPins(c.Pins)
+	return config, nil
+}
+
+var errPinMismatch = errors.New("tls certificate does not match any pin")
+
+// verifyPins accepts a handshake only when a certificate in the chain has
+// the SHA-256 of its SubjectPublicKeyInfo among pins. It runs even when
+// verification is skipped, so a self-signed proxy can be pinned.
+func verifyPins(pins []string) func(tls.ConnectionState) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	accepted := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		accepted[strings.TrimPrefix(pin, "sha256/")] = true
+	}
+	return func(cs tls.ConnectionState) error {
+		for _, cert := range cs.PeerCertificates {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if accepted[base64.StdEncoding.EncodeToString(sum[:])] {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w for %s", errPinMismatch, cs.ServerName)
+	}
+}
+
+func validatePins(pins []string) error {
+	for _, pin := range pins {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("invalid pin %q, expected sha256/<base64>", pin)
+		}
+	}
+	return nil
+}
+
+type tlsDialer struct {
+	config  *tls.Config
+	via     proxy.Dialer
+	timeout time.Duration
+}
+
+func (d *tlsDialer) Dial(network string, addr string) (net.Conn, error) {
+	conn, err := dialServer(d.via, addr, d.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return tlsHandshake(conn, d.config)
+}
+
+func tlsHandshake(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	tlsConn := tls.Client(conn, config)
+	conn.SetDeadline(handshakeDeadline())
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,143 @@
+package tun2socks
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+type transportConfig struct {
+	Type       string            `json:"type,omitempty"`
+	Path       string            `json:"path,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	TLS        bool              `json:"tls,omitempty"`
+	ServerName string            `json:"serverName,omitempty"`
+	Insecure   bool              `json:"insecure,omitempty"`
+	Pins       []string          `json:"pins,omitempty"`
+	KCP        *kcpConfig        `json:"kcp,omitempty"`
+}
+
+func dialTransport(cfg *transportConfig, via proxy.Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if cfg.isKCP() {
+		conn, err = dialKCP(cfg, addr)
+	} else {
+		conn, err = dialServer(via, addr, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return conn, nil
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	conn.SetDeadline(handshakeDeadline())
+	if cfg.TLS {
+		serverName := cfg.ServerName
+		if serverName == "" {
+			serverName = host
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: cfg.Insecure, VerifyConnection: verifyPins(cfg.Pins)})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	switch strings.ToLower(cfg.Type) {
+	case "", "tcp", "kcp":
+	case "ws", "websocket":
+		ws, err := upgradeWebSocket(conn, cfg, addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = ws
+	case "obfs-http":
+		conn = newObfsHTTPConn(conn, cfg, addr)
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("unsupported transport %q", cfg.Type)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// isKCP reports whether cfg carries the proxy over KCP on UDP rather than
+// a TCP connection.
+func (cfg *transportConfig) isKCP() bool {
+	return cfg != nil && strings.EqualFold(cfg.Type, "kcp")
+}
+
+// transportDialer dials proxy servers through a transport for protocols
+// that take a proxy.Dialer.
+type transportDialer struct {
+	config  *transportConfig
+	via     proxy.Dialer
+	timeout time.Duration
+}
+
+func (d *transportDialer) Dial(network string, addr string) (net.Conn, error) {
+	return dialTransport(d.config, d.via, addr, d.timeout)
+}
+
+func upgradeWebSocket(conn net.Conn, cfg *transportConfig, addr string) (net.Conn, error) {
+	scheme := "ws"
+	origin := "http"
+	if cfg.TLS {
+		scheme = "wss"
+		origin = "https"
+	}
+	host := cfg.Host
+	if host == "" {
+		host = addr
+	}
+	path := cfg.Path
+	if path == "" {
+		path = "/"
+	}
+
+	location := &url.URL{Scheme: scheme, Host: host, Path: path}
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		location.Path = path[:i]
+		location.RawQuery = path[i+1:]
+	}
+	wsConfig, err := websocket.NewConfig(location.String(), origin+"://"+host)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range cfg.Headers {
+		wsConfig.Header.Set(k, v)
+	}
+
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{Conn: ws, raw: conn}, nil
+}
+
+type wsConn struct {
+	*websocket.Conn
+	raw net.Conn
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.raw.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.raw.RemoteAddr()
+}
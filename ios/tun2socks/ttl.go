@@ -0,0 +1,82 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// ttlConfig sets the TTL (IPv4) or hop limit (IPv6) of the packets the
+// tunnel sends to the TUN device, for networks that treat the default
+// value differently, and drops packets from the device that arrive with
+// fewer than MinIncoming hops left. A packet routed back into the tunnel
+// loses a hop on every pass, so a loop ends there instead of being relayed
+// again. Zero leaves either unchanged.
+type ttlConfig struct {
+	Outgoing    int `json:"outgoing,omitempty"`
+	MinIncoming int `json:"minIncoming,omitempty"`
+}
+
+var (
+	outgoingTTL atomic.Uint32
+	minIncoming atomic.Uint32
+)
+
+func configureTTL(cfg *ttlConfig) {
+	if cfg == nil {
+		outgoingTTL.Store(0)
+		minIncoming.Store(0)
+		return
+	}
+	outgoingTTL.Store(uint32(cfg.Outgoing))
+	minIncoming.Store(uint32(cfg.MinIncoming))
+}
+
+// setTTL rewrites the TTL or hop limit of an outgoing packet in place.
+func setTTL(packet []byte) {
+	ttl := byte(outgoingTTL.Load())
+	if ttl == 0 || len(packet) < 1 {
+		return
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 || packet[8] == ttl {
+			return
+		}
+		old := binary.BigEndian.Uint16(packet[8:10])
+		packet[8] = ttl
+		updateChecksum(packet[10:12], old, binary.BigEndian.Uint16(packet[8:10]))
+	case 6:
+		if len(packet) >= 40 {
+			packet[7] = ttl
+		}
+	}
+}
+
+// ttlExpired reports whether packet from the device has too few hops left
+// and must be dropped.
+func ttlExpired(packet []byte) bool {
+	limit := minIncoming.Load()
+	if limit == 0 || len(packet) < 1 {
+		return false
+	}
+	var ttl byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return false
+		}
+		ttl = packet[8]
+	case 6:
+		if len(packet) < 40 {
+			return false
+		}
+		ttl = packet[7]
+	default:
+		return false
+	}
+	if uint32(ttl) >= limit {
+		return false
+	}
+	stats.ttlDropped.Add(1)
+	return true
+}
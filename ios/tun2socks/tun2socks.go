@@ -1,27 +1,19 @@
-package main
-
-/*
-#include <stdint.h>
-*/
-import "C"
+package tun2socks
 
 import (
 	"bufio"
-	"encoding/base64"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"runtime/debug"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-	"unsafe"
 
 	"github.com/eycorsican/go-tun2socks/core"
-	"github.com/eycorsican/go-tun2socks/proxy/dnsfallback"
-	"github.com/eycorsican/go-tun2socks/proxy/socks"
 	"golang.org/x/net/proxy"
 )
 
@@ -31,304 +23,882 @@ var (
 	outputQueue chan []byte
 	stopCh      chan struct{}
 	lwipStack   core.LWIPStack
+	resources   []io.Closer
+	tcpSwitch   *switchTCPHandler
+	udpSwitch   *trackedUDPHandler
+
+	outputFn  func(packet []byte)
+	tunDevice io.ReadWriteCloser
 )
 
-func init() {
-	debug.SetGCPercent(10)
-	ticker := time.NewTicker(time.Minute)
-	go func() {
-		for range ticker.C {
-			debug.FreeOSMemory()
-		}
-	}()
-}
+var (
+	// ErrInvalidConfig is returned for a malformed or incomplete
+	// configuration.
+	ErrInvalidConfig = errors.New("invalid configuration")
+	// ErrNotRunning is returned when the tunnel must be running.
+	ErrNotRunning = errors.New("tunnel is not running")
+	// ErrUnsupported is returned for an operation the current
+	// configuration or platform cannot perform.
+	ErrUnsupported = errors.New("operation not supported")
+	// ErrAlreadyRunning is returned by NewTunnel while another tunnel
+	// runs, since the process has a single lwIP stack.
+	ErrAlreadyRunning = errors.New("a tunnel is already running")
+	// ErrPanic marks an operation cut short by a recovered panic.
+	ErrPanic = errors.New("internal error")
+)
 
-//export Tun2SocksStart
-func Tun2SocksStart(proxyType *C.char, host *C.char, port C.int, username *C.char, password *C.char) (result C.int) {
-	defer func() {
-		if recover() != nil {
-			result = -9
-		}
-	}()
+// Start runs the tunnel through a single proxy. It does nothing if the
+// tunnel is already running.
+func Start(proxyType string, host string, port int, username string, password string) error {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
 	stateMu.Lock()
 	defer stateMu.Unlock()
 
 	if running {
-		return 0
+		return nil
 	}
 
-	if proxyType == nil || host == nil || port <= 0 {
-		return -1
+	if proxyType == "" || host == "" || port <= 0 {
+		return ErrInvalidConfig
 	}
 
-	proxyTypeStr := strings.ToLower(C.GoString(proxyType))
-	hostStr := C.GoString(host)
-	userStr := cStringOrEmpty(username)
-	passStr := cStringOrEmpty(password)
+	cfg := &tunnelConfig{
+		Proxy: proxyConfig{
+			Type:     strings.ToLower(proxyType),
+			Host:     host,
+			Port:     port,
+			Username: username,
+			Password: password,
+		},
+	}
+
+	return startLocked(cfg)
+}
+
+// StartWithConfig runs the tunnel from a JSON configuration document.
+func StartWithConfig(jsonConfig string) error {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	return startWithConfig(jsonConfig)
+}
 
-	outputQueue = make(chan []byte, 2048)
+// startWithConfig is StartWithConfig with lifecycleMu held.
+func startWithConfig(jsonConfig string) error {
+	if isRunning() {
+		return nil
+	}
+	reportStep("config")
+	jsonConfig, remote := withRemote(jsonConfig)
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	cfg, err := parseConfig(jsonConfig)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	if err := startLocked(cfg); err != nil {
+		return err
+	}
+	setRemote(remote)
+	return nil
+}
+
+// isRunning reports whether the tunnel runs. Starts and stops hold
+// lifecycleMu, so the answer holds while the caller does.
+func isRunning() bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return running
+}
+
+func startLocked(cfg *tunnelConfig) error {
+	configureQueue(cfg.Queue)
+	if cfg.HTTPPool != nil {
+		httpProxyPool.configure(cfg.HTTPPool.MaxPerHost, time.Duration(cfg.HTTPPool.IdleTimeoutMs)*time.Millisecond)
+	}
+
+	outputQueue = make(chan []byte, queueSize)
+	droppedPackets.Store(0)
+	stats.reset()
+	resetErrors()
+	draining.Store(false)
 	stopCh = make(chan struct{})
+	activeRemote.Store(nil)
+	setPhase(stateStarting, cfg.Proxy.Type)
 
-	stack, err := configureStack(proxyTypeStr, hostStr, int(port), userStr, passStr)
+	stack, err := configureStack(cfg)
 	if err != nil {
+		logger.Error("start failed", "proxy", cfg.Proxy.Type, "error", err)
+		recordFailure("start", err)
+		setPhase(stateStopped, "")
+		stopInboundLocked()
+		stopForwardsLocked()
+		stopKeepaliveLocked()
+		deactivateHandlers()
+		closeResources()
+		StopCapture()
 		outputQueue = nil
 		stopCh = nil
-		return -2
+		return err
 	}
 
 	lwipStack = stack
+	activateHandlers()
 	running = true
-	return 0
+	tunnelGen++
+	setActiveConfig(cfg.Proxy.Type)
+	setPhase(stateRunning, cfg.Proxy.Type)
+	go runUsage(stopCh)
+	go runRemote(stopCh)
+	go runWatchdog(stopCh)
+	logger.Info("tunnel started", "proxy", cfg.Proxy.Type)
+	return nil
 }
 
-//export Tun2SocksStop
-func Tun2SocksStop() {
-	defer func() {
-		_ = recover()
-	}()
+// Stop shuts the tunnel down. New flows are refused while open ones get
+// the drain timeout to finish; the rest are aborted. A "stopped" event
+// follows once their relays have exited.
+func Stop() {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	stop()
+}
+
+// stop is Stop with lifecycleMu held.
+func stop() {
 	stateMu.Lock()
-	defer stateMu.Unlock()
+	isRunning := running
+	stateMu.Unlock()
+	if !isRunning {
+		return
+	}
+
+	// Flows are drained and aborted before taking stateMu: the stack must
+	// keep running meanwhile, and resetting a TCP flow writes an RST
+	// through writeOutput.
+	started := time.Now()
+	setPhase(stateStopping, "")
+	drained := drainFlows()
+	aborted := abortFlows("", 0)
 
+	stateMu.Lock()
 	if !running {
+		stateMu.Unlock()
 		return
 	}
 
 	running = false
+	usage.sample(time.Now())
+	usage.save()
 	if stopCh != nil {
 		close(stopCh)
 	}
 	stopCh = nil
 	outputQueue = nil
-	if lwipStack != nil {
-		_ = lwipStack.Close()
-		lwipStack = nil
+	if tunDevice != nil {
+		tunDevice.Close()
+		tunDevice = nil
+	}
+	dropHeldPacket()
+	httpProxyPool.closeAll()
+	kcpSessions.closeAll()
+	stack := lwipStack
+	lwipStack = nil
+	deactivateHandlers()
+	stopInboundLocked()
+	stopForwardsLocked()
+	stopKeepaliveLocked()
+	dropPreparedLocked()
+	closeResources()
+	namedOutbounds = nil
+	activeFakeIPPool = nil
+	activeReverseMap = nil
+	activeRemote.Store(nil)
+	StopCapture()
+	stateMu.Unlock()
+
+	// Closing the stack aborts the flows it still holds, and their RSTs go
+	// through writeOutput, which takes stateMu.
+	if stack != nil {
+		_ = stack.Close()
 	}
+	draining.Store(false)
+	setPhase(stateStopped, "")
+	logger.Info("tunnel stopped", "drained", drained, "aborted", aborted)
+	go reportShutdown(started, drained, aborted)
 }
 
-//export Tun2SocksInput
-func Tun2SocksInput(data *C.uint8_t, length C.int) (result C.int) {
-	defer func() {
-		if recover() != nil {
-			result = 0
+func closeResources() {
+	closeAll(resources)
+	resources = nil
+}
+
+// startResources starts the background work of resources that wait for
+// their configuration to become the active one.
+func startResources(list []io.Closer) {
+	for _, r := range list {
+		if s, ok := r.(interface{ start() }); ok {
+			s.start()
 		}
-	}()
+	}
+}
+
+func closeAll(list []io.Closer) {
+	for _, r := range list {
+		if err := r.Close(); err != nil {
+			logger.Debug("close failed", "error", err)
+		}
+	}
+}
+
+// Input hands one packet read from the TUN interface to the stack. The
+// packet is copied, so the caller may reuse it. It reports whether the
+// tunnel is running.
+func Input(packet []byte) bool {
 	stateMu.Lock()
-	queue := outputQueue
 	stack := lwipStack
 	isRunning := running
 	stateMu.Unlock()
 
-	if !isRunning || data == nil || length <= 0 || stack == nil {
+	if !isRunning {
+		return false
+	}
+	return inputTo(stack, packet)
+}
+
+func inputTo(stack core.LWIPStack, packet []byte) bool {
+	if len(packet) == 0 || stack == nil {
+		return false
+	}
+
+	buf := getPacket(len(packet))
+	defer putPacket(buf)
+	copy(buf, packet)
+	if err := inputPacket(stack, buf); err != nil {
+		logger.Debug("stack write failed", "error", err)
+	}
+	return true
+}
+
+// InputBatch hands several packets to the stack and returns how many were
+// accepted. Empty entries are skipped.
+func InputBatch(packets [][]byte) int {
+	stateMu.Lock()
+	stack := lwipStack
+	isRunning := running
+	stateMu.Unlock()
+
+	if !isRunning || stack == nil {
 		return 0
 	}
 
-	packet := C.GoBytes(unsafe.Pointer(data), length)
+	accepted := 0
+	for _, p := range packets {
+		if len(p) == 0 {
+			continue
+		}
+		buf := getPacket(len(p))
+		copy(buf, p)
+		if inputPacket(stack, buf) == nil {
+			accepted++
+		}
+		putPacket(buf)
+	}
+	return accepted
+}
+
+// inputPacket hands one packet from the TUN side to the stack. The packet
+// may be rewritten in place and is not retained.
+func inputPacket(stack core.LWIPStack, packet []byte) error {
+	capturePacket(packet, true)
+	if ttlExpired(packet) || filterMulticast(packet) || filterQUIC(packet) || handlePing(packet) {
+		return nil
+	}
+	clampMSS(packet)
+	countSyn(packet)
 	if _, err := stack.Write(packet); err != nil {
-		_ = err
+		return err
 	}
+	stats.recordUplink(packet)
+	return nil
+}
 
-	if queue == nil {
+// ReadPacket copies the next queued output packet into buf without
+// blocking. It returns the packet length, 0 when nothing is queued, or the
+// negated length when buf is too small; the packet is then kept for the
+// next read.
+func ReadPacket(buf []byte) int {
+	stateMu.Lock()
+	queue := outputQueue
+	isRunning := running
+	stateMu.Unlock()
+
+	if !isRunning || len(buf) == 0 || queue == nil {
 		return 0
 	}
 
-	return 1
+	if packet, ok := heldOrNextPacket(queue); ok {
+		return deliverPacket(packet, buf)
+	}
+	return 0
 }
 
-//export Tun2SocksReadPacket
-func Tun2SocksReadPacket(buffer *C.uint8_t, bufferLen C.int) (result C.int) {
-	defer func() {
-		if recover() != nil {
-			result = 0
-		}
-	}()
+// ReadPacketTimeout is ReadPacket waiting up to timeout for a packet.
+func ReadPacketTimeout(buf []byte, timeout time.Duration) int {
 	stateMu.Lock()
 	queue := outputQueue
 	stop := stopCh
 	isRunning := running
 	stateMu.Unlock()
 
-	if !isRunning || buffer == nil || bufferLen <= 0 || queue == nil {
+	if !isRunning || len(buf) == 0 || queue == nil {
 		return 0
 	}
 
+	if packet, ok := heldOrNextPacket(queue); ok {
+		return deliverPacket(packet, buf)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
 	select {
 	case packet := <-queue:
-		out := unsafe.Slice((*byte)(unsafe.Pointer(buffer)), int(bufferLen))
-		count := copy(out, packet)
-		return C.int(count)
+		return deliverPacket(packet, buf)
 	case <-stop:
 		return 0
-	default:
+	case <-timer.C:
 		return 0
 	}
 }
 
-func configureStack(proxyType string, host string, port int, username string, password string) (core.LWIPStack, error) {
-	core.RegisterOutputFn(func(data []byte) (int, error) {
-		stateMu.Lock()
-		queue := outputQueue
-		stateMu.Unlock()
+// ReadPackets fills buffers with queued packets without blocking, storing
+// each length in lengths, and returns how many were read. If the first
+// packet does not fit, its length is returned negated.
+func ReadPackets(buffers [][]byte, lengths []int) int {
+	stateMu.Lock()
+	queue := outputQueue
+	isRunning := running
+	stateMu.Unlock()
 
-		if queue == nil {
-			return 0, nil
+	if !isRunning || queue == nil {
+		return 0
+	}
+
+	read := 0
+	for read < len(buffers) && read < len(lengths) {
+		if len(buffers[read]) == 0 {
+			break
+		}
+		packet, ok := heldOrNextPacket(queue)
+		if !ok {
+			break
+		}
+		n := deliverPacket(packet, buffers[read])
+		if n < 0 {
+			if read == 0 {
+				return n
+			}
+			break
 		}
+		lengths[read] = n
+		read++
+	}
 
-		packet := make([]byte, len(data))
-		copy(packet, data)
+	return read
+}
 
-		select {
-		case queue <- packet:
-		default:
+// SetOutputFunc delivers every output packet to fn synchronously instead of
+// queueing it. The packet is only valid during the call. A nil fn returns
+// to the queue.
+func SetOutputFunc(fn func(packet []byte)) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	outputFn = fn
+}
+
+func configureStack(cfg *tunnelConfig) (core.LWIPStack, error) {
+	registerStack()
+	if err := configureIPv6(cfg.IPv6, cfg.NAT64); err != nil {
+		return nil, startFailure("ipv6", err)
+	}
+	configureMTU(cfg.MTU)
+	configureQUIC(cfg.QUIC, cfg.relaysUDP(&cfg.Proxy))
+	configureMulticast(cfg.Multicast, cfg.Proxy)
+	configureICMP(cfg.ICMP, cfg.Proxy, cfg.Timeouts.connect())
+	configureBandwidth(cfg.Bandwidth)
+	configureQoS(cfg.QoS)
+	configureIdle(cfg.Timeouts)
+	configureDrain(cfg.Timeouts)
+	configureRetry(cfg.Retry)
+	configureSocket(cfg.Socket)
+	configureLimits(cfg.Stack)
+	configureDNSCache(cfg.DNS.Cache)
+	configureUDP(cfg.UDP)
+	configureBootstrap(cfg)
+	configureMemory(cfg.Memory)
+	configureWatchdog(cfg.Watchdog, cfg.Proxy.Type)
+	configureTTL(cfg.TTL)
+	configureReject(cfg.Reject)
+	if err := configureCapture(cfg.Capture); err != nil {
+		return nil, startFailure("capture", err)
+	}
+	if err := configureUsage(cfg.Usage); err != nil {
+		return nil, startFailure("usage", err)
+	}
+
+	reportStep("outbounds")
+	if cfg.Proxy.Type == "wireguard" {
+		device, err := newWireGuardDevice(cfg.Proxy.WireGuard, writeOutput)
+		if err != nil {
+			return nil, startFailure("wireguard", err)
 		}
+		return device, nil
+	}
 
-		return len(data), nil
-	})
+	tcpHandler, udpHandler, outbounds, err := buildHandlers(cfg)
+	if err != nil {
+		return nil, startFailure("outbounds", err)
+	}
+	namedOutbounds = outbounds
+	startResources(resources)
 
-	stack := core.NewLWIPStack()
+	tcpSwitch = &switchTCPHandler{handler: tcpHandler}
+	udpSwitch = newTrackedUDPHandler(udpHandler)
+	if err := configureInbound(cfg.Inbound); err != nil {
+		return nil, startFailure("inbound", err)
+	}
+	if err := configureForwards(cfg.Forwards); err != nil {
+		return nil, startFailure("forwards", err)
+	}
+	if err := configureKeepalive(cfg.Keepalive); err != nil {
+		return nil, startFailure("keepalive", err)
+	}
 
-	switch proxyType {
-	case "socks5", "socks":
-		core.RegisterTCPConnHandler(newSocksTCPHandler(host, uint16(port), username, password))
-		if username == "" && password == "" {
-			core.RegisterUDPConnHandler(socks.NewUDPHandler(host, uint16(port), 30*time.Second))
-		} else {
-			core.RegisterUDPConnHandler(dnsfallback.NewUDPHandler())
+	reportStep("stack")
+	if err := configureTCPBuffers(cfg.Stack); err != nil {
+		return nil, startFailure("stack", err)
+	}
+	return newLWIPStack()
+}
+
+// newLWIPStack sets up the lwIP listeners, which panics when lwIP is out of
+// PCBs.
+func newLWIPStack() (stack core.LWIPStack, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = startFailure("stack", fmt.Errorf("%v", r))
 		}
-	case "http", "https":
-		core.RegisterTCPConnHandler(newHTTPConnectHandler(host, uint16(port), username, password))
-		core.RegisterUDPConnHandler(dnsfallback.NewUDPHandler())
-	default:
-		return nil, errors.New("unsupported proxy type")
+	}()
+	return core.NewLWIPStack(), nil
+}
+
+func buildHandlers(cfg *tunnelConfig) (outbound, core.UDPConnHandler, map[string]outbound, error) {
+	dialTimeout := cfg.Timeouts.connect()
+	udpTimeout := cfg.Timeouts.udpIdle()
+
+	tcpOutbounds := map[string]outbound{
+		outboundDirect: newDirectOutbound(dialTimeout),
+		outboundBlock:  blockOutbound{},
+	}
+	udpOutbounds := map[string]core.UDPConnHandler{
+		outboundDirect: newDirectUDPHandler(udpTimeout),
+		outboundBlock:  blockUDPHandler{},
 	}
+	// A chained outbound is built after the one it goes through; validate
+	// has ruled out loops.
+	named := make(map[string]proxyConfig, len(cfg.Outbounds))
+	for _, oc := range cfg.Outbounds {
+		named[oc.Name] = oc
+	}
+	var build func(oc proxyConfig) error
+	build = func(oc proxyConfig) error {
+		if _, ok := tcpOutbounds[oc.Name]; ok {
+			return nil
+		}
+		var via proxy.Dialer
+		if oc.Via != "" {
+			if err := build(named[oc.Via]); err != nil {
+				return err
+			}
+			via = tcpOutbounds[oc.Via]
+		}
+		ob, udp, err := newOutbound(oc, via, dialTimeout, udpTimeout)
+		if err != nil {
+			return err
+		}
+		trackResource(ob)
+		ob = newTimedOutbound(oc.Name, ob)
+		tcpOutbounds[oc.Name], udpOutbounds[oc.Name] = ob, udp
+		return nil
+	}
+	for _, oc := range cfg.Outbounds {
+		if groupTypes[oc.Type] {
+			continue
+		}
+		if err := build(oc); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	for _, oc := range cfg.Outbounds {
+		if !groupTypes[oc.Type] {
+			continue
+		}
+		g, err := newOutboundGroup(oc.Name, oc, tcpOutbounds, udpOutbounds)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		trackResource(g)
+		tcpOutbounds[oc.Name], udpOutbounds[oc.Name] = g, g.udpHandler()
+	}
+
+	var tcpHandler outbound
+	var udpHandler core.UDPConnHandler
+	if groupTypes[cfg.Proxy.Type] {
+		g, err := newOutboundGroup(outboundProxy, cfg.Proxy, tcpOutbounds, udpOutbounds)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		trackResource(g)
+		tcpHandler, udpHandler = g, g.udpHandler()
+	} else {
+		var via proxy.Dialer
+		if cfg.Proxy.Via != "" {
+			via = tcpOutbounds[cfg.Proxy.Via]
+		}
+		var err error
+		tcpHandler, udpHandler, err = newOutbound(cfg.Proxy, via, dialTimeout, udpTimeout)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		trackResource(tcpHandler)
+		tcpHandler = newTimedOutbound(outboundProxy, tcpHandler)
+	}
+	tcpOutbounds[outboundProxy], udpOutbounds[outboundProxy] = tcpHandler, udpHandler
+
+	proxyOutbound := tcpHandler
+	var r *router
+	if cfg.Routing.enabled() {
+		var err error
+		r, err = newRouter(cfg.Routing)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		resources = append(resources, r)
+		tcpHandler = newRoutedOutbound(r, tcpOutbounds)
+		udpHandler = newRoutedUDPHandler(r, udpOutbounds)
+	}
+
+	var names *reverseMap
+	if cfg.DNS.ReverseMap && !cfg.DNS.FakeIP {
+		names = sharedReverseMap()
+		for name, ob := range tcpOutbounds {
+			if name != outboundDirect && name != outboundBlock {
+				tcpOutbounds[name] = newReverseMapOutbound(ob, names)
+			}
+		}
+		if r == nil {
+			tcpHandler = tcpOutbounds[outboundProxy]
+		}
+	}
+
+	tcpHandler = newFTPOutbound(tcpHandler, dialTimeout)
 
-	return stack, nil
+	if cfg.DNS.enabled() {
+		resolver, err := newDNSUpstream(cfg.DNS, proxyOutbound, dialTimeout)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if cfg.DNS.FakeIP {
+			pool, err := sharedFakeIPPool(cfg.DNS.FakeIPRange)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			tcpHandler = newFakeIPOutbound(tcpHandler, pool)
+			udpHandler = newFakeIPUDPHandler(udpHandler, pool, resolver)
+			resolver = newFakeIPResolver(pool, resolver)
+		}
+		// Names with their own resolver get real addresses even with
+		// fake-IP, so internal hosts can be reached directly.
+		if len(cfg.DNS.Rules) > 0 {
+			resolver, err = newSplitResolver(cfg.DNS.Rules, resolver, tcpOutbounds, dialTimeout)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		if cfg.IPv6 == "disable" {
+			resolver = newNoAAAAResolver(resolver)
+		}
+		if names != nil {
+			resolver = newReverseMapResolver(names, resolver)
+		}
+		if r != nil && r.blocks() {
+			resolver = newBlockingResolver(resolver, r)
+		}
+		// Hosts entries win over everything else, fake-IP and blocking
+		// included, and are not recorded by the reverse map.
+		if len(cfg.DNS.Hosts) > 0 {
+			resolver, err = newHostsResolver(cfg.DNS.Hosts, resolver)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		tcpHandler = newDNSTCPHandler(tcpHandler, resolver)
+		udpHandler = newDNSUDPHandler(udpHandler, resolver, udpTimeout)
+	}
+	udpHandler = newMulticastUDPHandler(udpHandler, udpOutbounds[outboundDirect])
+
+	return tcpHandler, udpHandler, tcpOutbounds, nil
+}
+
+func trackResource(v any) {
+	if c, ok := v.(io.Closer); ok {
+		resources = append(resources, c)
+	}
+}
+
+func writeOutput(data []byte) (int, error) {
+	stateMu.Lock()
+	queue := outputQueue
+	fn := outputFn
+	device := tunDevice
+	policy := queuePolicy
+	deadline := queueDeadline
+	stateMu.Unlock()
+
+	stats.recordDownlink(data)
+	clampMSS(data)
+	setTTL(data)
+	capturePacket(data, false)
+
+	if device != nil {
+		n, err := device.Write(data)
+		if err == nil {
+			stackOutputs.Add(1)
+		}
+		return n, err
+	}
+
+	if fn != nil {
+		fn(data)
+		stackOutputs.Add(1)
+		return len(data), nil
+	}
+
+	if queue == nil {
+		return 0, nil
+	}
+
+	packet := getPacket(len(data))
+	copy(packet, data)
+
+	enqueuePacket(queue, packet, policy, deadline)
+	stackOutputs.Add(1)
+	return len(data), nil
 }
 
 type socksTCPHandler struct {
-	proxyHost string
-	proxyPort uint16
-	auth      *proxy.Auth
+	proxyHost   string
+	proxyPort   uint16
+	auth        *proxy.Auth
+	tlsConfig   *tls.Config
+	transport   *transportConfig
+	via         proxy.Dialer
+	dialTimeout time.Duration
 }
 
-func newSocksTCPHandler(host string, port uint16, username string, password string) core.TCPConnHandler {
+func newSocksTCPHandler(host string, port uint16, username string, password string, tlsConfig *tls.Config, transport *transportConfig, via proxy.Dialer, dialTimeout time.Duration) outbound {
 	var auth *proxy.Auth
 	if username != "" || password != "" {
 		auth = &proxy.Auth{User: username, Password: password}
 	}
 
 	return &socksTCPHandler{
-		proxyHost: host,
-		proxyPort: port,
-		auth:      auth,
+		proxyHost:   host,
+		proxyPort:   port,
+		auth:        auth,
+		tlsConfig:   tlsConfig,
+		transport:   transport,
+		via:         via,
+		dialTimeout: dialTimeout,
 	}
 }
 
 func (h *socksTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	if target == nil {
-		return errors.New("missing target address")
+	return relayThrough(h, conn, target)
+}
+
+func (h *socksTCPHandler) Dial(network string, addr string) (net.Conn, error) {
+	dialer, err := proxy.SOCKS5("tcp", h.proxyAddr(), h.auth, &handshakeDialer{h.forward()})
+	if err != nil {
+		return nil, err
 	}
-	proxyAddr := net.JoinHostPort(h.proxyHost, strconv.Itoa(int(h.proxyPort)))
-	dialer, err := proxy.SOCKS5("tcp", proxyAddr, h.auth, proxy.Direct)
+	conn, err := dialer.Dial(network, addr)
 	if err != nil {
-		return err
+		if strings.Contains(err.Error(), "unknown error ") {
+			// The proxy answered the request with a failure reply.
+			return nil, fmt.Errorf("%w: %v", errConnectRejected, err)
+		}
+		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
 
-	c, err := dialer.Dial(target.Network(), target.String())
-	if err != nil {
-		return err
+func (h *socksTCPHandler) proxyAddr() string {
+	return net.JoinHostPort(h.proxyHost, strconv.Itoa(int(h.proxyPort)))
+}
+
+// forward returns the dialer that reaches the proxy server.
+func (h *socksTCPHandler) forward() proxy.Dialer {
+	if h.transport != nil {
+		return &transportDialer{config: h.transport, via: h.via, timeout: h.dialTimeout}
+	}
+	if h.tlsConfig != nil {
+		return &tlsDialer{config: h.tlsConfig, via: h.via, timeout: h.dialTimeout}
+	}
+	if h.via != nil {
+		return h.via
 	}
+	return &upstreamDialer{timeout: h.dialTimeout}
+}
 
-	go relayTCP(conn, c)
-	return nil
+// handshakeDialer starts the handshake deadline once the proxy connection
+// is up; the caller clears it when the proxy has accepted the target.
+type handshakeDialer struct {
+	proxy.Dialer
+}
+
+func (d *handshakeDialer) Dial(network string, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(handshakeDeadline())
+	return conn, nil
 }
 
 type httpConnectHandler struct {
-	proxyHost string
-	proxyPort uint16
-	username  string
-	password  string
+	proxyHost   string
+	proxyPort   uint16
+	username    string
+	password    string
+	authScheme  string
+	header      http.Header
+	tlsConfig   *tls.Config
+	via         proxy.Dialer
+	dialTimeout time.Duration
 }
 
-func newHTTPConnectHandler(host string, port uint16, username string, password string) core.TCPConnHandler {
+func newHTTPConnectHandler(host string, port uint16, username string, password string, authScheme string, header http.Header, tlsConfig *tls.Config, via proxy.Dialer, dialTimeout time.Duration) outbound {
 	return &httpConnectHandler{
-		proxyHost: host,
-		proxyPort: port,
-		username:  username,
-		password:  password,
+		proxyHost:   host,
+		proxyPort:   port,
+		username:    username,
+		password:    password,
+		authScheme:  authScheme,
+		header:      header,
+		tlsConfig:   tlsConfig,
+		via:         via,
+		dialTimeout: dialTimeout,
 	}
 }
 
 func (h *httpConnectHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	if target == nil {
-		return errors.New("missing target address")
-	}
+	return relayThrough(h, conn, target)
+}
+
+func (h *httpConnectHandler) Dial(network string, addr string) (net.Conn, error) {
 	proxyAddr := net.JoinHostPort(h.proxyHost, strconv.Itoa(int(h.proxyPort)))
-	proxyConn, err := net.DialTimeout("tcp", proxyAddr, 10*time.Second)
+	if h.via != nil {
+		proxyConn, err := h.via.Dial("tcp", proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		return h.open(proxyConn, addr)
+	}
+	proxyConn, reused, err := httpProxyPool.get(proxyAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	targetAddr := target.String()
-	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", targetAddr, targetAddr)
-	if h.username != "" || h.password != "" {
-		token := base64.StdEncoding.EncodeToString([]byte(h.username + ":" + h.password))
-		req += "Proxy-Authorization: Basic " + token + "\r\n"
+	conn, err := h.open(proxyConn, addr)
+	if err != nil && reused && !errors.Is(err, errConnectRejected) {
+		proxyConn, err = dialTCP(proxyAddr, h.dialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		conn, err = h.open(proxyConn, addr)
 	}
-	req += "\r\n"
+	return conn, err
+}
 
-	if _, err := io.WriteString(proxyConn, req); err != nil {
-		proxyConn.Close()
-		return err
-	}
+// open sends the CONNECT, answering authentication challenges on the
+// same connection while the proxy keeps it open and on a new one otherwise.
+func (h *httpConnectHandler) open(proxyConn net.Conn, targetAddr string) (net.Conn, error) {
+	auth := newProxyAuth(h.username, h.password, h.authScheme)
+	authorization := auth.first()
+	for {
+		if h.tlsConfig != nil {
+			tlsConn, err := tlsHandshake(proxyConn, h.tlsConfig)
+			if err != nil {
+				return nil, err
+			}
+			proxyConn = tlsConn
+		}
+
+		reader := bufio.NewReader(proxyConn)
+		for {
+			resp, err := h.connect(proxyConn, reader, targetAddr, authorization)
+			if err != nil {
+				proxyConn.Close()
+				return nil, err
+			}
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				proxyConn.SetDeadline(time.Time{})
+				return &bufferedConn{halfCloser: halfCloser{proxyConn}, reader: reader}, nil
+			}
+			authorization, err = auth.next(resp, targetAddr)
+			if err != nil {
+				proxyConn.Close()
+				return nil, err
+			}
+			if !drainChallenge(resp) {
+				break
+			}
+		}
 
-	reader := bufio.NewReader(proxyConn)
-	code, err := readHTTPStatusCode(reader)
-	if err != nil {
-		proxyConn.Close()
-		return err
-	}
-	if code < 200 || code >= 300 {
 		proxyConn.Close()
-		return fmt.Errorf("proxy connect failed with status %d", code)
+		var err error
+		proxyConn, err = dialServer(h.via, net.JoinHostPort(h.proxyHost, strconv.Itoa(int(h.proxyPort))), h.dialTimeout)
+		if err != nil {
+			return nil, err
+		}
 	}
-
-	buffered := &bufferedConn{Conn: proxyConn, reader: reader}
-	go relayTCP(conn, buffered)
-	return nil
 }
 
-func readHTTPStatusCode(reader *bufio.Reader) (int, error) {
-	statusLine, err := reader.ReadString('\n')
-	if err != nil {
-		return 0, err
+func (h *httpConnectHandler) connect(proxyConn net.Conn, reader *bufio.Reader, targetAddr string, authorization string) (*http.Response, error) {
+	var req strings.Builder
+	fmt.Fprintf(&req, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", targetAddr, targetAddr)
+	h.header.Write(&req)
+	if authorization != "" {
+		req.WriteString("Proxy-Authorization: " + authorization + "\r\n")
 	}
+	req.WriteString("\r\n")
 
-	statusLine = strings.TrimSpace(statusLine)
-	parts := strings.SplitN(statusLine, " ", 3)
-	if len(parts) < 2 {
-		return 0, errors.New("invalid proxy response")
+	proxyConn.SetDeadline(handshakeDeadline())
+	if _, err := io.WriteString(proxyConn, req.String()); err != nil {
+		return nil, err
 	}
-
-	code, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return 0, err
-	}
-
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			return 0, err
-		}
-		if line == "\r\n" {
-			break
-		}
-	}
-
-	return code, nil
+	return http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
 }
 
 type bufferedConn struct {
-	net.Conn
+	halfCloser
 	reader *bufio.Reader
 }
 
@@ -336,34 +906,64 @@ func (c *bufferedConn) Read(p []byte) (int, error) {
 	return c.reader.Read(p)
 }
 
-func (c *bufferedConn) CloseRead() error {
+type direction byte
+
+type duplexConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+// halfCloser is embedded by connection wrappers to pass CloseRead and
+// CloseWrite on to the wrapped connection, when it has them.
+type halfCloser struct {
+	net.Conn
+}
+
+func (c halfCloser) CloseRead() error {
 	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
 		return cr.CloseRead()
 	}
 	return nil
 }
 
-func (c *bufferedConn) CloseWrite() error {
+func (c halfCloser) CloseWrite() error {
 	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
 		return cw.CloseWrite()
 	}
 	return nil
 }
 
-type direction byte
-
-type duplexConn interface {
-	net.Conn
-	CloseRead() error
-	CloseWrite() error
-}
-
 const (
 	dirUplink direction = iota
 	dirDownlink
 )
 
 func relayTCP(lhs, rhs net.Conn) {
+	relayConn(lhs, rhs, openConn("tcp", lhs.LocalAddr(), lhs.RemoteAddr()))
+}
+
+// relayConn copies between an app-side connection and its upstream until
+// both directions are done, accounting the flow in record.
+func relayConn(lhs, rhs net.Conn, record *connRecord) {
+	defer record.close()
+
+	abort := func() {
+		abortConn(lhs)
+		rhs.Close()
+	}
+	record.setAbort(abort)
+	record.setSocket(upstreamSocket(rhs))
+	record.setClass(classifyPort(record.target))
+	if activeQoS.Load() != nil {
+		record.setPriority(flowPriority(record.target, resolvedTargetName(record.target)))
+	}
+	stopIdle := watchIdle(record, func() {
+		logger.Debug("tcp idle timeout", "target", record.target, "class", record.getClass())
+		abort()
+	})
+	defer stopIdle()
+
 	upCh := make(chan struct{})
 
 	cls := func(dir direction, interrupt bool) {
@@ -387,30 +987,29 @@ func relayTCP(lhs, rhs net.Conn) {
 	}
 
 	go func() {
-		_, err := io.Copy(rhs, lhs)
-		if err != nil {
-			cls(dirUplink, true)
-		} else {
-			cls(dirUplink, false)
-		}
+		err := copyRelay(&shapedWriter{Writer: rhs, limiter: uplinkLimiter().forFlow(record)}, &sniffingReader{Reader: lhs, record: record})
+		cls(dirUplink, err != nil)
 		upCh <- struct{}{}
 	}()
 
-	_, err := io.Copy(lhs, rhs)
-	if err != nil {
-		cls(dirDownlink, true)
-	} else {
-		cls(dirDownlink, false)
-	}
+	err := copyRelay(&shapedWriter{Writer: &countingWriter{Writer: lhs, record: record}, limiter: downlinkLimiter().forFlow(record)}, rhs)
+	cls(dirDownlink, err != nil)
 
-	<-upCh
-}
-
-func cStringOrEmpty(value *C.char) string {
-	if value == nil {
-		return ""
+	// Once the upstream is done, the app gets lingerMs to finish sending
+	// before its side is closed.
+	if linger := time.Duration(tcpLingerTimeout.Load()); err == nil && linger > 0 {
+		timer := time.NewTimer(linger)
+		select {
+		case <-upCh:
+			timer.Stop()
+		case <-timer.C:
+			logger.Debug("tcp linger timeout", "target", record.target)
+			lhs.Close()
+			<-upCh
+		}
+	} else {
+		<-upCh
 	}
-	return C.GoString(value)
+	lhs.Close()
+	rhs.Close()
 }
-
-func main() {}
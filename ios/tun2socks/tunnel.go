@@ -0,0 +1,104 @@
+package tun2socks
+
+import "time"
+
+// tunnelGen counts successful starts and identifies the tunnel a Tunnel
+// handle belongs to. It is guarded by stateMu.
+var tunnelGen uint64
+
+// Tunnel is a handle on a running tunnel. Its methods only act on the
+// tunnel it was started as, so a handle kept past Stop cannot feed packets
+// to, read from or stop a tunnel started after it.
+//
+// There is one tunnel per process: go-tun2socks keeps the lwIP stack, its
+// output function and its handlers in package and C globals, so a second
+// stack cannot run beside the first. To try a new server while the tunnel
+// carries traffic, name it in the outbounds and use TestOutbound.
+type Tunnel struct {
+	gen uint64
+}
+
+// NewTunnel starts the tunnel like StartWithFD or, when fd is negative,
+// like StartWithConfig, and returns its handle. It fails with
+// ErrAlreadyRunning while a tunnel runs.
+func NewTunnel(fd int, jsonConfig string) (*Tunnel, error) {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	if isRunning() {
+		return nil, ErrAlreadyRunning
+	}
+	var err error
+	if fd < 0 {
+		err = startWithConfig(jsonConfig)
+	} else {
+		err = startWithFD(fd, jsonConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return &Tunnel{gen: tunnelGen}, nil
+}
+
+// TunnelFromHandle returns the Tunnel of a value from Handle.
+func TunnelFromHandle(handle uint64) *Tunnel {
+	return &Tunnel{gen: handle}
+}
+
+// Handle returns a number that identifies t, for callers that cannot hold
+// Go pointers. It is never 0.
+func (t *Tunnel) Handle() uint64 {
+	return t.gen
+}
+
+// Running reports whether the tunnel of t still runs.
+func (t *Tunnel) Running() bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return t.currentLocked()
+}
+
+func (t *Tunnel) currentLocked() bool {
+	return running && t.gen == tunnelGen
+}
+
+// Input is like the package Input, for the tunnel of t.
+func (t *Tunnel) Input(packet []byte) bool {
+	stateMu.Lock()
+	stack := lwipStack
+	current := t.currentLocked()
+	stateMu.Unlock()
+
+	if !current {
+		return false
+	}
+	return inputTo(stack, packet)
+}
+
+// ReadPacket is like the package ReadPacket, for the tunnel of t.
+func (t *Tunnel) ReadPacket(buf []byte) int {
+	if !t.Running() {
+		return 0
+	}
+	return ReadPacket(buf)
+}
+
+// ReadPacketTimeout is like the package ReadPacketTimeout, for the tunnel
+// of t.
+func (t *Tunnel) ReadPacketTimeout(buf []byte, timeout time.Duration) int {
+	if !t.Running() {
+		return 0
+	}
+	return ReadPacketTimeout(buf, timeout)
+}
+
+// Stop stops the tunnel of t, if it still runs.
+func (t *Tunnel) Stop() {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	if t.Running() {
+		stop()
+	}
+}
@@ -0,0 +1,125 @@
+package tun2socks
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// UDP filtering as in RFC 4787: which remote endpoints may answer through a
+// session once the app has sent from its local port.
+const (
+	udpFilterFullCone int32 = iota
+	udpFilterAddress
+	udpFilterAddressPort
+)
+
+var udpFilterModes = map[string]int32{
+	"":                   udpFilterFullCone,
+	"full-cone":          udpFilterFullCone,
+	"address-restricted": udpFilterAddress,
+	"port-restricted":    udpFilterAddressPort,
+}
+
+type udpConfig struct {
+	Filtering   string `json:"filtering,omitempty"`
+	MaxSessions int    `json:"maxSessions,omitempty"`
+	UnrepliedMs int    `json:"unrepliedMs,omitempty"`
+}
+
+var (
+	udpFiltering   atomic.Int32
+	udpMaxSessions atomic.Int64
+	udpUnreplied   atomic.Int64
+)
+
+// configureUDP applies to sessions opened from now on.
+func configureUDP(cfg *udpConfig) {
+	if cfg == nil {
+		cfg = &udpConfig{}
+	}
+	udpFiltering.Store(udpFilterModes[cfg.Filtering])
+	udpMaxSessions.Store(int64(cfg.MaxSessions))
+	udpUnreplied.Store(int64(time.Duration(cfg.UnrepliedMs) * time.Millisecond))
+}
+
+// peerKey is the part of a remote endpoint the session's filtering looks
+// at.
+func (c *trackedUDPConn) peerKey(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	ip := ap.Addr().Unmap()
+	if c.filtering == udpFilterAddress {
+		return netip.AddrPortFrom(ip, 0)
+	}
+	return netip.AddrPortFrom(ip, ap.Port())
+}
+
+// addPeer remembers a destination the app sent to, so it may answer.
+func (c *trackedUDPConn) addPeer(addr *net.UDPAddr) {
+	if c.filtering == udpFilterFullCone || addr == nil {
+		return
+	}
+	key := c.peerKey(addr)
+	c.peerMu.Lock()
+	c.peers[key] = struct{}{}
+	c.peerMu.Unlock()
+}
+
+// allowFrom reports whether a datagram from addr may reach the app.
+func (c *trackedUDPConn) allowFrom(addr *net.UDPAddr) bool {
+	if c.filtering == udpFilterFullCone {
+		return true
+	}
+	if addr == nil {
+		return false
+	}
+	key := c.peerKey(addr)
+	c.peerMu.Lock()
+	_, ok := c.peers[key]
+	c.peerMu.Unlock()
+	return ok
+}
+
+// evictIdlest closes the session that has been quiet longest once the
+// table holds maxSessions, making room for a new one.
+func (h *trackedUDPHandler) evictIdlest() {
+	limit := int(udpMaxSessions.Load())
+	if limit <= 0 {
+		return
+	}
+	h.Lock()
+	var victim *trackedUDPConn
+	if len(h.conns) >= limit {
+		for _, c := range h.conns {
+			if victim == nil || c.record.idle() > victim.record.idle() {
+				victim = c
+			}
+		}
+	}
+	h.Unlock()
+
+	if victim != nil {
+		stats.udpEvicted.Add(1)
+		logger.Debug("udp session evicted", "target", victim.record.target, "idle", victim.record.idle())
+		victim.record.emit("evict")
+		victim.Close()
+	}
+}
+
+// watchUnreplied closes the session when nothing came back within the
+// unreplied timeout, so one-way traffic does not hold a mapping for the
+// whole idle timeout.
+func watchUnreplied(c *trackedUDPConn) func() {
+	timeout := time.Duration(udpUnreplied.Load())
+	if timeout <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(timeout, func() {
+		if c.record.downlink.Load() == 0 {
+			logger.Debug("udp session unreplied", "target", c.record.target)
+			c.Close()
+		}
+	})
+	return func() { timer.Stop() }
+}
@@ -0,0 +1,170 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"golang.org/x/net/proxy"
+)
+
+// UDP-over-TCP version 2 as used by sing-box and compatible servers: the
+// proxy is asked to CONNECT to a magic hostname, and every datagram is then
+// framed as address, port, length and payload on that stream. Servers match
+// the hostname only; sing-box sends port 0, which the SOCKS5 dialer refuses,
+// so 443 stands in.
+const (
+	uotMagicAddress = "sp.v2.udp-over-tcp.arpa:443"
+	uotFamilyIPv4   = 0x00
+	uotFamilyIPv6   = 0x01
+	uotFamilyFQDN   = 0x02
+)
+
+type uotUDPHandler struct {
+	sync.Mutex
+
+	dialer  proxy.Dialer
+	timeout time.Duration
+	conns   map[core.UDPConn]net.Conn
+}
+
+func newUoTUDPHandler(dialer proxy.Dialer, timeout time.Duration) core.UDPConnHandler {
+	return &uotUDPHandler{
+		dialer:  dialer,
+		timeout: timeout,
+		conns:   make(map[core.UDPConn]net.Conn, 8),
+	}
+}
+
+func (h *uotUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	if target == nil {
+		return errors.New("missing target address")
+	}
+	c, err := h.dialer.Dial("tcp", uotMagicAddress)
+	if err != nil {
+		return err
+	}
+	// The request carries isConnect=false so every packet names its own
+	// destination.
+	if _, err := c.Write(append([]byte{0}, uotAddr(target)...)); err != nil {
+		c.Close()
+		return err
+	}
+
+	h.Lock()
+	h.conns[conn] = c
+	h.Unlock()
+
+	go h.fetchInput(conn, c)
+	return nil
+}
+
+func (h *uotUDPHandler) fetchInput(conn core.UDPConn, c net.Conn) {
+	defer h.Close(conn)
+
+	buf := make([]byte, 65535)
+	for {
+		c.SetReadDeadline(time.Now().Add(h.timeout))
+		src, err := readUoTAddr(c)
+		if err != nil {
+			return
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(c, length[:]); err != nil {
+			return
+		}
+		payload := buf[:binary.BigEndian.Uint16(length[:])]
+		if _, err := io.ReadFull(c, payload); err != nil {
+			return
+		}
+		if src == nil {
+			continue
+		}
+		if _, err := conn.WriteFrom(payload, src); err != nil {
+			return
+		}
+	}
+}
+
+func (h *uotUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.Lock()
+	c, ok := h.conns[conn]
+	h.Unlock()
+
+	if !ok {
+		h.Close(conn)
+		return fmt.Errorf("proxy connection %v->%v does not exist", conn.LocalAddr(), addr)
+	}
+
+	packet := uotAddr(addr)
+	packet = binary.BigEndian.AppendUint16(packet, uint16(len(data)))
+	packet = append(packet, data...)
+	if _, err := c.Write(packet); err != nil {
+		h.Close(conn)
+		return fmt.Errorf("write remote failed: %v", err)
+	}
+	return nil
+}
+
+func (h *uotUDPHandler) Close(conn core.UDPConn) {
+	conn.Close()
+
+	h.Lock()
+	defer h.Unlock()
+
+	if c, ok := h.conns[conn]; ok {
+		c.Close()
+		delete(h.conns, conn)
+	}
+}
+
+func uotAddr(addr *net.UDPAddr) []byte {
+	var b []byte
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append([]byte{uotFamilyIPv4}, ip4...)
+	} else {
+		b = append([]byte{uotFamilyIPv6}, addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
+
+// readUoTAddr reads a framed address. Hostname sources are consumed but
+// reported as nil since they cannot be written back into the stack.
+func readUoTAddr(r io.Reader) (*net.UDPAddr, error) {
+	var family [1]byte
+	if _, err := io.ReadFull(r, family[:]); err != nil {
+		return nil, err
+	}
+
+	var ip net.IP
+	switch family[0] {
+	case uotFamilyIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case uotFamilyIPv6:
+		ip = make(net.IP, net.IPv6len)
+	case uotFamilyFQDN:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, make([]byte, int(n[0])+2)); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	default:
+		return nil, errors.New("unsupported udp-over-tcp address family")
+	}
+	if _, err := io.ReadFull(r, ip); err != nil {
+		return nil, err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+}
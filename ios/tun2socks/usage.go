@@ -0,0 +1,192 @@
+package tun2socks
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	usageSampleInterval = 10 * time.Second
+	usageSaveInterval   = time.Minute
+	usageHours          = 7 * 24
+	usageDays           = 90
+)
+
+type usageConfig struct {
+	Path string `json:"path"`
+}
+
+type usageBucket struct {
+	Start         int64  `json:"start"`
+	UplinkBytes   uint64 `json:"uplinkBytes"`
+	DownlinkBytes uint64 `json:"downlinkBytes"`
+}
+
+type usageHistory struct {
+	Hourly []usageBucket `json:"hourly"`
+	Daily  []usageBucket `json:"daily"`
+}
+
+// usageTracker adds the traffic counters into hourly and daily buckets in
+// local time and keeps them in a file, so the history outlives the
+// extension process.
+type usageTracker struct {
+	mu       sync.Mutex
+	path     string
+	history  usageHistory
+	lastUp   uint64
+	lastDown uint64
+	dirty    bool
+	saved    time.Time
+}
+
+var usage usageTracker
+
+// UsageHistory returns the traffic per hour for the last week and per day
+// for the last 90 days as JSON, oldest first. Each bucket has its local
+// start time in Unix seconds and the uplink and downlink bytes.
+func UsageHistory() string {
+	usage.sample(time.Now())
+
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	data, err := json.Marshal(usage.history)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// configureUsage points the tracker at path, loading the history stored
+// there when it changes.
+func configureUsage(cfg *usageConfig) error {
+	path := ""
+	if cfg != nil {
+		path = cfg.Path
+	}
+
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	if path == usage.path {
+		return nil
+	}
+	usage.saveLocked()
+	usage.path = path
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		usage.dirty = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stored usageHistory
+	if err := json.Unmarshal(data, &stored); err != nil {
+		logger.Warn("usage history unreadable, starting over", "path", path, "error", err)
+		return nil
+	}
+	usage.history = stored
+	return nil
+}
+
+// runUsage samples the counters until stop is closed. It is started with
+// every tunnel, right after the counters were reset.
+func runUsage(stop <-chan struct{}) {
+	usage.mu.Lock()
+	usage.lastUp, usage.lastDown = 0, 0
+	usage.mu.Unlock()
+
+	ticker := time.NewTicker(usageSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			usage.sample(now)
+			if now.Sub(usage.savedAt()) >= usageSaveInterval {
+				usage.save()
+			}
+		}
+	}
+}
+
+func (u *usageTracker) sample(now time.Time) {
+	up, down := stats.totals()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// The counters restart with every tunnel.
+	if up < u.lastUp || down < u.lastDown {
+		u.lastUp, u.lastDown = 0, 0
+	}
+	deltaUp, deltaDown := up-u.lastUp, down-u.lastDown
+	u.lastUp, u.lastDown = up, down
+	if deltaUp == 0 && deltaDown == 0 {
+		return
+	}
+
+	y, m, d := now.Date()
+	hour := time.Date(y, m, d, now.Hour(), 0, 0, 0, now.Location()).Unix()
+	day := time.Date(y, m, d, 0, 0, 0, 0, now.Location()).Unix()
+	u.history.Hourly = addUsage(u.history.Hourly, hour, deltaUp, deltaDown, usageHours)
+	u.history.Daily = addUsage(u.history.Daily, day, deltaUp, deltaDown, usageDays)
+	u.dirty = true
+}
+
+func addUsage(buckets []usageBucket, start int64, up uint64, down uint64, keep int) []usageBucket {
+	if n := len(buckets); n == 0 || buckets[n-1].Start != start {
+		buckets = append(buckets, usageBucket{Start: start})
+	}
+	last := &buckets[len(buckets)-1]
+	last.UplinkBytes += up
+	last.DownlinkBytes += down
+	if len(buckets) > keep {
+		buckets = append(buckets[:0], buckets[len(buckets)-keep:]...)
+	}
+	return buckets
+}
+
+func (u *usageTracker) savedAt() time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.saved
+}
+
+// save writes the history next to the file and renames it into place, so
+// a crash never leaves half a file.
+func (u *usageTracker) save() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.saveLocked()
+}
+
+func (u *usageTracker) saveLocked() {
+	u.saved = time.Now()
+	if u.path == "" || !u.dirty {
+		return
+	}
+	data, err := json.Marshal(u.history)
+	if err != nil {
+		return
+	}
+	tmp := u.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		logger.Warn("usage history not saved", "path", u.path, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, u.path); err != nil {
+		logger.Warn("usage history not saved", "path", u.path, "error", err)
+		return
+	}
+	u.dirty = false
+}
@@ -0,0 +1,129 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func parseUUID(s string) ([16]byte, error) {
+	var id [16]byte
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != 16 {
+		return id, fmt.Errorf("invalid uuid %q", s)
+	}
+	copy(id[:], raw)
+	return id, nil
+}
+
+// portThenAddress encodes a target in the V2Ray wire format shared by
+// VMess and VLESS: port, address type (1 IPv4, 2 domain, 3 IPv6), address.
+func portThenAddress(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := binary.BigEndian.AppendUint16(nil, uint16(port))
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, 1)
+			return append(buf, ip4...), nil
+		}
+		buf = append(buf, 3)
+		return append(buf, ip.To16()...), nil
+	}
+	if len(host) > 255 {
+		return nil, errors.New("domain name too long")
+	}
+	buf = append(buf, 2, byte(len(host)))
+	return append(buf, host...), nil
+}
+
+type vlessTCPHandler struct {
+	serverAddr  string
+	id          [16]byte
+	transport   *transportConfig
+	via         proxy.Dialer
+	dialTimeout time.Duration
+}
+
+func newVLESSTCPHandler(host string, port uint16, uuid string, transport *transportConfig, via proxy.Dialer, dialTimeout time.Duration) (outbound, error) {
+	id, err := parseUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	return &vlessTCPHandler{
+		serverAddr:  net.JoinHostPort(host, strconv.Itoa(int(port))),
+		id:          id,
+		transport:   transport,
+		via:         via,
+		dialTimeout: dialTimeout,
+	}, nil
+}
+
+func (h *vlessTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(h, conn, target)
+}
+
+func (h *vlessTCPHandler) Dial(network string, addr string) (net.Conn, error) {
+	target, err := portThenAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialTransport(h.transport, h.via, h.serverAddr, h.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, 0, 1+16+1+1+len(target))
+	req = append(req, 0)
+	req = append(req, h.id[:]...)
+	req = append(req, 0, 1)
+	req = append(req, target...)
+	if _, err := c.Write(req); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &vlessConn{halfCloser: halfCloser{c}}, nil
+}
+
+type vlessConn struct {
+	halfCloser
+	once sync.Once
+	err  error
+}
+
+func (c *vlessConn) Read(p []byte) (int, error) {
+	c.once.Do(func() {
+		var header [2]byte
+		if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+			c.err = err
+			return
+		}
+		if header[0] != 0 {
+			c.err = fmt.Errorf("unexpected vless response version %d", header[0])
+			return
+		}
+		if header[1] > 0 {
+			_, c.err = io.CopyN(io.Discard, c.Conn, int64(header[1]))
+		}
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
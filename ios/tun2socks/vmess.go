@@ -0,0 +1,388 @@
+package tun2socks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	vmessSecurityAES128GCM        = 3
+	vmessSecurityChacha20Poly1305 = 4
+	vmessSecurityNone             = 5
+
+	vmessOptionChunkStream = 0x01
+	vmessCmdTCP            = 1
+	vmessMaxChunk          = 8192
+)
+
+func vmessSecurity(name string) (byte, error) {
+	switch strings.ToLower(name) {
+	case "", "auto", "aes-128-gcm":
+		return vmessSecurityAES128GCM, nil
+	case "chacha20-poly1305", "chacha20-ietf-poly1305":
+		return vmessSecurityChacha20Poly1305, nil
+	case "none":
+		return vmessSecurityNone, nil
+	default:
+		return 0, fmt.Errorf("unsupported vmess security %q", name)
+	}
+}
+
+type kdfHash struct {
+	parent *kdfHash
+	key    []byte
+}
+
+func (k *kdfHash) create() hash.Hash {
+	if k.parent == nil {
+		return hmac.New(sha256.New, k.key)
+	}
+	return hmac.New(k.parent.create, k.key)
+}
+
+// vmessKDF is the nested HMAC-SHA256 key derivation used by VMess AEAD.
+func vmessKDF(key []byte, path ...string) []byte {
+	h := &kdfHash{key: []byte("VMess AEAD KDF")}
+	for _, p := range path {
+		h = &kdfHash{parent: h, key: []byte(p)}
+	}
+	mac := h.create()
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealVMessHeader(cmdKey []byte, header []byte) ([]byte, error) {
+	var authID [16]byte
+	binary.BigEndian.PutUint64(authID[:8], uint64(time.Now().Unix()))
+	if _, err := rand.Read(authID[8:12]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(authID[12:], crc32.ChecksumIEEE(authID[:12]))
+	block, err := aes.NewCipher(vmessKDF(cmdKey, "AES Auth ID Encryption")[:16])
+	if err != nil {
+		return nil, err
+	}
+	block.Encrypt(authID[:], authID[:])
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	lengthAEAD, err := newGCM(vmessKDF(cmdKey, "VMess Header AEAD Key_Length", string(authID[:]), string(nonce))[:16])
+	if err != nil {
+		return nil, err
+	}
+	lengthIV := vmessKDF(cmdKey, "VMess Header AEAD Nonce_Length", string(authID[:]), string(nonce))[:12]
+	length := binary.BigEndian.AppendUint16(nil, uint16(len(header)))
+
+	payloadAEAD, err := newGCM(vmessKDF(cmdKey, "VMess Header AEAD Key", string(authID[:]), string(nonce))[:16])
+	if err != nil {
+		return nil, err
+	}
+	payloadIV := vmessKDF(cmdKey, "VMess Header AEAD Nonce", string(authID[:]), string(nonce))[:12]
+
+	out := append([]byte{}, authID[:]...)
+	out = lengthAEAD.Seal(out, lengthIV, length, authID[:])
+	out = append(out, nonce...)
+	return payloadAEAD.Seal(out, payloadIV, header, authID[:]), nil
+}
+
+type vmessTCPHandler struct {
+	serverAddr  string
+	cmdKey      []byte
+	security    byte
+	transport   *transportConfig
+	via         proxy.Dialer
+	dialTimeout time.Duration
+}
+
+func newVMessTCPHandler(host string, port uint16, uuid string, security string, transport *transportConfig, via proxy.Dialer, dialTimeout time.Duration) (outbound, error) {
+	id, err := parseUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	sec, err := vmessSecurity(security)
+	if err != nil {
+		return nil, err
+	}
+	cmdKey := md5.Sum(append(id[:], "c48619fe-8f02-49e0-b9e9-edf763e17e21"...))
+	return &vmessTCPHandler{
+		serverAddr:  net.JoinHostPort(host, strconv.Itoa(int(port))),
+		cmdKey:      cmdKey[:],
+		security:    sec,
+		transport:   transport,
+		via:         via,
+		dialTimeout: dialTimeout,
+	}, nil
+}
+
+func (h *vmessTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return relayThrough(h, conn, target)
+}
+
+func (h *vmessTCPHandler) Dial(network string, addr string) (net.Conn, error) {
+	target, err := portThenAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	vc := &vmessConn{security: h.security}
+	if _, err := rand.Read(vc.reqKey[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(vc.reqIV[:]); err != nil {
+		return nil, err
+	}
+	var v [1]byte
+	if _, err := rand.Read(v[:]); err != nil {
+		return nil, err
+	}
+	vc.respV = v[0]
+	respKey := sha256.Sum256(vc.reqKey[:])
+	respIV := sha256.Sum256(vc.reqIV[:])
+	copy(vc.respKey[:], respKey[:16])
+	copy(vc.respIV[:], respIV[:16])
+
+	var padding [1]byte
+	rand.Read(padding[:])
+	paddingLen := int(padding[0] % 16)
+
+	header := []byte{1}
+	header = append(header, vc.reqIV[:]...)
+	header = append(header, vc.reqKey[:]...)
+	header = append(header, vc.respV, vmessOptionChunkStream, byte(paddingLen<<4)|h.security, 0, vmessCmdTCP)
+	header = append(header, target...)
+	pad := make([]byte, paddingLen)
+	rand.Read(pad)
+	header = append(header, pad...)
+	sum := fnv.New32a()
+	sum.Write(header)
+	header = sum.Sum(header)
+
+	sealed, err := sealVMessHeader(h.cmdKey, header)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := dialTransport(h.transport, h.via, h.serverAddr, h.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(sealed); err != nil {
+		c.Close()
+		return nil, err
+	}
+	vc.Conn = c
+	if vc.writer, err = vc.newBodyAEAD(vc.reqKey[:]); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return vc, nil
+}
+
+type vmessConn struct {
+	halfCloser
+	security byte
+	reqKey   [16]byte
+	reqIV    [16]byte
+	respKey  [16]byte
+	respIV   [16]byte
+	respV    byte
+
+	writeMu    sync.Mutex
+	writer     cipher.AEAD
+	writeCount uint16
+
+	reader    cipher.AEAD
+	readCount uint16
+	readErr   error
+	headerOK  bool
+	pending   []byte
+	readBuf   []byte
+}
+
+func (c *vmessConn) newBodyAEAD(key []byte) (cipher.AEAD, error) {
+	switch c.security {
+	case vmessSecurityAES128GCM:
+		return newGCM(key)
+	case vmessSecurityChacha20Poly1305:
+		k1 := md5.Sum(key)
+		k2 := md5.Sum(k1[:])
+		return chacha20poly1305.New(append(k1[:], k2[:]...))
+	default:
+		return nil, nil
+	}
+}
+
+func vmessNonce(iv []byte, count uint16) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint16(nonce, count)
+	copy(nonce[2:], iv[2:12])
+	return nonce
+}
+
+func (c *vmessConn) writeChunk(p []byte) error {
+	var chunk []byte
+	if c.writer != nil {
+		sealed := c.writer.Seal(nil, vmessNonce(c.reqIV[:], c.writeCount), p, nil)
+		c.writeCount++
+		chunk = binary.BigEndian.AppendUint16(nil, uint16(len(sealed)))
+		chunk = append(chunk, sealed...)
+	} else {
+		chunk = binary.BigEndian.AppendUint16(nil, uint16(len(p)))
+		chunk = append(chunk, p...)
+	}
+	_, err := c.Conn.Write(chunk)
+	return err
+}
+
+func (c *vmessConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > vmessMaxChunk {
+			n = vmessMaxChunk
+		}
+		if err := c.writeChunk(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *vmessConn) readHeader() error {
+	lengthAEAD, err := newGCM(vmessKDF(c.respKey[:], "AEAD Resp Header Len Key")[:16])
+	if err != nil {
+		return err
+	}
+	lengthIV := vmessKDF(c.respIV[:], "AEAD Resp Header Len IV")[:12]
+	buf := make([]byte, 2+lengthAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	length, err := lengthAEAD.Open(nil, lengthIV, buf, nil)
+	if err != nil {
+		return err
+	}
+
+	payloadAEAD, err := newGCM(vmessKDF(c.respKey[:], "AEAD Resp Header Key")[:16])
+	if err != nil {
+		return err
+	}
+	payloadIV := vmessKDF(c.respIV[:], "AEAD Resp Header IV")[:12]
+	buf = make([]byte, int(binary.BigEndian.Uint16(length))+payloadAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	header, err := payloadAEAD.Open(nil, payloadIV, buf, nil)
+	if err != nil {
+		return err
+	}
+	if len(header) < 4 || header[0] != c.respV {
+		return errors.New("unexpected vmess response header")
+	}
+
+	c.reader, err = c.newBodyAEAD(c.respKey[:])
+	c.readBuf = make([]byte, 65535)
+	return err
+}
+
+func (c *vmessConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	if !c.headerOK {
+		if err := c.readHeader(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+		c.headerOK = true
+	}
+
+	var size [2]byte
+	if _, err := io.ReadFull(c.Conn, size[:]); err != nil {
+		c.readErr = err
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	overhead := 0
+	if c.reader != nil {
+		overhead = c.reader.Overhead()
+	}
+	if n == overhead {
+		c.readErr = io.EOF
+		return 0, io.EOF
+	}
+	if n < overhead {
+		c.readErr = errors.New("invalid vmess chunk")
+		return 0, c.readErr
+	}
+
+	buf := c.readBuf[:n]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		c.readErr = err
+		return 0, err
+	}
+	payload := buf
+	if c.reader != nil {
+		var err error
+		payload, err = c.reader.Open(buf[:0], vmessNonce(c.respIV[:], c.readCount), buf, nil)
+		if err != nil {
+			c.readErr = err
+			return 0, err
+		}
+		c.readCount++
+	}
+
+	copied := copy(p, payload)
+	c.pending = payload[copied:]
+	return copied, nil
+}
+
+func (c *vmessConn) CloseWrite() error {
+	c.writeMu.Lock()
+	err := c.writeChunk(nil)
+	c.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.halfCloser.CloseWrite()
+}
@@ -0,0 +1,189 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+const (
+	defaultWatchdogStall = 30 * time.Second
+	watchdogInterval     = 5 * time.Second
+	// watchdogCloseWait bounds how long recovery waits for the wedged stack
+	// to close before replacing it anyway.
+	watchdogCloseWait = 5 * time.Second
+)
+
+// watchdogConfig sets how long the stack may take TCP packets without
+// making progress before it is rebuilt. A negative StallMs turns the
+// watchdog off.
+type watchdogConfig struct {
+	StallMs int `json:"stallMs,omitempty"`
+}
+
+type watchdogEvent struct {
+	Event      string `json:"event"`
+	Reason     string `json:"reason"`
+	StalledMs  int64  `json:"stalledMs"`
+	Recoveries uint64 `json:"recoveries"`
+}
+
+var (
+	watchdogStall atomic.Int64
+
+	// Progress counters of the stack, sampled by the watchdog.
+	stackSyns    atomic.Uint64
+	stackAccepts atomic.Uint64
+	stackOutputs atomic.Uint64
+)
+
+func configureWatchdog(cfg *watchdogConfig, proxyType string) {
+	stall := defaultWatchdogStall
+	if cfg != nil && cfg.StallMs != 0 {
+		stall = time.Duration(cfg.StallMs) * time.Millisecond
+	}
+	if proxyType == "wireguard" {
+		// The WireGuard device has no lwIP stack to rebuild.
+		stall = -1
+	}
+	watchdogStall.Store(int64(stall))
+}
+
+// runWatchdog rebuilds the lwIP stack when it wedges, until stop is
+// closed: TCP packets keep coming in while nothing goes out, or SYNs
+// arrive and no connection completes its handshake.
+func runWatchdog(stop <-chan struct{}) {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	var lastIn, lastOut, lastSyns, lastAccepts uint64
+	var outStalled, acceptStalled time.Duration
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		in, out := stats.tcp.uplinkPackets.Load(), stackOutputs.Load()
+		syns, accepts := stackSyns.Load(), stackAccepts.Load()
+
+		outStalled = stallAfter(outStalled, in != lastIn, out != lastOut)
+		acceptStalled = stallAfter(acceptStalled, syns != lastSyns, accepts != lastAccepts)
+		lastIn, lastOut, lastSyns, lastAccepts = in, out, syns, accepts
+
+		stall := time.Duration(watchdogStall.Load())
+		if stall <= 0 {
+			outStalled, acceptStalled = 0, 0
+			continue
+		}
+		reason, stalled := "", time.Duration(0)
+		switch {
+		case outStalled >= stall:
+			reason, stalled = "no output", outStalled
+		case acceptStalled >= stall:
+			reason, stalled = "no handshakes", acceptStalled
+		default:
+			continue
+		}
+		if err := recoverStack(stop, reason, stalled); err != nil {
+			logger.Error("stack recovery failed", "error", err)
+		}
+		outStalled, acceptStalled = 0, 0
+	}
+}
+
+// stallAfter extends a stall by one interval while there is input and no
+// progress, and ends it otherwise.
+func stallAfter(stalled time.Duration, input bool, progress bool) time.Duration {
+	if input && !progress {
+		return stalled + watchdogInterval
+	}
+	return 0
+}
+
+// recoverStack replaces the lwIP stack of the running tunnel with a new
+// one. Flows held by the old stack are reset; outbounds, listeners and
+// the TUN device stay.
+func recoverStack(stop <-chan struct{}, reason string, stalled time.Duration) error {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+
+	select {
+	case <-stop:
+		return nil
+	default:
+	}
+	stateMu.Lock()
+	old := lwipStack
+	lwipStack = nil
+	stateMu.Unlock()
+	if old == nil {
+		return nil
+	}
+	logger.Warn("stack wedged, rebuilding", "reason", reason, "stalledMs", stalled.Milliseconds())
+
+	// Resetting flows writes RSTs through writeOutput, which takes stateMu.
+	closed := make(chan struct{})
+	go func() {
+		old.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(watchdogCloseWait):
+		logger.Warn("wedged stack did not close, replacing it anyway")
+	}
+
+	stack, err := newLWIPStack()
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if err != nil {
+		if running {
+			recordFailure("stack recovery", err)
+		}
+		return err
+	}
+	if !running {
+		stack.Close()
+		return errors.New("tunnel stopped during recovery")
+	}
+	lwipStack = stack
+	n := stats.stackRecoveries.Add(1)
+	emitEvent(watchdogEvent{Event: "stackRecovered", Reason: reason, StalledMs: stalled.Milliseconds(), Recoveries: n})
+	logger.Info("stack rebuilt", "recoveries", n)
+	return nil
+}
+
+// currentStack returns the stack packets go to, which the watchdog may
+// have replaced.
+func currentStack() core.LWIPStack {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return lwipStack
+}
+
+// countSyn counts a TCP SYN that opens a connection.
+func countSyn(packet []byte) {
+	var tcp []byte
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if len(packet) < ihl+20 || packet[9] != ipProtoTCP || binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return
+		}
+		tcp = packet[ihl:]
+	case len(packet) >= 60 && packet[0]>>4 == 6:
+		if packet[6] != ipProtoTCP {
+			return
+		}
+		tcp = packet[40:]
+	default:
+		return
+	}
+	if tcp[13]&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN {
+		stackSyns.Add(1)
+	}
+}
@@ -0,0 +1,280 @@
+package tun2socks
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// wgQueueSize bounds the packets from the TUN waiting for wireguard-go to
+// pick them up.
+const wgQueueSize = 1024
+
+type wgConfig struct {
+	privateKey   [32]byte
+	peerKey      [32]byte
+	presharedKey [32]byte
+	endpoint     string
+	keepalive    time.Duration
+}
+
+func parseWireGuardConfig(text string) (*wgConfig, error) {
+	cfg := &wgConfig{}
+	section := ""
+	peers := 0
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if section == "peer" {
+				peers++
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid wireguard config line %q", line)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch section + "." + key {
+		case "interface.privatekey":
+			err = parseWGKey(value, &cfg.privateKey)
+		case "peer.publickey":
+			err = parseWGKey(value, &cfg.peerKey)
+		case "peer.presharedkey":
+			err = parseWGKey(value, &cfg.presharedKey)
+		case "peer.endpoint":
+			cfg.endpoint = value
+		case "peer.persistentkeepalive":
+			if value != "off" {
+				var secs int
+				secs, err = strconv.Atoi(value)
+				cfg.keepalive = time.Duration(secs) * time.Second
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("wireguard %s: %w", key, err)
+		}
+	}
+
+	var zero [32]byte
+	switch {
+	case peers != 1:
+		return nil, errors.New("wireguard config needs exactly one peer")
+	case cfg.privateKey == zero || cfg.peerKey == zero:
+		return nil, errors.New("wireguard private and peer public keys are required")
+	case cfg.endpoint == "":
+		return nil, errors.New("wireguard peer endpoint is required")
+	}
+	return cfg, nil
+}
+
+func parseWGKey(value string, key *[32]byte) error {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	if len(b) != len(key) {
+		return errors.New("invalid key length")
+	}
+	copy(key[:], b)
+	return nil
+}
+
+// uapi returns the configuration in wireguard-go's IPC format, with the
+// peer at endpoint. Every packet goes to the one peer; the host app decides
+// with its routes which packets reach the TUN.
+func (c *wgConfig) uapi(endpoint *net.UDPAddr) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "private_key=%s\n", hex.EncodeToString(c.privateKey[:]))
+	fmt.Fprintf(&b, "public_key=%s\n", hex.EncodeToString(c.peerKey[:]))
+	if c.presharedKey != [32]byte{} {
+		fmt.Fprintf(&b, "preshared_key=%s\n", hex.EncodeToString(c.presharedKey[:]))
+	}
+	fmt.Fprintf(&b, "endpoint=%s\n", wgEndpoint(endpoint))
+	fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", int(c.keepalive/time.Second))
+	b.WriteString("allowed_ip=0.0.0.0/0\nallowed_ip=::/0\n")
+	return b.String()
+}
+
+// wgEndpoint formats addr for wireguard-go, which sends to an IPv4 mapped
+// address over its IPv6 socket.
+func wgEndpoint(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// wgDevice replaces the lwIP stack with a wireguard-go device: packets from
+// the TUN are encrypted and sent to the peer as-is, and decrypted packets
+// are written back to output.
+type wgDevice struct {
+	cfg *wgConfig
+	dev *device.Device
+	tun *wgTUN
+}
+
+func newWireGuardDevice(text string, output func([]byte) (int, error)) (*wgDevice, error) {
+	cfg, err := parseWireGuardConfig(text)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := resolveUDPAddr(cfg.endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &wgTUN{
+		in:     make(chan []byte, wgQueueSize),
+		output: output,
+		events: make(chan tun.Event, 1),
+		done:   make(chan struct{}),
+	}
+	dev := device.NewDevice(t, conn.NewDefaultBind(), &device.Logger{
+		Verbosef: func(format string, args ...any) {
+			logger.Debug("wireguard", "message", fmt.Sprintf(format, args...))
+		},
+		Errorf: func(format string, args ...any) {
+			logger.Warn("wireguard", "message", fmt.Sprintf(format, args...))
+		},
+	})
+	if err := dev.IpcSet(cfg.uapi(endpoint)); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return &wgDevice{cfg: cfg, dev: dev, tun: t}, nil
+}
+
+func (d *wgDevice) Write(packet []byte) (int, error) {
+	if err := d.tun.queue(packet); err != nil {
+		return 0, err
+	}
+	return len(packet), nil
+}
+
+func (d *wgDevice) Close() error {
+	d.dev.Close()
+	return nil
+}
+
+func (d *wgDevice) RestartTimeouts() {}
+
+// networkChanged resolves the endpoint again, moves the tunnel to sockets
+// on the new network and sends a keepalive from them, so the peer learns
+// the new endpoint right away instead of after the next handshake.
+func (d *wgDevice) networkChanged() {
+	endpoint, err := resolveUDPAddr(d.cfg.endpoint)
+	if err != nil {
+		logger.Warn("wireguard rebind failed", "endpoint", d.cfg.endpoint, "error", err)
+		return
+	}
+	update := fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", hex.EncodeToString(d.cfg.peerKey[:]), wgEndpoint(endpoint))
+	if err := d.dev.IpcSet(update); err != nil {
+		logger.Warn("wireguard rebind failed", "endpoint", d.cfg.endpoint, "error", err)
+		return
+	}
+	if err := d.dev.BindUpdate(); err != nil {
+		logger.Warn("wireguard rebind failed", "endpoint", d.cfg.endpoint, "error", err)
+		return
+	}
+	d.dev.SendKeepalivesToPeersWithCurrentKeypair()
+}
+
+// wgTUN is the tun.Device wireguard-go reads the packets to encrypt from
+// and writes the decrypted ones to.
+type wgTUN struct {
+	in        chan []byte
+	output    func([]byte) (int, error)
+	events    chan tun.Event
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// queue hands a copy of packet to wireguard-go, waiting while its queue is
+// full.
+func (t *wgTUN) queue(packet []byte) error {
+	packet = append([]byte(nil), packet...)
+	select {
+	case t.in <- packet:
+		return nil
+	case <-t.done:
+		return net.ErrClosed
+	}
+}
+
+func (t *wgTUN) File() *os.File { return nil }
+
+func (t *wgTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	var packet []byte
+	select {
+	case packet = <-t.in:
+	case <-t.done:
+		return 0, os.ErrClosed
+	}
+	n := 0
+	for {
+		sizes[n] = copy(bufs[n][offset:], packet)
+		n++
+		if n == len(bufs) {
+			return n, nil
+		}
+		select {
+		case packet = <-t.in:
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (t *wgTUN) Write(bufs [][]byte, offset int) (int, error) {
+	for _, buf := range bufs {
+		t.output(buf[offset:])
+	}
+	return len(bufs), nil
+}
+
+func (t *wgTUN) MTU() (int, error) {
+	if mtu := int(clampMTU.Load()); mtu > 0 {
+		return mtu, nil
+	}
+	return defaultMTU, nil
+}
+
+func (t *wgTUN) Name() (string, error) { return "tun2socks", nil }
+
+func (t *wgTUN) Events() <-chan tun.Event { return t.events }
+
+func (t *wgTUN) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		close(t.events)
+	})
+	return nil
+}
+
+func (t *wgTUN) BatchSize() int { return conn.IdealBatchSize }